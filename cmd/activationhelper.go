@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"os/user"
+	"strconv"
+
+	"github.com/nlewo/comin/internal/activation"
+	"github.com/nlewo/comin/internal/nix"
+	"github.com/nlewo/comin/internal/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var activationHelperCmd = &cobra.Command{
+	Use:   "activation-helper",
+	Short: "Activate the configurations on behalf of an unprivileged comin daemon",
+	Long: `Listen on the unix socket of the activation_helper option of the
+configuration file and activate the configurations requested by the
+comin daemon. This privileged helper only sets the system profile, runs
+switch-to-configuration and restarts the comin service, which allows
+the comin daemon (fetching, evaluating, building and serving the API)
+to run as an unprivileged user.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := readConfig()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if cfg.ActivationHelper.SocketPath == "" {
+			logrus.Fatal("The socket_path of the activation_helper option is not set")
+		}
+		// Without trusted keys, a compromised daemon could activate
+		// any store path it builds
+		if len(cfg.Nix.TrustedPublicKeys) == 0 {
+			logrus.Fatal("The trusted_public_keys of the nix option are required by the activation helper")
+		}
+		group, err := user.LookupGroup(cfg.ActivationHelper.SocketGroup)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		gid, err := strconv.Atoi(group.Gid)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		l, err := activation.Listen(cfg.ActivationHelper.SocketPath, gid)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("Listening on %s for the requests of the group %s", cfg.ActivationHelper.SocketPath, cfg.ActivationHelper.SocketGroup)
+		n := nix.New(cfg.Nix)
+		err = activation.Serve(l, activation.Handler{
+			Activate:     n.ActivateSystem,
+			RestartComin: utils.CominServiceRestart,
+		})
+		logrus.Fatal(err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(activationHelperCmd)
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultApiTokenPath is the file of the API token when the
+// configuration file can't be read
+const defaultApiTokenPath = "/var/lib/comin/api-token"
+
+// apiToken returns the token required by the requests modifying the
+// state of the comin daemon. It is only readable by the user running
+// comin.
+func apiToken() string {
+	path := defaultApiTokenPath
+	if cfg, err := readConfig(); err == nil {
+		path = cfg.ApiServer.TokenPath
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		logrus.Debugf("Failed to read the API token: %s", err)
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// newApiRequest returns a request of the comin API authenticated with
+// the API token
+func newApiRequest(method, url string) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiToken())
+	return req, nil
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func approve(uuid string) error {
+	url := fmt.Sprintf("http://localhost:4242/deployments/%s/approve", uuid)
+	client := http.Client{
+		Timeout: time.Second * 2,
+	}
+	req, err := newApiRequest(http.MethodPost, url)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("Failed to approve the generation %s: %s", uuid, body)
+	}
+	return nil
+}
+
+var approveCmd = &cobra.Command{
+	Use:   "approve ID",
+	Short: "Approve the deployment of a generation waiting for an approval",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := approve(args[0]); err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Printf("The generation %s has been approved\n", args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(approveCmd)
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/nlewo/comin/internal/audit"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var verifyAuditLogCmd = &cobra.Command{
+	Use:   "verify-audit-log [PATH]",
+	Short: "Verify the hash chain of the audit log",
+	Long: `Verify the entries of the audit log, the path of the audit option of
+the configuration file by default, have not been modified or removed
+since they have been written. Only the entries written with the
+hash_chain option can be verified.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var path string
+		if len(args) == 1 {
+			path = args[0]
+		} else {
+			cfg, err := readConfig()
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			if cfg.Audit.Path == "" {
+				logrus.Fatal("The audit log is not enabled in the configuration file")
+			}
+			path = cfg.Audit.Path
+		}
+		count, err := audit.Verify(path)
+		if err != nil {
+			logrus.Fatalf("The audit log %s is not valid: %s", path, err)
+		}
+		fmt.Printf("The %d entries of the audit log %s are valid\n", count, path)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyAuditLogCmd)
+}
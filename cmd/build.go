@@ -2,35 +2,151 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
 
 	"github.com/nlewo/comin/internal/nix"
+	"github.com/nlewo/comin/internal/types"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+var parallel int
+var keepGoing bool
+
+type buildResult struct {
+	host string
+	// The build has not been started because a previous build
+	// failed
+	skipped bool
+	err     error
+}
+
+// status returns 'succeeded', 'failed' or 'skipped'
+func (r buildResult) status() string {
+	switch {
+	case r.skipped:
+		return "skipped"
+	case r.err != nil:
+		return "failed"
+	}
+	return "succeeded"
+}
+
+// buildResultJson is the build result of a host printed by --output json
+type buildResultJson struct {
+	Host     string `json:"host"`
+	Status   string `json:"status"`
+	ErrorMsg string `json:"error_msg,omitempty"`
+}
+
+func buildHost(ctx context.Context, n nix.Nix, host string) error {
+	logrus.Infof("Building the NixOS configuration of machine '%s'", host)
+	drvPath, _, err := n.ShowDerivation(ctx, flakeUrl, host)
+	if err != nil {
+		return fmt.Errorf("Failed to evaluate the configuration '%s': '%s'", host, err)
+	}
+	err = n.Build(ctx, drvPath)
+	if err != nil {
+		return fmt.Errorf("Failed to build the configuration '%s': '%s'", host, err)
+	}
+	return nil
+}
+
+// buildHosts builds hosts with a pool of parallel workers and returns
+// the build result of each host. Unless keepGoing is set, the builds
+// which are not started yet are skipped once a build fails.
+func buildHosts(ctx context.Context, n nix.Nix, hosts []string, parallel int, keepGoing bool) []buildResult {
+	hostCh := make(chan string)
+	resultCh := make(chan buildResult, len(hosts))
+	var mu sync.Mutex
+	failed := false
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range hostCh {
+				mu.Lock()
+				skip := failed && !keepGoing
+				mu.Unlock()
+				if skip {
+					resultCh <- buildResult{host: host, skipped: true}
+					continue
+				}
+				err := buildHost(ctx, n, host)
+				if err != nil {
+					logrus.Error(err)
+					mu.Lock()
+					failed = true
+					mu.Unlock()
+				}
+				resultCh <- buildResult{host: host, err: err}
+			}
+		}()
+	}
+	for _, host := range hosts {
+		hostCh <- host
+	}
+	close(hostCh)
+	wg.Wait()
+	close(resultCh)
+
+	results := make([]buildResult, 0, len(hosts))
+	for r := range resultCh {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].host < results[j].host
+	})
+	return results
+}
+
 var buildCmd = &cobra.Command{
 	Use:   "build",
 	Short: "Build a machine configuration",
 	Args:  cobra.MinimumNArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := context.TODO()
+		n := nix.New(types.Nix{NonFlake: nonFlake, Mode: mode, Impure: impure, ConfigurationAttr: configurationAttr, MaxJobs: maxJobs, Cores: cores, BuildStore: buildStore})
 		hosts := make([]string, 1)
 		if hostname != "" {
 			hosts[0] = hostname
 		} else {
-			hosts, _ = nix.List(flakeUrl)
+			hosts, _ = n.List(ctx, flakeUrl)
+		}
+		if parallel < 1 {
+			parallel = 1
 		}
-		for _, host := range hosts {
-			logrus.Infof("Building the NixOS configuration of machine '%s'", host)
+		results := buildHosts(ctx, n, hosts, parallel, keepGoing)
 
-			drvPath, _, err := nix.ShowDerivation(ctx, flakeUrl, host)
-			if err != nil {
-				logrus.Errorf("Failed to evaluate the configuration '%s': '%s'", host, err)
+		failed := false
+		summary := make([]buildResultJson, 0, len(results))
+		for _, r := range results {
+			if r.status() != "succeeded" {
+				failed = true
 			}
-			err = nix.Build(ctx, drvPath)
-			if err != nil {
-				logrus.Errorf("Failed to build the configuration '%s': '%s'", host, err)
+			result := buildResultJson{Host: r.host, Status: r.status()}
+			if r.err != nil {
+				result.ErrorMsg = r.err.Error()
 			}
+			summary = append(summary, result)
+		}
+		if jsonOutput() {
+			printJson(summary)
+		} else {
+			fmt.Printf("Build summary\n")
+			for _, r := range summary {
+				fmt.Printf("  %s: %s\n", r.Host, r.Status)
+				if r.ErrorMsg != "" {
+					fmt.Printf("    %s\n", r.ErrorMsg)
+				}
+			}
+		}
+		if failed {
+			os.Exit(1)
 		}
 	},
 }
@@ -38,5 +154,15 @@ var buildCmd = &cobra.Command{
 func init() {
 	buildCmd.Flags().StringVarP(&hostname, "hostname", "", "", "the name of the configuration to build")
 	buildCmd.Flags().StringVarP(&flakeUrl, "flake-url", "", ".", "the URL of the flake")
+	buildCmd.Flags().BoolVarP(&nonFlake, "non-flake", "", false, "the flake URL is the path of a nix file which is not a flake")
+	buildCmd.Flags().StringVarP(&mode, "mode", "", "nixos", "the kind of configurations: 'nixos' or 'home-manager'")
+	buildCmd.Flags().StringVarP(&configurationAttr, "configuration-attr", "", "", "the attribute template of configurations, where %s is the hostname")
+	buildCmd.Flags().BoolVarP(&impure, "impure", "", false, "evaluate the configuration in impure mode")
+	buildCmd.Flags().StringVarP(&maxJobs, "max-jobs", "", "", "the maximal number of build jobs of each configuration build")
+	buildCmd.Flags().IntVarP(&cores, "cores", "", 0, "the number of cores used by each build job")
+	buildCmd.Flags().StringVarP(&buildStore, "build-store", "", "", "the remote store where configurations are built, such as ssh-ng://builder")
+	buildCmd.Flags().IntVarP(&parallel, "parallel", "p", 1, "the number of configurations built concurrently")
+	buildCmd.Flags().BoolVarP(&keepGoing, "keep-going", "k", false, "keep building the other configurations when a build fails")
+	buildCmd.RegisterFlagCompletionFunc("hostname", completeHostname)
 	rootCmd.AddCommand(buildCmd)
 }
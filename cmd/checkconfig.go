@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/nlewo/comin/internal/nix"
+	"github.com/nlewo/comin/internal/repository"
+	"github.com/spf13/cobra"
+)
+
+// fetchErrorHint returns an action fixing a fetch error of the kind
+func fetchErrorHint(kind string) string {
+	switch kind {
+	case repository.FetchErrorAuthentication:
+		return "check the access token or the SSH key of the auth option and their permissions on the repository"
+	case repository.FetchErrorNotFound:
+		return "check the URL of the repository and the name of the branch"
+	case repository.FetchErrorTimeout, repository.FetchErrorNetwork:
+		return "check the network access to the repository, the proxy option or the timeout option"
+	}
+	return ""
+}
+
+func printCheckError(err error) {
+	fmt.Printf("    Error: %s\n", err)
+	var fetchErr repository.FetchError
+	if errors.As(err, &fetchErr) {
+		if hint := fetchErrorHint(fetchErr.Kind); hint != "" {
+			fmt.Printf("    Hint: %s\n", hint)
+		}
+	}
+}
+
+var checkConfigCmd = &cobra.Command{
+	Use:   "check-config",
+	Short: "Check the configuration file, the access to the repositories and the nix installation",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.TODO()
+		failed := false
+
+		cfg, err := readConfig()
+		if err != nil && configFilepath == "" {
+			fmt.Printf("No configuration file found\n")
+			fmt.Printf("  Error: %s\n", err)
+			os.Exit(1)
+		} else if err != nil {
+			fmt.Printf("The configuration file %s is not valid\n", configFilepath)
+			fmt.Printf("  Error: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("The configuration file %s is valid\n", configFilepath)
+
+		for _, remote := range cfg.Remotes {
+			fmt.Printf("  Remote %s\n", remote.Name)
+			if err := repository.CheckRemote(ctx, remote); err != nil {
+				failed = true
+				printCheckError(err)
+			} else {
+				fmt.Printf("    Reachable\n")
+			}
+		}
+		for _, input := range cfg.Inputs {
+			fmt.Printf("  Input %s\n", input.Name)
+			if err := repository.CheckInput(ctx, input); err != nil {
+				failed = true
+				printCheckError(err)
+			} else {
+				fmt.Printf("    Reachable\n")
+			}
+		}
+
+		// Git repositories are managed by comin itself (go-git):
+		// only nix is required
+		version, err := nix.Version()
+		if err != nil {
+			failed = true
+			fmt.Printf("  Nix is not available\n")
+			fmt.Printf("    Error: %s\n", err)
+			fmt.Printf("    Hint: add nix to the PATH of comin\n")
+		} else {
+			fmt.Printf("  Nix is available (%s)\n", version)
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(checkConfigCmd)
+}
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/nlewo/comin/internal/nix"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// completeHostname completes the --hostname flag with the
+// configurations of the flake given by --flake-url. The other flags of
+// the command have already been parsed when it is called.
+func completeHostname(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	logrus.SetLevel(logrus.ErrorLevel)
+	n := nix.New(types.Nix{NonFlake: nonFlake, Mode: mode, Impure: impure, ConfigurationAttr: configurationAttr})
+	hosts, err := n.List(context.TODO(), flakeUrl)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	completions := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if strings.HasPrefix(host, toComplete) {
+			completions = append(completions, host)
+		}
+	}
+	sort.Strings(completions)
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/nlewo/comin/internal/attestation"
+	"github.com/nlewo/comin/internal/config"
+	"github.com/nlewo/comin/internal/deployment"
+	"github.com/nlewo/comin/internal/nix"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/nlewo/comin/internal/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var deployCommit string
+var deployOperation string
+var deployMachineIdSource string
+var deployMachineIdPath string
+
+// readDeployConfig returns the configuration of the comin daemon of the
+// machine. It returns false when there is no configuration file, for
+// instance when the machine is bootstrapped.
+func readDeployConfig() (types.Configuration, bool) {
+	if _, err := config.Find(configFilepath); err != nil {
+		return types.Configuration{}, false
+	}
+	cfg, err := readConfig()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return cfg, true
+}
+
+// deploy evaluates, builds and activates with deployFunc the
+// configuration hostname of the flake flakeUrl on the local machine,
+// whose machine ID is read from machineIdentity
+func deploy(ctx context.Context, n nix.Nix, deployFunc deployment.DeployFunc, machineIdentity types.MachineIdentity, flakeUrl, hostname, operation string) error {
+	logrus.Infof("Evaluating the configuration '%s' of %s", hostname, flakeUrl)
+	drvPath, outPath, expectedMachineId, specialisation, err := n.Eval(ctx, flakeUrl, hostname)
+	if err != nil {
+		return fmt.Errorf("Failed to evaluate the configuration '%s': %s", hostname, err)
+	}
+	if expectedMachineId != "" {
+		machineId, err := utils.ReadMachineId(machineIdentity)
+		if err != nil {
+			return err
+		}
+		if !utils.MachineIdAccepted(expectedMachineId, machineId) {
+			return fmt.Errorf("The evaluated comin.machineId '%s' is different from the machine ID '%s' of this machine", expectedMachineId, machineId)
+		}
+	}
+	if _, err = n.Realize(ctx, drvPath, outPath); err != nil {
+		return fmt.Errorf("Failed to build the configuration '%s': %s", hostname, err)
+	}
+	if specialisation != "" {
+		if outPath, err = nix.SpecialisationOutPath(outPath, specialisation); err != nil {
+			return err
+		}
+		logrus.Infof("The specialisation '%s' (%s) is activated", specialisation, outPath)
+	}
+	needToRestartComin, _, err := deployFunc(ctx, expectedMachineId, outPath, operation)
+	if err != nil {
+		return fmt.Errorf("Failed to deploy the configuration '%s': %s", hostname, err)
+	}
+	if needToRestartComin {
+		logrus.Infof("The comin service has been modified: it has to be restarted")
+	}
+	return nil
+}
+
+var deployCmd = &cobra.Command{
+	Use:   "deploy",
+	Short: "Deploy a configuration on the local machine once, without the comin daemon",
+	Long: `Evaluate, build and activate the configuration of the local machine
+from a flake URL, optionally at a given commit. The comin daemon is not
+involved: this is intended to bootstrap a machine or to deploy from a
+CI pipeline. Note a running comin daemon deploys its own commit again
+at its next fetch.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		switch deployOperation {
+		case "switch", "boot", "test", "dry-activate":
+		default:
+			logrus.Fatalf("The operation '%s' is not supported: use 'switch', 'boot', 'test' or 'dry-activate'", deployOperation)
+		}
+		if hostname == "" {
+			h, err := os.Hostname()
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			hostname = h
+		}
+		url := flakeUrl
+		if deployCommit != "" {
+			if nonFlake {
+				logrus.Fatal("A commit can't be selected with --non-flake")
+			}
+			var err error
+			if url, err = nix.RevUrl(flakeUrl, deployCommit); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+		n := nix.New(types.Nix{NonFlake: nonFlake, Mode: mode, Impure: impure, ConfigurationAttr: configurationAttr}).DetectVersion()
+		deployFunc := n.Deploy
+		// The machine ID is read and the configuration is
+		// attested as they would be by the comin daemon
+		cfg, ok := readDeployConfig()
+		if ok && cfg.TpmAttestation.Enable {
+			deployFunc = attestation.New(cfg.TpmAttestation).Wrap(deployFunc)
+		}
+		if deployMachineIdSource != "" {
+			cfg.MachineIdentity = types.MachineIdentity{Source: deployMachineIdSource, Path: deployMachineIdPath}
+			if err := config.CheckMachineIdentity(cfg.MachineIdentity); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+		if err := deploy(context.TODO(), n, deployFunc, cfg.MachineIdentity, url, hostname, deployOperation); err != nil {
+			logrus.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	deployCmd.Flags().StringVarP(&hostname, "hostname", "", "", "the name of the configuration to deploy (the hostname of the machine by default)")
+	deployCmd.Flags().StringVarP(&flakeUrl, "flake-url", "", ".", "the URL of the flake")
+	deployCmd.Flags().StringVarP(&deployCommit, "commit", "", "", "the full ID of the commit of the flake repository to deploy")
+	deployCmd.Flags().StringVarP(&deployOperation, "operation", "", "switch", "the operation: 'switch', 'boot', 'test' or 'dry-activate'")
+	deployCmd.Flags().BoolVarP(&nonFlake, "non-flake", "", false, "the flake URL is the path of a nix file which is not a flake")
+	deployCmd.Flags().StringVarP(&mode, "mode", "", "nixos", "the kind of configurations: 'nixos' or 'home-manager'")
+	deployCmd.Flags().StringVarP(&configurationAttr, "configuration-attr", "", "", "the attribute template of configurations, where %s is the hostname")
+	deployCmd.Flags().BoolVarP(&impure, "impure", "", false, "evaluate the configuration in impure mode")
+	deployCmd.Flags().StringVarP(&deployMachineIdSource, "machine-id-source", "", "", "the source of the machine ID: 'machine-id', 'dmi', 'hostname' or 'file' (machine_identity.source of the configuration by default)")
+	deployCmd.Flags().StringVarP(&deployMachineIdPath, "machine-id-path", "", "", "the file of the machine ID when the source is 'file'")
+	deployCmd.RegisterFlagCompletionFunc("hostname", completeHostname)
+	rootCmd.AddCommand(deployCmd)
+}
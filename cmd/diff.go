@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/nlewo/comin/internal/config"
+	"github.com/nlewo/comin/internal/nix"
+	"github.com/nlewo/comin/internal/repository"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// diffJson is the result of the diff command printed by --output json
+type diffJson struct {
+	CommitId   string `json:"commit_id"`
+	RemoteName string `json:"remote_name"`
+	BranchName string `json:"branch_name"`
+	OutPath    string `json:"outpath"`
+	// Empty when the running system would not change
+	ClosureDiff string `json:"closure_diff"`
+}
+
+// fetchSelected fetches the remotes of the configuration in the
+// directory dir, without modifying the state of the comin daemon. It
+// returns the repository status, the flake URL of the selected commit
+// and a context where the flake inputs are overridden by the fetched
+// inputs.
+func fetchSelected(ctx context.Context, cfg types.Configuration, n nix.Nix, dir string) (context.Context, repository.RepositoryStatus, string, error) {
+	gitConfig := config.MkGitConfig(cfg)
+	gitConfig.Path = filepath.Join(dir, "repository")
+	gitConfig.InputsPath = filepath.Join(dir, "inputs")
+
+	r, err := newRepository(gitConfig, "")
+	if err != nil {
+		return ctx, repository.RepositoryStatus{}, "", fmt.Errorf("Failed to initialize the repository: %s", err)
+	}
+	rs := <-r.FetchAndUpdate(ctx, "")
+	for _, remote := range rs.Remotes {
+		if remote.FetchErrorMsg != "" {
+			logrus.Errorf("Failed to fetch the remote '%s': %s", remote.Name, remote.FetchErrorMsg)
+		}
+	}
+	if rs.ErrorMsg != "" {
+		return ctx, rs, "", fmt.Errorf("%s", rs.ErrorMsg)
+	}
+	if rs.SelectedCommitId == "" {
+		return ctx, rs, "", fmt.Errorf("No commit can be selected from the remotes")
+	}
+
+	flakeUrl := n.Url(gitConfig.Path, rs.SelectedCommitId)
+	if rs.SelectedPath != "" {
+		flakeUrl = n.PathUrl(rs.SelectedPath)
+	}
+	inputs := make(map[string]string)
+	for _, input := range rs.Inputs {
+		if input.CommitId != "" {
+			inputs[input.Name] = nix.InputUrl(input.Path, input.CommitId)
+		}
+	}
+	if len(inputs) > 0 {
+		ctx = nix.WithInputs(ctx, inputs)
+	}
+	return ctx, rs, flakeUrl, nil
+}
+
+// diff builds the commit comin would deploy from the remotes fetched
+// in the directory dir and prints its closure diff against the running
+// system
+func diff(ctx context.Context, cfg types.Configuration, dir string) error {
+	n := nix.New(cfg.Nix).DetectVersion()
+	ctx, rs, flakeUrl, err := fetchSelected(ctx, cfg, n, dir)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Building the commit %s from '%s/%s'", rs.SelectedCommitId, rs.SelectedRemoteName, rs.SelectedBranchName)
+	drvPath, outPath, err := n.ShowDerivation(ctx, flakeUrl, cfg.Hostname)
+	if err != nil {
+		return fmt.Errorf("Failed to evaluate the configuration '%s': %s", cfg.Hostname, err)
+	}
+	if err = n.Build(ctx, drvPath); err != nil {
+		return fmt.Errorf("Failed to build the configuration '%s': %s", cfg.Hostname, err)
+	}
+	closureDiff, err := n.ClosureDiff(ctx, outPath)
+	if err != nil {
+		return fmt.Errorf("Failed to compute the closure diff: %s", err)
+	}
+	if jsonOutput() {
+		printJson(diffJson{
+			CommitId:    rs.SelectedCommitId,
+			RemoteName:  rs.SelectedRemoteName,
+			BranchName:  rs.SelectedBranchName,
+			OutPath:     outPath,
+			ClosureDiff: closureDiff,
+		})
+		return nil
+	}
+	fmt.Printf("Commit %s from '%s/%s'\n", rs.SelectedCommitId, rs.SelectedRemoteName, rs.SelectedBranchName)
+	fmt.Printf("  Output path: %s\n", outPath)
+	if closureDiff == "" {
+		fmt.Printf("  The running system would not change\n")
+	} else {
+		fmt.Print(closureDiff)
+	}
+	return nil
+}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Show the changes the deployment of the remotes would bring to the running system",
+	Long: `Fetch the remotes of the configuration file, select the commit comin
+would deploy, build it and print its closure diff against the running
+system. The remotes are fetched in a temporary repository: the state
+of the comin daemon is not modified and nothing is deployed.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := readConfig()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		dir, err := os.MkdirTemp("", "comin-diff-")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		err = diff(context.TODO(), cfg, dir)
+		os.RemoveAll(dir)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+}
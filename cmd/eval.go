@@ -2,30 +2,65 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"os"
 
 	"github.com/nlewo/comin/internal/nix"
+	"github.com/nlewo/comin/internal/types"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+var evalAttrs []string
+
 var evalCmd = &cobra.Command{
 	Use:   "eval",
 	Short: "Eval a machine from a local repository",
-	Args:  cobra.MinimumNArgs(0),
+	Long: `Eval the attributes of a machine configuration used by comin (the
+derivation and the output path of the configuration, the expected
+machine ID and the specialisation) with the nix commands run by the
+comin daemon. Additional attributes of the configuration, such as
+config.networking.hostName, can be evaluated with --attr.`,
+	Args: cobra.MinimumNArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
 		hosts := make([]string, 1)
 		ctx := context.TODO()
+		n := nix.New(types.Nix{NonFlake: nonFlake, Mode: mode, Impure: impure, ConfigurationAttr: configurationAttr}).DetectVersion()
 		if hostname != "" {
 			hosts[0] = hostname
 		} else {
-			hosts, _ = nix.List(flakeUrl)
+			hosts, _ = n.List(ctx, flakeUrl)
 		}
+		failed := false
 		for _, host := range hosts {
 			logrus.Infof("Evaluating the NixOS configuration of machine '%s'", host)
-			_, _, err := nix.ShowDerivation(ctx, flakeUrl, host)
+			drvPath, outPath, machineId, specialisation, err := n.Eval(ctx, flakeUrl, host)
 			if err != nil {
 				logrus.Errorf("Failed to eval the configuration '%s': '%s'", host, err)
+				failed = true
+				continue
+			}
+			fmt.Printf("Configuration %s\n", host)
+			fmt.Printf("  Derivation: %s\n", drvPath)
+			fmt.Printf("  Output path: %s\n", outPath)
+			if machineId != "" {
+				fmt.Printf("  Expected machine ID: %s\n", machineId)
+			}
+			if specialisation != "" {
+				fmt.Printf("  Specialisation: %s\n", specialisation)
 			}
+			for _, attr := range evalAttrs {
+				value, err := n.EvalAttr(ctx, flakeUrl, host, attr)
+				if err != nil {
+					logrus.Errorf("Failed to eval the attribute '%s' of the configuration '%s': '%s'", attr, host, err)
+					failed = true
+					continue
+				}
+				fmt.Printf("  %s = %s\n", attr, value)
+			}
+		}
+		if failed {
+			os.Exit(1)
 		}
 	},
 }
@@ -33,5 +68,11 @@ var evalCmd = &cobra.Command{
 func init() {
 	evalCmd.Flags().StringVarP(&hostname, "hostname", "", "", "the name of the configuration to eval")
 	evalCmd.Flags().StringVarP(&flakeUrl, "flake-url", "", ".", "the URL of the flake")
+	evalCmd.Flags().BoolVarP(&nonFlake, "non-flake", "", false, "the flake URL is the path of a nix file which is not a flake")
+	evalCmd.Flags().StringVarP(&mode, "mode", "", "nixos", "the kind of configurations: 'nixos' or 'home-manager'")
+	evalCmd.Flags().StringVarP(&configurationAttr, "configuration-attr", "", "", "the attribute template of configurations, where %s is the hostname")
+	evalCmd.Flags().BoolVarP(&impure, "impure", "", false, "evaluate the configuration in impure mode")
+	evalCmd.Flags().StringArrayVarP(&evalAttrs, "attr", "a", nil, "an attribute of the configuration to evaluate, such as config.networking.hostName (can be repeated)")
+	evalCmd.RegisterFlagCompletionFunc("hostname", completeHostname)
 	rootCmd.AddCommand(evalCmd)
 }
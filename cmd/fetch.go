@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/nlewo/comin/internal/deployment"
+	"github.com/nlewo/comin/internal/generation"
+	"github.com/nlewo/comin/internal/manager"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func fetch(remote string) (fetchRequest manager.FetchRequest, err error) {
+	u := fmt.Sprintf("http://localhost:4242/fetch?remote=%s", url.QueryEscape(remote))
+	client := http.Client{
+		Timeout: time.Second * 2,
+	}
+	req, err := newApiRequest(http.MethodPost, u)
+	if err != nil {
+		return
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusAccepted {
+		err = fmt.Errorf("Failed to request a fetch: %s", body)
+		return
+	}
+	err = json.Unmarshal(body, &fetchRequest)
+	return
+}
+
+// waitFetch waits for the deployment of the commit selected by the
+// fetch request id. It returns an error if the deployment fails.
+func waitFetch(id string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	waitingReported := false
+	for ; time.Now().Before(deadline); time.Sleep(time.Second) {
+		status, err := getStatus()
+		if err != nil {
+			// comin could be restarting after the
+			// deployment of a new comin version
+			logrus.Debugf("Failed to get the status: %s", err)
+			continue
+		}
+		for _, superseded := range status.SupersededFetches {
+			if superseded.ID == id {
+				fmt.Printf("The fetch %s has been superseded by the fetch %s\n", id, superseded.SupersededBy)
+				id = superseded.SupersededBy
+			}
+		}
+		g := status.Generation
+		d := status.Deployment
+		if d.Generation.FetchId == id && (d.Status == deployment.Done || d.Status == deployment.Failed) {
+			fmt.Printf("The commit %s has been deployed by the deployment %s: %s\n", d.Generation.SelectedCommitId, d.UUID, deployment.StatusToString(d.Status))
+			if d.Status == deployment.Failed {
+				return fmt.Errorf("The deployment %s failed: %s", d.UUID, d.ErrorMsg)
+			}
+			return nil
+		}
+		if g.FetchId == id {
+			switch {
+			case g.Status == generation.EvaluationFailed:
+				return fmt.Errorf("The evaluation of the commit %s failed (generation %s)", g.SelectedCommitId, g.UUID)
+			case g.Status == generation.BuildFailed:
+				return fmt.Errorf("The build of the commit %s failed (generation %s)", g.SelectedCommitId, g.UUID)
+			case status.IsWaitingForApproval && !waitingReported:
+				fmt.Printf("The commit %s is waiting for an approval: run 'comin approve %s'\n", g.SelectedCommitId, g.UUID)
+				waitingReported = true
+			case (status.IsWaitingForWindow || status.IsWaitingForUnfreeze) && !waitingReported:
+				fmt.Printf("The commit %s is waiting for a deployment window or an unfreeze\n", g.SelectedCommitId)
+				waitingReported = true
+			}
+			continue
+		}
+		for _, unchanged := range status.UnchangedFetchIds {
+			if unchanged == id {
+				fmt.Printf("There is no new commit to deploy\n")
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("The fetch %s is not deployed after %s", id, timeout)
+}
+
+var fetchWait bool
+var fetchTimeout time.Duration
+
+var fetchCmd = &cobra.Command{
+	Use:   "fetch [REMOTE]",
+	Short: "Request comin to fetch a remote (all remotes by default)",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		remote := ""
+		if len(args) == 1 {
+			remote = args[0]
+		}
+		req, err := fetch(remote)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if req.Position > 0 {
+			fmt.Printf("The fetch %s is queued since comin is running\n", req.ID)
+		} else {
+			fmt.Printf("The fetch %s has been started\n", req.ID)
+		}
+		if fetchWait {
+			if err := waitFetch(req.ID, fetchTimeout); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+	},
+}
+
+func init() {
+	fetchCmd.Flags().BoolVarP(&fetchWait, "wait", "w", false, "wait for the deployment of the fetched commit")
+	fetchCmd.Flags().DurationVarP(&fetchTimeout, "timeout", "", time.Hour, "the maximal duration to wait for with --wait")
+	rootCmd.AddCommand(fetchCmd)
+}
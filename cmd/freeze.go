@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/nlewo/comin/internal/manager"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var freezeReason string
+
+// freezeUser returns the user running the command, or the user who ran
+// sudo
+func freezeUser() string {
+	if u := os.Getenv("SUDO_USER"); u != "" {
+		return u
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+func freeze(method string, query url.Values) error {
+	u := "http://localhost:4242/freeze?" + query.Encode()
+	client := http.Client{
+		Timeout: time.Second * 2,
+	}
+	req, err := newApiRequest(method, u)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("Failed to update the freeze lock: %s", body)
+	}
+	return nil
+}
+
+// freezeStatus returns the description of the freeze
+func freezeStatus(info *manager.FreezeInfo) string {
+	s := "Deployments are frozen"
+	if info == nil {
+		return s
+	}
+	if info.By != "" {
+		s += fmt.Sprintf(" by %s", info.By)
+	}
+	if !info.At.IsZero() {
+		s += fmt.Sprintf(" since %s", humanize.Time(info.At))
+	}
+	if info.Reason != "" {
+		s += fmt.Sprintf(": %s", info.Reason)
+	}
+	return s
+}
+
+var freezeCmd = &cobra.Command{
+	Use:     "freeze",
+	Aliases: []string{"pause"},
+	Short:   "Prevent comin from deploying generations, while still fetching and building them",
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		query := url.Values{}
+		query.Set("by", freezeUser())
+		query.Set("reason", freezeReason)
+		if err := freeze(http.MethodPost, query); err != nil {
+			logrus.Fatal(err)
+		}
+		status, err := getStatus()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Printf("%s\n", freezeStatus(status.Freeze))
+	},
+}
+
+var unfreezeCmd = &cobra.Command{
+	Use:     "unfreeze",
+	Aliases: []string{"resume"},
+	Short:   "Allow comin to deploy generations again",
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		status, err := getStatus()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if !status.IsFrozen {
+			fmt.Printf("Deployments are not frozen\n")
+			return
+		}
+		fmt.Printf("%s\n", freezeStatus(status.Freeze))
+		if err := freeze(http.MethodDelete, url.Values{}); err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Printf("Deployments are unfrozen\n")
+	},
+}
+
+func init() {
+	freezeCmd.Flags().StringVarP(&freezeReason, "reason", "r", "", "the reason of the freeze, shown by comin status")
+	rootCmd.AddCommand(freezeCmd)
+	rootCmd.AddCommand(unfreezeCmd)
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/nlewo/comin/internal/history"
+	"github.com/nlewo/comin/internal/logs"
+	"github.com/nlewo/comin/internal/nix"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var gcDryRun bool
+var gcHistoryBefore string
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove the gcroots, deployment records and logs exceeding the retention policy",
+	Long: `Remove the gcroots of deployed configurations exceeding
+nix.gc_roots_keep, the logs exceeding logs.max_files or logs.max_size
+and the oldest deployments of the history. The Nix store itself is
+not garbage collected: run nix-collect-garbage to remove the store
+paths which are no longer protected by a gcroot.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := readConfig()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		var before time.Time
+		if gcHistoryBefore != "" {
+			if before, err = history.ParseTime(gcHistoryBefore, time.Now()); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+		action := "Removed"
+		if gcDryRun {
+			action = "Would remove"
+		}
+
+		gcRoots, err := nix.New(cfg.Nix).PruneGcRoots(gcDryRun)
+		if err != nil {
+			logrus.Fatalf("Failed to prune the gcroots: %s", err)
+		}
+		for _, gcRoot := range gcRoots {
+			fmt.Printf("%s the gcroot %s (%s)\n", action, gcRoot.Name, gcRoot.OutPath)
+		}
+		l := logs.New(cfg.Logs)
+		removedLogs, err := l.Prune(gcDryRun)
+		if err != nil {
+			logrus.Fatalf("Failed to prune the logs: %s", err)
+		}
+		for _, l := range removedLogs {
+			fmt.Printf("%s the logs %s (%s)\n", action, l.Id, humanize.Bytes(uint64(l.Size)))
+		}
+		h := history.New(filepath.Join(cfg.StateDir, "history.jsonl")).WithMaxEntries(cfg.History.MaxEntries)
+		entries, err := h.Prune(before, gcDryRun)
+		if err != nil {
+			logrus.Fatalf("Failed to prune the history: %s", err)
+		}
+		for _, e := range entries {
+			fmt.Printf("%s the deployment of %s from %s\n", action, e.CommitId, e.StartAt.Local().Format("2006-01-02 15:04:05"))
+			// The logs of the removed deployments are removed
+			if !gcDryRun && e.GenerationUUID != "" {
+				if err := l.Remove(e.GenerationUUID); err != nil {
+					logrus.Errorf("Failed to remove the logs %s: %s", e.GenerationUUID, err)
+				}
+			}
+		}
+		if len(gcRoots)+len(removedLogs)+len(entries) == 0 {
+			fmt.Printf("Nothing to remove\n")
+		}
+	},
+}
+
+func init() {
+	gcCmd.Flags().BoolVarP(&gcDryRun, "dry-run", "", false, "only print what would be removed")
+	gcCmd.Flags().StringVarP(&gcHistoryBefore, "history-before", "", "", "also remove deployments started before this date (2006-01-02), time (2006-01-02 15:04) or duration ago (720h) from the history")
+	rootCmd.AddCommand(gcCmd)
+}
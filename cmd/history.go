@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/nlewo/comin/internal/history"
+	"github.com/nlewo/comin/internal/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var historyStateDir string
+var historySince string
+var historyUntil string
+var historyStatus string
+var historyCommit string
+var historyOperation string
+var historyLimit int
+var historyJson bool
+
+// seconds returns the duration of s seconds rounded to the second
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Second)
+}
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "List the past deployments of the local machine, the most recent first",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		now := time.Now()
+		filter := history.Filter{
+			Status:    historyStatus,
+			CommitId:  historyCommit,
+			Operation: historyOperation,
+		}
+		var err error
+		if historySince != "" {
+			if filter.Since, err = history.ParseTime(historySince, now); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+		if historyUntil != "" {
+			if filter.Until, err = history.ParseTime(historyUntil, now); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+		entries, err := history.New(filepath.Join(historyStateDir, "history.jsonl")).Read()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		selected := make([]history.Entry, 0)
+		for i := len(entries) - 1; i >= 0; i-- {
+			if historyLimit > 0 && len(selected) >= historyLimit {
+				break
+			}
+			if filter.Match(entries[i]) {
+				selected = append(selected, entries[i])
+			}
+		}
+
+		if historyJson || jsonOutput() {
+			printJson(selected)
+			return
+		}
+		for _, e := range selected {
+			status := e.Status
+			if e.RolledBack {
+				status = "rolled back"
+			}
+			fmt.Printf("%s  %s  %s (%s)\n", e.StartAt.Local().Format("2006-01-02 15:04:05"), e.Operation, status, e.Duration().Round(time.Second))
+			fmt.Printf("  Commit %s from '%s/%s'\n", e.CommitId, e.RemoteName, e.BranchName)
+			fmt.Printf("    %s\n", utils.FormatCommitMsg(e.CommitMsg))
+			if e.CommitAuthor != "" {
+				fmt.Printf("    Author: %s (%s)\n", e.CommitAuthor, e.CommitDate.Local().Format("2006-01-02 15:04:05"))
+			}
+			if e.EvalDuration > 0 || e.BuildDuration > 0 || e.SwitchDuration > 0 {
+				fmt.Printf("  Durations: eval %s, build %s, switch %s\n", seconds(e.EvalDuration), seconds(e.BuildDuration), seconds(e.SwitchDuration))
+			}
+			if e.ClosureSize > 0 {
+				fmt.Printf("  Closure size: %s\n", humanize.IBytes(uint64(e.ClosureSize)))
+			}
+			if e.RebootNeeded {
+				fmt.Printf("  A reboot is needed\n")
+			}
+			if e.ErrorMsg != "" {
+				fmt.Printf("  Error: %s\n", e.ErrorMsg)
+			}
+			if e.GenerationUUID != "" {
+				fmt.Printf("  Logs: comin logs %s\n", e.GenerationUUID)
+			}
+		}
+	},
+}
+
+func init() {
+	historyCmd.Flags().StringVarP(&historyStateDir, "state-dir", "", "/var/lib/comin", "the state directory of comin")
+	historyCmd.Flags().StringVarP(&historySince, "since", "", "", "only list deployments started after this date (2006-01-02), time (2006-01-02 15:04) or duration ago (48h)")
+	historyCmd.Flags().StringVarP(&historyUntil, "until", "", "", "only list deployments started before this date, time or duration ago")
+	historyCmd.Flags().StringVarP(&historyStatus, "status", "", "", "only list deployments with this status: 'done' or 'failed'")
+	historyCmd.Flags().StringVarP(&historyCommit, "commit", "", "", "only list deployments of commits starting with this prefix")
+	historyCmd.Flags().StringVarP(&historyOperation, "operation", "", "", "only list deployments with this operation: 'switch', 'boot', 'test' or 'dry-activate'")
+	historyCmd.Flags().IntVarP(&historyLimit, "limit", "n", 20, "the maximal number of deployments listed (0 to list all)")
+	historyCmd.Flags().BoolVarP(&historyJson, "json", "", false, "print the deployments in JSON (same as --output json)")
+	rootCmd.AddCommand(historyCmd)
+}
@@ -1,24 +1,111 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"text/tabwriter"
+
 	"github.com/nlewo/comin/internal/nix"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+var listDetails bool
+
+// hostDetails describes a configuration listed by --details
+type hostDetails struct {
+	Host    string `json:"host"`
+	DrvPath string `json:"drv_path"`
+	OutPath string `json:"outpath"`
+	// The outPath is in the local Nix store
+	Cached bool `json:"cached"`
+	// The comin.machineId option, empty when it is not set
+	MachineId string `json:"machine_id"`
+	// The configuration name is the hostname of the local machine
+	Local    bool   `json:"local"`
+	ErrorMsg string `json:"error_msg,omitempty"`
+}
+
+func getHostDetails(ctx context.Context, n nix.Nix, host, localHostname string) hostDetails {
+	d := hostDetails{Host: host, Local: host == localHostname}
+	drvPath, outPath, machineId, _, err := n.Eval(ctx, flakeUrl, host)
+	if err != nil {
+		d.ErrorMsg = err.Error()
+		return d
+	}
+	d.DrvPath = drvPath
+	d.OutPath = outPath
+	d.MachineId = machineId
+	d.Cached = n.IsRealized(ctx, outPath)
+	return d
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
 var listCmd = &cobra.Command{
-	Use:   "list",
-	Short: "List hosts of the local repository",
-	Args:  cobra.MinimumNArgs(0),
+	Use:     "list",
+	Aliases: []string{"hosts"},
+	Short:   "List hosts of the local repository",
+	Long: `List the configurations of the local repository. With --details,
+each configuration is evaluated to show its output path, whether it
+is in the local Nix store, whether comin.machineId is set and whether
+it is the configuration of the local machine.`,
+	Args: cobra.MinimumNArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
-		hosts, _ := nix.List(flakeUrl)
+		ctx := context.TODO()
+		n := nix.New(types.Nix{NonFlake: nonFlake, Mode: mode, ConfigurationAttr: configurationAttr})
+		hosts, _ := n.List(ctx, flakeUrl)
+		if !listDetails {
+			if jsonOutput() {
+				printJson(hosts)
+				return
+			}
+			for _, host := range hosts {
+				fmt.Println(host)
+			}
+			return
+		}
+
+		n = n.DetectVersion()
+		localHostname, _ := os.Hostname()
+		details := make([]hostDetails, 0, len(hosts))
 		for _, host := range hosts {
-			fmt.Println(host)
+			details = append(details, getHostDetails(ctx, n, host, localHostname))
+		}
+		if jsonOutput() {
+			printJson(details)
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "HOST\tLOCAL\tMACHINE ID\tCACHED\tOUTPATH")
+		for _, d := range details {
+			if d.ErrorMsg != "" {
+				logrus.Errorf("Failed to eval the configuration '%s': %s", d.Host, d.ErrorMsg)
+				fmt.Fprintf(w, "%s\t%s\t-\t-\tevaluation failed\n", d.Host, yesNo(d.Local))
+				continue
+			}
+			machineId := "-"
+			if d.MachineId != "" {
+				machineId = d.MachineId
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.Host, yesNo(d.Local), machineId, yesNo(d.Cached), d.OutPath)
 		}
+		w.Flush()
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(listCmd)
 	listCmd.Flags().StringVarP(&flakeUrl, "flake-url", "", ".", "the URL of the flake")
+	listCmd.Flags().BoolVarP(&nonFlake, "non-flake", "", false, "the flake URL is the path of a nix file which is not a flake")
+	listCmd.Flags().StringVarP(&mode, "mode", "", "nixos", "the kind of configurations: 'nixos' or 'home-manager'")
+	listCmd.Flags().StringVarP(&configurationAttr, "configuration-attr", "", "", "the attribute template of configurations, where %s is the hostname")
+	listCmd.Flags().BoolVarP(&listDetails, "details", "l", false, "evaluate the configurations to show their details")
 }
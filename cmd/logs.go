@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/nlewo/comin/internal/logs"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var logsList bool
+var logsFollow bool
+
+func getLogs() (list []logs.Log, err error) {
+	body, err := getApi("/logs")
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &list)
+	return
+}
+
+// followLog prints the content of the log id from the offset until the
+// generation of the log is no longer running
+func followLog(id string, offset int) error {
+	for {
+		status, err := getStatus()
+		if err != nil {
+			return err
+		}
+		content, err := getApi("/logs/" + id)
+		if err != nil {
+			return err
+		}
+		if len(content) > offset {
+			os.Stdout.Write(content[offset:])
+			offset = len(content)
+		}
+		if !status.IsRunning || status.Generation.UUID != id {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+var logsCmd = &cobra.Command{
+	Use:   "logs [ID]",
+	Short: "Print the logs of the current generation, or of the generation ID",
+	Long: `Print the evaluation, build and deployment logs of the current
+generation, or of a past generation whose ID, or a prefix of it, is
+given. The generation IDs of past deployments are listed by
+'comin history' and 'comin logs --list'.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if logsList {
+			list, err := getLogs()
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			for _, l := range list {
+				fmt.Printf("%s  %s  %s\n", l.Id, humanize.Time(time.Unix(0, l.ModTime)), humanize.Bytes(uint64(l.Size)))
+			}
+			return
+		}
+		var id string
+		if len(args) == 1 {
+			list, err := getLogs()
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			if id, err = logs.Find(list, args[0]); err != nil {
+				logrus.Fatal(err)
+			}
+		} else {
+			status, err := getStatus()
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			if status.Generation.UUID == "" {
+				logrus.Fatal("No generation has been created yet")
+			}
+			id = status.Generation.UUID
+		}
+		if logsFollow {
+			if err := followLog(id, 0); err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		}
+		content, err := getApi("/logs/" + id)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		os.Stdout.Write(content)
+	},
+}
+
+func init() {
+	logsCmd.Flags().BoolVarP(&logsList, "list", "l", false, "list the logs of the generations, the most recent first")
+	logsCmd.Flags().BoolVarP(&logsFollow, "follow", "f", false, "print the logs until the generation is evaluated, built and deployed")
+	rootCmd.AddCommand(logsCmd)
+}
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func pin(method, commitId string) error {
+	u := fmt.Sprintf("http://localhost:4242/pin?commit=%s", url.QueryEscape(commitId))
+	client := http.Client{
+		Timeout: time.Second * 2,
+	}
+	req, err := newApiRequest(method, u)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("Failed to update the pin: %s", body)
+	}
+	return nil
+}
+
+var pinCmd = &cobra.Command{
+	Use:   "pin COMMIT",
+	Short: "Keep deploying a commit and ignore newer ones until unpinned",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := pin(http.MethodPost, args[0]); err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Printf("Deployments are pinned to the commit %s\n", args[0])
+	},
+}
+
+var unpinCmd = &cobra.Command{
+	Use:   "unpin",
+	Short: "Deploy the heads of the branches again",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := pin(http.MethodDelete, ""); err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Printf("Deployments are unpinned\n")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pinCmd)
+	rootCmd.AddCommand(unpinCmd)
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func requestRollback(target string) error {
+	u := fmt.Sprintf("http://localhost:4242/rollback?target=%s", url.QueryEscape(target))
+	client := http.Client{
+		Timeout: time.Second * 2,
+	}
+	req, err := newApiRequest(http.MethodPost, u)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("Failed to roll back: %s", body)
+	}
+	return nil
+}
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback [GENERATION|COMMIT]",
+	Short: "Activate again the previous generation, or a generation number or a commit deployed by comin",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		target := ""
+		if len(args) == 1 {
+			target = args[0]
+		}
+		if err := requestRollback(target); err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Printf("The rollback has been started: run 'comin status' to follow it\n")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rollbackCmd)
+}
@@ -4,14 +4,31 @@ Copyright © 2022 lewo <lewo@abesis.fr>
 package cmd
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/nlewo/comin/internal/config"
+	"github.com/nlewo/comin/internal/logging"
+	"github.com/nlewo/comin/internal/types"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"os"
 )
 
 var debug bool
+var quiet bool
+var logLevel string
+var logFormat string
 var hostname string
 var flakeUrl string
+var nonFlake bool
+var mode string
+var impure bool
+var configurationAttr string
+var maxJobs string
+var cores int
+var buildStore string
+var output string
+var configFilepath string
 
 // Set at build time
 var version = "0.0.0"
@@ -29,12 +46,73 @@ func Execute() {
 	}
 }
 
+// readConfig reads the configuration file given by --config, or found
+// in the search paths. The log level and the log format of the
+// configuration are applied unless they are set by command line
+// options.
+func readConfig() (cfg types.Configuration, err error) {
+	if configFilepath, err = config.Find(configFilepath); err != nil {
+		return
+	}
+	if cfg, err = config.Read(configFilepath); err != nil {
+		return
+	}
+	if cfg.LogLevel != "" && logLevel == "" && !quiet && !debug {
+		level, _ := logrus.ParseLevel(cfg.LogLevel)
+		logrus.SetLevel(level)
+	}
+	if cfg.LogFormat != "" && logFormat == "" {
+		logging.SetFormat(cfg.LogFormat)
+	}
+	return
+}
+
+// jsonOutput returns true when the command has to print JSON instead
+// of text. Logs are still written to stderr.
+func jsonOutput() bool {
+	return output == "json"
+}
+
+// printJson prints v as indented JSON on stdout
+func printJson(v interface{}) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	fmt.Println(string(out))
+}
+
 func init() {
 	rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		if logLevel != "" {
+			level, err := logrus.ParseLevel(logLevel)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			logrus.SetLevel(level)
+		}
+		if logFormat != "" {
+			if err := logging.SetFormat(logFormat); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+		if quiet {
+			logrus.SetLevel(logrus.WarnLevel)
+		}
 		if debug {
 			logrus.Info("Debug logs enabled")
 			logrus.SetLevel(logrus.DebugLevel)
 		}
+		if output != "text" && output != "json" {
+			logrus.Fatalf("The output format '%s' is not supported: use 'text' or 'json'", output)
+		}
 	}
 	rootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "verbose logging")
+	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "only log warnings and errors, such as failures of the nix commands run by comin")
+	rootCmd.PersistentFlags().StringVarP(&logLevel, "log-level", "", "", "the level of the logs: 'debug', 'info', 'warn' or 'error' (default 'info' or the log_level of the configuration file)")
+	rootCmd.PersistentFlags().StringVarP(&logFormat, "log-format", "", "", "the format of the logs: 'text', 'json' or 'journald' (default 'text' or the log_format of the configuration file)")
+	rootCmd.PersistentFlags().StringVarP(&configFilepath, "config", "", "", "the configuration file path (default: $XDG_CONFIG_HOME/comin/config.yaml or /etc/comin/config.yaml)")
+	rootCmd.PersistentFlags().StringVarP(&output, "output", "", "text", "the output format of the build, diff, history, list and status commands: 'text' or 'json'")
+	rootCmd.RegisterFlagCompletionFunc("output", cobra.FixedCompletions([]string{"text", "json"}, cobra.ShellCompDirectiveNoFileComp))
+	rootCmd.RegisterFlagCompletionFunc("log-format", cobra.FixedCompletions([]string{"text", "json", "journald"}, cobra.ShellCompDirectiveNoFileComp))
 }
@@ -1,59 +1,171 @@
 package cmd
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
+	"github.com/nlewo/comin/internal/activation"
+	"github.com/nlewo/comin/internal/announce"
+	"github.com/nlewo/comin/internal/attestation"
+	"github.com/nlewo/comin/internal/audit"
+	"github.com/nlewo/comin/internal/commitstatus"
 	"github.com/nlewo/comin/internal/config"
+	"github.com/nlewo/comin/internal/gc"
+	"github.com/nlewo/comin/internal/health"
+	"github.com/nlewo/comin/internal/history"
+	"github.com/nlewo/comin/internal/hooks"
 	"github.com/nlewo/comin/internal/http"
+	"github.com/nlewo/comin/internal/logging"
+	"github.com/nlewo/comin/internal/logs"
 	"github.com/nlewo/comin/internal/manager"
+	"github.com/nlewo/comin/internal/nix"
+	"github.com/nlewo/comin/internal/notify"
 	"github.com/nlewo/comin/internal/poller"
 	"github.com/nlewo/comin/internal/prometheus"
 	"github.com/nlewo/comin/internal/repository"
+	"github.com/nlewo/comin/internal/rollback"
+	"github.com/nlewo/comin/internal/systemd"
+	"github.com/nlewo/comin/internal/types"
 	"github.com/nlewo/comin/internal/utils"
+	"github.com/nlewo/comin/internal/window"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
-var configFilepath string
-
 var runCmd = &cobra.Command{
 	Use:   "run",
 	Short: "Run comin to deploy your published configurations",
 	Run: func(cmd *cobra.Command, args []string) {
-		cfg, err := config.Read(configFilepath)
+		cfg, err := readConfig()
 		if err != nil {
 			logrus.Error(err)
 			os.Exit(1)
 		}
+		logging.SetField(logging.FieldHostname, cfg.Hostname)
 		gitConfig := config.MkGitConfig(cfg)
 
-		repositoryStatus := repository.RepositoryStatus{}
-		repository, err := repository.New(gitConfig, repositoryStatus)
+		// The force pushes are detected against the head of
+		// the main branch known before the restart
+		r, err := newRepository(gitConfig, manager.ReadMainCommitId(cfg.StateFilepath))
 		if err != nil {
 			logrus.Errorf("Failed to initialize the repository: %s", err)
 			os.Exit(1)
 		}
 
-		machineId, err := utils.ReadMachineId()
+		machineId, err := utils.ReadMachineId(cfg.MachineIdentity)
 		if err != nil {
 			logrus.Error(err)
 			os.Exit(1)
 		}
 
-		metrics := prometheus.New()
+		metrics := prometheus.New().WithTextfile(cfg.Exporter.TextfilePath)
 		metrics.SetBuildInfo(cmd.Version)
-		manager := manager.New(repository, metrics, gitConfig.Path, cfg.Hostname, machineId)
-		go poller.Poller(manager, cfg.Remotes)
+		l := logs.New(cfg.Logs)
+		n := nix.New(cfg.Nix).DetectVersion().WithActivationHelper(cfg.ActivationHelper.SocketPath)
+		manager := manager.New(r, metrics, n, l, health.New(cfg.HealthChecks), gitConfig.Path, cfg.Hostname, machineId)
+		windows, err := window.New(cfg.DeploymentWindows)
+		if err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		manager = manager.WithDeploymentWindows(windows)
+		manager = manager.WithHooks(hooks.New(cfg.Hooks))
+		manager = manager.WithFreezeFile(filepath.Join(cfg.StateDir, "freeze"))
+		manager = manager.WithPinFile(gitConfig.PinFilepath)
+		manager = manager.WithDeploymentTimeout(cfg.DeploymentTimeout)
+		manager = manager.WithPathFilters(cfg.PathFilters)
+		manager = manager.WithFastForwardOnly(cfg.FastForwardOnly)
+		manager = manager.WithHistory(history.New(filepath.Join(cfg.StateDir, "history.jsonl")).WithMaxEntries(cfg.History.MaxEntries))
+		manager = manager.WithStateFile(cfg.StateFilepath)
+		manager = manager.WithAuditLog(audit.New(cfg.Audit, cfg.CommitSignatures))
+		if cfg.ActivationHelper.SocketPath != "" {
+			manager = manager.WithCominServiceRestart(activation.New(cfg.ActivationHelper.SocketPath).RestartComin)
+		}
+		manager, err = manager.WithAutoReboot(cfg.AutoReboot)
+		if err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		if cfg.MagicRollback.Enable {
+			r := rollback.New(cfg.MagicRollback, n, cfg.ApiServer.ListenAddress, cfg.ApiServer.Port)
+			manager = manager.WithMagicRollback(r)
+			// Confirm the deployment which has restarted comin
+			go r.ConfirmPending(context.Background())
+		}
+		if cfg.TpmAttestation.Enable {
+			manager = manager.WithTpmAttestation(attestation.New(cfg.TpmAttestation))
+		}
+		go pollAndReload(manager, cfg.Remotes)
+		go gc.Scheduler(manager, cfg.Gc)
+		metricsPort := cfg.Exporter.Port
+		if cfg.Exporter.DisableHttp {
+			metricsPort = 0
+		}
+		token, err := http.Token(cfg.ApiServer.TokenPath)
+		if err != nil {
+			logrus.Errorf("Failed to read the API token: %s", err)
+			os.Exit(1)
+		}
 		http.Serve(manager,
 			metrics,
-			cfg.ApiServer.ListenAddress, cfg.ApiServer.Port,
-			cfg.Exporter.ListenAddress, cfg.Exporter.Port)
+			l,
+			cfg.ApiServer.ListenAddress, cfg.ApiServer.Port, token,
+			cfg.Exporter.ListenAddress, metricsPort)
+		go systemd.Run(manager)
+		manager.Handle(notify.New(cfg.Notifications, cfg.Hostname, l))
+		commitstatus.New(cfg.CommitStatuses, cfg.Hostname).Run(manager)
+		go announce.New(cfg.Announcements).Run(manager)
 		manager.Run()
 	},
 }
 
+// pollAndReload runs the poller and reloads the remotes of the
+// configuration file when comin receives SIGHUP. Other options are
+// only applied by restarting comin.
+func pollAndReload(m manager.Manager, remotes []types.Remote) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		go poller.Poller(ctx, m, remotes)
+		for range sigCh {
+			r, err := reloadRemotes(m)
+			if err == nil {
+				remotes = r
+				break
+			}
+		}
+		cancel()
+	}
+}
+
+func reloadRemotes(m manager.Manager) ([]types.Remote, error) {
+	logrus.Infof("Reloading the remotes from the configuration file %s", configFilepath)
+	cfg, err := readConfig()
+	if err != nil {
+		logrus.Errorf("Failed to read the configuration: %s", err)
+		return nil, err
+	}
+	if err := m.Reload(cfg.Remotes); err != nil {
+		return nil, err
+	}
+	return cfg.Remotes, nil
+}
+
+// newRepository returns the repository of the remotes, which is an
+// archive for a tarball remote. The mainCommitId is the head of the
+// main branch before comin started.
+func newRepository(gitConfig types.GitConfig, mainCommitId string) (repository.Repository, error) {
+	rs := repository.RepositoryStatus{MainCommitId: mainCommitId}
+	if len(gitConfig.Remotes) == 1 && gitConfig.Remotes[0].Kind == "tarball" {
+		return repository.NewTarball(gitConfig, rs)
+	}
+	return repository.New(gitConfig, rs)
+}
+
 func init() {
-	runCmd.PersistentFlags().StringVarP(&configFilepath, "config", "", "", "the configuration file path")
-	runCmd.MarkPersistentFlagRequired("config")
 	rootCmd.AddCommand(runCmd)
 }
@@ -1,10 +1,12 @@
 package cmd
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -29,9 +31,21 @@ func generationStatus(g generation.Generation) {
 	case generation.Building:
 		fmt.Printf("    Status: building (since %s)\n", humanize.Time(g.BuildStartedAt))
 	case generation.BuildSucceeded:
-		fmt.Printf("    Status: built (%s)\n", humanize.Time(g.BuildEndedAt))
+		if g.BuildSkipped {
+			fmt.Printf("    Status: built (%s, already in the Nix store)\n", humanize.Time(g.BuildEndedAt))
+		} else {
+			fmt.Printf("    Status: built (%s)\n", humanize.Time(g.BuildEndedAt))
+		}
 	}
 	printCommit(g.SelectedRemoteName, g.SelectedBranchName, g.SelectedCommitId, g.SelectedCommitMsg)
+	printCommitAuthor(g.SelectedCommitAuthor, g.SelectedCommitDate)
+	printInputCommits(g.InputCommitIds)
+	if g.NotFastForward {
+		fmt.Printf("    This commit is not a descendant of the deployed commit\n")
+	}
+	if g.Specialisation != "" {
+		fmt.Printf("    Specialisation: %s\n", g.Specialisation)
+	}
 }
 
 func deploymentStatus(d deployment.Deployment) {
@@ -48,6 +62,42 @@ func deploymentStatus(d deployment.Deployment) {
 		fmt.Printf("    Status: failed (%s)\n", humanize.Time(d.EndAt))
 	}
 	printCommit(d.Generation.SelectedRemoteName, d.Generation.SelectedBranchName, d.Generation.SelectedCommitId, d.Generation.SelectedCommitMsg)
+	printCommitAuthor(d.Generation.SelectedCommitAuthor, d.Generation.SelectedCommitDate)
+	printInputCommits(d.Generation.InputCommitIds)
+	if d.Generation.Impure {
+		fmt.Printf("    Evaluated in impure mode\n")
+	}
+	if d.Status == deployment.Done || d.Status == deployment.Failed {
+		fmt.Printf("    Durations: eval %s, build %s, switch %s\n",
+			d.Generation.EvalDuration().Round(time.Second),
+			d.Generation.BuildDuration().Round(time.Second),
+			d.SwitchDuration().Round(time.Second))
+	}
+	if d.ClosureSize > 0 {
+		fmt.Printf("    Closure size: %s\n", humanize.IBytes(uint64(d.ClosureSize)))
+	}
+	if d.RestartComin {
+		fmt.Printf("    comin has been restarted\n")
+	}
+	if d.RebootNeeded {
+		fmt.Printf("    A reboot is needed\n")
+	}
+	if d.HealthCheckErrorMsg != "" {
+		fmt.Printf("    Health checks failed: %s\n", d.HealthCheckErrorMsg)
+		if d.RolledBack {
+			fmt.Printf("    Rolled back to %s\n", d.PreviousOutPath)
+		} else if d.RollbackErrorMsg != "" {
+			fmt.Printf("    Rollback failed: %s\n", d.RollbackErrorMsg)
+		}
+	}
+	if d.Output != "" {
+		fmt.Printf("    Output\n")
+		fmt.Printf("      %s\n", utils.FormatCommitMsg(d.Output))
+	}
+	if d.ClosureDiff != "" {
+		fmt.Printf("    Closure diff\n")
+		fmt.Printf("      %s\n", utils.FormatCommitMsg(d.ClosureDiff))
+	}
 }
 
 func printCommit(selectedRemoteName, selectedBranchName, selectedCommitId, selectedCommitMsg string) {
@@ -61,8 +111,30 @@ func printCommit(selectedRemoteName, selectedBranchName, selectedCommitId, selec
 	)
 }
 
-func getStatus() (status manager.State, err error) {
-	url := "http://localhost:4242/status"
+func printCommitAuthor(author string, date time.Time) {
+	if author == "" {
+		return
+	}
+	fmt.Printf("      Author: %s (%s)\n", author, date.Local().Format("2006-01-02 15:04:05"))
+}
+
+func printInputCommits(inputCommitIds map[string]string) {
+	names := make([]string, 0, len(inputCommitIds))
+	for name := range inputCommitIds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("    Input %s at commit %s\n", name, inputCommitIds[name])
+	}
+}
+
+var statusJson bool
+
+// getApi returns the body of the response of the local comin daemon
+// API to a GET request on path
+func getApi(path string) (body []byte, err error) {
+	url := "http://localhost:4242" + path
 	client := http.Client{
 		Timeout: time.Second * 2,
 	}
@@ -77,7 +149,24 @@ func getStatus() (status manager.State, err error) {
 	if res.Body != nil {
 		defer res.Body.Close()
 	}
-	body, err := io.ReadAll(res.Body)
+	body, err = io.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("The request %s failed (%s): %s", path, res.Status, body)
+	}
+	return
+}
+
+// getStatusBody returns the status of the local comin daemon as
+// returned by its API
+func getStatusBody() (body []byte, err error) {
+	return getApi("/status")
+}
+
+func getStatus() (status manager.State, err error) {
+	body, err := getStatusBody()
 	if err != nil {
 		return
 	}
@@ -93,6 +182,18 @@ var statusCmd = &cobra.Command{
 	Short: "Get the status of the local machine",
 	Args:  cobra.MinimumNArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
+		if statusJson || jsonOutput() {
+			body, err := getStatusBody()
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			var out bytes.Buffer
+			if err := json.Indent(&out, body, "", "  "); err != nil {
+				logrus.Fatal(err)
+			}
+			fmt.Println(out.String())
+			return
+		}
 		status, err := getStatus()
 		if err != nil {
 			logrus.Fatal(err)
@@ -102,12 +203,97 @@ var statusCmd = &cobra.Command{
 			fmt.Printf("  Remote %s fetched %s\n",
 				r.Url, humanize.Time(r.FetchedAt),
 			)
+			if r.FetchErrorMsg != "" {
+				fmt.Printf("    Fetch failed (%s): %s\n", r.FetchErrorKind, r.FetchErrorMsg)
+			}
+			if r.Main != nil && r.Main.ForcePushed {
+				fmt.Printf("    The branch %s has been force pushed\n", r.Main.Name)
+			}
+		}
+		for _, i := range status.RepositoryStatus.Inputs {
+			fmt.Printf("  Input %s from %s fetched %s\n",
+				i.Name, i.Url, humanize.Time(i.FetchedAt),
+			)
+			if i.CommitId != "" {
+				fmt.Printf("    Commit %s from the branch %s\n", i.CommitId, i.Branch)
+			}
+			if i.FetchErrorMsg != "" {
+				fmt.Printf("    Fetch failed (%s): %s\n", i.FetchErrorKind, i.FetchErrorMsg)
+			}
+		}
+		if status.RepositoryStatus.ErrorMsg != "" {
+			fmt.Printf("  Repository error: %s\n", status.RepositoryStatus.ErrorMsg)
+		}
+		if status.RebootNeeded {
+			fmt.Printf("  The machine has to be rebooted to run the deployed kernel, initrd or systemd\n")
+			if status.IsRebootScheduled {
+				fmt.Printf("  The machine is going to be rebooted %s\n", humanize.Time(status.RebootScheduledAt))
+			}
+		}
+		if status.RepositoryStatus.SelectedRemoteName != "" {
+			fmt.Printf("  The selected commit is served by the remote %s\n", status.RepositoryStatus.SelectedRemoteName)
+		}
+		if status.RepositoryStatus.SelectedBranchIsTesting {
+			fmt.Printf("  The testing branch %s is deployed: it is tested until the main branch catches up\n", status.RepositoryStatus.SelectedBranchName)
+		}
+		if status.RepositoryStatus.PinnedCommitId != "" {
+			fmt.Printf("  Deployments are pinned to the commit %s: run 'comin unpin' to deploy newer commits\n", status.RepositoryStatus.PinnedCommitId)
+		}
+		if status.IsFrozen {
+			fmt.Printf("  %s: run 'comin unfreeze' to allow them\n", freezeStatus(status.Freeze))
+		}
+		if status.ConsecutiveFailures > 0 {
+			fmt.Printf("  %d consecutive failures since %s\n", status.ConsecutiveFailures, humanize.Time(status.FailingSince))
+		}
+		if status.SkippedCommitId != "" {
+			fmt.Printf("  The commit %s has been skipped %s: %s\n", status.SkippedCommitId, humanize.Time(status.SkippedAt), status.SkippedReason)
+		}
+		if r := status.ManualRollback; r != nil {
+			if r.IsRunning {
+				fmt.Printf("  Rolling back to %s (since %s)\n", r.OutPath, humanize.Time(r.StartedAt))
+			} else if r.ErrorMsg != "" {
+				fmt.Printf("  The rollback to %s failed (%s): %s\n", r.OutPath, humanize.Time(r.EndedAt), r.ErrorMsg)
+			} else {
+				fmt.Printf("  Rolled back to %s (%s)\n", r.OutPath, humanize.Time(r.EndedAt))
+			}
 		}
 		deploymentStatus(status.Deployment)
+		if len(status.SystemGenerations) > 0 {
+			fmt.Printf("  System Generations\n")
+			for _, g := range status.SystemGenerations {
+				fmt.Printf("    %d: commit %s (%s)\n", g.Number, g.CommitId, g.OutPath)
+			}
+		}
 		generationStatus(status.Generation)
+		if status.IsTimedOut {
+			fmt.Printf("    Aborted: the deployment timeout has been exceeded\n")
+		}
+		if status.IsWaitingForApproval {
+			fmt.Printf("    Waiting for an approval: run 'comin approve %s'\n", status.Generation.UUID)
+		}
+		if status.IsWaitingForWindow {
+			fmt.Printf("    Waiting for the next deployment window\n")
+		}
+		if status.IsWaitingForUnfreeze {
+			fmt.Printf("    Waiting for deployments to be unfrozen\n")
+		}
+		if status.IsFetching {
+			fmt.Printf("  The remotes are being fetched\n")
+		}
+		if pending := status.PendingFetch; pending != nil {
+			remote := pending.Remote
+			if remote == "" {
+				remote = "all remotes"
+			}
+			fmt.Printf("  The fetch %s of %s is pending\n", pending.ID, remote)
+		}
+		if status.IsCollectingGarbage {
+			fmt.Printf("  The Nix store is being garbage collected\n")
+		}
 	},
 }
 
 func init() {
+	statusCmd.Flags().BoolVarP(&statusJson, "json", "", false, "print the status in JSON (same as --output json)")
 	rootCmd.AddCommand(statusCmd)
 }
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/dustin/go-humanize"
+	"github.com/nlewo/comin/internal/gc"
+	"github.com/nlewo/comin/internal/nix"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/nlewo/comin/internal/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// verifyMinFreeSpace is the free space of the Nix store required when
+// the gc.min_free_space option is not set
+const verifyMinFreeSpace = 1024 * 1024 * 1024
+
+// verify prints the deployment preconditions of the machine and
+// returns false if one of them is not met. The remotes are fetched in
+// the directory dir.
+func verify(ctx context.Context, cfg types.Configuration, dir string) bool {
+	ok := true
+	n := nix.New(cfg.Nix).DetectVersion()
+	fmt.Printf("Deployment preconditions of the machine %s\n", cfg.Hostname)
+
+	fmt.Printf("  Nix daemon\n")
+	if err := n.PingStore(ctx, "daemon"); err != nil {
+		ok = false
+		fmt.Printf("    Error: %s\n", err)
+		fmt.Printf("    Hint: check the nix-daemon service is running\n")
+	} else {
+		fmt.Printf("    Reachable\n")
+	}
+
+	substituters, err := n.Substituters(ctx)
+	if err != nil {
+		ok = false
+		fmt.Printf("  Substituters\n")
+		fmt.Printf("    Error: %s\n", err)
+	}
+	for _, substituter := range substituters {
+		fmt.Printf("  Substituter %s\n", substituter)
+		if err := n.PingStore(ctx, substituter); err != nil {
+			ok = false
+			fmt.Printf("    Error: %s\n", err)
+		} else {
+			fmt.Printf("    Reachable\n")
+		}
+	}
+
+	minFreeSpace := cfg.Gc.MinFreeSpace
+	if minFreeSpace == 0 {
+		minFreeSpace = verifyMinFreeSpace
+	}
+	fmt.Printf("  Free space of /nix/store\n")
+	if free, err := gc.FreeSpace("/nix/store"); err != nil {
+		ok = false
+		fmt.Printf("    Error: %s\n", err)
+	} else if free < minFreeSpace {
+		ok = false
+		fmt.Printf("    Error: %s are available, less than %s\n", humanize.Bytes(free), humanize.Bytes(minFreeSpace))
+		fmt.Printf("    Hint: collect the garbage of the Nix store\n")
+	} else {
+		fmt.Printf("    %s are available\n", humanize.Bytes(free))
+	}
+
+	fmt.Printf("  Selected commit\n")
+	ctx, rs, flakeUrl, err := fetchSelected(ctx, cfg, n, dir)
+	if err != nil {
+		printCheckError(err)
+		return false
+	}
+	fmt.Printf("    Commit %s from '%s/%s'\n", rs.SelectedCommitId, rs.SelectedRemoteName, rs.SelectedBranchName)
+	if len(cfg.CommitSignatures.GpgPublicKeyPaths) > 0 || cfg.CommitSignatures.SshAllowedSignersPath != "" {
+		fmt.Printf("    The signature is valid\n")
+	}
+
+	fmt.Printf("  Machine ID\n")
+	_, _, expectedMachineId, _, err := n.Eval(ctx, flakeUrl, cfg.Hostname)
+	if err != nil {
+		fmt.Printf("    Error: failed to evaluate the configuration '%s': %s\n", cfg.Hostname, err)
+		return false
+	}
+	machineId, err := utils.ReadMachineId(cfg.MachineIdentity)
+	switch {
+	case err != nil:
+		ok = false
+		fmt.Printf("    Error: %s\n", err)
+	case expectedMachineId == "":
+		fmt.Printf("    comin.machineId is not set: the machine ID is not checked\n")
+	case !utils.MachineIdAccepted(expectedMachineId, machineId):
+		ok = false
+		fmt.Printf("    Error: the evaluated comin.machineId '%s' is different from the machine ID '%s' (%s source)\n", expectedMachineId, machineId, cfg.MachineIdentity.Source)
+		fmt.Printf("    Hint: check the configuration '%s' is the configuration of this machine\n", cfg.Hostname)
+	default:
+		fmt.Printf("    The machine ID %s matches\n", machineId)
+	}
+	return ok
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check the deployment preconditions of the local machine, without building anything",
+	Long: `Check the Nix daemon and the substituters are reachable, the Nix
+store has enough free space (gc.min_free_space, or 1GB when it is not
+set), the commit comin would deploy is signed by a trusted key when
+commit signatures are required and the evaluated comin.machineId
+matches /etc/machine-id. The remotes are fetched in a temporary
+repository and the configuration is evaluated but not built.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := readConfig()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		dir, err := os.MkdirTemp("", "comin-verify-")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		ok := verify(context.TODO(), cfg, dir)
+		os.RemoveAll(dir)
+		if !ok {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+}
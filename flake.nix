@@ -33,9 +33,16 @@
           "-X github.com/nlewo/comin/cmd.version=${version}"
         ];
         buildInputs = [ final.makeWrapper ];
+        nativeBuildInputs = [ final.installShellFiles ];
         postInstall = ''
-          # This is because Nix needs Git at runtime by the go-git library
+          # comin fetches repositories with the go-git library but
+          # Nix needs Git at runtime to evaluate git+file flakes
           wrapProgram $out/bin/comin --prefix PATH : ${final.git}/bin
+        '' + final.lib.optionalString (final.stdenv.buildPlatform.canExecute final.stdenv.hostPlatform) ''
+          installShellCompletion --cmd comin \
+            --bash <($out/bin/comin completion bash) \
+            --fish <($out/bin/comin completion fish) \
+            --zsh <($out/bin/comin completion zsh)
         '';
       };
     };
@@ -0,0 +1,184 @@
+package activation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The actions the helper runs on behalf of the comin daemon
+const (
+	// Activate a configuration
+	Activate = "activate"
+	// Restart the comin service, once its unit file changed
+	RestartComin = "restart-comin"
+)
+
+// Request is sent by the comin daemon to the helper
+type Request struct {
+	Action    string `json:"action"`
+	OutPath   string `json:"outpath,omitempty"`
+	Operation string `json:"operation,omitempty"`
+}
+
+// Response is sent back by the helper once the action terminated
+type Response struct {
+	// The output of the activation
+	Output   string `json:"output,omitempty"`
+	ErrorMsg string `json:"error,omitempty"`
+}
+
+// storePathRegexp matches the top-level store paths: the helper never
+// activates a path nested in a store path.
+var storePathRegexp = regexp.MustCompile(`^/nix/store/[0-9a-z]{32}-[^/]+$`)
+
+// Check returns an error when the request is not an action the helper
+// runs
+func (r Request) Check() error {
+	switch r.Action {
+	case RestartComin:
+		return nil
+	case Activate:
+	default:
+		return fmt.Errorf("The action '%s' is not supported", r.Action)
+	}
+	switch r.Operation {
+	case "switch", "boot", "test", "dry-activate":
+	default:
+		return fmt.Errorf("The operation '%s' is not supported", r.Operation)
+	}
+	if !storePathRegexp.MatchString(r.OutPath) {
+		return fmt.Errorf("The path '%s' is not a store path", r.OutPath)
+	}
+	return nil
+}
+
+// Client sends requests to the helper listening on a unix socket
+type Client struct {
+	socketPath string
+}
+
+func New(socketPath string) Client {
+	return Client{socketPath: socketPath}
+}
+
+func (c Client) request(ctx context.Context, req Request) (resp Response, err error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", c.socketPath)
+	if err != nil {
+		return resp, fmt.Errorf("Failed to connect to the activation helper: %s", err)
+	}
+	defer conn.Close()
+	// The activation is not interrupted when the context is
+	// canceled, but the daemon stops waiting for it
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return resp, fmt.Errorf("Failed to send the request to the activation helper: %s", err)
+	}
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return resp, fmt.Errorf("Failed to read the response of the activation helper: %s", err)
+	}
+	if resp.ErrorMsg != "" {
+		return resp, fmt.Errorf("%s", resp.ErrorMsg)
+	}
+	return resp, nil
+}
+
+// Activate asks the helper to activate the outPath with the operation
+// and returns the output of the activation
+func (c Client) Activate(ctx context.Context, outPath, operation string) (string, error) {
+	resp, err := c.request(ctx, Request{Action: Activate, OutPath: outPath, Operation: operation})
+	return resp.Output, err
+}
+
+// RestartComin asks the helper to restart the comin service
+func (c Client) RestartComin() error {
+	_, err := c.request(context.Background(), Request{Action: RestartComin})
+	return err
+}
+
+// Handler runs the actions of the requests
+type Handler struct {
+	Activate     func(ctx context.Context, outPath, operation string) (output string, err error)
+	RestartComin func() error
+}
+
+// Listen creates the unix socket socketPath, only accessible by its
+// owner, root when it is run by the helper, and the group gid
+func Listen(socketPath string, gid int) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		return nil, err
+	}
+	// A socket left by a previous helper
+	os.Remove(socketPath)
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chown(socketPath, -1, gid); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serve runs the actions requested on the listener l. Actions are run
+// one at a time.
+func Serve(l net.Listener, h Handler) error {
+	var mu sync.Mutex
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			var req Request
+			if err := json.NewDecoder(conn).Decode(&req); err != nil {
+				logrus.Errorf("activation: failed to read the request: %s", err)
+				return
+			}
+			mu.Lock()
+			resp := h.handle(req)
+			mu.Unlock()
+			if err := json.NewEncoder(conn).Encode(resp); err != nil {
+				logrus.Errorf("activation: failed to send the response: %s", err)
+			}
+		}()
+	}
+}
+
+func (h Handler) handle(req Request) (resp Response) {
+	if err := req.Check(); err != nil {
+		logrus.Errorf("activation: the request %#v is rejected: %s", req, err)
+		resp.ErrorMsg = err.Error()
+		return
+	}
+	var err error
+	switch req.Action {
+	case Activate:
+		logrus.Infof("activation: activating %s with the operation %s", req.OutPath, req.Operation)
+		resp.Output, err = h.Activate(context.Background(), req.OutPath, req.Operation)
+	case RestartComin:
+		logrus.Infof("activation: restarting comin")
+		err = h.RestartComin()
+	}
+	if err != nil {
+		resp.ErrorMsg = err.Error()
+	}
+	return
+}
@@ -0,0 +1,67 @@
+package activation
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	outPath := "/nix/store/0123456789abcdfghijklmnpqrsvwxyz-nixos-system-machine"
+	assert.Nil(t, Request{Action: Activate, OutPath: outPath, Operation: "switch"}.Check())
+	assert.Nil(t, Request{Action: RestartComin}.Check())
+	assert.ErrorContains(t, Request{Action: "run", OutPath: outPath, Operation: "switch"}.Check(), "action")
+	assert.ErrorContains(t, Request{Action: Activate, OutPath: outPath, Operation: "reboot"}.Check(), "operation")
+	assert.ErrorContains(t, Request{Action: Activate, OutPath: "/tmp/system", Operation: "switch"}.Check(), "store path")
+	assert.ErrorContains(t, Request{Action: Activate, OutPath: outPath + "/../../../tmp", Operation: "switch"}.Check(), "store path")
+}
+
+func TestServe(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "activation.sock")
+	l, err := Listen(socketPath, os.Getgid())
+	assert.Nil(t, err)
+	defer l.Close()
+	info, err := os.Stat(socketPath)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+
+	var activated []string
+	restarted := false
+	go Serve(l, Handler{
+		Activate: func(ctx context.Context, outPath, operation string) (string, error) {
+			activated = append(activated, operation+" "+outPath)
+			if operation == "boot" {
+				return "no boot loader", fmt.Errorf("switch-to-configuration failed")
+			}
+			return "restarting nginx.service", nil
+		},
+		RestartComin: func() error {
+			restarted = true
+			return nil
+		},
+	})
+
+	c := New(socketPath)
+	outPath := "/nix/store/0123456789abcdfghijklmnpqrsvwxyz-nixos-system-machine"
+	output, err := c.Activate(context.Background(), outPath, "switch")
+	assert.Nil(t, err)
+	assert.Equal(t, "restarting nginx.service", output)
+
+	output, err = c.Activate(context.Background(), outPath, "boot")
+	assert.ErrorContains(t, err, "switch-to-configuration failed")
+	assert.Equal(t, "no boot loader", output)
+
+	_, err = c.Activate(context.Background(), "/tmp/system", "switch")
+	assert.ErrorContains(t, err, "not a store path")
+	assert.Equal(t, []string{"switch " + outPath, "boot " + outPath}, activated)
+
+	assert.Nil(t, c.RestartComin())
+	assert.True(t, restarted)
+
+	_, err = New(filepath.Join(t.TempDir(), "missing.sock")).Activate(context.Background(), outPath, "switch")
+	assert.ErrorContains(t, err, "Failed to connect to the activation helper")
+}
@@ -0,0 +1,96 @@
+package announce
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/nlewo/comin/internal/events"
+	"github.com/nlewo/comin/internal/manager"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/nlewo/comin/internal/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// wallCommand is the command broadcasting the messages to the logged
+// in users
+var wallCommand = "wall"
+
+// Announcer announces the deployments to the interactive users of the
+// machine, with a MOTD fragment and wall messages
+type Announcer struct {
+	motdPath string
+	wall     bool
+}
+
+func New(config types.Announcements) Announcer {
+	return Announcer{
+		motdPath: config.MotdPath,
+		wall:     config.Wall,
+	}
+}
+
+// Message returns the message announcing the event to the users of
+// the machine. It is empty when the event is not announced: only the
+// activations and their results are announced.
+func Message(e events.Event) string {
+	switch e.Type {
+	case events.Switching:
+		return fmt.Sprintf("comin is deploying the commit %s since %s: services may be restarted.", e.CommitId, e.At.Local().Format("2006-01-02 15:04"))
+	case events.Done:
+		if e.DeploymentUUID == "" {
+			return ""
+		}
+		return fmt.Sprintf("comin deployed the commit %s at %s.", e.CommitId, e.At.Local().Format("2006-01-02 15:04"))
+	case events.Failed:
+		// An evaluation or a build failure doesn't modify the
+		// running system
+		if e.DeploymentUUID == "" {
+			return ""
+		}
+		return fmt.Sprintf("comin failed to deploy the commit %s at %s: %s", e.CommitId, e.At.Local().Format("2006-01-02 15:04"), utils.CommitSubject(e.ErrorMsg))
+	}
+	return ""
+}
+
+// Announce writes the message of the event to the MOTD fragment and
+// broadcasts it with wall
+func (a Announcer) Announce(e events.Event) error {
+	msg := Message(e)
+	if msg == "" {
+		return nil
+	}
+	if a.motdPath != "" {
+		if err := os.MkdirAll(filepath.Dir(a.motdPath), 0755); err != nil {
+			return err
+		}
+		if err := utils.WriteFileAtomic(a.motdPath, []byte(msg+"\n"), 0644); err != nil {
+			return fmt.Errorf("Failed to write the MOTD fragment %s: %s", a.motdPath, err)
+		}
+	}
+	if a.wall {
+		cmd := exec.Command(wallCommand)
+		cmd.Stdin = strings.NewReader(msg + "\n")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("Failed to run %s: %s: %s", wallCommand, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// Run announces the activations and their results on the events of the
+// manager
+func (a Announcer) Run(m manager.Manager) {
+	if a.motdPath == "" && !a.wall {
+		return
+	}
+	eventCh, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+	for e := range eventCh {
+		if err := a.Announce(e); err != nil {
+			logrus.Errorf("Failed to announce the deployment: %s", err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package announce
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nlewo/comin/internal/events"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessage(t *testing.T) {
+	at := time.Date(2024, 3, 1, 10, 30, 0, 0, time.Local)
+	assert.Equal(t, "", Message(events.Event{Type: events.Building, CommitId: "abc", At: at}))
+	assert.Equal(t, "", Message(events.Event{Type: events.Failed, CommitId: "abc", GenerationUUID: "g1", ErrorMsg: "build failed", At: at}))
+	assert.Equal(t, "comin is deploying the commit abc since 2024-03-01 10:30: services may be restarted.",
+		Message(events.Event{Type: events.Switching, CommitId: "abc", DeploymentUUID: "d1", At: at}))
+	assert.Equal(t, "comin deployed the commit abc at 2024-03-01 10:30.",
+		Message(events.Event{Type: events.Done, CommitId: "abc", DeploymentUUID: "d1", At: at}))
+	assert.Equal(t, "comin failed to deploy the commit abc at 2024-03-01 10:30: switch failed",
+		Message(events.Event{Type: events.Failed, CommitId: "abc", DeploymentUUID: "d1", ErrorMsg: "switch failed\nexit status 4", At: at}))
+}
+
+func TestAnnounce(t *testing.T) {
+	dir := t.TempDir()
+	// The wall command stores the broadcasted message
+	wallPath := filepath.Join(dir, "wall")
+	wallCommand = filepath.Join(dir, "wall.sh")
+	defer func() { wallCommand = "wall" }()
+	err := os.WriteFile(wallCommand, []byte("#!/bin/sh\ncat > "+wallPath+"\n"), 0755)
+	assert.Nil(t, err)
+
+	motdPath := filepath.Join(dir, "motd.d", "comin")
+	a := New(types.Announcements{MotdPath: motdPath, Wall: true})
+	at := time.Date(2024, 3, 1, 10, 30, 0, 0, time.Local)
+
+	err = a.Announce(events.Event{Type: events.Switching, CommitId: "abc", DeploymentUUID: "d1", At: at})
+	assert.Nil(t, err)
+	motd, _ := os.ReadFile(motdPath)
+	assert.Equal(t, "comin is deploying the commit abc since 2024-03-01 10:30: services may be restarted.\n", string(motd))
+	wall, _ := os.ReadFile(wallPath)
+	assert.Equal(t, string(motd), string(wall))
+
+	err = a.Announce(events.Event{Type: events.Done, CommitId: "abc", DeploymentUUID: "d1", At: at})
+	assert.Nil(t, err)
+	motd, _ = os.ReadFile(motdPath)
+	assert.Equal(t, "comin deployed the commit abc at 2024-03-01 10:30.\n", string(motd))
+}
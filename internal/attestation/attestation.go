@@ -0,0 +1,141 @@
+package attestation
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/nlewo/comin/internal/deployment"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+)
+
+// PublicKeyPath is the file of the expected public key in the
+// configuration to deploy, relative to its output path. It is written
+// by the NixOS module from services.comin.tpm_attestation.public_key.
+const PublicKeyPath = "etc/comin/tpm-public-key.pem"
+
+// tpm2SignCommand is the command signing with the TPM key
+var tpm2SignCommand = "tpm2_sign"
+
+// Attestation proves, before each activation, that the machine holds
+// the TPM-resident key declared by the configuration to deploy. A
+// machine only spoofing the machine ID of another one can not sign
+// with its key.
+type Attestation struct {
+	keyHandle string
+	signFunc  func(ctx context.Context, keyHandle string, message []byte) ([]byte, error)
+}
+
+func New(config types.TpmAttestation) Attestation {
+	return Attestation{
+		keyHandle: config.KeyHandle,
+		signFunc:  sign,
+	}
+}
+
+// sign signs the SHA-256 digest of the message with the TPM key
+// keyHandle. ECDSA signatures are DER encoded and RSA signatures are
+// PKCS #1 v1.5 signatures.
+func sign(ctx context.Context, keyHandle string, message []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "comin-attestation-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	messagePath := filepath.Join(dir, "message")
+	signaturePath := filepath.Join(dir, "signature")
+	if err := os.WriteFile(messagePath, message, 0600); err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, tpm2SignCommand, "-c", keyHandle, "-g", "sha256", "-f", "plain", "-o", signaturePath, messagePath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("Failed to run %s: %s: %s", tpm2SignCommand, err, strings.TrimSpace(string(out)))
+	}
+	return os.ReadFile(signaturePath)
+}
+
+// ReadPublicKey reads the expected public key declared by the
+// configuration of the output path outPath
+func ReadPublicKey(outPath string) (crypto.PublicKey, error) {
+	path := filepath.Join(outPath, PublicKeyPath)
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("The configuration doesn't declare the TPM public key (services.comin.tpm_attestation.public_key)")
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("The TPM public key %s is not a PEM encoded key", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the TPM public key %s: %s", path, err)
+	}
+	return key, nil
+}
+
+// verify checks the signature of the message by the private key of
+// publicKey
+func verify(publicKey crypto.PublicKey, message, signature []byte) error {
+	digest := sha256.Sum256(message)
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return fmt.Errorf("invalid ECDSA signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	}
+	return fmt.Errorf("the key type %T is not supported: use an ECDSA or a RSA key", publicKey)
+}
+
+// Attest proves the TPM holds the private key of the public key
+// declared by the configuration of the output path outPath, by
+// signing a random challenge
+func (a Attestation) Attest(ctx context.Context, outPath string) error {
+	publicKey, err := ReadPublicKey(outPath)
+	if err != nil {
+		return err
+	}
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	signature, err := a.signFunc(ctx, a.keyHandle, challenge)
+	if err != nil {
+		return fmt.Errorf("Failed to sign the attestation challenge with the TPM key %s: %s", a.keyHandle, err)
+	}
+	if err := verify(publicKey, challenge, signature); err != nil {
+		return fmt.Errorf("The TPM key %s is not the key declared by the configuration: %s", a.keyHandle, err)
+	}
+	logrus.Infof("attestation: the TPM key %s is the key declared by the configuration %s", a.keyHandle, outPath)
+	return nil
+}
+
+// Wrap returns a DeployFunc only running deployFunc once the TPM
+// attestation succeeded. The dry activations, which don't modify the
+// machine, are not attested.
+func (a Attestation) Wrap(deployFunc deployment.DeployFunc) deployment.DeployFunc {
+	return func(ctx context.Context, machineId, outPath, operation string) (bool, string, error) {
+		if operation == "dry-activate" {
+			return deployFunc(ctx, machineId, outPath, operation)
+		}
+		if err := a.Attest(ctx, outPath); err != nil {
+			return false, "", err
+		}
+		return deployFunc(ctx, machineId, outPath, operation)
+	}
+}
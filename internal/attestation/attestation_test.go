@@ -0,0 +1,107 @@
+package attestation
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// writePublicKey writes the public key in the configuration of the
+// output path outPath
+func writePublicKey(t *testing.T, outPath string, publicKey crypto.PublicKey) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	assert.Nil(t, err)
+	assert.Nil(t, os.MkdirAll(filepath.Join(outPath, "etc", "comin"), 0755))
+	content := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	assert.Nil(t, os.WriteFile(filepath.Join(outPath, PublicKeyPath), content, 0644))
+}
+
+// softwareSigner signs like the TPM with a software key
+func softwareSigner(key crypto.Signer) func(context.Context, string, []byte) ([]byte, error) {
+	return func(ctx context.Context, keyHandle string, message []byte) ([]byte, error) {
+		digest := sha256.Sum256(message)
+		return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+}
+
+func TestAttest(t *testing.T) {
+	ctx := context.Background()
+	outPath := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	a := New(types.TpmAttestation{Enable: true, KeyHandle: "0x81000001"})
+	a.signFunc = softwareSigner(key)
+
+	err = a.Attest(ctx, outPath)
+	assert.ErrorContains(t, err, "doesn't declare the TPM public key")
+
+	writePublicKey(t, outPath, key.Public())
+	assert.Nil(t, a.Attest(ctx, outPath))
+
+	a.signFunc = softwareSigner(other)
+	err = a.Attest(ctx, outPath)
+	assert.ErrorContains(t, err, "is not the key declared by the configuration")
+
+	a.signFunc = func(context.Context, string, []byte) ([]byte, error) {
+		return nil, fmt.Errorf("no TPM")
+	}
+	err = a.Attest(ctx, outPath)
+	assert.ErrorContains(t, err, "no TPM")
+}
+
+func TestAttestRSA(t *testing.T) {
+	outPath := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	writePublicKey(t, outPath, key.Public())
+
+	a := New(types.TpmAttestation{Enable: true, KeyHandle: "0x81000001"})
+	a.signFunc = softwareSigner(key)
+	assert.Nil(t, a.Attest(context.Background(), outPath))
+}
+
+func TestWrap(t *testing.T) {
+	outPath := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	a := New(types.TpmAttestation{Enable: true, KeyHandle: "0x81000001"})
+	a.signFunc = softwareSigner(key)
+
+	deployed := false
+	deployFunc := a.Wrap(func(ctx context.Context, machineId, outPath, operation string) (bool, string, error) {
+		deployed = true
+		return false, "", nil
+	})
+
+	// The configuration doesn't declare the key: it is not deployed
+	_, _, err = deployFunc(context.Background(), "", outPath, "switch")
+	assert.NotNil(t, err)
+	assert.False(t, deployed)
+
+	// Dry activations are not attested
+	_, _, err = deployFunc(context.Background(), "", outPath, "dry-activate")
+	assert.Nil(t, err)
+	assert.True(t, deployed)
+
+	deployed = false
+	writePublicKey(t, outPath, key.Public())
+	_, _, err = deployFunc(context.Background(), "", outPath, "switch")
+	assert.Nil(t, err)
+	assert.True(t, deployed)
+}
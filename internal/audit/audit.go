@@ -0,0 +1,235 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nlewo/comin/internal/deployment"
+	"github.com/nlewo/comin/internal/types"
+)
+
+// The actions recorded in the audit log
+const (
+	// A commit has been deployed
+	Deployment = "deployment"
+	// An operator activated again a previous configuration
+	Rollback = "rollback"
+)
+
+// The signature status of the deployed commits
+const (
+	// The commit is signed by a trusted key: comin doesn't deploy
+	// other commits
+	SignatureVerified = "verified"
+	// The commit signatures are not checked
+	SignatureUnchecked = "unchecked"
+)
+
+// Entry is a line of the audit log
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Host   string    `json:"host"`
+	Action string    `json:"action"`
+	// What triggered the action: the poller, a fetch request or
+	// the API
+	Trigger string `json:"trigger"`
+	// The generation has been approved with the API
+	Approved       bool   `json:"approved,omitempty"`
+	DeploymentUUID string `json:"deployment_uuid,omitempty"`
+	GenerationUUID string `json:"generation_uuid,omitempty"`
+	CommitId       string `json:"commit_id,omitempty"`
+	RemoteName     string `json:"remote_name,omitempty"`
+	BranchName     string `json:"branch_name,omitempty"`
+	Signature      string `json:"signature,omitempty"`
+	OutPath        string `json:"outpath"`
+	Operation      string `json:"operation"`
+	Result         string `json:"result"`
+	ErrorMsg       string `json:"error,omitempty"`
+	// The health checks failed and the previous configuration has
+	// been activated again
+	RolledBack bool `json:"rolled_back,omitempty"`
+	// The hash of the previous entry, when the entries are hash
+	// chained
+	PrevHash string `json:"prev_hash,omitempty"`
+	// The SHA-256 of the entry without its hash
+	Hash string `json:"hash,omitempty"`
+}
+
+// computeHash returns the hash of the entry, computed on its JSON
+// encoding without its hash
+func (e Entry) computeHash() (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Log appends the deployments to a JSONL file. Existing entries are
+// never modified.
+type Log struct {
+	path      string
+	hashChain bool
+	signature string
+}
+
+// New returns the audit log of the configuration. The log is disabled
+// when its path is empty.
+func New(config types.Audit, signatures types.CommitSignatures) Log {
+	l := Log{
+		path:      config.Path,
+		hashChain: config.HashChain,
+		signature: SignatureUnchecked,
+	}
+	if len(signatures.GpgPublicKeyPaths) > 0 || signatures.SshAllowedSignersPath != "" {
+		l.signature = SignatureVerified
+	}
+	return l
+}
+
+// NewDeploymentEntry returns the entry of the finished deployment d
+func (l Log) NewDeploymentEntry(hostname string, d deployment.Deployment) Entry {
+	trigger := "poller"
+	if d.Generation.FetchId != "" {
+		trigger = "fetch request " + d.Generation.FetchId
+	}
+	return Entry{
+		Time:           d.EndAt,
+		Host:           hostname,
+		Action:         Deployment,
+		Trigger:        trigger,
+		Approved:       d.Generation.SelectedBranchRequireApproval,
+		DeploymentUUID: d.UUID,
+		GenerationUUID: d.Generation.UUID,
+		CommitId:       d.Generation.SelectedCommitId,
+		RemoteName:     d.Generation.SelectedRemoteName,
+		BranchName:     d.Generation.SelectedBranchName,
+		Signature:      l.signature,
+		OutPath:        d.Generation.OutPath,
+		Operation:      d.Operation,
+		Result:         deployment.StatusToString(d.Status),
+		ErrorMsg:       d.ErrorMsg,
+		RolledBack:     d.RolledBack,
+	}
+}
+
+// NewRollbackEntry returns the entry of a rollback to outPath
+// requested with the API
+func NewRollbackEntry(hostname string, at time.Time, outPath string, err error) Entry {
+	e := Entry{
+		Time:      at,
+		Host:      hostname,
+		Action:    Rollback,
+		Trigger:   "api",
+		OutPath:   outPath,
+		Operation: "switch",
+		Result:    "done",
+	}
+	if err != nil {
+		e.Result = "failed"
+		e.ErrorMsg = err.Error()
+	}
+	return e
+}
+
+// lastHash returns the hash of the last entry of the log
+func (l Log) lastHash() (hash string, err error) {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return "", fmt.Errorf("The audit log %s is corrupted: %s", l.path, err)
+		}
+		hash = e.Hash
+	}
+	return hash, scanner.Err()
+}
+
+// Append appends the entry to the log and syncs it to the disk
+func (l Log) Append(e Entry) (err error) {
+	if l.path == "" {
+		return nil
+	}
+	if l.hashChain {
+		if e.PrevHash, err = l.lastHash(); err != nil {
+			return
+		}
+		if e.Hash, err = e.computeHash(); err != nil {
+			return
+		}
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(l.path), 0750); err != nil {
+		return
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return
+	}
+	if _, err = f.Write(append(line, '\n')); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
+
+// Verify checks the hash chain of the audit log path and returns its
+// number of entries. The chain starts at the first hashed entry: the
+// entries written before the hash chaining was enabled can not be
+// verified.
+func Verify(path string) (count int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	prevHash := ""
+	for line := 1; scanner.Scan(); line++ {
+		var e Entry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return count, fmt.Errorf("The line %d is not a valid entry: %s", line, err)
+		}
+		count++
+		if e.Hash == "" {
+			if prevHash != "" {
+				return count, fmt.Errorf("The entry of the line %d is not hashed", line)
+			}
+			continue
+		}
+		if e.PrevHash != prevHash {
+			return count, fmt.Errorf("The entry of the line %d is not chained to the previous entry", line)
+		}
+		hash, err := e.computeHash()
+		if err != nil {
+			return count, err
+		}
+		if hash != e.Hash {
+			return count, fmt.Errorf("The entry of the line %d has been modified", line)
+		}
+		prevHash = e.Hash
+	}
+	return count, scanner.Err()
+}
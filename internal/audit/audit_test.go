@@ -0,0 +1,75 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlewo/comin/internal/deployment"
+	"github.com/nlewo/comin/internal/generation"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDeploymentEntry(t *testing.T) {
+	d := deployment.Deployment{
+		UUID: "d1",
+		Generation: generation.Generation{
+			UUID:                          "g1",
+			SelectedCommitId:              "abc",
+			SelectedRemoteName:            "origin",
+			SelectedBranchName:            "main",
+			SelectedBranchRequireApproval: true,
+			OutPath:                       "/nix/store/system",
+			FetchId:                       "f1",
+		},
+		Operation: "switch",
+		Status:    deployment.Done,
+	}
+	e := New(types.Audit{}, types.CommitSignatures{}).NewDeploymentEntry("machine", d)
+	assert.Equal(t, "fetch request f1", e.Trigger)
+	assert.Equal(t, SignatureUnchecked, e.Signature)
+	assert.True(t, e.Approved)
+	assert.Equal(t, "done", e.Result)
+
+	d.Generation.FetchId = ""
+	e = New(types.Audit{}, types.CommitSignatures{SshAllowedSignersPath: "/etc/allowed_signers"}).NewDeploymentEntry("machine", d)
+	assert.Equal(t, "poller", e.Trigger)
+	assert.Equal(t, SignatureVerified, e.Signature)
+}
+
+func TestAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	at := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+
+	// Entries written before the hash chaining was enabled
+	l := New(types.Audit{Path: path}, types.CommitSignatures{})
+	assert.Nil(t, l.Append(NewRollbackEntry("machine", at, "/nix/store/system-1", nil)))
+
+	l = New(types.Audit{Path: path, HashChain: true}, types.CommitSignatures{})
+	assert.Nil(t, l.Append(NewRollbackEntry("machine", at, "/nix/store/system-2", nil)))
+	assert.Nil(t, l.Append(NewRollbackEntry("machine", at, "/nix/store/system-3", fmt.Errorf("failed"))))
+	count, err := Verify(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	lines := strings.SplitAfter(string(content), "\n")
+	assert.Len(t, lines, 4)
+
+	// A modified entry
+	modified := strings.Replace(string(content), "system-2", "system-4", 1)
+	assert.Nil(t, os.WriteFile(path, []byte(modified), 0640))
+	_, err = Verify(path)
+	assert.ErrorContains(t, err, "line 2 has been modified")
+
+	// A removed entry
+	removed := lines[0] + lines[2]
+	assert.Nil(t, os.WriteFile(path, []byte(removed), 0640))
+	_, err = Verify(path)
+	assert.ErrorContains(t, err, "line 2 is not chained")
+}
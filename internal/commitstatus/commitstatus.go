@@ -0,0 +1,260 @@
+package commitstatus
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlewo/comin/internal/events"
+	"github.com/nlewo/comin/internal/manager"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+)
+
+type State string
+
+const (
+	// The commit is evaluated, built or deployed
+	Pending State = "pending"
+	Success State = "success"
+	Failure State = "failure"
+)
+
+// maxDescriptionLength is the maximal length of the description of a
+// status accepted by the forges
+const maxDescriptionLength = 140
+
+// Status is the status of a commit on a machine
+type Status struct {
+	CommitId    string
+	State       State
+	Description string
+	// The URL of the logs or of the deployment on the comin API,
+	// empty when the URL of the API is not configured
+	TargetUrl string
+	// The name of the status, which identifies the machine among
+	// the statuses of the commit
+	Context string
+}
+
+// Reporter reports the statuses of commits to a forge
+type Reporter interface {
+	// Name identifies the reporter in the logs
+	Name() string
+	Report(ctx context.Context, s Status) error
+}
+
+// requestTimeout is the timeout of an attempt to report a status
+var requestTimeout = 10 * time.Second
+
+// retryDelay is the delay before the first retry of a status which
+// failed to be reported. It doubles at each retry.
+var retryDelay = time.Second
+
+// retries is the number of retries of a status which failed to be
+// reported
+const retries = 3
+
+// queue holds the statuses waiting to be reported by a reporter. Only
+// the last status of a commit is kept: a status superseded before
+// being reported, for instance while the forge is unreachable, is not
+// reported.
+type queue struct {
+	reporter Reporter
+	mu       sync.Mutex
+	// The commits having a status to report, in the order of
+	// their first status
+	commitIds []string
+	statuses  map[string]Status
+	wakeCh    chan struct{}
+	// Counts the statuses queued or being reported
+	wg *sync.WaitGroup
+}
+
+func newQueue(reporter Reporter, wg *sync.WaitGroup) *queue {
+	return &queue{
+		reporter: reporter,
+		statuses: make(map[string]Status),
+		wakeCh:   make(chan struct{}, 1),
+		wg:       wg,
+	}
+}
+
+// push queues the status s, replacing the queued status of its commit
+func (q *queue) push(s Status) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.statuses[s.CommitId]; !ok {
+		q.commitIds = append(q.commitIds, s.CommitId)
+		q.wg.Add(1)
+	}
+	q.statuses[s.CommitId] = s
+	select {
+	case q.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the oldest queued status. It returns false when the
+// queue is empty.
+func (q *queue) pop() (Status, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.commitIds) == 0 {
+		return Status{}, false
+	}
+	commitId := q.commitIds[0]
+	q.commitIds = q.commitIds[1:]
+	s := q.statuses[commitId]
+	delete(q.statuses, commitId)
+	return s, true
+}
+
+// run reports the queued statuses. The statuses of a commit are
+// reported in order since a reporter reports one status at a time.
+func (q *queue) run() {
+	for range q.wakeCh {
+		for {
+			s, ok := q.pop()
+			if !ok {
+				break
+			}
+			report(q.reporter, s)
+			q.wg.Done()
+		}
+	}
+}
+
+// Reporters reports the progress of the deployments of the machine as
+// commit statuses to the forges. Each reporter has its own queue: a
+// slow or unreachable forge neither delays the other ones nor the
+// deployments.
+type Reporters struct {
+	hostname  string
+	targetUrl string
+	queues    []*queue
+	wg        *sync.WaitGroup
+}
+
+func New(config types.CommitStatuses, hostname string) Reporters {
+	r := Reporters{
+		hostname:  hostname,
+		targetUrl: strings.TrimSuffix(config.TargetUrl, "/"),
+		wg:        &sync.WaitGroup{},
+	}
+	var reporters []Reporter
+	for _, c := range config.GitHub {
+		reporters = append(reporters, newGitHub(c))
+	}
+	for _, c := range config.GitLab {
+		reporters = append(reporters, newGitLab(c))
+	}
+	for _, c := range config.Gitea {
+		reporters = append(reporters, newGitea(c))
+	}
+	for _, reporter := range reporters {
+		r.queues = append(r.queues, newQueue(reporter, r.wg))
+	}
+	return r
+}
+
+// status returns the status of the commit of the event. It returns
+// false when the event doesn't change the status of the commit.
+func (r Reporters) status(e events.Event) (Status, bool) {
+	s := Status{
+		CommitId: e.CommitId,
+		Context:  "comin/" + r.hostname,
+	}
+	switch e.Type {
+	case events.Evaluating:
+		s.State, s.Description = Pending, "Evaluating on "+r.hostname
+	case events.Building:
+		s.State, s.Description = Pending, "Building on "+r.hostname
+	case events.Switching:
+		s.State, s.Description = Pending, "Deploying on "+r.hostname
+	case events.Done:
+		s.State, s.Description = Success, "Deployed on "+r.hostname
+	case events.Failed:
+		s.State, s.Description = Failure, fmt.Sprintf("Failed on %s: %s", r.hostname, strings.ReplaceAll(e.ErrorMsg, "\n", " "))
+	default:
+		return s, false
+	}
+	if e.CommitId == "" {
+		return s, false
+	}
+	if len(s.Description) > maxDescriptionLength {
+		s.Description = s.Description[:maxDescriptionLength-3] + "..."
+	}
+	if r.targetUrl != "" {
+		if e.DeploymentUUID != "" {
+			s.TargetUrl = r.targetUrl + "/deployments/" + e.DeploymentUUID
+		} else if e.GenerationUUID != "" {
+			s.TargetUrl = r.targetUrl + "/logs/" + e.GenerationUUID
+		}
+	}
+	return s, true
+}
+
+// report reports the status and retries with an exponential backoff
+// when it fails
+func report(reporter Reporter, s Status) {
+	delay := retryDelay
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		err := reporter.Report(ctx, s)
+		cancel()
+		if err == nil {
+			logrus.Debugf("commitstatus: the status %s of the commit %s has been reported to %s", s.State, s.CommitId, reporter.Name())
+			return
+		}
+		if attempt >= retries {
+			logrus.Errorf("commitstatus: failed to report the status %s of the commit %s to %s: %s", s.State, s.CommitId, reporter.Name(), err)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Handle queues the status of the commit of the event e to all
+// reporters. It never blocks.
+func (r Reporters) Handle(e events.Event) {
+	s, ok := r.status(e)
+	if !ok {
+		return
+	}
+	for _, q := range r.queues {
+		q.push(s)
+	}
+}
+
+// Wait waits for the queued statuses being reported, at most during
+// timeout. It is used before comin restarts.
+func (r Reporters) Wait(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logrus.Errorf("commitstatus: statuses are still being reported after %s", timeout)
+	}
+}
+
+// Run starts reporting the statuses of the commits on the events of
+// the manager. The events are handled synchronously by the manager
+// so that no status is lost, and the statuses are reported before
+// comin restarts.
+func (r Reporters) Run(m manager.Manager) {
+	if len(r.queues) == 0 {
+		return
+	}
+	for _, q := range r.queues {
+		go q.run()
+	}
+	m.Handle(r)
+}
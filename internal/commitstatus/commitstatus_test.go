@@ -0,0 +1,192 @@
+package commitstatus
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlewo/comin/internal/events"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatus(t *testing.T) {
+	r := New(types.CommitStatuses{TargetUrl: "https://machine.example.org:4242/"}, "machine")
+
+	_, ok := r.status(events.Event{Type: events.Fetched, CommitId: "abc"})
+	assert.False(t, ok)
+
+	s, ok := r.status(events.Event{Type: events.Building, CommitId: "abc", GenerationUUID: "g1"})
+	assert.True(t, ok)
+	assert.Equal(t, Status{
+		CommitId:    "abc",
+		State:       Pending,
+		Description: "Building on machine",
+		TargetUrl:   "https://machine.example.org:4242/logs/g1",
+		Context:     "comin/machine",
+	}, s)
+
+	s, ok = r.status(events.Event{Type: events.Done, CommitId: "abc", GenerationUUID: "g1", DeploymentUUID: "d1"})
+	assert.True(t, ok)
+	assert.Equal(t, Success, s.State)
+	assert.Equal(t, "https://machine.example.org:4242/deployments/d1", s.TargetUrl)
+
+	s, ok = r.status(events.Event{Type: events.Failed, CommitId: "abc", ErrorMsg: strings.Repeat("error ", 50)})
+	assert.True(t, ok)
+	assert.Equal(t, Failure, s.State)
+	assert.Len(t, s.Description, maxDescriptionLength)
+	assert.True(t, strings.HasPrefix(s.Description, "Failed on machine: error error"))
+}
+
+// blockingReporter records the reported statuses and blocks until
+// unblockCh is closed
+type blockingReporter struct {
+	mu        sync.Mutex
+	statuses  []Status
+	unblockCh chan struct{}
+}
+
+func (r *blockingReporter) Name() string { return "blocking" }
+
+func (r *blockingReporter) Report(ctx context.Context, s Status) error {
+	<-r.unblockCh
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statuses = append(r.statuses, s)
+	return nil
+}
+
+func TestReporters(t *testing.T) {
+	reporter := &blockingReporter{unblockCh: make(chan struct{})}
+	r := New(types.CommitStatuses{}, "machine")
+	r.queues = append(r.queues, newQueue(reporter, r.wg))
+	go r.queues[0].run()
+
+	// The events are handled without blocking while the forge is
+	// slow
+	r.Handle(events.Event{Type: events.Evaluating, CommitId: "abc"})
+	assert.Eventually(t, func() bool {
+		r.queues[0].mu.Lock()
+		defer r.queues[0].mu.Unlock()
+		return len(r.queues[0].commitIds) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	r.Handle(events.Event{Type: events.Building, CommitId: "abc"})
+	r.Handle(events.Event{Type: events.Evaluating, CommitId: "def"})
+	r.Handle(events.Event{Type: events.Switching, CommitId: "abc"})
+	r.Handle(events.Event{Type: events.Done, CommitId: "abc"})
+
+	close(reporter.unblockCh)
+	r.Wait(5 * time.Second)
+	// Only the last status of a queued commit is reported
+	var reported []string
+	for _, s := range reporter.statuses {
+		reported = append(reported, s.CommitId+" "+s.Description)
+	}
+	assert.Equal(t, []string{
+		"abc Evaluating on machine",
+		"abc Deployed on machine",
+		"def Evaluating on machine",
+	}, reported)
+}
+
+func TestGitHub(t *testing.T) {
+	var req *http.Request
+	var status gitHubStatus
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&status))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	g := newGitHub(types.GitHubStatus{
+		Repository:  "owner/infra",
+		ApiUrl:      server.URL,
+		AccessToken: "ghp_secret",
+	})
+	err := g.Report(context.Background(), Status{
+		CommitId:    "abc",
+		State:       Success,
+		Description: "Deployed on machine",
+		TargetUrl:   "https://machine.example.org:4242/deployments/d1",
+		Context:     "comin/machine",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "/repos/owner/infra/statuses/abc", req.URL.Path)
+	assert.Equal(t, "Bearer ghp_secret", req.Header.Get("Authorization"))
+	assert.Equal(t, gitHubStatus{
+		State:       "success",
+		TargetUrl:   "https://machine.example.org:4242/deployments/d1",
+		Description: "Deployed on machine",
+		Context:     "comin/machine",
+	}, status)
+}
+
+func TestGitLab(t *testing.T) {
+	var paths []string
+	var statuses []gitLabStatus
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		assert.Equal(t, "glpat-secret", r.Header.Get("PRIVATE-TOKEN"))
+		var status gitLabStatus
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&status))
+		statuses = append(statuses, status)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	g := newGitLab(types.GitLabStatus{
+		Project:     "group/infra",
+		ApiUrl:      server.URL,
+		AccessToken: "glpat-secret",
+	})
+	for _, s := range []Status{
+		{CommitId: "abc", State: Pending, Description: "Evaluating on machine", Context: "comin/machine"},
+		{CommitId: "abc", State: Pending, Description: "Building on machine", Context: "comin/machine"},
+		{CommitId: "abc", State: Failure, Description: "Failed on machine", Context: "comin/machine"},
+	} {
+		assert.Nil(t, g.Report(context.Background(), s))
+	}
+	// The second pending status is not reported: GitLab refuses it
+	assert.Equal(t, []string{"/api/v4/projects/group%2Finfra/statuses/abc", "/api/v4/projects/group%2Finfra/statuses/abc"}, paths)
+	assert.Equal(t, []gitLabStatus{
+		{State: "running", Name: "comin/machine", Description: "Evaluating on machine"},
+		{State: "failed", Name: "comin/machine", Description: "Failed on machine"},
+	}, statuses)
+}
+
+func TestGitea(t *testing.T) {
+	var req *http.Request
+	var status giteaStatus
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&status))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	g := newGitea(types.GiteaStatus{
+		Repository:  "owner/infra",
+		ApiUrl:      server.URL + "/",
+		AccessToken: "gitea-secret",
+	})
+	err := g.Report(context.Background(), Status{
+		CommitId:    "abc",
+		State:       Pending,
+		Description: "Building on machine",
+		Context:     "comin/machine",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "/api/v1/repos/owner/infra/statuses/abc", req.URL.Path)
+	assert.Equal(t, "token gitea-secret", req.Header.Get("Authorization"))
+	assert.Equal(t, giteaStatus{
+		State:       "pending",
+		Description: "Building on machine",
+		Context:     "comin/machine",
+	}, status)
+}
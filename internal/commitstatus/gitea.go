@@ -0,0 +1,44 @@
+package commitstatus
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/nlewo/comin/internal/utils"
+)
+
+// gitea reports the statuses with the commit statuses API of Gitea,
+// which is also implemented by Forgejo
+type gitea struct {
+	config types.GiteaStatus
+}
+
+func newGitea(config types.GiteaStatus) gitea {
+	return gitea{config: config}
+}
+
+func (g gitea) Name() string {
+	return fmt.Sprintf("the Gitea repository %s", g.config.Repository)
+}
+
+type giteaStatus struct {
+	State       string `json:"state"`
+	TargetUrl   string `json:"target_url,omitempty"`
+	Description string `json:"description"`
+	Context     string `json:"context"`
+}
+
+func (g gitea) Report(ctx context.Context, s Status) error {
+	url := fmt.Sprintf("%s/api/v1/repos/%s/statuses/%s", strings.TrimSuffix(g.config.ApiUrl, "/"), g.config.Repository, s.CommitId)
+	headers := map[string]string{
+		"Authorization": "token " + string(g.config.AccessToken),
+	}
+	return utils.PostJson(ctx, url, headers, giteaStatus{
+		State:       string(s.State),
+		TargetUrl:   s.TargetUrl,
+		Description: s.Description,
+		Context:     s.Context,
+	})
+}
@@ -0,0 +1,44 @@
+package commitstatus
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/nlewo/comin/internal/utils"
+)
+
+// gitHub reports the statuses with the commit statuses API of GitHub
+type gitHub struct {
+	config types.GitHubStatus
+}
+
+func newGitHub(config types.GitHubStatus) gitHub {
+	return gitHub{config: config}
+}
+
+func (g gitHub) Name() string {
+	return fmt.Sprintf("the GitHub repository %s", g.config.Repository)
+}
+
+type gitHubStatus struct {
+	State       string `json:"state"`
+	TargetUrl   string `json:"target_url,omitempty"`
+	Description string `json:"description"`
+	Context     string `json:"context"`
+}
+
+func (g gitHub) Report(ctx context.Context, s Status) error {
+	url := fmt.Sprintf("%s/repos/%s/statuses/%s", strings.TrimSuffix(g.config.ApiUrl, "/"), g.config.Repository, s.CommitId)
+	headers := map[string]string{
+		"Accept":        "application/vnd.github+json",
+		"Authorization": "Bearer " + string(g.config.AccessToken),
+	}
+	return utils.PostJson(ctx, url, headers, gitHubStatus{
+		State:       string(s.State),
+		TargetUrl:   s.TargetUrl,
+		Description: s.Description,
+		Context:     s.Context,
+	})
+}
@@ -0,0 +1,72 @@
+package commitstatus
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/nlewo/comin/internal/utils"
+)
+
+// gitLab reports the statuses with the commit statuses API of GitLab
+type gitLab struct {
+	config types.GitLabStatus
+	// GitLab refuses a status identical to the current one: the
+	// last reported status is not reported again
+	last *gitLabStatus
+}
+
+func newGitLab(config types.GitLabStatus) gitLab {
+	return gitLab{
+		config: config,
+		last:   &gitLabStatus{},
+	}
+}
+
+func (g gitLab) Name() string {
+	return fmt.Sprintf("the GitLab project %s", g.config.Project)
+}
+
+type gitLabStatus struct {
+	sha         string
+	State       string `json:"state"`
+	Name        string `json:"name"`
+	TargetUrl   string `json:"target_url,omitempty"`
+	Description string `json:"description"`
+}
+
+// gitLabState returns the GitLab state of the state. A pending status
+// is a running job on GitLab: pending means it has not started yet.
+func gitLabState(state State) string {
+	switch state {
+	case Pending:
+		return "running"
+	case Failure:
+		return "failed"
+	}
+	return string(state)
+}
+
+func (g gitLab) Report(ctx context.Context, s Status) error {
+	status := gitLabStatus{
+		sha:         s.CommitId,
+		State:       gitLabState(s.State),
+		Name:        s.Context,
+		TargetUrl:   s.TargetUrl,
+		Description: s.Description,
+	}
+	if status.sha == g.last.sha && status.State == g.last.State && status.Name == g.last.Name {
+		return nil
+	}
+	u := fmt.Sprintf("%s/api/v4/projects/%s/statuses/%s", strings.TrimSuffix(g.config.ApiUrl, "/"), url.PathEscape(g.config.Project), s.CommitId)
+	headers := map[string]string{
+		"PRIVATE-TOKEN": string(g.config.AccessToken),
+	}
+	if err := utils.PostJson(ctx, u, headers, status); err != nil {
+		return err
+	}
+	*g.last = status
+	return nil
+}
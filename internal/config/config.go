@@ -1,13 +1,46 @@
 package config
 
 import (
+	"fmt"
 	"github.com/nlewo/comin/internal/types"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
 )
 
+// searchPaths returns the paths where the configuration file is
+// searched when it is not given: the user configuration directory
+// first, then /etc/comin
+func searchPaths() []string {
+	paths := make([]string, 0, 2)
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		paths = append(paths, filepath.Join(dir, "comin", "config.yaml"))
+	} else if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".config", "comin", "config.yaml"))
+	}
+	return append(paths, "/etc/comin/config.yaml")
+}
+
+// Find returns the path of the configuration file: path when it is not
+// empty, otherwise the first existing file of the search paths
+func Find(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	paths := searchPaths()
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("No configuration file found in %s: use the --config option", strings.Join(paths, ", "))
+}
+
 func Read(path string) (config types.Configuration, err error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -20,16 +53,77 @@ func Read(path string) (config types.Configuration, err error) {
 		return config, err
 	}
 	for i, remote := range config.Remotes {
-		if remote.Auth.AccessTokenPath != "" {
-			content, err := os.ReadFile(remote.Auth.AccessTokenPath)
-			if err != nil {
-				return config, err
-			}
-			config.Remotes[i].Auth.AccessToken = string(content)
+		if err := readAccessToken(&config.Remotes[i].Auth); err != nil {
+			return config, err
+		}
+		if err := readProxy(&config.Remotes[i].Proxy); err != nil {
+			return config, fmt.Errorf("The proxy of the remote '%s' is invalid: %s", remote.Name, err)
 		}
 		if remote.Timeout == 0 {
 			config.Remotes[i].Timeout = 300
 		}
+		switch remote.Branches.Main.ForcePushPolicy {
+		case "", "refuse", "approve", "accept":
+		default:
+			return config, fmt.Errorf("The force push policy '%s' of the remote '%s' is not supported (it should be 'refuse', 'approve' or 'accept')", remote.Branches.Main.ForcePushPolicy, remote.Name)
+		}
+		// The history of a shallow fetch is truncated: force
+		// pushes can not be detected and are always accepted
+		if remote.Depth > 0 && remote.Branches.Main.ForcePushPolicy != "accept" {
+			return config, fmt.Errorf("The remote '%s' is fetched with a depth, which doesn't allow to detect force pushes: its force_push_policy has to be 'accept'", remote.Name)
+		}
+		for _, operation := range []string{remote.Branches.Main.Operation, remote.Branches.Testing.Operation} {
+			if !isValidOperation(operation) {
+				return config, fmt.Errorf("The operation '%s' of the remote '%s' is not supported (it should be 'switch', 'boot', 'test' or 'dry-activate')", operation, remote.Name)
+			}
+		}
+		switch remote.Kind {
+		case "", "git":
+		case "tarball":
+			// Commits of archives can not be compared to
+			// commits of other remotes
+			if len(config.Remotes) != 1 {
+				return config, fmt.Errorf("The tarball remote '%s' has to be the only remote", remote.Name)
+			}
+			// Archives have no history and are not signed
+			if config.FastForwardOnly || len(config.PathFilters) > 0 || len(config.AllowedCommitters) > 0 ||
+				len(config.CommitSignatures.GpgPublicKeyPaths) > 0 || config.CommitSignatures.SshAllowedSignersPath != "" {
+				return config, fmt.Errorf("The tarball remote '%s' doesn't support fast_forward_only, path_filters, allowed_committers and commit_signatures", remote.Name)
+			}
+		default:
+			return config, fmt.Errorf("The kind '%s' of the remote '%s' is not supported (it should be 'git' or 'tarball')", remote.Kind, remote.Name)
+		}
+	}
+
+	for i, input := range config.Inputs {
+		if input.Name == "" || input.URL == "" {
+			return config, fmt.Errorf("The name and the url of inputs are required")
+		}
+		if err := readAccessToken(&config.Inputs[i].Auth); err != nil {
+			return config, err
+		}
+		if err := readProxy(&config.Inputs[i].Proxy); err != nil {
+			return config, fmt.Errorf("The proxy of the input '%s' is invalid: %s", input.Name, err)
+		}
+		if input.Branch == "" {
+			config.Inputs[i].Branch = "main"
+		}
+		if input.Timeout == 0 {
+			config.Inputs[i].Timeout = 300
+		}
+	}
+	if err := readProxy(&config.Nix.Proxy); err != nil {
+		return config, fmt.Errorf("The nix proxy is invalid: %s", err)
+	}
+	switch config.LogLevel {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return config, fmt.Errorf("The log level '%s' is not supported (it should be 'debug', 'info', 'warn' or 'error')", config.LogLevel)
+	}
+	switch config.LogFormat {
+	case "", "text", "json", "journald":
+	default:
+		return config, fmt.Errorf("The log format '%s' is not supported (it should be 'text', 'json' or 'journald')", config.LogFormat)
 	}
 
 	if config.ApiServer.ListenAddress == "" {
@@ -38,12 +132,270 @@ func Read(path string) (config types.Configuration, err error) {
 	if config.ApiServer.Port == 0 {
 		config.ApiServer.Port = 4242
 	}
+	if config.ApiServer.TokenPath == "" {
+		config.ApiServer.TokenPath = filepath.Join(config.StateDir, "api-token")
+	} else {
+		config.ApiServer.TokenPath = os.ExpandEnv(config.ApiServer.TokenPath)
+	}
 	if config.Exporter.ListenAddress == "" {
 		config.Exporter.ListenAddress = "0.0.0.0"
 	}
 	if config.Exporter.Port == 0 {
 		config.Exporter.Port = 4243
 	}
+	if config.Exporter.TextfilePath != "" && !strings.HasSuffix(config.Exporter.TextfilePath, ".prom") {
+		return config, fmt.Errorf("The textfile path '%s' of the exporter has to end with .prom to be read by node-exporter", config.Exporter.TextfilePath)
+	}
+	if config.Nix.Mode == "" {
+		config.Nix.Mode = "nixos"
+	}
+	if config.Nix.Mode != "nixos" && config.Nix.Mode != "home-manager" {
+		return config, fmt.Errorf("The nix mode '%s' is not supported (it should be 'nixos' or 'home-manager')", config.Nix.Mode)
+	}
+	if config.Nix.ConfigurationAttr != "" && strings.Count(config.Nix.ConfigurationAttr, "%s") != 1 {
+		return config, fmt.Errorf("The configuration attribute '%s' has to contain the hostname placeholder %%s once", config.Nix.ConfigurationAttr)
+	}
+	if config.Nix.BuildStore != "" {
+		// The configurations are evaluated on the builder, over ssh
+		if !strings.HasPrefix(config.Nix.BuildStore, "ssh://") && !strings.HasPrefix(config.Nix.BuildStore, "ssh-ng://") {
+			return config, fmt.Errorf("The build_store '%s' has to be a ssh:// or ssh-ng:// store", config.Nix.BuildStore)
+		}
+		if config.Nix.NonFlake {
+			return config, fmt.Errorf("The build_store is only supported with flakes")
+		}
+	}
+	if config.Nix.File == "" {
+		config.Nix.File = "default.nix"
+	}
+	if config.Nix.SigsNeeded == 0 {
+		config.Nix.SigsNeeded = 1
+	}
+	if config.Nix.GcRootsDir == "" {
+		config.Nix.GcRootsDir = filepath.Join(config.StateDir, "gcroots")
+	}
+	if config.Nix.GcRootsKeep == 0 {
+		config.Nix.GcRootsKeep = 3
+	}
+	if config.Nix.BuildRetryDelay == 0 {
+		config.Nix.BuildRetryDelay = 10
+	}
+	if config.Logs.Dir == "" {
+		config.Logs.Dir = filepath.Join(config.StateDir, "logs")
+	}
+	if config.Logs.MaxFiles == 0 {
+		config.Logs.MaxFiles = 20
+	}
+	if config.History.MaxEntries == 0 {
+		config.History.MaxEntries = 1000
+	}
+	if config.Logs.MaxSize == 0 {
+		config.Logs.MaxSize = 100 * 1024 * 1024
+	}
+	for i, probe := range config.HealthChecks.HttpProbes {
+		if probe.ExpectedStatus == 0 {
+			config.HealthChecks.HttpProbes[i].ExpectedStatus = 200
+		}
+		if probe.Timeout == 0 {
+			config.HealthChecks.HttpProbes[i].Timeout = 5
+		}
+		if probe.RetryInterval == 0 {
+			config.HealthChecks.HttpProbes[i].RetryInterval = 1
+		}
+	}
+	for i, probe := range config.HealthChecks.TcpProbes {
+		if probe.Timeout == 0 {
+			config.HealthChecks.TcpProbes[i].Timeout = 5
+		}
+		if probe.RetryInterval == 0 {
+			config.HealthChecks.TcpProbes[i].RetryInterval = 1
+		}
+	}
+	if config.HealthChecks.GracePeriod == 0 {
+		config.HealthChecks.GracePeriod = 60
+	}
+	if config.HealthChecks.Interval == 0 {
+		config.HealthChecks.Interval = 5
+	}
+	if config.MagicRollback.Enable && config.Nix.Mode != "nixos" {
+		return config, fmt.Errorf("The magic rollback is only supported in the nixos mode")
+	}
+	if config.MagicRollback.Timeout == 0 {
+		config.MagicRollback.Timeout = 120
+	}
+	if config.Hooks.Timeout == 0 {
+		config.Hooks.Timeout = 300
+	}
+	if config.AutoReboot.Delay == 0 {
+		config.AutoReboot.Delay = 5
+	}
+	if config.AutoReboot.Message == "" {
+		config.AutoReboot.Message = "comin: rebooting to run the deployed configuration"
+	}
+	if config.Notifications.Retries == nil {
+		retries := 3
+		config.Notifications.Retries = &retries
+	} else if *config.Notifications.Retries < 0 {
+		return config, fmt.Errorf("The retries of the notifications can not be negative")
+	}
+	// URLs can contain secrets: they are not reported in errors
+	for i, webhook := range config.Notifications.Webhooks {
+		if (webhook.URL == "") == (webhook.URLPath == "") {
+			return config, fmt.Errorf("Either the url or the url_path of the webhook %d is required", i)
+		}
+		if err := checkNotificationEvents(webhook.Events); err != nil {
+			return config, fmt.Errorf("The webhook %d is invalid: %s", i, err)
+		}
+		if webhook.URLPath != "" {
+			if config.Notifications.Webhooks[i].URL, err = readSecret(webhook.URLPath); err != nil {
+				return config, err
+			}
+		}
+		if webhook.SecretPath != "" {
+			if config.Notifications.Webhooks[i].Secret, err = readSecret(webhook.SecretPath); err != nil {
+				return config, err
+			}
+		}
+	}
+	for i, ntfy := range config.Notifications.Ntfy {
+		if ntfy.Topic == "" {
+			return config, fmt.Errorf("The topic of ntfy notifications is required")
+		}
+		if err := checkNotificationEvents(ntfy.Events); err != nil {
+			return config, fmt.Errorf("The ntfy topic '%s' is invalid: %s", ntfy.Topic, err)
+		}
+		if ntfy.URL == "" {
+			config.Notifications.Ntfy[i].URL = "https://ntfy.sh"
+		}
+		priorities := map[string]int{"start": 2, "success": 3, "failure": 5}
+		for event, priority := range ntfy.Priorities {
+			if err := checkNotificationEvents([]string{event}); err != nil {
+				return config, fmt.Errorf("The priorities of the ntfy topic '%s' are invalid: %s", ntfy.Topic, err)
+			}
+			if priority < 1 || priority > 5 {
+				return config, fmt.Errorf("The priority %d of the ntfy topic '%s' is invalid: it should be between 1 and 5", priority, ntfy.Topic)
+			}
+			priorities[event] = priority
+		}
+		config.Notifications.Ntfy[i].Priorities = priorities
+		if ntfy.AccessTokenPath != "" {
+			if config.Notifications.Ntfy[i].AccessToken, err = readSecret(ntfy.AccessTokenPath); err != nil {
+				return config, err
+			}
+		}
+	}
+	for i, matrix := range config.Notifications.Matrix {
+		if matrix.Homeserver == "" || matrix.RoomId == "" || matrix.AccessTokenPath == "" {
+			return config, fmt.Errorf("The homeserver, the room_id and the access_token_path of Matrix notifications are required")
+		}
+		if err := checkNotificationEvents(matrix.Events); err != nil {
+			return config, fmt.Errorf("The Matrix room '%s' is invalid: %s", matrix.RoomId, err)
+		}
+		if config.Notifications.Matrix[i].AccessToken, err = readSecret(matrix.AccessTokenPath); err != nil {
+			return config, err
+		}
+	}
+	for i, slack := range config.Notifications.Slack {
+		if slack.URLPath == "" {
+			return config, fmt.Errorf("The url_path of Slack notifications is required")
+		}
+		if err := checkNotificationEvents(slack.Events); err != nil {
+			return config, fmt.Errorf("The Slack webhook %d is invalid: %s", i, err)
+		}
+		if _, err := template.New("slack").Parse(slack.Template); err != nil {
+			return config, fmt.Errorf("The template of the Slack webhook %d is invalid: %s", i, err)
+		}
+		if config.Notifications.Slack[i].URL, err = readSecret(slack.URLPath); err != nil {
+			return config, err
+		}
+	}
+	for i, email := range config.Notifications.Email {
+		if email.Host == "" || email.From == "" || len(email.To) == 0 {
+			return config, fmt.Errorf("The host, the from and the to of email notifications are required")
+		}
+		if err := checkNotificationEvents(email.Events); err != nil {
+			return config, fmt.Errorf("The email notifications of %s are invalid: %s", email.Host, err)
+		}
+		if email.Port == 0 {
+			config.Notifications.Email[i].Port = 587
+		}
+		if len(email.Events) == 0 {
+			config.Notifications.Email[i].Events = []string{"failure"}
+		}
+		if email.PasswordPath != "" {
+			if config.Notifications.Email[i].Password, err = readSecret(email.PasswordPath); err != nil {
+				return config, err
+			}
+		}
+	}
+	for i, telegram := range config.Notifications.Telegram {
+		if telegram.BotTokenPath == "" || telegram.ChatId == "" {
+			return config, fmt.Errorf("The bot_token_path and the chat_id of Telegram notifications are required")
+		}
+		if err := checkNotificationEvents(telegram.Events); err != nil {
+			return config, fmt.Errorf("The Telegram chat '%s' is invalid: %s", telegram.ChatId, err)
+		}
+		if config.Notifications.Telegram[i].BotToken, err = readSecret(telegram.BotTokenPath); err != nil {
+			return config, err
+		}
+	}
+	for i, discord := range config.Notifications.Discord {
+		if discord.URLPath == "" {
+			return config, fmt.Errorf("The url_path of Discord notifications is required")
+		}
+		if err := checkNotificationEvents(discord.Events); err != nil {
+			return config, fmt.Errorf("The Discord webhook %d is invalid: %s", i, err)
+		}
+		if config.Notifications.Discord[i].URL, err = readSecret(discord.URLPath); err != nil {
+			return config, err
+		}
+	}
+	for i, github := range config.CommitStatuses.GitHub {
+		if github.Repository == "" || github.AccessTokenPath == "" {
+			return config, fmt.Errorf("The repository and the access_token_path of GitHub commit statuses are required")
+		}
+		if github.ApiUrl == "" {
+			config.CommitStatuses.GitHub[i].ApiUrl = "https://api.github.com"
+		}
+		if config.CommitStatuses.GitHub[i].AccessToken, err = readSecret(github.AccessTokenPath); err != nil {
+			return config, err
+		}
+	}
+	for i, gitlab := range config.CommitStatuses.GitLab {
+		if gitlab.Project == "" || gitlab.AccessTokenPath == "" {
+			return config, fmt.Errorf("The project and the access_token_path of GitLab commit statuses are required")
+		}
+		if gitlab.ApiUrl == "" {
+			config.CommitStatuses.GitLab[i].ApiUrl = "https://gitlab.com"
+		}
+		if config.CommitStatuses.GitLab[i].AccessToken, err = readSecret(gitlab.AccessTokenPath); err != nil {
+			return config, err
+		}
+	}
+	for i, gitea := range config.CommitStatuses.Gitea {
+		if gitea.Repository == "" || gitea.ApiUrl == "" || gitea.AccessTokenPath == "" {
+			return config, fmt.Errorf("The repository, the api_url and the access_token_path of Gitea commit statuses are required")
+		}
+		if config.CommitStatuses.Gitea[i].AccessToken, err = readSecret(gitea.AccessTokenPath); err != nil {
+			return config, err
+		}
+	}
+	if config.MachineIdentity.Source == "" {
+		config.MachineIdentity.Source = "machine-id"
+	}
+	if err := CheckMachineIdentity(config.MachineIdentity); err != nil {
+		return config, err
+	}
+	if config.TpmAttestation.Enable {
+		if config.TpmAttestation.KeyHandle == "" {
+			config.TpmAttestation.KeyHandle = "0x81000001"
+		}
+		if _, err := strconv.ParseUint(strings.TrimPrefix(config.TpmAttestation.KeyHandle, "0x"), 16, 32); err != nil {
+			return config, fmt.Errorf("The tpm_attestation key_handle '%s' is not a hexadecimal TPM handle", config.TpmAttestation.KeyHandle)
+		}
+	}
+	if config.ActivationHelper.SocketPath != "" && config.ActivationHelper.SocketGroup == "" {
+		config.ActivationHelper.SocketGroup = "comin"
+	}
 	if config.StateFilepath == "" {
 		config.StateFilepath = filepath.Join(config.StateDir, "state.json")
 	}
@@ -51,9 +403,102 @@ func Read(path string) (config types.Configuration, err error) {
 	return
 }
 
+// CheckMachineIdentity returns an error if the source of the machine
+// ID is not supported or if the file source has no path
+func CheckMachineIdentity(identity types.MachineIdentity) error {
+	switch identity.Source {
+	case "machine-id", "hostname", "dmi":
+	case "file":
+		if identity.Path == "" {
+			return fmt.Errorf("The path of the machine_identity is required by the file source")
+		}
+	default:
+		return fmt.Errorf("The machine_identity source '%s' is not supported: use 'machine-id', 'file', 'hostname' or 'dmi'", identity.Source)
+	}
+	return nil
+}
+
+// isValidOperation returns true if the operation is a
+// switch-to-configuration operation supported by comin. An empty
+// operation means the default operation of the branch is used.
+func isValidOperation(operation string) bool {
+	switch operation {
+	case "", "switch", "boot", "test", "dry-activate":
+		return true
+	}
+	return false
+}
+
+// checkNotificationEvents returns an error if an event is not a
+// notified event
+func checkNotificationEvents(events []string) error {
+	for _, event := range events {
+		switch event {
+		case "start", "success", "failure":
+		default:
+			return fmt.Errorf("the event '%s' is not supported (it should be 'start', 'success' or 'failure')", event)
+		}
+	}
+	return nil
+}
+
 func MkGitConfig(config types.Configuration) types.GitConfig {
 	return types.GitConfig{
-		Path:    filepath.Join(config.StateDir, "repository"),
-		Remotes: config.Remotes,
+		Path:                  filepath.Join(config.StateDir, "repository"),
+		Remotes:               config.Remotes,
+		PinFilepath:           filepath.Join(config.StateDir, "pin"),
+		GpgPublicKeyPaths:     config.CommitSignatures.GpgPublicKeyPaths,
+		SshAllowedSignersPath: config.CommitSignatures.SshAllowedSignersPath,
+		AllowedCommitters:     config.AllowedCommitters,
+		Inputs:                config.Inputs,
+		InputsPath:            filepath.Join(config.StateDir, "inputs"),
+	}
+}
+
+// readAccessToken reads the token from the AccessTokenPath file
+func readAccessToken(auth *types.Auth) error {
+	if auth.AccessTokenPath == "" {
+		return nil
+	}
+	token, err := readSecret(auth.AccessTokenPath)
+	if err != nil {
+		return err
+	}
+	auth.AccessToken = token
+	return nil
+}
+
+// readSecret returns the content of the file path, without the
+// trailing newline
+func readSecret(path string) (types.Secret, error) {
+	// To support systemd credentials:
+	// $CREDENTIALS_DIRECTORY/<name>
+	content, err := os.ReadFile(os.ExpandEnv(path))
+	if err != nil {
+		return "", err
+	}
+	return types.Secret(strings.TrimSpace(string(content))), nil
+}
+
+// readProxy checks the proxy URL scheme and reads the proxy password
+// from its file
+func readProxy(proxy *types.Proxy) error {
+	if proxy.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(proxy.URL)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("the scheme '%s' of the proxy URL is not supported (it should be 'http', 'https' or 'socks5')", u.Scheme)
+	}
+	if proxy.PasswordPath != "" {
+		if proxy.Password, err = readSecret(proxy.PasswordPath); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -1,12 +1,17 @@
 package config
 
 import (
+	"fmt"
 	"github.com/nlewo/comin/internal/types"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
 func TestConfig(t *testing.T) {
+	retries := 3
 	configPath := "./configuration.yaml"
 	expected := types.Configuration{
 		Hostname:      "machine",
@@ -35,13 +40,535 @@ func TestConfig(t *testing.T) {
 		ApiServer: types.HttpServer{
 			ListenAddress: "127.0.0.1",
 			Port:          4242,
+			TokenPath:     "/var/lib/comin/api-token",
 		},
-		Exporter: types.HttpServer{
+		Exporter: types.Exporter{
 			ListenAddress: "0.0.0.0",
 			Port:          4243,
 		},
+		Nix: types.Nix{
+			Mode:            "nixos",
+			File:            "default.nix",
+			SigsNeeded:      1,
+			GcRootsDir:      "/var/lib/comin/gcroots",
+			GcRootsKeep:     3,
+			BuildRetryDelay: 10,
+		},
+		Logs: types.Logs{
+			Dir:      "/var/lib/comin/logs",
+			MaxFiles: 20,
+			MaxSize:  104857600,
+		},
+		History: types.History{
+			MaxEntries: 1000,
+		},
+		MachineIdentity: types.MachineIdentity{
+			Source: "machine-id",
+		},
+		HealthChecks: types.HealthChecks{
+			GracePeriod: 60,
+			Interval:    5,
+		},
+		MagicRollback: types.MagicRollback{
+			Timeout: 120,
+		},
+		Hooks: types.Hooks{
+			Timeout: 300,
+		},
+		AutoReboot: types.AutoReboot{
+			Delay:   5,
+			Message: "comin: rebooting to run the deployed configuration",
+		},
+		Notifications: types.Notifications{
+			Retries: &retries,
+		},
 	}
 	config, err := Read(configPath)
 	assert.Nil(t, err)
 	assert.Equal(t, expected, config)
 }
+
+func TestConfigAccessTokenCredential(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+	err := os.WriteFile(filepath.Join(dir, "token"), []byte("my-secret\n"), 0600)
+	assert.Nil(t, err)
+	configPath := filepath.Join(dir, "configuration.yaml")
+	content := `
+hostname: machine
+state_dir: /var/lib/comin
+remotes:
+  - name: origin
+    url: https://framagit.org/owner/infra
+    auth:
+      access_token_path: $CREDENTIALS_DIRECTORY/token
+`
+	err = os.WriteFile(configPath, []byte(content), 0644)
+	assert.Nil(t, err)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, types.Secret("my-secret"), config.Remotes[0].Auth.AccessToken)
+	assert.NotContains(t, fmt.Sprintf("%#v", config), "my-secret")
+	assert.NotContains(t, fmt.Sprintf("%v", config), "my-secret")
+}
+
+func TestConfigProxy(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "proxy-password"), []byte("my-secret\n"), 0600)
+	assert.Nil(t, err)
+	configPath := filepath.Join(dir, "configuration.yaml")
+	content := fmt.Sprintf(`
+hostname: machine
+state_dir: /var/lib/comin
+remotes:
+  - name: origin
+    url: https://framagit.org/owner/infra
+    proxy:
+      url: http://proxy.example.org:3128
+      username: comin
+      password_path: %s/proxy-password
+nix:
+  proxy:
+    url: socks5://proxy.example.org:1080
+`, dir)
+	err = os.WriteFile(configPath, []byte(content), 0644)
+	assert.Nil(t, err)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, types.Secret("my-secret"), config.Remotes[0].Proxy.Password)
+	assert.Equal(t, "socks5://proxy.example.org:1080", config.Nix.Proxy.URL)
+	assert.NotContains(t, fmt.Sprintf("%#v", config), "my-secret")
+
+	content = `
+hostname: machine
+state_dir: /var/lib/comin
+nix:
+  proxy:
+    url: ftp://proxy.example.org
+`
+	err = os.WriteFile(configPath, []byte(content), 0644)
+	assert.Nil(t, err)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "ftp")
+}
+
+func TestConfigTarball(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "configuration.yaml")
+	content := `
+hostname: machine
+state_dir: /var/lib/comin
+remotes:
+  - name: origin
+    kind: tarball
+    url: https://releases.example.org/infra.tar.gz
+`
+	err := os.WriteFile(configPath, []byte(content), 0644)
+	assert.Nil(t, err)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "tarball", config.Remotes[0].Kind)
+
+	content = `
+hostname: machine
+state_dir: /var/lib/comin
+remotes:
+  - name: origin
+    kind: tarball
+    url: https://releases.example.org/infra.tar.gz
+  - name: backup
+    url: https://framagit.org/owner/infra
+`
+	err = os.WriteFile(configPath, []byte(content), 0644)
+	assert.Nil(t, err)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "only remote")
+
+	content = `
+hostname: machine
+state_dir: /var/lib/comin
+remotes:
+  - name: origin
+    kind: svn
+    url: https://framagit.org/owner/infra
+`
+	err = os.WriteFile(configPath, []byte(content), 0644)
+	assert.Nil(t, err)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "svn")
+}
+
+func TestConfigLogLevel(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "configuration.yaml")
+	err := os.WriteFile(configPath, []byte("hostname: machine\nlog_level: warn\n"), 0644)
+	assert.Nil(t, err)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "warn", config.LogLevel)
+
+	err = os.WriteFile(configPath, []byte("hostname: machine\nlog_level: verbose\n"), 0644)
+	assert.Nil(t, err)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "log level")
+
+	err = os.WriteFile(configPath, []byte("hostname: machine\nlog_format: json\n"), 0644)
+	assert.Nil(t, err)
+	config, err = Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "json", config.LogFormat)
+
+	err = os.WriteFile(configPath, []byte("hostname: machine\nlog_format: xml\n"), 0644)
+	assert.Nil(t, err)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "log format")
+}
+
+func TestConfigExporterTextfile(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "configuration.yaml")
+	err := os.WriteFile(configPath, []byte("hostname: machine\nexporter:\n  textfile_path: /var/lib/node-exporter/comin.prom\n"), 0644)
+	assert.Nil(t, err)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "/var/lib/node-exporter/comin.prom", config.Exporter.TextfilePath)
+
+	err = os.WriteFile(configPath, []byte("hostname: machine\nexporter:\n  textfile_path: /var/lib/node-exporter/comin.txt\n"), 0644)
+	assert.Nil(t, err)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, ".prom")
+}
+
+func TestFind(t *testing.T) {
+	path, err := Find("/tmp/comin.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, "/tmp/comin.yaml", path)
+
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	assert.Equal(t, filepath.Join(dir, "comin", "config.yaml"), searchPaths()[0])
+	assert.Equal(t, "/etc/comin/config.yaml", searchPaths()[1])
+
+	err = os.MkdirAll(filepath.Join(dir, "comin"), 0750)
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(dir, "comin", "config.yaml"), []byte{}, 0640)
+	assert.Nil(t, err)
+	path, err = Find("")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "comin", "config.yaml"), path)
+}
+
+func TestConfigNotifications(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "configuration.yaml")
+	content := `
+hostname: machine
+notifications:
+  retries: 5
+  webhooks:
+    - url: https://hooks.example.org/comin
+      events: [success, failure]
+`
+	err := os.WriteFile(configPath, []byte(content), 0644)
+	assert.Nil(t, err)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	retries := 5
+	assert.Equal(t, types.Notifications{
+		Retries: &retries,
+		Webhooks: []types.Webhook{{
+			URL:    "https://hooks.example.org/comin",
+			Events: []string{"success", "failure"},
+		}},
+	}, config.Notifications)
+
+	content = `
+hostname: machine
+notifications:
+  webhooks:
+    - url: https://hooks.example.org/comin
+      events: [started]
+`
+	err = os.WriteFile(configPath, []byte(content), 0644)
+	assert.Nil(t, err)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "started")
+
+	// Notifications can be sent without retry
+	err = os.WriteFile(configPath, []byte("hostname: machine\nnotifications:\n  retries: 0\n"), 0644)
+	assert.Nil(t, err)
+	config, err = Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, *config.Notifications.Retries)
+}
+
+func TestConfigNotifiers(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "secret"), []byte("https://example.org/tk_secret\n"), 0600)
+	assert.Nil(t, err)
+	t.Setenv("SECRET_PATH", filepath.Join(dir, "secret"))
+	configPath := filepath.Join(dir, "configuration.yaml")
+
+	tests := []struct {
+		name    string
+		content string
+		// The secret read from the file, when the configuration
+		// is valid
+		secret func(types.Configuration) types.Secret
+		err    string
+	}{{
+		name: "webhook url",
+		content: `
+webhooks:
+  - url_path: $SECRET_PATH`,
+		secret: func(c types.Configuration) types.Secret { return c.Notifications.Webhooks[0].URL },
+	}, {
+		name: "webhook secret",
+		content: `
+webhooks:
+  - url: https://hooks.example.org/comin
+    secret_path: $SECRET_PATH`,
+		secret: func(c types.Configuration) types.Secret { return c.Notifications.Webhooks[0].Secret },
+	}, {
+		name: "webhook with url and url_path",
+		content: `
+webhooks:
+  - url: https://hooks.example.org/comin
+    url_path: $SECRET_PATH`,
+		err: "Either the url or the url_path",
+	}, {
+		name: "ntfy",
+		content: `
+ntfy:
+  - topic: deployments
+    access_token_path: $SECRET_PATH`,
+		secret: func(c types.Configuration) types.Secret { return c.Notifications.Ntfy[0].AccessToken },
+	}, {
+		name: "ntfy invalid priority",
+		content: `
+ntfy:
+  - topic: deployments
+    priorities:
+      failure: 6`,
+		err: "priority 6",
+	}, {
+		name: "matrix",
+		content: `
+matrix:
+  - homeserver: https://matrix.org
+    room_id: "!room:matrix.org"
+    access_token_path: $SECRET_PATH`,
+		secret: func(c types.Configuration) types.Secret { return c.Notifications.Matrix[0].AccessToken },
+	}, {
+		name: "matrix without token",
+		content: `
+matrix:
+  - homeserver: https://matrix.org
+    room_id: "!room:matrix.org"`,
+		err: "access_token_path",
+	}, {
+		name: "slack",
+		content: `
+slack:
+  - url_path: $SECRET_PATH
+    template: "{{.Title}}"`,
+		secret: func(c types.Configuration) types.Secret { return c.Notifications.Slack[0].URL },
+	}, {
+		name: "slack invalid template",
+		content: `
+slack:
+  - url_path: $SECRET_PATH
+    template: "{{.Title"`,
+		err: "template",
+	}, {
+		name: "email",
+		content: `
+email:
+  - host: smtp.example.org
+    from: comin@example.org
+    to: [ops@example.org]
+    password_path: $SECRET_PATH`,
+		secret: func(c types.Configuration) types.Secret { return c.Notifications.Email[0].Password },
+	}, {
+		name: "email without recipient",
+		content: `
+email:
+  - host: smtp.example.org
+    from: comin@example.org`,
+		err: "required",
+	}, {
+		name: "telegram",
+		content: `
+telegram:
+  - bot_token_path: $SECRET_PATH
+    chat_id: "-1001234"`,
+		secret: func(c types.Configuration) types.Secret { return c.Notifications.Telegram[0].BotToken },
+	}, {
+		name: "discord",
+		content: `
+discord:
+  - url_path: $SECRET_PATH`,
+		secret: func(c types.Configuration) types.Secret { return c.Notifications.Discord[0].URL },
+	}, {
+		name: "discord without url",
+		content: `
+discord:
+  - events: [failure]`,
+		err: "url_path",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := "hostname: machine\nnotifications:" + strings.ReplaceAll(test.content, "\n", "\n  ") + "\n"
+			err := os.WriteFile(configPath, []byte(content), 0644)
+			assert.Nil(t, err)
+			config, err := Read(configPath)
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, types.Secret("https://example.org/tk_secret"), test.secret(config))
+			assert.NotContains(t, fmt.Sprintf("%#v", config), "tk_secret")
+			assert.NotContains(t, fmt.Sprintf("%v", config), "tk_secret")
+		})
+	}
+}
+
+func TestConfigCommitStatuses(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "token"), []byte("ghp_secret\n"), 0600)
+	assert.Nil(t, err)
+	configPath := filepath.Join(dir, "configuration.yaml")
+	content := fmt.Sprintf(`
+hostname: machine
+commit_statuses:
+  target_url: https://machine.example.org:4242
+  github:
+    - repository: owner/infra
+      access_token_path: %[1]s/token
+  gitlab:
+    - project: group/infra
+      access_token_path: %[1]s/token
+  gitea:
+    - repository: owner/infra
+      api_url: https://git.example.org
+      access_token_path: %[1]s/token
+`, dir)
+	err = os.WriteFile(configPath, []byte(content), 0644)
+	assert.Nil(t, err)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://api.github.com", config.CommitStatuses.GitHub[0].ApiUrl)
+	assert.Equal(t, "https://gitlab.com", config.CommitStatuses.GitLab[0].ApiUrl)
+	for _, token := range []types.Secret{
+		config.CommitStatuses.GitHub[0].AccessToken,
+		config.CommitStatuses.GitLab[0].AccessToken,
+		config.CommitStatuses.Gitea[0].AccessToken,
+	} {
+		assert.Equal(t, types.Secret("ghp_secret"), token)
+	}
+	assert.NotContains(t, fmt.Sprintf("%#v", config), "ghp_secret")
+
+	err = os.WriteFile(configPath, []byte("hostname: machine\ncommit_statuses:\n  github:\n    - repository: owner/infra\n"), 0644)
+	assert.Nil(t, err)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "access_token_path")
+}
+
+func TestConfigNotifierDefaults(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "configuration.yaml")
+	content := `
+hostname: machine
+notifications:
+  ntfy:
+    - topic: deployments
+      priorities:
+        success: 1
+  email:
+    - host: smtp.example.org
+      from: comin@example.org
+      to: [ops@example.org]
+`
+	err := os.WriteFile(configPath, []byte(content), 0644)
+	assert.Nil(t, err)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	ntfy := config.Notifications.Ntfy[0]
+	assert.Equal(t, "https://ntfy.sh", ntfy.URL)
+	assert.Equal(t, map[string]int{"start": 2, "success": 1, "failure": 5}, ntfy.Priorities)
+	assert.Equal(t, 587, config.Notifications.Email[0].Port)
+	assert.Equal(t, []string{"failure"}, config.Notifications.Email[0].Events)
+}
+
+func TestConfigDepth(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "configuration.yaml")
+	content := `
+hostname: machine
+remotes:
+  - name: origin
+    url: https://framagit.org/owner/infra
+    depth: 1
+`
+	err := os.WriteFile(configPath, []byte(content), 0644)
+	assert.Nil(t, err)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "force_push_policy")
+
+	content += `    branches:
+      main:
+        force_push_policy: accept
+`
+	err = os.WriteFile(configPath, []byte(content), 0644)
+	assert.Nil(t, err)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, config.Remotes[0].Depth)
+}
+
+func TestConfigMachineIdentity(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "configuration.yaml")
+	err := os.WriteFile(configPath, []byte("hostname: machine\nmachine_identity:\n  source: file\n  path: /etc/comin/machine-id\n"), 0644)
+	assert.Nil(t, err)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, types.MachineIdentity{Source: "file", Path: "/etc/comin/machine-id"}, config.MachineIdentity)
+
+	err = os.WriteFile(configPath, []byte("hostname: machine\nmachine_identity:\n  source: file\n"), 0644)
+	assert.Nil(t, err)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "path")
+
+	err = os.WriteFile(configPath, []byte("hostname: machine\nmachine_identity:\n  source: serial\n"), 0644)
+	assert.Nil(t, err)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "serial")
+}
+
+func TestConfigTpmAttestation(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "configuration.yaml")
+	err := os.WriteFile(configPath, []byte("hostname: machine\ntpm_attestation:\n  enable: true\n"), 0644)
+	assert.Nil(t, err)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, types.TpmAttestation{Enable: true, KeyHandle: "0x81000001"}, config.TpmAttestation)
+
+	err = os.WriteFile(configPath, []byte("hostname: machine\ntpm_attestation:\n  enable: true\n  key_handle: primary\n"), 0644)
+	assert.Nil(t, err)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "key_handle")
+}
+
+func TestConfigBuildStore(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "configuration.yaml")
+	err := os.WriteFile(configPath, []byte("hostname: machine\nnix:\n  build_store: ssh-ng://builder\n"), 0644)
+	assert.Nil(t, err)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "ssh-ng://builder", config.Nix.BuildStore)
+
+	err = os.WriteFile(configPath, []byte("hostname: machine\nnix:\n  build_store: https://cache.example.org\n"), 0644)
+	assert.Nil(t, err)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "ssh-ng://")
+
+	err = os.WriteFile(configPath, []byte("hostname: machine\nnix:\n  build_store: ssh-ng://builder\n  non_flake: true\n"), 0644)
+	assert.Nil(t, err)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "flakes")
+}
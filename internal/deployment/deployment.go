@@ -2,6 +2,7 @@ package deployment
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -46,7 +47,30 @@ func StatusFromString(status string) Status {
 	return Init
 }
 
-type DeployFunc func(context.Context, string, string, string) (bool, error)
+type DeployFunc func(context.Context, string, string, string) (bool, string, error)
+
+// ClosureDiffFunc returns the closure diff between the running system
+// and the provided outPath.
+type ClosureDiffFunc func(context.Context, string) (string, error)
+
+// ClosureSizeFunc returns the size in bytes of the closure of the
+// provided outPath.
+type ClosureSizeFunc func(context.Context, string) (int64, error)
+
+// HealthCheckFunc returns an error when the machine is not healthy
+// once the configuration has been activated.
+type HealthCheckFunc func(context.Context) error
+
+// CurrentFunc returns the outPath of the currently activated
+// configuration.
+type CurrentFunc func() (string, error)
+
+// RollbackFunc activates again the outPath of a previous
+// configuration with the provided operation.
+type RollbackFunc func(context.Context, string, string) error
+
+// HookFunc runs hooks for the deployment d.
+type HookFunc func(ctx context.Context, d Deployment) error
 
 type Deployment struct {
 	UUID       string                `json:"uuid"`
@@ -59,33 +83,139 @@ type Deployment struct {
 	RestartComin bool   `json:"restart_comin"`
 	Status       Status `json:"status"`
 	Operation    string `json:"operation"`
+	// The closure diff between the running system and the
+	// deployed one, computed before switching
+	ClosureDiff string `json:"closure_diff"`
+	// The output of the activation script (units restarted,
+	// warnings...). For the dry-activate operation, it reports what
+	// would be changed by a switch.
+	Output string `json:"output"`
+	// The configuration activated before this deployment
+	PreviousOutPath     string `json:"previous_outpath"`
+	HealthCheckErrorMsg string `json:"health_check_error_msg"`
+	// The previous configuration has been activated again because
+	// health checks failed
+	RolledBack       bool   `json:"rolled_back"`
+	RollbackErrorMsg string `json:"rollback_error_msg"`
+	// The activation of the configuration
+	SwitchStartAt time.Time `json:"switch_start_at"`
+	SwitchEndAt   time.Time `json:"switch_end_at"`
+	// The size in bytes of the closure of the deployed
+	// configuration, 0 if unknown
+	ClosureSize int64 `json:"closure_size"`
+	// The machine has to be rebooted to run the kernel, initrd or
+	// systemd of the deployed configuration
+	RebootNeeded bool `json:"reboot_needed"`
 
-	deployerFunc DeployFunc
-	deploymentCh chan DeploymentResult
+	deployerFunc    DeployFunc
+	closureDiffFunc ClosureDiffFunc
+	closureSizeFunc ClosureSizeFunc
+	healthCheckFunc HealthCheckFunc
+	currentFunc     CurrentFunc
+	rollbackFunc    RollbackFunc
+	preHookFunc     HookFunc
+	postHookFunc    HookFunc
+	deploymentCh    chan DeploymentResult
 }
 
 type DeploymentResult struct {
-	Err          error
-	EndAt        time.Time
-	RestartComin bool
+	Err             error
+	EndAt           time.Time
+	RestartComin    bool
+	ClosureDiff     string
+	Output          string
+	PreviousOutPath string
+	HealthCheckErr  error
+	RolledBack      bool
+	RollbackErr     error
+	SwitchStartAt   time.Time
+	SwitchEndAt     time.Time
+	ClosureSize     int64
 }
 
-func New(g generation.Generation, deployerFunc DeployFunc, deploymentCh chan DeploymentResult) Deployment {
-	operation := "switch"
-	if g.SelectedBranchIsTesting {
-		operation = "test"
+// Operation returns the switch-to-configuration operation used to
+// deploy the generation g.
+func Operation(g generation.Generation) string {
+	operation := g.SelectedBranchOperation
+	if operation == "" {
+		operation = "switch"
+		if g.SelectedBranchIsTesting {
+			operation = "test"
+		}
 	}
+	return operation
+}
+
+func New(g generation.Generation, deployerFunc DeployFunc, closureDiffFunc ClosureDiffFunc, deploymentCh chan DeploymentResult) Deployment {
+	operation := Operation(g)
 
 	return Deployment{
-		UUID:         uuid.NewString(),
-		Generation:   g,
-		deployerFunc: deployerFunc,
-		deploymentCh: deploymentCh,
-		Status:       Init,
-		Operation:    operation,
+		UUID:            uuid.NewString(),
+		Generation:      g,
+		deployerFunc:    deployerFunc,
+		closureDiffFunc: closureDiffFunc,
+		deploymentCh:    deploymentCh,
+		Status:          Init,
+		Operation:       operation,
 	}
 }
 
+// WithHealthCheck returns a deployment running health checks once the
+// configuration has been activated. When they fail, the previously
+// activated configuration is activated again.
+func (d Deployment) WithHealthCheck(healthCheckFunc HealthCheckFunc, currentFunc CurrentFunc, rollbackFunc RollbackFunc) Deployment {
+	d.healthCheckFunc = healthCheckFunc
+	d.currentFunc = currentFunc
+	d.rollbackFunc = rollbackFunc
+	return d
+}
+
+// WithClosureSize returns a deployment recording the size of the
+// closure of the deployed configuration.
+func (d Deployment) WithClosureSize(closureSizeFunc ClosureSizeFunc) Deployment {
+	d.closureSizeFunc = closureSizeFunc
+	return d
+}
+
+// WithHooks returns a deployment running the preHookFunc before the
+// activation and the postHookFunc once the deployment is terminated.
+func (d Deployment) WithHooks(preHookFunc, postHookFunc HookFunc) Deployment {
+	d.preHookFunc = preHookFunc
+	d.postHookFunc = postHookFunc
+	return d
+}
+
+// detachedContext carries the values of its parent but is never
+// canceled, such as context.WithoutCancel which requires Go 1.21
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) { return }
+func (detachedContext) Done() <-chan struct{}                   { return nil }
+func (detachedContext) Err() error                              { return nil }
+func (c detachedContext) Value(key interface{}) interface{}     { return c.parent.Value(key) }
+
+// runPostHook runs the post-deployment hooks with the terminated
+// deployment. Their failure doesn't change the deployment status.
+// They are run even if the deployment has been aborted because its
+// context has been canceled or its timeout exceeded: they are then
+// only bounded by their own timeout.
+func (d Deployment) runPostHook(ctx context.Context, dr DeploymentResult) {
+	if d.postHookFunc == nil {
+		return
+	}
+	if err := d.postHookFunc(detachedContext{parent: ctx}, d.Update(dr)); err != nil {
+		logrus.Errorf("The post-deployment hooks failed: %s", err)
+	}
+}
+
+// hasHealthCheck returns true if health checks have to be run: the
+// boot and dry-activate operations don't activate the configuration.
+func (d Deployment) hasHealthCheck() bool {
+	return d.healthCheckFunc != nil && (d.Operation == "switch" || d.Operation == "test")
+}
+
 func (d Deployment) Update(dr DeploymentResult) Deployment {
 	d.EndAt = dr.EndAt
 	d.Err = dr.Err
@@ -93,6 +223,19 @@ func (d Deployment) Update(dr DeploymentResult) Deployment {
 		d.ErrorMsg = dr.Err.Error()
 	}
 	d.RestartComin = dr.RestartComin
+	d.ClosureDiff = dr.ClosureDiff
+	d.Output = dr.Output
+	d.PreviousOutPath = dr.PreviousOutPath
+	if dr.HealthCheckErr != nil {
+		d.HealthCheckErrorMsg = dr.HealthCheckErr.Error()
+	}
+	d.RolledBack = dr.RolledBack
+	d.SwitchStartAt = dr.SwitchStartAt
+	d.SwitchEndAt = dr.SwitchEndAt
+	d.ClosureSize = dr.ClosureSize
+	if dr.RollbackErr != nil {
+		d.RollbackErrorMsg = dr.RollbackErr.Error()
+	}
 	if dr.Err == nil {
 		d.Status = Done
 	} else {
@@ -101,35 +244,122 @@ func (d Deployment) Update(dr DeploymentResult) Deployment {
 	return d
 }
 
+// SwitchDuration returns the duration of the activation of the
+// configuration, 0 if it has not been activated
+func (d Deployment) SwitchDuration() time.Duration {
+	if d.SwitchEndAt.Before(d.SwitchStartAt) {
+		return 0
+	}
+	return d.SwitchEndAt.Sub(d.SwitchStartAt)
+}
+
+// IsTesting returns true when the deployment activates the
+// configuration without adding a boot entry.
 func (d Deployment) IsTesting() bool {
-	return d.Operation == "testing"
+	return d.Operation == "test"
 }
 
 // Deploy returns a updated deployment (mainly the startAt is updated)
 // and asyncronously tun the deployment. Once finished, a
 // DeploymentResult is emitted on the channel d.deploymentCh.
 func (d Deployment) Deploy(ctx context.Context) Deployment {
+	d.Status = Running
+	d.StartAt = time.Now()
+	// The goroutine gets its own copy: the returned deployment is
+	// updated by the manager while it is running
+	dd := d
 	go func() {
+		// The closure diff is only informative: a failure
+		// doesn't prevent the deployment
+		closureDiff, err := dd.closureDiffFunc(ctx, dd.Generation.OutPath)
+		if err != nil {
+			logrus.Errorf("Failed to compute the closure diff: %s", err)
+		}
+
+		deploymentResult := DeploymentResult{}
+		if dd.closureSizeFunc != nil {
+			if deploymentResult.ClosureSize, err = dd.closureSizeFunc(ctx, dd.Generation.OutPath); err != nil {
+				logrus.Errorf("Failed to compute the closure size: %s", err)
+			}
+		}
+		if dd.preHookFunc != nil {
+			if err := dd.preHookFunc(ctx, dd); err != nil {
+				logrus.Errorf("The pre-deployment hooks failed: the deployment is aborted: %s", err)
+				deploymentResult.Err = fmt.Errorf("The pre-deployment hooks failed: %s", err)
+				deploymentResult.EndAt = time.Now()
+				deploymentResult.ClosureDiff = closureDiff
+				dd.runPostHook(ctx, deploymentResult)
+				dd.deploymentCh <- deploymentResult
+				return
+			}
+		}
+		if dd.hasHealthCheck() {
+			deploymentResult.PreviousOutPath, err = dd.currentFunc()
+			if err != nil {
+				logrus.Errorf("Failed to get the current configuration: the deployment could not be rolled back: %s", err)
+			}
+		}
+
+		// The previous configuration is left untouched when the
+		// deployment timeout has been exceeded. Note the
+		// activation itself is never interrupted.
+		if err := ctx.Err(); err != nil {
+			deploymentResult.Err = fmt.Errorf("The deployment is aborted: %s", err)
+			deploymentResult.EndAt = time.Now()
+			deploymentResult.ClosureDiff = closureDiff
+			dd.runPostHook(ctx, deploymentResult)
+			dd.deploymentCh <- deploymentResult
+			return
+		}
+
 		// FIXME: propagate context
-		cominNeedRestart, err := d.deployerFunc(
+		deploymentResult.SwitchStartAt = time.Now()
+		cominNeedRestart, output, err := dd.deployerFunc(
 			ctx,
-			d.Generation.EvalMachineId,
-			d.Generation.OutPath,
-			d.Operation,
+			dd.Generation.EvalMachineId,
+			dd.Generation.OutPath,
+			dd.Operation,
 		)
+		deploymentResult.SwitchEndAt = time.Now()
 
-		deploymentResult := DeploymentResult{}
 		deploymentResult.Err = err
-		if err != nil {
-			logrus.Error(err)
+		if err == nil && dd.hasHealthCheck() {
+			deploymentResult = dd.checkHealth(ctx, deploymentResult)
+		}
+		if deploymentResult.Err != nil {
+			logrus.Error(deploymentResult.Err)
 			logrus.Infof("Deployment failed")
 		}
 
 		deploymentResult.EndAt = time.Now()
 		deploymentResult.RestartComin = cominNeedRestart
-		d.deploymentCh <- deploymentResult
+		deploymentResult.ClosureDiff = closureDiff
+		deploymentResult.Output = output
+		dd.runPostHook(ctx, deploymentResult)
+		dd.deploymentCh <- deploymentResult
 	}()
-	d.Status = Running
-	d.StartAt = time.Now()
 	return d
 }
+
+// checkHealth runs the health checks and activates the previous
+// configuration if they fail.
+func (d Deployment) checkHealth(ctx context.Context, dr DeploymentResult) DeploymentResult {
+	err := d.healthCheckFunc(ctx)
+	if err == nil {
+		return dr
+	}
+	dr.HealthCheckErr = err
+	dr.Err = fmt.Errorf("The health checks failed: %s", err)
+	if dr.PreviousOutPath == "" || dr.PreviousOutPath == d.Generation.OutPath {
+		logrus.Infof("No previous configuration: the deployment is not rolled back")
+		return dr
+	}
+	if err := d.rollbackFunc(ctx, dr.PreviousOutPath, d.Operation); err != nil {
+		logrus.Errorf("Failed to roll back to '%s': %s", dr.PreviousOutPath, err)
+		dr.RollbackErr = err
+		return dr
+	}
+	logrus.Infof("The deployment has been rolled back to '%s'", dr.PreviousOutPath)
+	dr.RolledBack = true
+	return dr
+}
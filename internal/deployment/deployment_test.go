@@ -1 +1,189 @@
 package deployment
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/nlewo/comin/internal/generation"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewOperation(t *testing.T) {
+	d := New(generation.Generation{}, nil, nil, nil)
+	assert.Equal(t, "switch", d.Operation)
+	assert.False(t, d.IsTesting())
+
+	d = New(generation.Generation{SelectedBranchIsTesting: true}, nil, nil, nil)
+	assert.Equal(t, "test", d.Operation)
+	assert.True(t, d.IsTesting())
+
+	d = New(generation.Generation{SelectedBranchIsTesting: true, SelectedBranchOperation: "dry-activate"}, nil, nil, nil)
+	assert.Equal(t, "dry-activate", d.Operation)
+}
+
+func TestHealthCheckRollback(t *testing.T) {
+	deploymentCh := make(chan DeploymentResult)
+	deployFunc := func(context.Context, string, string, string) (bool, string, error) {
+		return false, "", nil
+	}
+	closureDiffFunc := func(context.Context, string) (string, error) {
+		return "", nil
+	}
+	currentFunc := func() (string, error) {
+		return "previous-out-path", nil
+	}
+	var rolledBackTo string
+	rollbackFunc := func(ctx context.Context, outPath, operation string) error {
+		rolledBackTo = outPath
+		return nil
+	}
+
+	// Health checks succeed
+	healthCheckFunc := func(context.Context) error {
+		return nil
+	}
+	d := New(generation.Generation{OutPath: "out-path"}, deployFunc, closureDiffFunc, deploymentCh)
+	d = d.WithHealthCheck(healthCheckFunc, currentFunc, rollbackFunc)
+	d = d.Deploy(context.Background())
+	d = d.Update(<-deploymentCh)
+	assert.Equal(t, Done, d.Status)
+	assert.False(t, d.RolledBack)
+	assert.Equal(t, "", rolledBackTo)
+
+	// Health checks fail
+	healthCheckFunc = func(context.Context) error {
+		return fmt.Errorf("unhealthy")
+	}
+	d = New(generation.Generation{OutPath: "out-path"}, deployFunc, closureDiffFunc, deploymentCh)
+	d = d.WithHealthCheck(healthCheckFunc, currentFunc, rollbackFunc)
+	d = d.Deploy(context.Background())
+	d = d.Update(<-deploymentCh)
+	assert.Equal(t, Failed, d.Status)
+	assert.Equal(t, "unhealthy", d.HealthCheckErrorMsg)
+	assert.True(t, d.RolledBack)
+	assert.Equal(t, "previous-out-path", rolledBackTo)
+
+	// Health checks are not run by the boot operation
+	d = New(generation.Generation{OutPath: "out-path", SelectedBranchOperation: "boot"}, deployFunc, closureDiffFunc, deploymentCh)
+	d = d.WithHealthCheck(healthCheckFunc, currentFunc, rollbackFunc)
+	d = d.Deploy(context.Background())
+	d = d.Update(<-deploymentCh)
+	assert.Equal(t, Done, d.Status)
+}
+
+func TestPreHookAbort(t *testing.T) {
+	deploymentCh := make(chan DeploymentResult)
+	deployed := false
+	deployFunc := func(context.Context, string, string, string) (bool, string, error) {
+		deployed = true
+		return false, "", nil
+	}
+	closureDiffFunc := func(context.Context, string) (string, error) {
+		return "", nil
+	}
+	preHookFunc := func(ctx context.Context, d Deployment) error {
+		return fmt.Errorf("draining failed")
+	}
+	var postHookStatus Status
+	postHookFunc := func(ctx context.Context, d Deployment) error {
+		postHookStatus = d.Status
+		return nil
+	}
+	d := New(generation.Generation{OutPath: "out-path"}, deployFunc, closureDiffFunc, deploymentCh)
+	d = d.WithHooks(preHookFunc, postHookFunc)
+	d = d.Deploy(context.Background())
+	d = d.Update(<-deploymentCh)
+	assert.Equal(t, Failed, d.Status)
+	assert.Equal(t, "The pre-deployment hooks failed: draining failed", d.ErrorMsg)
+	assert.False(t, deployed)
+	// The post-deployment hooks are run on failures
+	assert.Equal(t, Failed, postHookStatus)
+}
+
+func TestPreHookDeployment(t *testing.T) {
+	deploymentCh := make(chan DeploymentResult)
+	deployFunc := func(context.Context, string, string, string) (bool, string, error) {
+		return false, "", nil
+	}
+	closureDiffFunc := func(context.Context, string) (string, error) {
+		return "", nil
+	}
+	var preHookDeployment Deployment
+	preHookFunc := func(ctx context.Context, d Deployment) error {
+		preHookDeployment = d
+		return nil
+	}
+	d := New(generation.Generation{OutPath: "out-path"}, deployFunc, closureDiffFunc, deploymentCh)
+	d = d.WithHooks(preHookFunc, nil)
+	d = d.Deploy(context.Background())
+	d = d.Update(<-deploymentCh)
+	assert.Equal(t, Done, d.Status)
+	// The pre-deployment hooks receive the started deployment
+	assert.Equal(t, Running, preHookDeployment.Status)
+	assert.False(t, preHookDeployment.StartAt.IsZero())
+	assert.Equal(t, d.StartAt, preHookDeployment.StartAt)
+}
+
+func TestDeployTimeout(t *testing.T) {
+	deploymentCh := make(chan DeploymentResult)
+	deployed := false
+	deployFunc := func(context.Context, string, string, string) (bool, string, error) {
+		deployed = true
+		return false, "", nil
+	}
+	closureDiffFunc := func(context.Context, string) (string, error) {
+		return "", nil
+	}
+	var postHookErr error
+	postHookFunc := func(ctx context.Context, d Deployment) error {
+		postHookErr = ctx.Err()
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	d := New(generation.Generation{OutPath: "out-path"}, deployFunc, closureDiffFunc, deploymentCh)
+	d = d.WithHooks(nil, postHookFunc)
+	d = d.Deploy(ctx)
+	d = d.Update(<-deploymentCh)
+	assert.Equal(t, Failed, d.Status)
+	// The configuration is not activated
+	assert.False(t, deployed)
+	// The post-deployment hooks don't receive the expired context
+	assert.Nil(t, postHookErr)
+}
+
+func TestDeploymentRecord(t *testing.T) {
+	deploymentCh := make(chan DeploymentResult)
+	deployFunc := func(context.Context, string, string, string) (bool, string, error) {
+		return false, "", nil
+	}
+	closureDiffFunc := func(context.Context, string) (string, error) {
+		return "", nil
+	}
+	var sizeOf string
+	closureSizeFunc := func(ctx context.Context, outPath string) (int64, error) {
+		sizeOf = outPath
+		return 1024, nil
+	}
+	d := New(generation.Generation{OutPath: "out-path"}, deployFunc, closureDiffFunc, deploymentCh)
+	d = d.WithClosureSize(closureSizeFunc)
+	d = d.Deploy(context.Background())
+	d = d.Update(<-deploymentCh)
+	assert.Equal(t, Done, d.Status)
+	assert.Equal(t, "out-path", sizeOf)
+	assert.Equal(t, int64(1024), d.ClosureSize)
+	assert.False(t, d.SwitchStartAt.IsZero())
+	assert.False(t, d.SwitchEndAt.Before(d.SwitchStartAt))
+
+	// The closure size is only informative
+	closureSizeFunc = func(ctx context.Context, outPath string) (int64, error) {
+		return 0, fmt.Errorf("no size")
+	}
+	d = New(generation.Generation{OutPath: "out-path"}, deployFunc, closureDiffFunc, deploymentCh)
+	d = d.WithClosureSize(closureSizeFunc)
+	d = d.Deploy(context.Background())
+	d = d.Update(<-deploymentCh)
+	assert.Equal(t, Done, d.Status)
+	assert.Equal(t, int64(0), d.ClosureSize)
+}
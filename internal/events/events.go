@@ -0,0 +1,131 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nlewo/comin/internal/deployment"
+	"github.com/nlewo/comin/internal/generation"
+)
+
+type Type string
+
+const (
+	// The remotes have been fetched
+	Fetched Type = "fetched"
+	// The configuration of the selected commit is evaluated
+	Evaluating Type = "evaluating"
+	// The evaluated configuration is built
+	Building Type = "building"
+	// The built configuration is activated
+	Switching Type = "switching"
+	// The deployment succeeded
+	Done Type = "done"
+	// The evaluation, the build or the deployment failed
+	Failed Type = "failed"
+)
+
+// Event is a step of the lifecycle of a deployment
+type Event struct {
+	Type           Type      `json:"type"`
+	At             time.Time `json:"at"`
+	GenerationUUID string    `json:"generation_uuid,omitempty"`
+	DeploymentUUID string    `json:"deployment_uuid,omitempty"`
+	CommitId       string    `json:"commit_id,omitempty"`
+	ErrorMsg       string    `json:"error_msg,omitempty"`
+	// The deployment of the events of a deployment, or the
+	// generation of the events of a generation. They are not
+	// streamed by the API.
+	Deployment *deployment.Deployment `json:"-"`
+	Generation *generation.Generation `json:"-"`
+}
+
+// subscriberBufferSize is the number of events a subscriber can lag
+// behind before events are dropped
+const subscriberBufferSize = 64
+
+// Handler handles all published events, unlike subscribers which can
+// miss events
+type Handler interface {
+	// Handle is called by Publish for each event: it must not
+	// block, for instance by queueing the event
+	Handle(e Event)
+	// Wait waits for the events handled so far being processed,
+	// at most during timeout
+	Wait(timeout time.Duration)
+}
+
+// Bus dispatches the published events to all subscribers and
+// handlers. Publishing never blocks: the events are dropped for
+// subscribers which don't consume them fast enough.
+type Bus struct {
+	mu          sync.Mutex
+	next        int
+	subscribers map[int]chan Event
+	handlers    []Handler
+}
+
+func New() *Bus {
+	return &Bus{
+		subscribers: make(map[int]chan Event),
+	}
+}
+
+// Subscribe returns a channel receiving the events published from now
+// and a function to unsubscribe, which closes the channel.
+func (b *Bus) Subscribe() (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	ch := make(chan Event, subscriberBufferSize)
+	b.subscribers[id] = ch
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subscribers, id)
+			close(ch)
+		})
+	}
+	return ch, unsubscribe
+}
+
+// Publish sends the event e to all subscribers
+func (b *Bus) Publish(e Event) {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, h := range b.handlers {
+		h.Handle(e)
+	}
+	for _, ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Handle registers the handler h receiving the events published from
+// now
+func (b *Bus) Handle(h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, h)
+}
+
+// Wait waits for the handlers having processed the published events,
+// at most during timeout
+func (b *Bus) Wait(timeout time.Duration) {
+	b.mu.Lock()
+	handlers := append([]Handler{}, b.handlers...)
+	b.mu.Unlock()
+	deadline := time.Now().Add(timeout)
+	for _, h := range handlers {
+		h.Wait(time.Until(deadline))
+	}
+}
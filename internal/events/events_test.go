@@ -0,0 +1,66 @@
+package events
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBus(t *testing.T) {
+	b := New()
+	// Publishing without subscriber doesn't block
+	b.Publish(Event{Type: Fetched})
+
+	ch1, unsubscribe1 := b.Subscribe()
+	ch2, unsubscribe2 := b.Subscribe()
+	b.Publish(Event{Type: Evaluating, CommitId: "abcd"})
+	e := <-ch1
+	assert.Equal(t, Evaluating, e.Type)
+	assert.Equal(t, "abcd", e.CommitId)
+	assert.False(t, e.At.IsZero())
+	assert.Equal(t, Evaluating, (<-ch2).Type)
+
+	unsubscribe1()
+	// Unsubscribing twice is not an error
+	unsubscribe1()
+	_, ok := <-ch1
+	assert.False(t, ok)
+	b.Publish(Event{Type: Building})
+	assert.Equal(t, Building, (<-ch2).Type)
+
+	// Events are dropped for a subscriber which doesn't consume
+	// them
+	for i := 0; i < subscriberBufferSize+10; i++ {
+		b.Publish(Event{Type: Building})
+	}
+	assert.Len(t, ch2, subscriberBufferSize)
+	unsubscribe2()
+}
+
+type handler struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (h *handler) Handle(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, e)
+}
+
+func (h *handler) Wait(timeout time.Duration) {}
+
+func TestBusHandler(t *testing.T) {
+	b := New()
+	h := &handler{}
+	b.Handle(h)
+	// Handlers receive all events, even without consuming a
+	// channel
+	for i := 0; i < subscriberBufferSize+10; i++ {
+		b.Publish(Event{Type: Building})
+	}
+	assert.Len(t, h.events, subscriberBufferSize+10)
+	b.Wait(time.Second)
+}
@@ -0,0 +1,66 @@
+package gc
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/nlewo/comin/internal/manager"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	checkPeriod = time.Minute
+	// The minimal delay between two garbage collections triggered
+	// by a low free space. This avoids continuously collecting
+	// garbage when the collection doesn't free enough space.
+	minFreeSpaceDelay = time.Hour
+	storeDir          = "/nix/store"
+)
+
+// FreeSpace returns the number of bytes available on the filesystem
+// of path
+func FreeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// Scheduler requests garbage collections to the manager,
+// periodically and when the free space of the Nix store is below
+// the configured threshold. Both are checked a minute after the start.
+// The manager ensures garbage collections don't run concurrently with
+// builds.
+func Scheduler(m manager.Manager, config types.Gc) {
+	if config.Period == 0 && config.MinFreeSpace == 0 {
+		return
+	}
+	logrus.Infof("Starting the garbage collection scheduler with period %ds and minimal free space %d bytes", config.Period, config.MinFreeSpace)
+	// The zero time lets the first check collect garbage: a
+	// scheduler restarted more often than the period, for instance
+	// by the deployment of comin, would otherwise never collect it
+	var lastGcAt time.Time
+	for {
+		time.Sleep(checkPeriod)
+		if config.Period != 0 && time.Since(lastGcAt) >= time.Duration(config.Period)*time.Second {
+			logrus.Infof("Requesting a periodic garbage collection")
+			m.CollectGarbage(config.DeleteOlderThan)
+			lastGcAt = time.Now()
+			continue
+		}
+		if config.MinFreeSpace != 0 && time.Since(lastGcAt) >= minFreeSpaceDelay {
+			free, err := FreeSpace(storeDir)
+			if err != nil {
+				logrus.Errorf("Failed to get the free space of %s: %s", storeDir, err)
+				continue
+			}
+			if free < config.MinFreeSpace {
+				logrus.Infof("Requesting a garbage collection since the free space of %s is %d bytes", storeDir, free)
+				m.CollectGarbage(config.DeleteOlderThan)
+				lastGcAt = time.Now()
+			}
+		}
+	}
+}
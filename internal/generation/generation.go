@@ -7,6 +7,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/nlewo/comin/internal/repository"
+	"github.com/nlewo/comin/internal/utils"
 	"github.com/sirupsen/logrus"
 )
 
@@ -69,39 +70,63 @@ type Generation struct {
 	FlakeUrl  string `json:"flake-url"`
 	Hostname  string `json:"hostname"`
 	MachineId string `json:"machine-id"`
+	// Is the configuration evaluated with --impure
+	Impure bool `json:"impure"`
 
 	Status Status `json:"status"`
 
-	SelectedRemoteName      string `json:"remote-name"`
-	SelectedBranchName      string `json:"branch-name"`
-	SelectedCommitId        string `json:"commit-id"`
-	SelectedCommitMsg       string `json:"commit-msg"`
-	SelectedBranchIsTesting bool   `json:"branch-is-testing"`
+	SelectedRemoteName string `json:"remote-name"`
+	SelectedBranchName string `json:"branch-name"`
+	SelectedCommitId   string `json:"commit-id"`
+	SelectedCommitMsg  string `json:"commit-msg"`
+	// The first line of the commit message
+	SelectedCommitSubject   string    `json:"commit-subject"`
+	SelectedCommitAuthor    string    `json:"commit-author,omitempty"`
+	SelectedCommitDate      time.Time `json:"commit-date,omitempty"`
+	SelectedBranchIsTesting bool      `json:"branch-is-testing"`
+	SelectedBranchOperation string    `json:"branch-operation"`
+	// The generation has to be approved to be deployed
+	SelectedBranchRequireApproval bool `json:"branch-require-approval"`
+	// The commit IDs of the repositories overriding inputs of the
+	// flake, indexed by the input names
+	InputCommitIds map[string]string `json:"input-commit-ids,omitempty"`
+	// The commit is not a descendant of the deployed commit
+	NotFastForward bool `json:"not-fast-forward,omitempty"`
+	// The ID of the fetch request which selected the commit
+	FetchId string `json:"fetch-id,omitempty"`
 
 	EvalStartedAt time.Time `json:"eval-started-at"`
-	evalTimeout   time.Duration
-	evalFunc      EvalFunc
-	evalCh        chan EvalResult
+	// The evaluation is aborted after this timeout, or before when
+	// the deployment timeout is exceeded
+	evalTimeout time.Duration
+	evalFunc    EvalFunc
+	evalCh      chan EvalResult
 
 	EvalEndedAt   time.Time `json:"eval-ended-at"`
 	EvalErr       error     `json:"-"`
 	OutPath       string    `json:"outpath"`
 	DrvPath       string    `json:"drvpath"`
 	EvalMachineId string    `json:"eval-machine-id"`
+	// The specialisation of the configuration to activate
+	Specialisation string `json:"specialisation"`
 
 	BuildStartedAt time.Time `json:"build-started-at"`
 	BuildEndedAt   time.Time `json:"build-ended-at"`
-	buildErr       error     `json:"-"`
-	buildFunc      BuildFunc
-	buildCh        chan BuildResult
+	// The build has been skipped because the outPath was already in
+	// the Nix store
+	BuildSkipped bool  `json:"build-skipped"`
+	buildErr     error `json:"-"`
+	buildFunc    BuildFunc
+	buildCh      chan BuildResult
 }
 
-type EvalFunc func(ctx context.Context, flakeUrl string, hostname string) (drvPath string, outPath string, machineId string, err error)
-type BuildFunc func(ctx context.Context, drvPath string) error
+type EvalFunc func(ctx context.Context, flakeUrl string, hostname string) (drvPath string, outPath string, machineId string, specialisation string, err error)
+type BuildFunc func(ctx context.Context, drvPath string, outPath string) (skipped bool, err error)
 
 type BuildResult struct {
-	EndAt time.Time
-	Err   error
+	EndAt   time.Time
+	Skipped bool
+	Err     error
 }
 
 type EvalResult struct {
@@ -110,26 +135,53 @@ type EvalResult struct {
 	DrvPath   string
 	MachineId string
 	Err       error
+	// The specialisation to activate, empty for the default
+	// configuration
+	Specialisation string
 }
 
 func New(repositoryStatus repository.RepositoryStatus, flakeUrl, hostname, machineId string, evalFunc EvalFunc, buildFunc BuildFunc) Generation {
 	return Generation{
-		UUID:                    uuid.NewString(),
-		SelectedRemoteName:      repositoryStatus.SelectedRemoteName,
-		SelectedBranchName:      repositoryStatus.SelectedBranchName,
-		SelectedCommitId:        repositoryStatus.SelectedCommitId,
-		SelectedCommitMsg:       repositoryStatus.SelectedCommitMsg,
-		SelectedBranchIsTesting: repositoryStatus.SelectedBranchIsTesting,
-		evalTimeout:             6 * time.Second,
-		evalFunc:                evalFunc,
-		buildFunc:               buildFunc,
-		FlakeUrl:                flakeUrl,
-		Hostname:                hostname,
-		MachineId:               machineId,
-		Status:                  Init,
+		UUID:                          uuid.NewString(),
+		SelectedRemoteName:            repositoryStatus.SelectedRemoteName,
+		SelectedBranchName:            repositoryStatus.SelectedBranchName,
+		SelectedCommitId:              repositoryStatus.SelectedCommitId,
+		SelectedCommitMsg:             repositoryStatus.SelectedCommitMsg,
+		SelectedCommitSubject:         utils.CommitSubject(repositoryStatus.SelectedCommitMsg),
+		SelectedCommitAuthor:          repositoryStatus.SelectedCommitAuthor,
+		SelectedCommitDate:            repositoryStatus.SelectedCommitDate,
+		SelectedBranchIsTesting:       repositoryStatus.SelectedBranchIsTesting,
+		SelectedBranchOperation:       repositoryStatus.SelectedBranchOperation,
+		SelectedBranchRequireApproval: repositoryStatus.SelectedBranchRequireApproval,
+		InputCommitIds:                repositoryStatus.InputCommitIds(),
+		evalTimeout:                   6 * time.Second,
+		evalFunc:                      evalFunc,
+		buildFunc:                     buildFunc,
+		FlakeUrl:                      flakeUrl,
+		Hostname:                      hostname,
+		MachineId:                     machineId,
+		Status:                        Init,
 	}
 }
 
+// EvalDuration returns the duration of the evaluation, 0 if it is not
+// finished
+func (g Generation) EvalDuration() time.Duration {
+	if g.EvalEndedAt.Before(g.EvalStartedAt) {
+		return 0
+	}
+	return g.EvalEndedAt.Sub(g.EvalStartedAt)
+}
+
+// BuildDuration returns the duration of the build, 0 if it is not
+// finished
+func (g Generation) BuildDuration() time.Duration {
+	if g.BuildEndedAt.Before(g.BuildStartedAt) {
+		return 0
+	}
+	return g.BuildEndedAt.Sub(g.BuildStartedAt)
+}
+
 func (g Generation) EvalCh() chan EvalResult {
 	return g.evalCh
 }
@@ -144,6 +196,7 @@ func (g Generation) UpdateEval(r EvalResult) Generation {
 	g.DrvPath = r.DrvPath
 	g.OutPath = r.OutPath
 	g.EvalMachineId = r.MachineId
+	g.Specialisation = r.Specialisation
 	g.EvalErr = r.Err
 	if g.EvalErr == nil {
 		g.Status = EvaluationSucceeded
@@ -156,6 +209,7 @@ func (g Generation) UpdateEval(r EvalResult) Generation {
 func (g Generation) UpdateBuild(r BuildResult) Generation {
 	logrus.Debugf("Build done with %#v", r)
 	g.BuildEndedAt = r.EndAt
+	g.BuildSkipped = r.Skipped
 	g.buildErr = r.Err
 	if g.buildErr == nil {
 		g.Status = BuildSucceeded
@@ -173,7 +227,7 @@ func (g Generation) Eval(ctx context.Context) Generation {
 	fn := func() {
 		ctx, cancel := context.WithTimeout(ctx, g.evalTimeout)
 		defer cancel()
-		drvPath, outPath, machineId, err := g.evalFunc(ctx, g.FlakeUrl, g.Hostname)
+		drvPath, outPath, machineId, specialisation, err := g.evalFunc(ctx, g.FlakeUrl, g.Hostname)
 		evaluationResult := EvalResult{
 			EndAt: time.Now(),
 		}
@@ -181,8 +235,9 @@ func (g Generation) Eval(ctx context.Context) Generation {
 			evaluationResult.DrvPath = drvPath
 			evaluationResult.OutPath = outPath
 			evaluationResult.MachineId = machineId
-			if machineId != "" && g.MachineId != machineId {
-				evaluationResult.Err = fmt.Errorf("The evaluated comin.machineId '%s' is different from the /etc/machine-id '%s' of this machine",
+			evaluationResult.Specialisation = specialisation
+			if machineId != "" && !utils.MachineIdAccepted(machineId, g.MachineId) {
+				evaluationResult.Err = fmt.Errorf("The evaluated comin.machineId '%s' is different from the machine ID '%s' of this machine",
 					machineId, g.MachineId)
 			}
 		} else {
@@ -198,12 +253,13 @@ func (g Generation) Build(ctx context.Context) Generation {
 	g.buildCh = make(chan BuildResult)
 	g.BuildStartedAt = time.Now()
 	g.Status = Building
+	// The build is only bounded by the deployment timeout of the
+	// context since it can be long
 	fn := func() {
-		ctx, cancel := context.WithTimeout(ctx, g.evalTimeout)
-		defer cancel()
-		err := g.buildFunc(ctx, g.DrvPath)
+		skipped, err := g.buildFunc(ctx, g.DrvPath, g.OutPath)
 		buildResult := BuildResult{
-			EndAt: time.Now(),
+			EndAt:   time.Now(),
+			Skipped: skipped,
 		}
 		buildResult.Err = err
 		g.buildCh <- buildResult
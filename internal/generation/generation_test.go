@@ -16,21 +16,23 @@ func TestEval(t *testing.T) {
 	machineId := "machine-id"
 	evalDone := make(chan struct{})
 
-	nixEvalMock := func(ctx context.Context, repositoryPath string, hostname string) (string, string, string, error) {
+	nixEvalMock := func(ctx context.Context, repositoryPath string, hostname string) (string, string, string, string, error) {
 		select {
 		case <-ctx.Done():
-			return "", "", "", fmt.Errorf("timeout exceeded")
+			return "", "", "", "", fmt.Errorf("timeout exceeded")
 		case <-evalDone:
-			return "", "", machineId, nil
+			return "", "", machineId, "", nil
 		}
 	}
-	nixBuildMock := func(ctx context.Context, drv string) error {
-		return nil
+	nixBuildMock := func(ctx context.Context, drv string, outPath string) (bool, error) {
+		return false, nil
 	}
 
 	repositoryPath := "repository/path/"
 	hostname := "machine"
 	g := New(repository.RepositoryStatus{}, repositoryPath, hostname, machineId, nixEvalMock, nixBuildMock)
+	// The evaluations are bounded even without deployment timeout
+	assert.Equal(t, 6*time.Second, g.evalTimeout)
 	g.evalTimeout = 1 * time.Second
 
 	// The eval job never terminates so it should timeout
@@ -48,3 +50,20 @@ func TestEval(t *testing.T) {
 	assert.Nil(t, evalResult.Err)
 	assert.Equal(t, machineId, evalResult.MachineId)
 }
+
+func TestBuildSkipped(t *testing.T) {
+	nixEvalMock := func(ctx context.Context, repositoryPath string, hostname string) (string, string, string, string, error) {
+		return "drv-path", "out-path", "", "", nil
+	}
+	nixBuildMock := func(ctx context.Context, drv string, outPath string) (bool, error) {
+		assert.Equal(t, "out-path", outPath)
+		return true, nil
+	}
+	g := New(repository.RepositoryStatus{}, "repository/path/", "machine", "", nixEvalMock, nixBuildMock)
+	g = g.Eval(context.Background())
+	g = g.UpdateEval(<-g.EvalCh())
+	g = g.Build(context.Background())
+	g = g.UpdateBuild(<-g.BuildCh())
+	assert.Equal(t, BuildSucceeded, g.Status)
+	assert.True(t, g.BuildSkipped)
+}
@@ -0,0 +1,179 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+)
+
+// Health checks the machine is healthy once a configuration has been
+// activated.
+type Health struct {
+	config types.HealthChecks
+}
+
+func New(config types.HealthChecks) Health {
+	return Health{
+		config: config,
+	}
+}
+
+// Enabled returns true when at least one health check is configured.
+func (h Health) Enabled() bool {
+	return len(h.config.Commands) > 0 || len(h.config.Units) > 0 || h.config.NoFailedUnits ||
+		len(h.config.HttpProbes) > 0 || len(h.config.TcpProbes) > 0
+}
+
+// Check runs the health checks until they all succeed. It returns the
+// error of the last failing check once the grace period is elapsed.
+func (h Health) Check(ctx context.Context) error {
+	deadline := time.Now().Add(time.Duration(h.config.GracePeriod) * time.Second)
+	for {
+		err := h.checkOnce(ctx)
+		if err == nil {
+			logrus.Infof("health: all health checks succeeded")
+			return nil
+		}
+		logrus.Infof("health: %s", err)
+		if !time.Now().Before(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(h.config.Interval) * time.Second):
+		}
+	}
+}
+
+func (h Health) checkOnce(ctx context.Context) error {
+	for _, c := range h.config.Commands {
+		if err := runCommand(ctx, c); err != nil {
+			return err
+		}
+	}
+	for _, u := range h.config.Units {
+		if err := checkUnitActive(ctx, u); err != nil {
+			return err
+		}
+	}
+	if h.config.NoFailedUnits {
+		if err := checkNoFailedUnits(ctx); err != nil {
+			return err
+		}
+	}
+	for _, p := range h.config.HttpProbes {
+		interval := time.Duration(p.RetryInterval) * time.Second
+		if err := retry(ctx, p.Retries, interval, func() error { return httpProbe(ctx, p) }); err != nil {
+			return err
+		}
+	}
+	for _, p := range h.config.TcpProbes {
+		interval := time.Duration(p.RetryInterval) * time.Second
+		if err := retry(ctx, p.Retries, interval, func() error { return tcpProbe(ctx, p) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retry runs fn until it succeeds, at most retries + 1 times, waiting
+// interval between two attempts.
+func retry(ctx context.Context, retries int, interval time.Duration, fn func() error) (err error) {
+	for i := 0; i <= retries; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(interval):
+			}
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func httpProbe(ctx context.Context, p types.HttpProbe) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.Timeout)*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Url, nil)
+	if err != nil {
+		return fmt.Errorf("The HTTP probe '%s' is invalid: %s", p.Url, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("The HTTP probe '%s' fails with %s", p.Url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != p.ExpectedStatus {
+		return fmt.Errorf("The HTTP probe '%s' returns the status %d instead of %d", p.Url, resp.StatusCode, p.ExpectedStatus)
+	}
+	return nil
+}
+
+func tcpProbe(ctx context.Context, p types.TcpProbe) error {
+	d := net.Dialer{Timeout: time.Duration(p.Timeout) * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", p.Address)
+	if err != nil {
+		return fmt.Errorf("The TCP probe '%s' fails with %s", p.Address, err)
+	}
+	conn.Close()
+	return nil
+}
+
+func checkUnitActive(ctx context.Context, unit string) error {
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, "systemctl", "is-active", unit)
+	cmd.Stdout = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("The systemd unit '%s' is not active (%s)", unit, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+func checkNoFailedUnits(ctx context.Context) error {
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, "systemctl", "list-units", "--state=failed", "--no-legend", "--plain")
+	cmd.Stdout = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Failed to list the failed systemd units: %s", err)
+	}
+	if units := failedUnits(output.String()); len(units) > 0 {
+		return fmt.Errorf("Some systemd units failed: %s", strings.Join(units, ", "))
+	}
+	return nil
+}
+
+// failedUnits returns the unit names of the 'systemctl list-units
+// --no-legend --plain' output.
+func failedUnits(output string) []string {
+	units := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			units = append(units, fields[0])
+		}
+	}
+	return units
+}
+
+func runCommand(ctx context.Context, command string) error {
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("The health check '%s' fails with %s: %s", command, err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	h := New(types.HealthChecks{})
+	assert.False(t, h.Enabled())
+	assert.True(t, New(types.HealthChecks{NoFailedUnits: true}).Enabled())
+
+	h = New(types.HealthChecks{Commands: []string{"true", "exit 0"}})
+	assert.True(t, h.Enabled())
+	assert.Nil(t, h.Check(context.Background()))
+
+	h = New(types.HealthChecks{Commands: []string{"true", "echo unhealthy; exit 1"}})
+	err := h.Check(context.Background())
+	assert.EqualError(t, err, "The health check 'echo unhealthy; exit 1' fails with exit status 1: unhealthy")
+}
+
+func TestCheckRetry(t *testing.T) {
+	marker := t.TempDir() + "/marker"
+	// The check fails the first time and succeeds the second time
+	h := New(types.HealthChecks{
+		Commands:    []string{"test -f " + marker + " || { touch " + marker + "; exit 1; }"},
+		GracePeriod: 5,
+		Interval:    0,
+	})
+	assert.Nil(t, h.Check(context.Background()))
+}
+
+func TestFailedUnits(t *testing.T) {
+	assert.Equal(t, []string{}, failedUnits(""))
+	output := `nginx.service  loaded failed failed nginx
+foo.timer      loaded failed failed foo
+`
+	assert.Equal(t, []string{"nginx.service", "foo.timer"}, failedUnits(output))
+}
+
+func TestProbes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	h := New(types.HealthChecks{
+		HttpProbes: []types.HttpProbe{{Url: server.URL + "/healthz", ExpectedStatus: 200, Timeout: 1}},
+		TcpProbes:  []types.TcpProbe{{Address: address, Timeout: 1}},
+	})
+	assert.True(t, h.Enabled())
+	assert.Nil(t, h.Check(context.Background()))
+
+	h = New(types.HealthChecks{
+		HttpProbes: []types.HttpProbe{{Url: server.URL + "/down", ExpectedStatus: 200, Timeout: 1, Retries: 2}},
+	})
+	err := h.Check(context.Background())
+	assert.EqualError(t, err, fmt.Sprintf("The HTTP probe '%s/down' returns the status 503 instead of 200", server.URL))
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddress := l.Addr().String()
+	l.Close()
+	h = New(types.HealthChecks{
+		TcpProbes: []types.TcpProbe{{Address: closedAddress, Timeout: 1}},
+	})
+	assert.NotNil(t, h.Check(context.Background()))
+}
+
+func TestRetry(t *testing.T) {
+	attempts := 0
+	start := time.Now()
+	err := retry(context.Background(), 2, 50*time.Millisecond, func() error {
+		attempts++
+		return fmt.Errorf("failure %d", attempts)
+	})
+	assert.EqualError(t, err, "failure 3")
+	assert.Equal(t, 3, attempts)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	attempts = 0
+	err = retry(context.Background(), 2, 0, func() error {
+		attempts++
+		if attempts < 2 {
+			return fmt.Errorf("failure")
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+
+	// The retries stop once the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts = 0
+	err = retry(ctx, 2, time.Hour, func() error {
+		attempts++
+		return fmt.Errorf("failure")
+	})
+	assert.EqualError(t, err, "failure")
+	assert.Equal(t, 1, attempts)
+}
@@ -0,0 +1,244 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nlewo/comin/internal/deployment"
+	"github.com/nlewo/comin/internal/utils"
+)
+
+// defaultMaxEntries is the number of deployments kept in the history
+// when it is not configured
+const defaultMaxEntries = 1000
+
+// History stores the finished deployments in a file, one JSON entry
+// per line, from the oldest to the most recent one. Only the last
+// maxEntries deployments are kept.
+type History struct {
+	path       string
+	maxEntries int
+}
+
+type Entry struct {
+	UUID string `json:"uuid"`
+	// The ID of the logs of the deployed generation
+	GenerationUUID string    `json:"generation_uuid"`
+	CommitId       string    `json:"commit_id"`
+	CommitMsg      string    `json:"commit_msg"`
+	CommitSubject  string    `json:"commit_subject,omitempty"`
+	CommitAuthor   string    `json:"commit_author,omitempty"`
+	CommitDate     time.Time `json:"commit_date,omitempty"`
+	RemoteName     string    `json:"remote_name"`
+	BranchName     string    `json:"branch_name"`
+	Operation      string    `json:"operation"`
+	Status         string    `json:"status"`
+	ErrorMsg       string    `json:"error_msg,omitempty"`
+	OutPath        string    `json:"outpath"`
+	StartAt        time.Time `json:"start_at"`
+	EndAt          time.Time `json:"end_at"`
+	// The previous configuration has been activated again because
+	// health checks failed
+	RolledBack bool `json:"rolled_back,omitempty"`
+	// The durations of the steps of the deployment, in seconds
+	EvalDuration   float64 `json:"eval_duration,omitempty"`
+	BuildDuration  float64 `json:"build_duration,omitempty"`
+	SwitchDuration float64 `json:"switch_duration,omitempty"`
+	// The size in bytes of the closure of the deployed configuration
+	ClosureSize int64 `json:"closure_size,omitempty"`
+	// comin has been restarted to run the deployed version
+	RestartComin bool `json:"restart_comin,omitempty"`
+	// The machine has to be rebooted to run the deployed kernel,
+	// initrd or systemd
+	RebootNeeded bool `json:"reboot_needed,omitempty"`
+}
+
+// New returns the history stored in the file path. The history is not
+// persisted when the path is empty.
+func New(path string) History {
+	return History{
+		path:       path,
+		maxEntries: defaultMaxEntries,
+	}
+}
+
+// WithMaxEntries returns a history keeping the last maxEntries
+// deployments
+func (h History) WithMaxEntries(maxEntries int) History {
+	if maxEntries > 0 {
+		h.maxEntries = maxEntries
+	}
+	return h
+}
+
+// NewEntry returns the history entry of the deployment d
+func NewEntry(d deployment.Deployment) Entry {
+	return Entry{
+		UUID:           d.UUID,
+		GenerationUUID: d.Generation.UUID,
+		CommitId:       d.Generation.SelectedCommitId,
+		CommitMsg:      d.Generation.SelectedCommitMsg,
+		CommitSubject:  d.Generation.SelectedCommitSubject,
+		CommitAuthor:   d.Generation.SelectedCommitAuthor,
+		CommitDate:     d.Generation.SelectedCommitDate,
+		RemoteName:     d.Generation.SelectedRemoteName,
+		BranchName:     d.Generation.SelectedBranchName,
+		Operation:      d.Operation,
+		Status:         deployment.StatusToString(d.Status),
+		ErrorMsg:       d.ErrorMsg,
+		OutPath:        d.Generation.OutPath,
+		StartAt:        d.StartAt,
+		EndAt:          d.EndAt,
+		RolledBack:     d.RolledBack,
+		EvalDuration:   d.Generation.EvalDuration().Seconds(),
+		BuildDuration:  d.Generation.BuildDuration().Seconds(),
+		SwitchDuration: d.SwitchDuration().Seconds(),
+		ClosureSize:    d.ClosureSize,
+		RestartComin:   d.RestartComin,
+		RebootNeeded:   d.RebootNeeded,
+	}
+}
+
+// Duration returns the duration of the deployment
+func (e Entry) Duration() time.Duration {
+	return e.EndAt.Sub(e.StartAt)
+}
+
+// Filter selects entries of the history. Empty fields match all
+// entries.
+type Filter struct {
+	// Entries of deployments started after Since
+	Since time.Time
+	// Entries of deployments started before Until
+	Until  time.Time
+	Status string
+	// A prefix of the commit ID
+	CommitId  string
+	Operation string
+}
+
+func (f Filter) Match(e Entry) bool {
+	switch {
+	case !f.Since.IsZero() && e.StartAt.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.StartAt.Before(f.Until):
+		return false
+	case f.Status != "" && e.Status != f.Status:
+		return false
+	case f.CommitId != "" && !strings.HasPrefix(e.CommitId, f.CommitId):
+		return false
+	case f.Operation != "" && e.Operation != f.Operation:
+		return false
+	}
+	return true
+}
+
+// ParseTime parses the bound of a filter: a date (2006-01-02), a
+// local time (2006-01-02 15:04), a RFC3339 time or a duration before
+// now (48h).
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("The time '%s' is not a date (2006-01-02), a time (2006-01-02 15:04) or a duration (48h)", value)
+}
+
+// Read returns the entries of the history, from the oldest to the most
+// recent one
+func (h History) Read() (entries []Entry, err error) {
+	if h.path == "" {
+		return
+	}
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A truncated line is skipped
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Append adds the entry to the history. The file is rewritten once it
+// contains more than maxEntries entries: the removed entries are
+// returned.
+func (h History) Append(entry Entry) (removed []Entry, err error) {
+	if h.path == "" {
+		return
+	}
+	entries, err := h.Read()
+	if err != nil {
+		return
+	}
+	entries = append(entries, entry)
+	if len(entries) > h.maxEntries {
+		removed = entries[:len(entries)-h.maxEntries]
+		return removed, h.write(entries[len(entries)-h.maxEntries:])
+	}
+	if err = os.MkdirAll(filepath.Dir(h.path), 0750); err != nil {
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return nil, json.NewEncoder(f).Encode(entry)
+}
+
+// Prune removes the entries of deployments started before the time
+// before, when it is not zero, and the oldest entries exceeding
+// maxEntries.
+// It returns the removed entries. When dryRun is true, the history is
+// not modified.
+func (h History) Prune(before time.Time, dryRun bool) (removed []Entry, err error) {
+	entries, err := h.Read()
+	if err != nil {
+		return
+	}
+	kept := make([]Entry, 0, len(entries))
+	for i, entry := range entries {
+		if len(entries)-i > h.maxEntries || (!before.IsZero() && entry.StartAt.Before(before)) {
+			removed = append(removed, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	if dryRun || len(removed) == 0 {
+		return
+	}
+	return removed, h.write(kept)
+}
+
+// write atomically replaces the history file by the entries
+func (h History) write(entries []Entry) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return utils.WriteFileAtomic(h.path, buf.Bytes(), 0640)
+}
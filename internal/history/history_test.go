@@ -0,0 +1,155 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nlewo/comin/internal/deployment"
+	"github.com/nlewo/comin/internal/generation"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistory(t *testing.T) {
+	h := New(filepath.Join(t.TempDir(), "history.jsonl"))
+	entries, err := h.Read()
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	var removed []Entry
+	for i := 0; i < defaultMaxEntries+2; i++ {
+		removed, err = h.Append(Entry{UUID: string(rune('a' + i%26)), CommitId: "abcd", Status: "done"})
+		assert.Nil(t, err)
+	}
+	// The last append removed the second entry
+	assert.Len(t, removed, 1)
+	assert.Equal(t, "b", removed[0].UUID)
+	entries, err = h.Read()
+	assert.Nil(t, err)
+	assert.Len(t, entries, defaultMaxEntries)
+	// The oldest entries have been removed
+	assert.Equal(t, string(rune('a'+(defaultMaxEntries+1)%26)), entries[defaultMaxEntries-1].UUID)
+	assert.Equal(t, string(rune('a'+2)), entries[0].UUID)
+
+	// A truncated line is skipped
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND, 0640)
+	assert.Nil(t, err)
+	_, err = f.WriteString(`{"uuid": "trunc`)
+	assert.Nil(t, err)
+	f.Close()
+	entries, err = h.Read()
+	assert.Nil(t, err)
+	assert.Len(t, entries, defaultMaxEntries)
+
+	// A history without path is not persisted
+	h = New("")
+	_, err = h.Append(Entry{UUID: "a"})
+	assert.Nil(t, err)
+	entries, err = h.Read()
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestMaxEntries(t *testing.T) {
+	h := New(filepath.Join(t.TempDir(), "history.jsonl")).WithMaxEntries(2)
+	for _, uuid := range []string{"a", "b"} {
+		removed, err := h.Append(Entry{UUID: uuid})
+		assert.Nil(t, err)
+		assert.Empty(t, removed)
+	}
+	removed, err := h.Append(Entry{UUID: "c"})
+	assert.Nil(t, err)
+	assert.Equal(t, "a", removed[0].UUID)
+	entries, _ := h.Read()
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "b", entries[0].UUID)
+}
+
+func TestPrune(t *testing.T) {
+	h := New(filepath.Join(t.TempDir(), "history.jsonl"))
+	now := time.Now()
+	for i, uuid := range []string{"a", "b", "c"} {
+		_, err := h.Append(Entry{UUID: uuid, StartAt: now.Add(time.Duration(i) * time.Hour)})
+		assert.Nil(t, err)
+	}
+	removed, err := h.Prune(now.Add(90*time.Minute), true)
+	assert.Nil(t, err)
+	assert.Len(t, removed, 2)
+	entries, _ := h.Read()
+	assert.Len(t, entries, 3)
+
+	removed, err = h.Prune(now.Add(90*time.Minute), false)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", removed[0].UUID)
+	assert.Equal(t, "b", removed[1].UUID)
+	entries, _ = h.Read()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "c", entries[0].UUID)
+
+	removed, err = h.Prune(time.Time{}, false)
+	assert.Nil(t, err)
+	assert.Empty(t, removed)
+}
+
+func TestFilter(t *testing.T) {
+	now := time.Now()
+	e := Entry{CommitId: "abcdef", Status: "failed", Operation: "switch", StartAt: now}
+	assert.True(t, Filter{}.Match(e))
+	assert.True(t, Filter{CommitId: "abc", Status: "failed", Operation: "switch"}.Match(e))
+	assert.False(t, Filter{CommitId: "bcd"}.Match(e))
+	assert.False(t, Filter{Status: "done"}.Match(e))
+	assert.False(t, Filter{Operation: "boot"}.Match(e))
+	assert.True(t, Filter{Since: now.Add(-time.Hour), Until: now.Add(time.Hour)}.Match(e))
+	assert.False(t, Filter{Since: now.Add(time.Hour)}.Match(e))
+	assert.False(t, Filter{Until: now}.Match(e))
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2024, 3, 14, 10, 0, 0, 0, time.UTC)
+	parsed, err := ParseTime("48h", now)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 3, 12, 10, 0, 0, 0, time.UTC), parsed)
+	parsed, err = ParseTime("2024-03-12", now)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 3, 12, 0, 0, 0, 0, time.UTC), parsed)
+	parsed, err = ParseTime("2024-03-12 14:30", now)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 3, 12, 14, 30, 0, 0, time.UTC), parsed)
+	_, err = ParseTime("last tuesday", now)
+	assert.NotNil(t, err)
+}
+
+func TestNewEntry(t *testing.T) {
+	start := time.Date(2024, 3, 12, 10, 0, 0, 0, time.UTC)
+	d := deployment.Deployment{
+		Generation: generation.Generation{
+			SelectedCommitId:      "abcd",
+			SelectedCommitSubject: "Update nixpkgs",
+			SelectedCommitAuthor:  "Jane <jane@example.com>",
+			EvalStartedAt:         start,
+			EvalEndedAt:           start.Add(10 * time.Second),
+			BuildStartedAt:        start.Add(10 * time.Second),
+			BuildEndedAt:          start.Add(70 * time.Second),
+		},
+		Status:        deployment.Done,
+		SwitchStartAt: start.Add(80 * time.Second),
+		SwitchEndAt:   start.Add(85 * time.Second),
+		ClosureSize:   1024,
+		RebootNeeded:  true,
+	}
+	e := NewEntry(d)
+	assert.Equal(t, "Update nixpkgs", e.CommitSubject)
+	assert.Equal(t, "Jane <jane@example.com>", e.CommitAuthor)
+	assert.Equal(t, 10.0, e.EvalDuration)
+	assert.Equal(t, 60.0, e.BuildDuration)
+	assert.Equal(t, 5.0, e.SwitchDuration)
+	assert.Equal(t, int64(1024), e.ClosureSize)
+	assert.True(t, e.RebootNeeded)
+	assert.False(t, e.RestartComin)
+
+	// The build has not been run
+	d.Generation.BuildStartedAt = time.Time{}
+	d.Generation.BuildEndedAt = time.Time{}
+	assert.Equal(t, 0.0, NewEntry(d).BuildDuration)
+}
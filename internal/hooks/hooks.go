@@ -0,0 +1,88 @@
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/nlewo/comin/internal/deployment"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+)
+
+// Hooks runs executables configured by users around deployments.
+type Hooks struct {
+	config  types.Hooks
+	timeout time.Duration
+}
+
+func New(config types.Hooks) Hooks {
+	return Hooks{
+		config:  config,
+		timeout: time.Duration(config.Timeout) * time.Second,
+	}
+}
+
+// env returns the environment variables describing the deployment d
+// to hooks.
+func env(d deployment.Deployment) []string {
+	return []string{
+		fmt.Sprintf("COMIN_DEPLOYMENT_UUID=%s", d.UUID),
+		fmt.Sprintf("COMIN_GENERATION_UUID=%s", d.Generation.UUID),
+		fmt.Sprintf("COMIN_REMOTE_NAME=%s", d.Generation.SelectedRemoteName),
+		fmt.Sprintf("COMIN_BRANCH_NAME=%s", d.Generation.SelectedBranchName),
+		fmt.Sprintf("COMIN_COMMIT_ID=%s", d.Generation.SelectedCommitId),
+		fmt.Sprintf("COMIN_OUT_PATH=%s", d.Generation.OutPath),
+		fmt.Sprintf("COMIN_OPERATION=%s", d.Operation),
+		fmt.Sprintf("COMIN_STATUS=%s", deployment.StatusToString(d.Status)),
+		fmt.Sprintf("COMIN_ERROR_MSG=%s", d.ErrorMsg),
+	}
+}
+
+// run runs the executable, which is killed once the timeout is
+// exceeded. There is no timeout when it is 0.
+func run(ctx context.Context, executable string, env []string, timeout time.Duration) error {
+	logrus.Infof("hooks: running '%s'", executable)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, executable)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("The hook '%s' fails with %s", executable, err)
+	}
+	return nil
+}
+
+// PostDeployment runs the post-deployment hooks corresponding to the
+// status of the terminated deployment d. All hooks are run, even if
+// one of them fails.
+func (h Hooks) PostDeployment(ctx context.Context, d deployment.Deployment) (err error) {
+	executables := h.config.PostDeploymentSuccess
+	if d.Status == deployment.Failed {
+		executables = h.config.PostDeploymentFailure
+	}
+	for _, e := range executables {
+		if e := run(ctx, e, env(d), h.timeout); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// PreDeployment runs the pre-deployment hooks. The deployment is
+// aborted when one of them fails.
+func (h Hooks) PreDeployment(ctx context.Context, d deployment.Deployment) error {
+	for _, e := range h.config.PreDeployment {
+		if err := run(ctx, e, env(d), h.timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
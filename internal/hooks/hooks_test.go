@@ -0,0 +1,68 @@
+package hooks
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nlewo/comin/internal/deployment"
+	"github.com/nlewo/comin/internal/generation"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeHook(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	err := os.WriteFile(path, []byte("#!/bin/sh\n"+content), 0755)
+	assert.Nil(t, err)
+	return path
+}
+
+func TestPreDeployment(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "output")
+	succeeding := writeHook(t, dir, "succeeding", "printf \"%s %s\" $COMIN_COMMIT_ID $COMIN_OPERATION > "+output)
+	failing := writeHook(t, dir, "failing", "exit 1")
+
+	d := deployment.Deployment{
+		Generation: generation.Generation{SelectedCommitId: "commit"},
+		Operation:  "switch",
+	}
+	h := New(types.Hooks{PreDeployment: []string{succeeding}})
+	assert.Nil(t, h.PreDeployment(context.Background(), d))
+	content, _ := os.ReadFile(output)
+	assert.Equal(t, "commit switch", string(content))
+
+	h = New(types.Hooks{PreDeployment: []string{failing, succeeding}})
+	assert.NotNil(t, h.PreDeployment(context.Background(), d))
+}
+
+func TestPostDeployment(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "output")
+	success := writeHook(t, dir, "success", "printf \"success %s\" $COMIN_STATUS > "+output)
+	failure := writeHook(t, dir, "failure", "printf \"failure %s %s\" $COMIN_STATUS $COMIN_ERROR_MSG > "+output)
+	h := New(types.Hooks{PostDeploymentSuccess: []string{success}, PostDeploymentFailure: []string{failure}})
+
+	d := deployment.Deployment{Status: deployment.Done}
+	assert.Nil(t, h.PostDeployment(context.Background(), d))
+	content, _ := os.ReadFile(output)
+	assert.Equal(t, "success done", string(content))
+
+	d = deployment.Deployment{Status: deployment.Failed, ErrorMsg: "error"}
+	assert.Nil(t, h.PostDeployment(context.Background(), d))
+	content, _ = os.ReadFile(output)
+	assert.Equal(t, "failure failed error", string(content))
+}
+
+func TestTimeout(t *testing.T) {
+	dir := t.TempDir()
+	sleeping := writeHook(t, dir, "sleeping", "exec sleep 10")
+	h := New(types.Hooks{PreDeployment: []string{sleeping}})
+	h.timeout = 100 * time.Millisecond
+	start := time.Now()
+	assert.NotNil(t, h.PreDeployment(context.Background(), deployment.Deployment{}))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
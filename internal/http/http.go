@@ -1,14 +1,22 @@
 package http
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/nlewo/comin/internal/logs"
 	"github.com/nlewo/comin/internal/manager"
 	"github.com/nlewo/comin/internal/prometheus"
+	"github.com/nlewo/comin/internal/utils"
 	"github.com/sirupsen/logrus"
 )
 
@@ -25,32 +33,349 @@ func handlerStatus(m manager.Manager, w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// handlerEvents streams the lifecycle events of deployments on GET
+// /events, as server-sent events whose data is the JSON event.
+func handlerEvents(m manager.Manager, w http.ResponseWriter, r *http.Request) {
+	logrus.Infof("Getting events request %s from %s", r.URL, r.RemoteAddr)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ch, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			rJson, err := json.Marshal(e)
+			if err != nil {
+				logrus.Error(err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, rJson)
+			flusher.Flush()
+		}
+	}
+}
+
+// handlerLogs returns the list of log files on /logs and the content
+// of a log file on /logs/ID.
+func handlerLogs(l logs.Logs, w http.ResponseWriter, r *http.Request) {
+	logrus.Infof("Getting logs request %s from %s", r.URL, r.RemoteAddr)
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/logs"), "/")
+	if id == "" {
+		list, err := l.List()
+		if err != nil {
+			logrus.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rJson, err := json.MarshalIndent(list, "", "\t")
+		if err != nil {
+			logrus.Error(err)
+		}
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, string(rJson))
+		return
+	}
+	content, err := l.Read(id)
+	if err != nil {
+		logrus.Debugf("Failed to read the log %s: %s", id, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(content)
+}
+
+// handlerDeployments returns the deployment ID on GET
+// /deployments/ID and approves a deployment on POST
+// /deployments/ID/approve, where ID is the UUID of the generation
+// waiting for an approval.
+func handlerDeployments(m manager.Manager, w http.ResponseWriter, r *http.Request) {
+	logrus.Infof("Getting deployments request %s from %s", r.URL, r.RemoteAddr)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 2 && r.Method == http.MethodGet {
+		entry, err := m.Deployment(parts[1])
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, err.Error())
+			return
+		}
+		rJson, err := json.MarshalIndent(entry, "", "\t")
+		if err != nil {
+			logrus.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(rJson)
+		return
+	}
+	if len(parts) != 3 || parts[2] != "approve" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := m.Approve(parts[1]); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlerRebootCancel cancels the scheduled reboot on POST
+// /reboot/cancel.
+func handlerRebootCancel(m manager.Manager, w http.ResponseWriter, r *http.Request) {
+	logrus.Infof("Getting reboot cancel request %s from %s", r.URL, r.RemoteAddr)
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := m.CancelReboot(); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlerFreeze freezes deployments on POST /freeze and unfreezes them
+// on DELETE /freeze. The by and reason query parameters of POST tell
+// who froze deployments and why.
+func handlerFreeze(m manager.Manager, w http.ResponseWriter, r *http.Request) {
+	logrus.Infof("Getting freeze request %s %s from %s", r.Method, r.URL, r.RemoteAddr)
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		err = m.Freeze(r.URL.Query().Get("by"), r.URL.Query().Get("reason"))
+	case http.MethodDelete:
+		err = m.Unfreeze()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlerFetch requests a fetch on POST /fetch. The remote to fetch
+// is given by the remote query parameter: when it is empty, all
+// remotes are fetched. The request is returned with the Accepted
+// status code when it is queued because the manager is running.
+func handlerFetch(m manager.Manager, w http.ResponseWriter, r *http.Request) {
+	logrus.Infof("Getting fetch request %s from %s", r.URL, r.RemoteAddr)
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	req := m.Fetch(r.URL.Query().Get("remote"))
+	rJson, err := json.MarshalIndent(req, "", "\t")
+	if err != nil {
+		logrus.Error(err)
+	}
+	if req.Position > 0 {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	io.WriteString(w, string(rJson))
+}
+
+// handlerRollback starts a rollback on POST /rollback. The target is
+// given by the target query parameter: when it is empty, the previous
+// generation of the profile is activated.
+func handlerRollback(m manager.Manager, w http.ResponseWriter, r *http.Request) {
+	logrus.Infof("Getting rollback request %s from %s", r.URL, r.RemoteAddr)
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := m.Rollback(r.URL.Query().Get("target")); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlerPin pins deployments to the commit given by the commit
+// query parameter on POST /pin and unpins them on DELETE /pin. A fetch
+// is then requested to apply the change.
+func handlerPin(m manager.Manager, w http.ResponseWriter, r *http.Request) {
+	logrus.Infof("Getting pin request %s %s from %s", r.Method, r.URL, r.RemoteAddr)
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		err = m.Pin(r.URL.Query().Get("commit"))
+	case http.MethodDelete:
+		err = m.Unpin()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+	m.Fetch("")
+	w.WriteHeader(http.StatusOK)
+}
+
+// Token returns the API token stored in the file path. A random token
+// only readable by the user running comin is created when the file
+// doesn't exist.
+func Token(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err == nil {
+		token := strings.TrimSpace(string(content))
+		if token == "" {
+			return "", fmt.Errorf("The API token file %s is empty", path)
+		}
+		return token, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return "", err
+	}
+	if err := utils.WriteFileAtomic(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	logrus.Infof("The API token has been created in %s", path)
+	return token, nil
+}
+
+// authorized only serves the requests modifying the state of comin
+// (POST and DELETE) when they provide the API token in the
+// Authorization header (Bearer TOKEN)
+func authorized(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			authorization := r.Header.Get("Authorization")
+			given := strings.TrimPrefix(authorization, "Bearer ")
+			if token == "" || given == authorization || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				logrus.Infof("Rejecting the unauthenticated request %s %s from %s", r.Method, r.URL, r.RemoteAddr)
+				w.WriteHeader(http.StatusUnauthorized)
+				io.WriteString(w, "The API token is required")
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
 // Serve starts http servers. We create two HTTP servers to easily be
 // able to expose metrics publicly while keeping on localhost only the
-// API.
-func Serve(m manager.Manager, p prometheus.Prometheus, apiAddress string, apiPort int, metricsAddress string, metricsPort int) {
+// API. The metrics server is not started when metricsPort is 0.
+// Serve returns once the servers listen on their ports. The requests
+// modifying the state of comin require the API token.
+func Serve(m manager.Manager, p prometheus.Prometheus, l logs.Logs, apiAddress string, apiPort int, token string, metricsAddress string, metricsPort int) {
 	handlerStatusFn := func(w http.ResponseWriter, r *http.Request) {
 		handlerStatus(m, w, r)
 		return
 	}
 
+	handlerEventsFn := func(w http.ResponseWriter, r *http.Request) {
+		handlerEvents(m, w, r)
+		return
+	}
+
+	handlerLogsFn := func(w http.ResponseWriter, r *http.Request) {
+		handlerLogs(l, w, r)
+		return
+	}
+
+	handlerDeploymentsFn := func(w http.ResponseWriter, r *http.Request) {
+		handlerDeployments(m, w, r)
+		return
+	}
+
+	handlerRebootCancelFn := func(w http.ResponseWriter, r *http.Request) {
+		handlerRebootCancel(m, w, r)
+		return
+	}
+
+	handlerFreezeFn := func(w http.ResponseWriter, r *http.Request) {
+		handlerFreeze(m, w, r)
+		return
+	}
+
+	handlerFetchFn := func(w http.ResponseWriter, r *http.Request) {
+		handlerFetch(m, w, r)
+		return
+	}
+
+	handlerRollbackFn := func(w http.ResponseWriter, r *http.Request) {
+		handlerRollback(m, w, r)
+		return
+	}
+
+	handlerPinFn := func(w http.ResponseWriter, r *http.Request) {
+		handlerPin(m, w, r)
+		return
+	}
+
 	muxStatus := http.NewServeMux()
 	muxStatus.HandleFunc("/status", handlerStatusFn)
+	muxStatus.HandleFunc("/events", handlerEventsFn)
+	muxStatus.HandleFunc("/logs", handlerLogsFn)
+	muxStatus.HandleFunc("/logs/", handlerLogsFn)
+	muxStatus.HandleFunc("/deployments/", handlerDeploymentsFn)
+	muxStatus.HandleFunc("/reboot/cancel", handlerRebootCancelFn)
+	muxStatus.HandleFunc("/freeze", handlerFreezeFn)
+	muxStatus.HandleFunc("/fetch", handlerFetchFn)
+	muxStatus.HandleFunc("/rollback", handlerRollbackFn)
+	muxStatus.HandleFunc("/pin", handlerPinFn)
 	muxMetrics := http.NewServeMux()
 	muxMetrics.Handle("/metrics", p.Handler())
 
+	apiUrl := fmt.Sprintf("%s:%d", apiAddress, apiPort)
+	logrus.Infof("Starting the API server on %s", apiUrl)
+	apiListener, err := net.Listen("tcp", apiUrl)
+	if err != nil {
+		logrus.Errorf("Failed to listen on %s: %s", apiUrl, err)
+		os.Exit(1)
+	}
 	go func() {
-		url := fmt.Sprintf("%s:%d", apiAddress, apiPort)
-		logrus.Infof("Starting the API server on %s", url)
-		if err := http.ListenAndServe(url, muxStatus); err != nil {
+		if err := http.Serve(apiListener, authorized(token, muxStatus)); err != nil {
 			logrus.Errorf("Error while running the API server: %s", err)
 			os.Exit(1)
 		}
 	}()
+	if metricsPort == 0 {
+		logrus.Infof("The metrics server is disabled")
+		return
+	}
+	metricsUrl := fmt.Sprintf("%s:%d", metricsAddress, metricsPort)
+	logrus.Infof("Starting the metrics server on %s", metricsUrl)
+	metricsListener, err := net.Listen("tcp", metricsUrl)
+	if err != nil {
+		logrus.Errorf("Failed to listen on %s: %s", metricsUrl, err)
+		os.Exit(1)
+	}
 	go func() {
-		url := fmt.Sprintf("%s:%d", metricsAddress, metricsPort)
-		logrus.Infof("Starting the metrics server on %s", url)
-		if err := http.ListenAndServe(url, muxMetrics); err != nil {
+		if err := http.Serve(metricsListener, muxMetrics); err != nil {
 			logrus.Errorf("Error while running the metrics server: %s", err)
 			os.Exit(1)
 		}
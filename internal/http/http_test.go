@@ -0,0 +1,50 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api-token")
+	token, err := Token(path)
+	assert.Nil(t, err)
+	assert.Len(t, token, 64)
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The existing token is kept
+	again, err := Token(path)
+	assert.Nil(t, err)
+	assert.Equal(t, token, again)
+}
+
+func TestAuthorized(t *testing.T) {
+	handler := authorized("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(method, authorization string) int {
+		req := httptest.NewRequest(method, "/pin?commit=abc", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, ""))
+	assert.Equal(t, http.StatusUnauthorized, serve(http.MethodPost, ""))
+	assert.Equal(t, http.StatusUnauthorized, serve(http.MethodPost, "Bearer wrong"))
+	assert.Equal(t, http.StatusUnauthorized, serve(http.MethodDelete, "secret"))
+	assert.Equal(t, http.StatusOK, serve(http.MethodPost, "Bearer secret"))
+
+	// Without token, no request can modify the state
+	handler = authorized("", handler)
+	assert.Equal(t, http.StatusUnauthorized, serve(http.MethodPost, "Bearer "))
+}
@@ -0,0 +1,105 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// journalSocket is the socket of the native protocol of journald
+var journalSocket = "/run/systemd/journal/socket"
+
+// journaldHook sends the log entries to journald with the native
+// protocol: the fields of the entries and the context fields are sent
+// as journal fields prefixed by COMIN_, such as COMIN_COMMIT.
+type journaldHook struct {
+	conn *net.UnixConn
+}
+
+func newJournaldHook() (*journaldHook, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to journald: %s", err)
+	}
+	return &journaldHook{conn: conn}, nil
+}
+
+func (h *journaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// priority returns the syslog priority of the logrus level
+func priority(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel:
+		return 0
+	case logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	}
+	return 7
+}
+
+// journalFieldName returns the journal field name of a log field:
+// upper case letters, digits and underscores, prefixed by COMIN_
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'):
+			return r
+		}
+		return '_'
+	}, key)
+	return "COMIN_" + name
+}
+
+// writeField writes a field with the native protocol. Values
+// containing a newline are written with their size.
+func writeField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// message returns the datagram of the entry e
+func (h *journaldHook) message(e *logrus.Entry) []byte {
+	var buf bytes.Buffer
+	writeField(&buf, "MESSAGE", e.Message)
+	writeField(&buf, "PRIORITY", fmt.Sprintf("%d", priority(e.Level)))
+	writeField(&buf, "SYSLOG_IDENTIFIER", "comin")
+	fields := logrus.Fields{}
+	hook.mu.Lock()
+	for k, v := range hook.fields {
+		fields[k] = v
+	}
+	hook.mu.Unlock()
+	for k, v := range e.Data {
+		fields[k] = v
+	}
+	for k, v := range fields {
+		writeField(&buf, journalFieldName(k), fmt.Sprint(v))
+	}
+	return buf.Bytes()
+}
+
+func (h *journaldHook) Fire(e *logrus.Entry) error {
+	_, err := h.conn.Write(h.message(e))
+	return err
+}
@@ -0,0 +1,56 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalFieldName(t *testing.T) {
+	assert.Equal(t, "COMIN_DEPLOYMENT_ID", journalFieldName(FieldDeploymentId))
+	assert.Equal(t, "COMIN_COMMIT", journalFieldName(FieldCommit))
+	assert.Equal(t, "COMIN_REMOTE_NAME", journalFieldName("remote-name"))
+}
+
+func TestWriteField(t *testing.T) {
+	var buf bytes.Buffer
+	writeField(&buf, "MESSAGE", "hello")
+	assert.Equal(t, "MESSAGE=hello\n", buf.String())
+
+	buf.Reset()
+	writeField(&buf, "MESSAGE", "a\nb")
+	expected := bytes.NewBufferString("MESSAGE\n")
+	binary.Write(expected, binary.LittleEndian, uint64(3))
+	expected.WriteString("a\nb\n")
+	assert.Equal(t, expected.Bytes(), buf.Bytes())
+}
+
+func TestJournaldHook(t *testing.T) {
+	journalSocket = filepath.Join(t.TempDir(), "socket")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	h, err := newJournaldHook()
+	assert.Nil(t, err)
+	SetDeployment("g1", "d1", "abcd")
+	defer SetDeployment("", "", "")
+	err = h.Fire(&logrus.Entry{Message: "Deploying", Level: logrus.ErrorLevel, Data: logrus.Fields{"remote": "origin"}})
+	assert.Nil(t, err)
+
+	buf := make([]byte, 4096)
+	n, err := listener.Read(buf)
+	assert.Nil(t, err)
+	msg := string(buf[:n])
+	assert.Contains(t, msg, "MESSAGE=Deploying\n")
+	assert.Contains(t, msg, "PRIORITY=3\n")
+	assert.Contains(t, msg, "SYSLOG_IDENTIFIER=comin\n")
+	assert.Contains(t, msg, "COMIN_DEPLOYMENT_ID=d1\n")
+	assert.Contains(t, msg, "COMIN_COMMIT=abcd\n")
+	assert.Contains(t, msg, "COMIN_REMOTE=origin\n")
+}
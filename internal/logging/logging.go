@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The fields added to the log entries in the JSON and journald formats
+const (
+	FieldHostname     = "hostname"
+	FieldGenerationId = "generation_id"
+	FieldDeploymentId = "deployment_id"
+	FieldCommit       = "commit"
+)
+
+// fieldsHook adds the context fields to all log entries. Fields set
+// by the log call are not overridden.
+type fieldsHook struct {
+	mu     sync.Mutex
+	fields logrus.Fields
+}
+
+var hook = &fieldsHook{fields: logrus.Fields{}}
+var hookOnce sync.Once
+
+func (h *fieldsHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *fieldsHook) Fire(e *logrus.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for k, v := range h.fields {
+		if _, ok := e.Data[k]; !ok {
+			e.Data[k] = v
+		}
+	}
+	return nil
+}
+
+// SetFormat sets the format of the logs: "text", "json" or
+// "journald". In the JSON format, the context fields are added to all
+// log entries. In the journald format, the logs are sent to journald
+// with the context fields instead of being written to stderr.
+func SetFormat(format string) error {
+	switch format {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+		hookOnce.Do(func() {
+			logrus.AddHook(hook)
+		})
+	case "journald":
+		h, err := newJournaldHook()
+		if err != nil {
+			return err
+		}
+		logrus.AddHook(h)
+		logrus.SetOutput(io.Discard)
+	default:
+		return fmt.Errorf("The log format '%s' is not supported (it should be 'text', 'json' or 'journald')", format)
+	}
+	return nil
+}
+
+// SetField sets the context field key. An empty value removes it.
+func SetField(key, value string) {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	if value == "" {
+		delete(hook.fields, key)
+	} else {
+		hook.fields[key] = value
+	}
+}
+
+// SetDeployment sets the context fields of the generation and the
+// deployment being run. Empty values remove them.
+func SetDeployment(generationId, deploymentId, commit string) {
+	SetField(FieldGenerationId, generationId)
+	SetField(FieldDeploymentId, deploymentId)
+	SetField(FieldCommit, commit)
+}
@@ -0,0 +1,40 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJsonFormat(t *testing.T) {
+	var out bytes.Buffer
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(&out)
+	defer SetFormat("text")
+
+	assert.NotNil(t, SetFormat("xml"))
+	assert.Nil(t, SetFormat("json"))
+	SetField(FieldHostname, "machine")
+	SetDeployment("g1", "d1", "abcd")
+	logrus.WithField(FieldCommit, "efgh").Info("Deploying")
+
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &entry))
+	assert.Equal(t, "Deploying", entry["msg"])
+	assert.Equal(t, "machine", entry[FieldHostname])
+	assert.Equal(t, "g1", entry[FieldGenerationId])
+	assert.Equal(t, "d1", entry[FieldDeploymentId])
+	// Fields of the log call are not overridden
+	assert.Equal(t, "efgh", entry[FieldCommit])
+
+	out.Reset()
+	SetDeployment("", "", "")
+	logrus.Info("Idle")
+	entry = map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &entry))
+	assert.Equal(t, "machine", entry[FieldHostname])
+	assert.NotContains(t, entry, FieldDeploymentId)
+}
@@ -0,0 +1,186 @@
+package logs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+)
+
+// Logs stores the logs of generations (evaluation, build and
+// deployment outputs) in files named by the generation UUID. Old
+// files are removed to keep at most MaxFiles files and MaxSize bytes.
+type Logs struct {
+	config types.Logs
+}
+
+type Log struct {
+	Id      string `json:"id"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"`
+}
+
+func New(config types.Logs) Logs {
+	return Logs{
+		config: config,
+	}
+}
+
+func (l Logs) path(id string) (string, error) {
+	if id == "" || filepath.Base(id) != id || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("The log id '%s' is not valid", id)
+	}
+	return filepath.Join(l.config.Dir, id+".log"), nil
+}
+
+// Create creates the log file of the id and rotates old log
+// files. It returns a nil writer when logs are not persisted.
+func (l Logs) Create(id string) (io.WriteCloser, error) {
+	if l.config.Dir == "" {
+		return nil, nil
+	}
+	path, err := l.path(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(l.config.Dir, 0750); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.rotate(id); err != nil {
+		logrus.Errorf("Failed to rotate log files: %s", err)
+	}
+	return f, nil
+}
+
+// Read returns the content of the log file of the id.
+func (l Logs) Read(id string) ([]byte, error) {
+	path, err := l.path(id)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// Remove removes the log file of the id. It is not an error if it
+// doesn't exist.
+func (l Logs) Remove(id string) error {
+	if l.config.Dir == "" {
+		return nil
+	}
+	path, err := l.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns the log files, sorted from the most recent to the
+// oldest one.
+func (l Logs) List() (logs []Log, err error) {
+	if l.config.Dir == "" {
+		return
+	}
+	entries, err := os.ReadDir(l.config.Dir)
+	if os.IsNotExist(err) {
+		return logs, nil
+	} else if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".log") || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return logs, err
+		}
+		logs = append(logs, Log{
+			Id:      strings.TrimSuffix(entry.Name(), ".log"),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+		})
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].ModTime > logs[j].ModTime
+	})
+	return
+}
+
+// Find returns the id of the log of logs starting with the prefix. An
+// error is returned when no log or several logs match.
+func Find(logs []Log, prefix string) (string, error) {
+	id := ""
+	for _, log := range logs {
+		if log.Id == prefix {
+			return log.Id, nil
+		}
+		if strings.HasPrefix(log.Id, prefix) {
+			if id != "" {
+				return "", fmt.Errorf("Several logs start with '%s'", prefix)
+			}
+			id = log.Id
+		}
+	}
+	if id == "" {
+		return "", fmt.Errorf("No log starts with '%s'", prefix)
+	}
+	return id, nil
+}
+
+// rotate removes the oldest log files to keep at most MaxFiles files
+// and MaxSize bytes. The log file of the current id is never removed.
+func (l Logs) rotate(current string) error {
+	_, err := l.prune(current, false)
+	return err
+}
+
+// Prune removes the oldest log files exceeding MaxFiles files or
+// MaxSize bytes, like the rotation done when a log file is created,
+// and returns the removed log files. The most recent log file is never
+// removed. When dryRun is true, log files are not removed.
+func (l Logs) Prune(dryRun bool) ([]Log, error) {
+	logs, err := l.List()
+	if err != nil || len(logs) == 0 {
+		return nil, err
+	}
+	return l.prune(logs[0].Id, dryRun)
+}
+
+func (l Logs) prune(current string, dryRun bool) (removed []Log, err error) {
+	logs, err := l.List()
+	if err != nil {
+		return
+	}
+	var size int64
+	count := 0
+	for _, log := range logs {
+		if log.Id == current {
+			continue
+		}
+		count += 1
+		size += log.Size
+		if (l.config.MaxFiles != 0 && count >= l.config.MaxFiles) || (l.config.MaxSize != 0 && size > l.config.MaxSize) {
+			path, _ := l.path(log.Id)
+			if !dryRun {
+				logrus.Debugf("Removing the log file '%s'", path)
+				if err = os.Remove(path); err != nil {
+					return
+				}
+			}
+			removed = append(removed, log)
+		}
+	}
+	return
+}
@@ -0,0 +1,102 @@
+package logs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	l := New(types.Logs{Dir: dir, MaxFiles: 3})
+	now := time.Now()
+	for i, id := range []string{"g1", "g2", "g3", "g4"} {
+		f, err := l.Create(id)
+		assert.Nil(t, err)
+		f.Write([]byte(id))
+		f.Close()
+		// Files are sorted by modification time
+		mtime := now.Add(time.Duration(i) * time.Second)
+		os.Chtimes(filepath.Join(dir, id+".log"), mtime, mtime)
+	}
+	logs, err := l.List()
+	assert.Nil(t, err)
+	assert.Len(t, logs, 3)
+	assert.Equal(t, "g4", logs[0].Id)
+	assert.Equal(t, "g2", logs[2].Id)
+
+	content, err := l.Read("g4")
+	assert.Nil(t, err)
+	assert.Equal(t, "g4", string(content))
+
+	_, err = l.Read("../state")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, l.Remove("g4"))
+	_, err = l.Read("g4")
+	assert.NotNil(t, err)
+	// Removing a missing log is not an error
+	assert.Nil(t, l.Remove("g4"))
+}
+
+func TestRotationSize(t *testing.T) {
+	dir := t.TempDir()
+	l := New(types.Logs{Dir: dir, MaxSize: 5})
+	now := time.Now()
+	for i, id := range []string{"g1", "g2", "g3"} {
+		f, _ := l.Create(id)
+		f.Write([]byte("abc"))
+		f.Close()
+		mtime := now.Add(time.Duration(i) * time.Second)
+		os.Chtimes(filepath.Join(dir, id+".log"), mtime, mtime)
+	}
+	logs, _ := l.List()
+	assert.Len(t, logs, 2)
+	assert.Equal(t, "g3", logs[0].Id)
+	assert.Equal(t, "g2", logs[1].Id)
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for i, id := range []string{"g1", "g2", "g3"} {
+		os.WriteFile(filepath.Join(dir, id+".log"), []byte(id), 0640)
+		mtime := now.Add(time.Duration(i) * time.Second)
+		os.Chtimes(filepath.Join(dir, id+".log"), mtime, mtime)
+	}
+	l := New(types.Logs{Dir: dir, MaxFiles: 2})
+	removed, err := l.Prune(true)
+	assert.Nil(t, err)
+	assert.Len(t, removed, 1)
+	assert.Equal(t, "g1", removed[0].Id)
+	logs, _ := l.List()
+	assert.Len(t, logs, 3)
+
+	removed, err = l.Prune(false)
+	assert.Nil(t, err)
+	assert.Len(t, removed, 1)
+	logs, _ = l.List()
+	assert.Len(t, logs, 2)
+	assert.Equal(t, "g3", logs[0].Id)
+}
+
+func TestFind(t *testing.T) {
+	logs := []Log{{Id: "3f2a-1"}, {Id: "3f2b-2"}, {Id: "3f2b"}}
+	id, err := Find(logs, "3f2a")
+	assert.Nil(t, err)
+	assert.Equal(t, "3f2a-1", id)
+
+	id, err = Find(logs, "3f2b")
+	assert.Nil(t, err)
+	assert.Equal(t, "3f2b", id)
+
+	_, err = Find(logs, "3f2")
+	assert.ErrorContains(t, err, "Several logs")
+
+	_, err = Find(logs, "4")
+	assert.ErrorContains(t, err, "No log")
+}
@@ -0,0 +1,56 @@
+package manager
+
+import (
+	"github.com/nlewo/comin/internal/deployment"
+	"github.com/nlewo/comin/internal/events"
+)
+
+// Subscribe returns a channel receiving the lifecycle events of the
+// deployments and a function to unsubscribe.
+func (m Manager) Subscribe() (<-chan events.Event, func()) {
+	return m.events.Subscribe()
+}
+
+// Handle registers the handler h of the lifecycle events of the
+// deployments. Unlike subscribers, it receives all events and comin
+// waits for it before restarting.
+func (m Manager) Handle(h events.Handler) {
+	m.events.Handle(h)
+}
+
+// publishGeneration publishes an event of the current generation
+func (m Manager) publishGeneration(t events.Type, err error) {
+	g := m.generation
+	e := events.Event{
+		Type:           t,
+		GenerationUUID: m.generation.UUID,
+		CommitId:       m.generation.SelectedCommitId,
+		Generation:     &g,
+	}
+	if err != nil {
+		e.ErrorMsg = err.Error()
+	}
+	m.events.Publish(e)
+}
+
+// publishDeployment publishes an event of the current deployment
+func (m Manager) publishDeployment(t events.Type) {
+	d := m.deployment
+	m.events.Publish(events.Event{
+		Type:           t,
+		GenerationUUID: m.deployment.Generation.UUID,
+		DeploymentUUID: m.deployment.UUID,
+		CommitId:       m.deployment.Generation.SelectedCommitId,
+		ErrorMsg:       m.deployment.ErrorMsg,
+		Deployment:     &d,
+	})
+}
+
+// deploymentEventType returns the event type of a terminated
+// deployment
+func deploymentEventType(d deployment.Deployment) events.Type {
+	if d.Status == deployment.Done {
+		return events.Done
+	}
+	return events.Failed
+}
@@ -0,0 +1,36 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// recordFailure counts a failed evaluation, build or deployment in the
+// current failure streak
+func (m Manager) recordFailure() Manager {
+	if m.consecutiveFailures == 0 {
+		m.failingSince = m.nowFunc()
+	}
+	m.consecutiveFailures++
+	m.prometheus.SetConsecutiveFailures(m.consecutiveFailures, m.failingSince)
+	m.writeTextfile()
+	return m
+}
+
+// recordSuccess ends the current failure streak
+func (m Manager) recordSuccess() Manager {
+	m.consecutiveFailures = 0
+	m.failingSince = time.Time{}
+	m.prometheus.SetConsecutiveFailures(0, m.failingSince)
+	m.writeTextfile()
+	return m
+}
+
+// writeTextfile writes the metrics to the textfile, so that the
+// failures of evaluations and builds are also exported
+func (m Manager) writeTextfile() {
+	if err := m.prometheus.WriteTextfile(); err != nil {
+		logrus.Errorf("Failed to write the metrics to the textfile: %s", err)
+	}
+}
@@ -0,0 +1,34 @@
+package manager
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// WithFastForwardOnly returns a manager requiring an approval to
+// deploy a commit which is not a descendant of the deployed commit,
+// for instance because the branch has been rebased or force pushed or
+// because another branch is selected.
+func (m Manager) WithFastForwardOnly(enable bool) Manager {
+	m.fastForwardOnly = enable
+	return m
+}
+
+// checkFastForward requires an approval for the current generation if
+// its commit is not a descendant of the deployed commit. The deployed
+// commit is restored from the state file when comin starts: it is
+// only unknown until a first commit has been deployed.
+func (m Manager) checkFastForward() Manager {
+	if !m.fastForwardOnly || m.deployedCommitId == "" || m.generation.SelectedCommitId == m.deployedCommitId {
+		return m
+	}
+	ok, err := m.repository.IsAncestor(m.deployedCommitId, m.generation.SelectedCommitId)
+	if err != nil {
+		logrus.Errorf("Failed to check if the commit %s is a descendant of the deployed commit %s: %s", m.generation.SelectedCommitId, m.deployedCommitId, err)
+	}
+	if err != nil || !ok {
+		logrus.Infof("The commit %s is not a descendant of the deployed commit %s: it has to be approved", m.generation.SelectedCommitId, m.deployedCommitId)
+		m.generation.NotFastForward = true
+		m.generation.SelectedBranchRequireApproval = true
+	}
+	return m
+}
@@ -0,0 +1,72 @@
+package manager
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/nlewo/comin/internal/repository"
+	"github.com/sirupsen/logrus"
+)
+
+// WithPathFilters only deploys commits changing at least one file
+// matching one of these globs. In a glob, ** matches any number of
+// directories while * and ? don't match the path separator.
+func (m Manager) WithPathFilters(filters []string) Manager {
+	for _, filter := range filters {
+		m.pathFilters = append(m.pathFilters, globToRegexp(filter))
+	}
+	return m
+}
+
+func globToRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i += 1
+		case glob[i] == '*':
+			b.WriteString("[^/]*")
+		case glob[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// hasRelevantChanges returns false when none of the files changed
+// between the commit of the current generation and the selected
+// commit matches a path filter. A commit selected from another branch
+// or deployed with another operation is always relevant: a commit
+// promoted from the testing branch to the main branch has to be
+// deployed to get a boot entry, even if its tree didn't change.
+func (m Manager) hasRelevantChanges(rs repository.RepositoryStatus) bool {
+	if len(m.pathFilters) == 0 || m.generation.SelectedCommitId == "" {
+		return true
+	}
+	if rs.SelectedBranchIsTesting != m.generation.SelectedBranchIsTesting ||
+		rs.SelectedBranchName != m.generation.SelectedBranchName ||
+		rs.SelectedBranchOperation != m.generation.SelectedBranchOperation {
+		return true
+	}
+	paths, err := m.repository.ChangedFiles(m.generation.SelectedCommitId, rs.SelectedCommitId)
+	if err != nil {
+		logrus.Errorf("Failed to get the files changed between %s and %s: %s", m.generation.SelectedCommitId, rs.SelectedCommitId, err)
+		return true
+	}
+	for _, path := range paths {
+		for _, filter := range m.pathFilters {
+			if filter.MatchString(path) {
+				return true
+			}
+		}
+	}
+	return false
+}
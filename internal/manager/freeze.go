@@ -0,0 +1,69 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nlewo/comin/internal/utils"
+)
+
+// FreezeInfo describes who froze deployments and why
+type FreezeInfo struct {
+	By     string    `json:"by"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// WithFreezeFile returns a manager which doesn't deploy generations
+// while the file path exists.
+func (m Manager) WithFreezeFile(path string) Manager {
+	m.freezeFilepath = path
+	return m
+}
+
+// freezeInfo returns nil when deployments are not frozen. The fields
+// are empty when the freeze file has been created by hand.
+func (m Manager) freezeInfo() *FreezeInfo {
+	if m.freezeFilepath == "" {
+		return nil
+	}
+	content, err := os.ReadFile(m.freezeFilepath)
+	if err != nil {
+		return nil
+	}
+	var info FreezeInfo
+	_ = json.Unmarshal(content, &info)
+	return &info
+}
+
+func (m Manager) isFrozen() bool {
+	return m.freezeInfo() != nil
+}
+
+// Freeze prevents generations from being deployed, while they are
+// still fetched and built. This survives comin restarts. The user who
+// froze deployments and the reason are reported in the state.
+func (m Manager) Freeze(by, reason string) error {
+	if m.freezeFilepath == "" {
+		return fmt.Errorf("The freeze file is not configured")
+	}
+	content, err := json.Marshal(FreezeInfo{By: by, Reason: reason, At: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(m.freezeFilepath, content, 0644)
+}
+
+// Unfreeze allows generations to be deployed again. A built
+// generation waiting for deployments to be unfrozen is deployed.
+func (m Manager) Unfreeze() error {
+	if m.freezeFilepath == "" {
+		return fmt.Errorf("The freeze file is not configured")
+	}
+	if err := os.Remove(m.freezeFilepath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package manager
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type GcFunc func(ctx context.Context, deleteOlderThan string) error
+
+// CollectGarbage requests a garbage collection. The garbage
+// collection never runs concurrently with a fetch, an evaluation, a
+// build or a deployment: if the manager is running, it is postponed
+// until the manager is idle.
+func (m Manager) CollectGarbage(deleteOlderThan string) {
+	m.triggerGcCh <- deleteOlderThan
+}
+
+func (m Manager) onTriggerGc(ctx context.Context, deleteOlderThan string) Manager {
+	if m.isCollectingGarbage {
+		logrus.Debugf("The manager is already collecting the garbage")
+		return m
+	}
+	m.gcPending = true
+	m.gcDeleteOlderThan = deleteOlderThan
+	if m.isRunning {
+		logrus.Infof("The garbage collection is postponed since the manager is running")
+	}
+	return m
+}
+
+func (m Manager) startGc(ctx context.Context) Manager {
+	m.gcPending = false
+	// This prevents the manager from fetching while collecting
+	m.isRunning = true
+	m.isCollectingGarbage = true
+	deleteOlderThan := m.gcDeleteOlderThan
+	go func() {
+		m.gcResultCh <- m.gcFunc(ctx, deleteOlderThan)
+	}()
+	return m
+}
+
+func (m Manager) onGc(ctx context.Context, err error) Manager {
+	if err != nil {
+		logrus.Errorf("The garbage collection failed: %s", err)
+	} else {
+		m.garbageCollectedAt = time.Now()
+	}
+	m.isCollectingGarbage = false
+	m.isRunning = false
+	return m
+}
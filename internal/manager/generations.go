@@ -0,0 +1,41 @@
+package manager
+
+import (
+	"github.com/nlewo/comin/internal/deployment"
+	"github.com/sirupsen/logrus"
+)
+
+// The number of system generations kept in the state
+const systemGenerationsMax = 20
+
+// SystemGeneration maps a generation of the system profile to the
+// commit it has been built from.
+type SystemGeneration struct {
+	Number   int    `json:"number"`
+	CommitId string `json:"commit_id"`
+	OutPath  string `json:"outpath"`
+}
+
+// recordSystemGeneration records the system profile generation
+// created by the deployment d. The most recent generation is first.
+func (m Manager) recordSystemGeneration(d deployment.Deployment) Manager {
+	number, err := m.profileGenerationFunc()
+	if err != nil {
+		logrus.Errorf("Failed to get the generation of the system profile: %s", err)
+		return m
+	}
+	g := SystemGeneration{
+		Number:   number,
+		CommitId: d.Generation.SelectedCommitId,
+		OutPath:  d.Generation.OutPath,
+	}
+	logrus.Infof("The commit %s is deployed as the system generation %d", g.CommitId, g.Number)
+	generations := []SystemGeneration{g}
+	for _, sg := range m.systemGenerations {
+		if sg.Number != g.Number && len(generations) < systemGenerationsMax {
+			generations = append(generations, sg)
+		}
+	}
+	m.systemGenerations = generations
+	return m
+}
@@ -0,0 +1,26 @@
+package manager
+
+import (
+	"fmt"
+
+	"github.com/nlewo/comin/internal/history"
+)
+
+// Deployment returns the deployment uuid: the current deployment, which
+// is not in the history while it is running, or a deployment of the
+// history
+func (m Manager) Deployment(uuid string) (history.Entry, error) {
+	if d := m.GetState().Deployment; uuid != "" && d.UUID == uuid {
+		return history.NewEntry(d), nil
+	}
+	entries, err := m.history.Read()
+	if err != nil {
+		return history.Entry{}, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].UUID == uuid {
+			return entries[i], nil
+		}
+	}
+	return history.Entry{}, fmt.Errorf("The deployment %s doesn't exist", uuid)
+}
@@ -0,0 +1,43 @@
+package manager
+
+import (
+	"context"
+
+	"github.com/nlewo/comin/internal/nix"
+	"github.com/nlewo/comin/internal/repository"
+)
+
+// inputsChanged returns true if the commit of a repository overriding
+// an input of the flake differs from the commit used by the current
+// generation.
+func (m Manager) inputsChanged(rs repository.RepositoryStatus) bool {
+	// Nothing can be deployed until a commit has been selected
+	if rs.SelectedCommitId == "" {
+		return false
+	}
+	commitIds := rs.InputCommitIds()
+	if len(commitIds) != len(m.generation.InputCommitIds) {
+		return true
+	}
+	for name, commitId := range commitIds {
+		if m.generation.InputCommitIds[name] != commitId {
+			return true
+		}
+	}
+	return false
+}
+
+// inputsContext returns a context where the flake inputs are
+// overridden by the fetched commits of their repositories.
+func (m Manager) inputsContext(ctx context.Context, rs repository.RepositoryStatus) context.Context {
+	inputs := make(map[string]string)
+	for _, input := range rs.Inputs {
+		if input.CommitId != "" {
+			inputs[input.Name] = nix.InputUrl(input.Path, input.CommitId)
+		}
+	}
+	if len(inputs) == 0 {
+		return ctx
+	}
+	return nix.WithInputs(ctx, inputs)
+}
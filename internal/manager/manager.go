@@ -3,13 +3,28 @@ package manager
 import (
 	"context"
 	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/nlewo/comin/internal/attestation"
+	"github.com/nlewo/comin/internal/audit"
 	"github.com/nlewo/comin/internal/deployment"
+	"github.com/nlewo/comin/internal/events"
 	"github.com/nlewo/comin/internal/generation"
+	"github.com/nlewo/comin/internal/health"
+	"github.com/nlewo/comin/internal/history"
+	"github.com/nlewo/comin/internal/hooks"
+	"github.com/nlewo/comin/internal/logging"
+	"github.com/nlewo/comin/internal/logs"
 	"github.com/nlewo/comin/internal/nix"
 	"github.com/nlewo/comin/internal/prometheus"
 	"github.com/nlewo/comin/internal/repository"
+	"github.com/nlewo/comin/internal/rollback"
+	"github.com/nlewo/comin/internal/types"
 	"github.com/nlewo/comin/internal/utils"
+	"github.com/nlewo/comin/internal/window"
 	"github.com/sirupsen/logrus"
 )
 
@@ -20,16 +35,71 @@ type State struct {
 	IsRunning        bool                  `json:"is_running"`
 	Deployment       deployment.Deployment `json:"deployment"`
 	Hostname         string                `json:"hostname"`
+	// Is nix-collect-garbage currently running
+	IsCollectingGarbage bool      `json:"is_collecting_garbage"`
+	GarbageCollectedAt  time.Time `json:"garbage_collected_at"`
+	// The built generation is waiting for a deployment window
+	IsWaitingForWindow bool `json:"is_waiting_for_window"`
+	// Deployments are frozen: generations are built but not
+	// deployed
+	IsFrozen             bool `json:"is_frozen"`
+	IsWaitingForUnfreeze bool `json:"is_waiting_for_unfreeze"`
+	// Who froze deployments and why
+	Freeze *FreezeInfo `json:"freeze,omitempty"`
+	// The built generation is waiting for an operator approval
+	IsWaitingForApproval bool `json:"is_waiting_for_approval"`
+	// The machine has to be rebooted to run the deployed kernel,
+	// initrd or systemd
+	RebootNeeded bool `json:"reboot_needed"`
+	// The machine is going to be rebooted at RebootScheduledAt
+	IsRebootScheduled bool      `json:"is_reboot_scheduled"`
+	RebootScheduledAt time.Time `json:"reboot_scheduled_at"`
+	// The last selected commit has not been deployed since its
+	// message contains a skip marker or it doesn't change files
+	// matching the path filters
+	SkippedCommitId string    `json:"skipped_commit_id"`
+	SkippedAt       time.Time `json:"skipped_at"`
+	SkippedReason   string    `json:"skipped_reason"`
+	// The fetch request started once the manager is idle
+	PendingFetch *FetchRequest `json:"pending_fetch,omitempty"`
+	// The last pending fetch requests replaced by a more recent
+	// request
+	SupersededFetches []SupersededFetch `json:"superseded_fetches,omitempty"`
+	// The IDs of the last fetch requests which didn't select a new
+	// commit to deploy
+	UnchangedFetchIds []string `json:"unchanged_fetch_ids,omitempty"`
+	// The last rollback requested by an operator
+	ManualRollback *ManualRollback `json:"manual_rollback,omitempty"`
+	// The generations of the system profile created by comin, the
+	// most recent first
+	SystemGenerations []SystemGeneration `json:"system_generations"`
+	// The last deployment has been aborted because it exceeded the
+	// deployment timeout
+	IsTimedOut bool `json:"is_timed_out"`
+	// The ID of the last started fetch request
+	FetchId string `json:"fetch_id"`
+	// The number of evaluations, builds or deployments which
+	// failed in a row since FailingSince. It is reset by a
+	// successful deployment.
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	FailingSince        time.Time `json:"failing_since"`
+}
+
+type approveRequest struct {
+	uuid  string
+	errCh chan error
 }
 
 type Manager struct {
 	repository repository.Repository
 	// FIXME: a generation should get a repository URL from the repository status
 	repositoryPath string
-	hostname       string
+	// nix is used to get the URL of the nix source to evaluate
+	nix      nix.Nix
+	hostname string
 	// The machine id of the current host
 	machineId         string
-	triggerRepository chan string
+	triggerRepository chan fetchRequest
 	generationFactory func(repository.RepositoryStatus, string, string) generation.Generation
 	stateRequestCh    chan struct{}
 	stateResultCh     chan State
@@ -37,6 +107,12 @@ type Manager struct {
 	// The generation currently managed
 	generation generation.Generation
 	isFetching bool
+	// The fetch request received while the manager was running
+	pendingFetch      *FetchRequest
+	supersededFetches []SupersededFetch
+	unchangedFetchIds []string
+	// True when the last fetch failed to reach all fetched remotes
+	isUnreachable bool
 	// FIXME: this is temporary in order to simplify the manager
 	// for a first iteration: this needs to be removed
 	isRunning               bool
@@ -48,25 +124,137 @@ type Manager struct {
 
 	deploymentResultCh chan deployment.DeploymentResult
 	// The deployment currenly managed
-	deployment   deployment.Deployment
-	deployerFunc deployment.DeployFunc
+	deployment      deployment.Deployment
+	deployerFunc    deployment.DeployFunc
+	closureDiffFunc deployment.ClosureDiffFunc
+	closureSizeFunc deployment.ClosureSizeFunc
+	// The health check functions are nil when no health check is
+	// configured
+	healthCheckFunc deployment.HealthCheckFunc
+	currentFunc     deployment.CurrentFunc
+	rollbackFunc    deployment.RollbackFunc
+	preHookFunc     deployment.HookFunc
+	postHookFunc    deployment.HookFunc
 
 	repositoryStatusCh  chan repository.RepositoryStatus
 	triggerDeploymentCh chan generation.Generation
 
 	prometheus prometheus.Prometheus
+
+	logs logs.Logs
+	// The log file of the generation currently managed
+	logFile io.WriteCloser
+
+	gcFunc      GcFunc
+	triggerGcCh chan string
+	gcResultCh  chan error
+	// A garbage collection has been requested while the manager
+	// was running: it is started once the manager is idle
+	gcPending           bool
+	gcDeleteOlderThan   string
+	isCollectingGarbage bool
+	garbageCollectedAt  time.Time
+
+	windows window.Windows
+	// The period between two checks of the deployment windows
+	windowCheckPeriod  time.Duration
+	isWaitingForWindow bool
+	// The file freezing deployments when it exists
+	freezeFilepath       string
+	isWaitingForUnfreeze bool
+	nowFunc              func() time.Time
+
+	approveCh            chan approveRequest
+	isWaitingForApproval bool
+	// The generation approved while the manager was running: it is
+	// deployed once the manager is idle
+	pendingApproval string
+
+	rebootNeededFunc func() (bool, error)
+	rebootNeeded     bool
+
+	autoReboot         types.AutoReboot
+	rebootWindows      window.Windows
+	scheduleRebootFunc func(delay int, message string) error
+	cancelRebootFunc   func() error
+	cancelRebootCh     chan chan error
+	isRebootScheduled  bool
+	rebootScheduledAt  time.Time
+	// The scheduled reboot has been canceled by an operator: it
+	// is not scheduled again until a new deployment
+	isRebootCanceled bool
+
+	skippedCommitId string
+	skippedAt       time.Time
+	skippedReason   string
+
+	rollbackCh         chan rollbackRequest
+	rollbackResultCh   chan error
+	manualRollback     *ManualRollback
+	rollbackTargetFunc func(target string) (string, error)
+	manualRollbackFunc deployment.RollbackFunc
+
+	profileGenerationFunc func() (int, error)
+	systemGenerations     []SystemGeneration
+
+	// The file containing the commit deployments are pinned to
+	pinFilepath string
+
+	specialisationFunc func(outPath, specialisation string) (string, error)
+
+	deploymentTimeout time.Duration
+	// The context of the deployment of the current commit
+	pipelineCtx    context.Context
+	cancelPipeline context.CancelFunc
+	isTimedOut     bool
+
+	// Commits which don't change files matching these filters are
+	// not deployed
+	pathFilters []*regexp.Regexp
+
+	reloadCh chan reloadRequest
+	// The reload received while the manager was fetching
+	pendingReload *reloadRequest
+
+	// Commits which are not descendants of the deployed commit
+	// have to be approved
+	fastForwardOnly bool
+	// The commit of the last successful deployment
+	deployedCommitId string
+
+	// The finished deployments are recorded in the history
+	history history.History
+	// The deployments and the rollbacks are recorded in the audit
+	// log
+	audit audit.Log
+	// The ID of the last started fetch request
+	fetchId string
+	// The file where the state is stored to be restored after a
+	// restart
+	stateFilepath string
+	// The lifecycle events of deployments are published on this
+	// bus
+	events *events.Bus
+	// The current failure streak
+	consecutiveFailures int
+	failingSince        time.Time
 }
 
-func New(r repository.Repository, p prometheus.Prometheus, path, hostname, machineId string) Manager {
-	return Manager{
+func New(r repository.Repository, p prometheus.Prometheus, n nix.Nix, l logs.Logs, h health.Health, path, hostname, machineId string) Manager {
+	m := Manager{
+		logs:                    l,
 		repository:              r,
 		repositoryPath:          path,
+		nix:                     n,
 		hostname:                hostname,
 		machineId:               machineId,
-		evalFunc:                nix.Eval,
-		buildFunc:               nix.Build,
-		deployerFunc:            nix.Deploy,
-		triggerRepository:       make(chan string),
+		evalFunc:                n.Eval,
+		buildFunc:               n.Realize,
+		deployerFunc:            n.Deploy,
+		closureDiffFunc:         n.ClosureDiff,
+		closureSizeFunc:         n.ClosureSize,
+		events:                  events.New(),
+		triggerRepository:       make(chan fetchRequest),
 		stateRequestCh:          make(chan struct{}),
 		stateResultCh:           make(chan State),
 		cominServiceRestartFunc: utils.CominServiceRestart,
@@ -74,7 +262,81 @@ func New(r repository.Repository, p prometheus.Prometheus, path, hostname, machi
 		repositoryStatusCh:      make(chan repository.RepositoryStatus),
 		triggerDeploymentCh:     make(chan generation.Generation, 1),
 		prometheus:              p,
+		gcFunc:                  nix.CollectGarbage,
+		triggerGcCh:             make(chan string),
+		gcResultCh:              make(chan error),
+		windowCheckPeriod:       time.Minute,
+		approveCh:               make(chan approveRequest),
+		rebootNeededFunc:        n.RebootNeeded,
+		scheduleRebootFunc:      utils.ScheduleReboot,
+		cancelRebootFunc:        utils.CancelReboot,
+		cancelRebootCh:          make(chan chan error),
+		nowFunc:                 time.Now,
+		rollbackCh:              make(chan rollbackRequest),
+		rollbackResultCh:        make(chan error),
+		reloadCh:                make(chan reloadRequest),
+		rollbackTargetFunc:      n.ResolveRollbackTarget,
+		manualRollbackFunc:      n.Rollback,
+		profileGenerationFunc:   n.CurrentProfileGeneration,
+		specialisationFunc:      nix.SpecialisationOutPath,
+	}
+	if h.Enabled() {
+		m.healthCheckFunc = h.Check
+		m.currentFunc = n.CurrentSystem
+		m.rollbackFunc = n.Rollback
 	}
+	return m
+}
+
+// WithMagicRollback returns a manager arming a rollback timer before
+// each deployment.
+func (m Manager) WithMagicRollback(r rollback.Rollback) Manager {
+	m.deployerFunc = r.Wrap(m.deployerFunc)
+	return m
+}
+
+// WithTpmAttestation returns a manager only activating the
+// configurations once the TPM proved it holds their declared key. It
+// has to be called after WithMagicRollback to attest before the
+// rollback timer is armed.
+func (m Manager) WithTpmAttestation(a attestation.Attestation) Manager {
+	m.deployerFunc = a.Wrap(m.deployerFunc)
+	return m
+}
+
+// WithHooks returns a manager running hooks around deployments.
+func (m Manager) WithHooks(h hooks.Hooks) Manager {
+	m.preHookFunc = h.PreDeployment
+	m.postHookFunc = h.PostDeployment
+	return m
+}
+
+// WithCominServiceRestart returns a manager restarting the comin
+// service with f when a deployment modified its unit file.
+func (m Manager) WithCominServiceRestart(f func() error) Manager {
+	m.cominServiceRestartFunc = f
+	return m
+}
+
+// WithDeploymentWindows returns a manager only deploying generations
+// during the deployment windows of their operation.
+func (m Manager) WithDeploymentWindows(w window.Windows) Manager {
+	m.windows = w
+	return m
+}
+
+// WithHistory returns a manager recording finished deployments in
+// the history.
+func (m Manager) WithHistory(h history.History) Manager {
+	m.history = h
+	return m
+}
+
+// WithAuditLog returns a manager recording the deployments and the
+// rollbacks in the audit log.
+func (m Manager) WithAuditLog(l audit.Log) Manager {
+	m.audit = l
+	return m
 }
 
 func (m Manager) GetState() State {
@@ -82,8 +344,20 @@ func (m Manager) GetState() State {
 	return <-m.stateResultCh
 }
 
-func (m Manager) Fetch(remote string) {
-	m.triggerRepository <- remote
+// Fetch requests a fetch of the remote. If the manager is running,
+// the request is queued and started once the manager is idle.
+func (m Manager) Fetch(remote string) FetchRequest {
+	resultCh := make(chan FetchRequest)
+	m.triggerRepository <- fetchRequest{remote: remote, resultCh: resultCh}
+	return <-resultCh
+}
+
+// Approve approves the deployment of the generation uuid, which is
+// waiting for an approval.
+func (m Manager) Approve(uuid string) error {
+	errCh := make(chan error)
+	m.approveCh <- approveRequest{uuid: uuid, errCh: errCh}
+	return <-errCh
 }
 
 func (m Manager) toState() State {
@@ -94,48 +368,244 @@ func (m Manager) toState() State {
 		IsRunning:        m.isRunning,
 		Deployment:       m.deployment,
 		Hostname:         m.hostname,
+
+		IsCollectingGarbage:  m.isCollectingGarbage,
+		GarbageCollectedAt:   m.garbageCollectedAt,
+		IsWaitingForWindow:   m.isWaitingForWindow,
+		IsFrozen:             m.isFrozen(),
+		Freeze:               m.freezeInfo(),
+		IsWaitingForUnfreeze: m.isWaitingForUnfreeze,
+
+		IsWaitingForApproval: m.isWaitingForApproval,
+		RebootNeeded:         m.rebootNeeded,
+		IsRebootScheduled:    m.isRebootScheduled,
+		RebootScheduledAt:    m.rebootScheduledAt,
+
+		SkippedCommitId:   m.skippedCommitId,
+		SkippedAt:         m.skippedAt,
+		SkippedReason:     m.skippedReason,
+		PendingFetch:      m.pendingFetch,
+		SupersededFetches: m.supersededFetches,
+		UnchangedFetchIds: m.unchangedFetchIds,
+		ManualRollback:    m.manualRollback,
+
+		SystemGenerations: m.systemGenerations,
+		IsTimedOut:        m.isTimedOut,
+		FetchId:           m.fetchId,
+
+		ConsecutiveFailures: m.consecutiveFailures,
+		FailingSince:        m.failingSince,
 	}
 }
 
 func (m Manager) onEvaluated(ctx context.Context, evalResult generation.EvalResult) Manager {
 	m.generation = m.generation.UpdateEval(evalResult)
 	if evalResult.Err == nil {
-		m.generation = m.generation.Build(ctx)
+		m.generation = m.generation.Build(m.pipelineContext(ctx))
+		m.publishGeneration(events.Building, nil)
 	} else {
+		m.publishGeneration(events.Failed, evalResult.Err)
+		logging.SetDeployment("", "", "")
+		m = m.recordFailure()
+		m.storeState()
+		m = m.checkTimeout()
 		m.isRunning = false
 	}
 	return m
 }
 
 func (m Manager) onBuilt(ctx context.Context, buildResult generation.BuildResult) Manager {
+	// The specialisation is activated instead of the configuration
+	if buildResult.Err == nil && m.generation.Specialisation != "" {
+		outPath, err := m.specialisationFunc(m.generation.OutPath, m.generation.Specialisation)
+		if err != nil {
+			buildResult.Err = err
+		} else {
+			logrus.Infof("The specialisation '%s' (%s) is activated", m.generation.Specialisation, outPath)
+			m.generation.OutPath = outPath
+		}
+	}
 	m.generation = m.generation.UpdateBuild(buildResult)
 	if buildResult.Err == nil {
-		m.triggerDeployment(ctx, m.generation)
+		if m.generation.SelectedBranchRequireApproval {
+			// The manager is idle in order to let a newer
+			// commit replace this generation
+			logrus.Infof("The generation %s is waiting for an approval", m.generation.UUID)
+			m.isWaitingForApproval = true
+			m.isRunning = false
+			return m
+		}
+		m = m.deployIfAllowed(ctx)
 	} else {
+		m.publishGeneration(events.Failed, buildResult.Err)
+		logging.SetDeployment("", "", "")
+		m = m.recordFailure()
+		m.storeState()
+		m = m.checkTimeout()
 		m.isRunning = false
 	}
 	return m
 }
 
+// deployIfAllowed deploys the current generation if deployments are
+// not frozen and the deployment window of its operation is open.
+func (m Manager) deployIfAllowed(ctx context.Context) Manager {
+	if m.isFrozen() {
+		logrus.Infof("Deployments are frozen: the deployment is postponed until deployments are unfrozen")
+		m.isWaitingForUnfreeze = true
+		m.isRunning = false
+		return m
+	}
+	operation := deployment.Operation(m.generation)
+	if !m.windows.IsAllowed(operation, m.nowFunc()) {
+		// The manager is idle in order to let a newer commit
+		// replace this generation
+		logrus.Infof("The %s operation is not allowed now: the deployment is postponed to the next deployment window", operation)
+		m.isWaitingForWindow = true
+		m.isRunning = false
+		return m
+	}
+	m.triggerDeployment(ctx, m.generation)
+	return m
+}
+
+func (m Manager) onApprove(ctx context.Context, r approveRequest) Manager {
+	if !m.isWaitingForApproval || m.generation.UUID != r.uuid {
+		r.errCh <- fmt.Errorf("The generation %s is not waiting for an approval", r.uuid)
+		return m
+	}
+	r.errCh <- nil
+	// A fetch or a garbage collection is running: the deployment
+	// can't be started in parallel
+	if m.isRunning {
+		logrus.Infof("The generation %s has been approved: it is deployed once the manager is idle", r.uuid)
+		m.pendingApproval = r.uuid
+		return m
+	}
+	logrus.Infof("The generation %s has been approved", r.uuid)
+	return m.deployApproved(ctx)
+}
+
+// startPendingApproval deploys the generation approved while the
+// manager was running, unless a newer generation replaced it.
+func (m Manager) startPendingApproval(ctx context.Context) Manager {
+	uuid := m.pendingApproval
+	m.pendingApproval = ""
+	if !m.isWaitingForApproval || m.generation.UUID != uuid {
+		logrus.Infof("The approved generation %s has been replaced: it is not deployed", uuid)
+		return m
+	}
+	return m.deployApproved(ctx)
+}
+
+func (m Manager) deployApproved(ctx context.Context) Manager {
+	m.isWaitingForApproval = false
+	m.isRunning = true
+	m = m.startPipeline(ctx)
+	return m.deployIfAllowed(ctx)
+}
+
+// onWindowCheck deploys the generation waiting for a deployment window
+// or for deployments to be unfrozen once it is allowed.
+func (m Manager) onWindowCheck(ctx context.Context) Manager {
+	if !(m.isWaitingForWindow || m.isWaitingForUnfreeze) || m.isRunning {
+		return m
+	}
+	if m.isFrozen() || !m.windows.IsAllowed(deployment.Operation(m.generation), m.nowFunc()) {
+		return m
+	}
+	logrus.Infof("The deployment is now allowed: deploying the generation %s", m.generation.UUID)
+	m.isWaitingForWindow = false
+	m.isWaitingForUnfreeze = false
+	m.isRunning = true
+	m = m.startPipeline(ctx)
+	m.triggerDeployment(ctx, m.generation)
+	return m
+}
+
 func (m Manager) triggerDeployment(ctx context.Context, g generation.Generation) {
 	m.triggerDeploymentCh <- g
 }
 
 func (m Manager) onTriggerDeployment(ctx context.Context, g generation.Generation) Manager {
-	m.deployment = deployment.New(g, m.deployerFunc, m.deploymentResultCh)
-	m.deployment = m.deployment.Deploy(ctx)
+	m.deployment = deployment.New(g, m.deployerFunc, m.closureDiffFunc, m.deploymentResultCh)
+	logging.SetDeployment(g.UUID, m.deployment.UUID, g.SelectedCommitId)
+	if m.healthCheckFunc != nil {
+		m.deployment = m.deployment.WithHealthCheck(m.healthCheckFunc, m.currentFunc, m.rollbackFunc)
+	}
+	m.deployment = m.deployment.WithHooks(m.preHookFunc, m.postHookFunc)
+	m.deployment = m.deployment.WithClosureSize(m.closureSizeFunc)
+	m.deployment = m.deployment.Deploy(m.pipelineContext(ctx))
+	m.publishDeployment(events.Switching)
 	return m
 }
 
 func (m Manager) onDeployment(ctx context.Context, deploymentResult deployment.DeploymentResult) Manager {
 	logrus.Debugf("Deploy done with %#v", deploymentResult)
 	m.deployment = m.deployment.Update(deploymentResult)
+	if m.deployment.Status == deployment.Failed {
+		m = m.recordFailure()
+		m = m.checkTimeout()
+	} else {
+		m = m.recordSuccess()
+	}
 	// The comin service is not restart by the switch-to-configuration script in order to let comin terminating properly. Instead, comin restarts itself.
 	if m.deployment.RestartComin {
 		m.needToBeRestarted = true
 	}
+	// The dry-activate operation doesn't activate the configuration
+	if m.deployment.Status == deployment.Done && m.deployment.Operation != "dry-activate" {
+		if err := m.nix.CreateGcRoot(m.deployment.Generation.SelectedCommitId, m.deployment.Generation.OutPath); err != nil {
+			logrus.Errorf("Failed to create the gcroot: %s", err)
+		}
+		m.deployedCommitId = m.deployment.Generation.SelectedCommitId
+	}
+	if m.deployment.Operation == "switch" || m.deployment.Operation == "boot" {
+		if m.deployment.Status == deployment.Done {
+			m = m.recordSystemGeneration(m.deployment)
+		}
+		m = m.updateRebootNeeded()
+		m.isRebootCanceled = false
+		m.deployment.RebootNeeded = m.rebootNeeded
+	}
+	if err := m.audit.Append(m.audit.NewDeploymentEntry(m.hostname, m.deployment)); err != nil {
+		logrus.Errorf("Failed to record the deployment in the audit log: %s", err)
+	}
+	removed, err := m.history.Append(history.NewEntry(m.deployment))
+	if err != nil {
+		logrus.Errorf("Failed to record the deployment in the history: %s", err)
+	}
+	// The logs of the deployments removed from the history are
+	// removed
+	for _, e := range removed {
+		if e.GenerationUUID == "" || e.GenerationUUID == m.generation.UUID {
+			continue
+		}
+		if err := m.logs.Remove(e.GenerationUUID); err != nil {
+			logrus.Errorf("Failed to remove the logs of the generation %s: %s", e.GenerationUUID, err)
+		}
+	}
+	m.storeState()
+	m.publishDeployment(deploymentEventType(m.deployment))
+	logging.SetDeployment("", "", "")
 	m.isRunning = false
 	m.prometheus.SetDeploymentInfo(m.deployment.Generation.SelectedCommitId, deployment.StatusToString(m.deployment.Status))
+	m.prometheus.SetDeploymentTimestamps(m.deployment.StartAt, m.deployment.EndAt)
+	m.writeTextfile()
+	return m
+}
+
+func (m Manager) updateRebootNeeded() Manager {
+	rebootNeeded, err := m.rebootNeededFunc()
+	if err != nil {
+		logrus.Errorf("Failed to detect if a reboot is needed: %s", err)
+		return m
+	}
+	if rebootNeeded && !m.rebootNeeded {
+		logrus.Infof("The machine has to be rebooted to run the deployed kernel, initrd or systemd")
+	}
+	m.rebootNeeded = rebootNeeded
+	m.prometheus.SetRebootNeeded(rebootNeeded)
 	return m
 }
 
@@ -143,6 +613,11 @@ func (m Manager) onRepositoryStatus(ctx context.Context, rs repository.Repositor
 	logrus.Debugf("Fetch done with %#v", rs)
 	m.isFetching = false
 	m.repositoryStatus = rs
+	m.events.Publish(events.Event{
+		Type:     events.Fetched,
+		CommitId: rs.SelectedCommitId,
+		ErrorMsg: rs.ErrorMsg,
+	})
 
 	for _, r := range rs.Remotes {
 		if r.LastFetched {
@@ -154,18 +629,80 @@ func (m Manager) onRepositoryStatus(ctx context.Context, rs repository.Repositor
 		}
 	}
 
-	if rs.SelectedCommitId == m.generation.SelectedCommitId && rs.SelectedBranchIsTesting == m.generation.SelectedBranchIsTesting {
+	var reconnected bool
+	m, reconnected = m.updateReachability(rs)
+	inputsChanged := m.inputsChanged(rs)
+	sameCommit := rs.SelectedCommitId == m.generation.SelectedCommitId && rs.SelectedBranchIsTesting == m.generation.SelectedBranchIsTesting
+	unresolvedInputs := rs.UnresolvedInputs()
+	if sameCommit && !inputsChanged && reconnected && m.isOfflineBuildPending() {
+		m = m.retryOfflineBuild(ctx)
+	} else if sameCommit && !inputsChanged {
 		logrus.Debugf("The repository status is the same than the previous one")
 		m.isRunning = false
+		m = m.recordUnchangedFetch()
+	} else if len(unresolvedInputs) > 0 {
+		// The flake.lock revision of an overridden input is never
+		// deployed
+		logrus.Errorf("The commit %s is not evaluated: the inputs %s have not been fetched yet", rs.SelectedCommitId, strings.Join(unresolvedInputs, ", "))
+		m.isRunning = false
+		m = m.recordUnchangedFetch()
+	} else if !sameCommit && hasSkipMarker(rs.SelectedCommitMsg) {
+		m = m.skipCommit(rs, "its message contains a skip marker")
+		m = m.recordUnchangedFetch()
+	} else if !inputsChanged && !m.hasRelevantChanges(rs) {
+		m = m.skipCommit(rs, "no relevant changes")
+		m = m.recordUnchangedFetch()
 	} else {
+		m.skippedCommitId = ""
 		// g.Stop(): this is required once we remove m.IsRunning
-		flakeUrl := fmt.Sprintf("git+file://%s?rev=%s", m.repositoryPath, m.repositoryStatus.SelectedCommitId)
+		flakeUrl := m.nix.Url(m.repositoryPath, m.repositoryStatus.SelectedCommitId)
+		if rs.SelectedPath != "" {
+			flakeUrl = m.nix.PathUrl(rs.SelectedPath)
+		}
 		m.generation = generation.New(rs, flakeUrl, m.hostname, m.machineId, m.evalFunc, m.buildFunc)
-		m.generation = m.generation.Eval(ctx)
+		m.generation.FetchId = m.fetchId
+		// A generation waiting for a deployment window or an
+		// approval is replaced
+		m.isWaitingForWindow = false
+		m.isWaitingForUnfreeze = false
+		m.isWaitingForApproval = false
+		m.generation.Impure = m.nix.Impure()
+		m = m.checkFastForward()
+		m = m.openLogFile()
+		logging.SetDeployment(m.generation.UUID, "", m.generation.SelectedCommitId)
+		m.generation = m.generation.Eval(m.inputsContext(m.pipelineContext(ctx), rs))
+		m.publishGeneration(events.Evaluating, nil)
+	}
+	return m
+}
+
+// openLogFile closes the log file of the previous generation and
+// opens the log file of the current generation. The previous
+// generation is no longer running since a new generation is only
+// created when the manager is idle.
+func (m Manager) openLogFile() Manager {
+	if m.logFile != nil {
+		m.logFile.Close()
+		m.logFile = nil
+	}
+	f, err := m.logs.Create(m.generation.UUID)
+	if err != nil {
+		logrus.Errorf("Failed to create the log file of the generation %s: %s", m.generation.UUID, err)
+		return m
 	}
+	m.logFile = f
 	return m
 }
 
+// withLogFile returns a context where nix commands outputs are
+// written to the log file of the current generation.
+func (m Manager) withLogFile(ctx context.Context) context.Context {
+	if m.logFile == nil {
+		return ctx
+	}
+	return nix.WithOutput(ctx, m.logFile)
+}
+
 func (m Manager) onTriggerRepository(ctx context.Context, remoteName string) Manager {
 	if m.isFetching {
 		logrus.Debugf("The manager is already fetching the repository")
@@ -179,7 +716,8 @@ func (m Manager) onTriggerRepository(ctx context.Context, remoteName string) Man
 	logrus.Debugf("Trigger fetch and update remote %s", remoteName)
 	m.isRunning = true
 	m.isFetching = true
-	m.repositoryStatusCh = m.repository.FetchAndUpdate(ctx, remoteName)
+	m = m.startPipeline(ctx)
+	m.repositoryStatusCh = m.repository.FetchAndUpdate(m.pipelineContext(ctx), remoteName)
 	return m
 }
 
@@ -190,12 +728,15 @@ func (m Manager) Run() {
 	logrus.Infof("  hostname = %s", m.hostname)
 	logrus.Infof("  machineId = %s", m.machineId)
 	logrus.Infof("  repositoryPath = %s", m.repositoryPath)
+	m = m.updateRebootNeeded()
+	windowTicker := time.NewTicker(m.windowCheckPeriod)
+	defer windowTicker.Stop()
 	for {
 		select {
 		case <-m.stateRequestCh:
 			m.stateResultCh <- m.toState()
-		case remoteName := <-m.triggerRepository:
-			m = m.onTriggerRepository(ctx, remoteName)
+		case r := <-m.triggerRepository:
+			m = m.onFetchRequest(ctx, r)
 		case rs := <-m.repositoryStatusCh:
 			m = m.onRepositoryStatus(ctx, rs)
 		case evalResult := <-m.generation.EvalCh():
@@ -206,8 +747,40 @@ func (m Manager) Run() {
 			m = m.onTriggerDeployment(ctx, generation)
 		case deploymentResult := <-m.deploymentResultCh:
 			m = m.onDeployment(ctx, deploymentResult)
+		case deleteOlderThan := <-m.triggerGcCh:
+			m = m.onTriggerGc(ctx, deleteOlderThan)
+		case err := <-m.gcResultCh:
+			m = m.onGc(ctx, err)
+		case <-windowTicker.C:
+			m = m.onWindowCheck(ctx)
+		case r := <-m.approveCh:
+			m = m.onApprove(ctx, r)
+		case errCh := <-m.cancelRebootCh:
+			m = m.onCancelReboot(ctx, errCh)
+		case r := <-m.rollbackCh:
+			m = m.onRollback(ctx, r)
+		case err := <-m.rollbackResultCh:
+			m = m.onRollbackResult(ctx, err)
+		case r := <-m.reloadCh:
+			m = m.onReload(ctx, r)
+		}
+		m = m.checkReboot(ctx)
+		if m.gcPending && !m.isRunning {
+			m = m.startGc(ctx)
+		}
+		if m.pendingReload != nil && !m.isFetching {
+			m = m.startPendingReload(ctx)
+		}
+		if m.pendingApproval != "" && !m.isRunning {
+			m = m.startPendingApproval(ctx)
+		}
+		if m.pendingFetch != nil && !m.isRunning {
+			m = m.startPendingFetch(ctx)
 		}
 		if m.needToBeRestarted {
+			// The result of the deployment is notified and
+			// reported before comin is stopped
+			m.events.Wait(time.Minute)
 			// TODO: stop contexts
 			if err := m.cominServiceRestartFunc(); err != nil {
 				logrus.Fatal(err)
@@ -2,12 +2,25 @@ package manager
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/nlewo/comin/internal/audit"
 	"github.com/nlewo/comin/internal/deployment"
+	"github.com/nlewo/comin/internal/events"
+	"github.com/nlewo/comin/internal/generation"
+	"github.com/nlewo/comin/internal/health"
+	"github.com/nlewo/comin/internal/history"
+	"github.com/nlewo/comin/internal/logs"
+	"github.com/nlewo/comin/internal/nix"
 	"github.com/nlewo/comin/internal/prometheus"
 	"github.com/nlewo/comin/internal/repository"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/nlewo/comin/internal/window"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -17,7 +30,10 @@ type metricsMock struct{}
 func (m metricsMock) SetDeploymentInfo(commitId, status string) {}
 
 type repositoryMock struct {
-	rsCh chan repository.RepositoryStatus
+	rsCh         chan repository.RepositoryStatus
+	changedFiles []string
+	remotes      []types.Remote
+	isAncestor   bool
 }
 
 func newRepositoryMock() (r *repositoryMock) {
@@ -29,29 +45,66 @@ func newRepositoryMock() (r *repositoryMock) {
 func (r *repositoryMock) FetchAndUpdate(ctx context.Context, remoteName string) (rsCh chan repository.RepositoryStatus) {
 	return r.rsCh
 }
+func (r *repositoryMock) ChangedFiles(from, to string) ([]string, error) {
+	return r.changedFiles, nil
+}
+func (r *repositoryMock) IsAncestor(base, top string) (bool, error) {
+	return r.isAncestor, nil
+}
+func (r *repositoryMock) Reload(remotes []types.Remote) error {
+	r.remotes = remotes
+	return nil
+}
+
+// newTestManager returns a manager whose evaluations, builds and
+// deployments succeed. Tests override the functions they check.
+func newTestManager(t *testing.T, r repository.Repository) Manager {
+	t.Helper()
+	m := New(r, prometheus.New(), nix.New(types.Nix{}), logs.New(types.Logs{}), health.New(types.HealthChecks{}), "", "", "")
+	m.evalFunc = func(ctx context.Context, repositoryPath string, hostname string) (string, string, string, string, error) {
+		return "drv-path", "out-path", "", "", nil
+	}
+	m.buildFunc = func(ctx context.Context, drvPath string, outPath string) (bool, error) {
+		return false, nil
+	}
+	m.deployerFunc = func(context.Context, string, string, string) (bool, string, error) {
+		return false, "", nil
+	}
+	m.closureDiffFunc = func(context.Context, string) (string, error) {
+		return "", nil
+	}
+	return m
+}
 
 func TestRun(t *testing.T) {
 	logrus.SetLevel(logrus.DebugLevel)
 	r := newRepositoryMock()
-	m := New(r, prometheus.New(), "", "", "")
+	m := New(r, prometheus.New(), nix.New(types.Nix{}), logs.New(types.Logs{}), health.New(types.HealthChecks{}), "", "", "")
 
 	evalDone := make(chan struct{})
 	buildDone := make(chan struct{})
-	nixEvalMock := func(ctx context.Context, repositoryPath string, hostname string) (string, string, string, error) {
+	nixEvalMock := func(ctx context.Context, repositoryPath string, hostname string) (string, string, string, string, error) {
 		<-evalDone
-		return "drv-path", "out-path", "", nil
+		return "drv-path", "out-path", "", "", nil
 	}
-	nixBuildMock := func(ctx context.Context, drvPath string) error {
+	nixBuildMock := func(ctx context.Context, drvPath string, outPath string) (bool, error) {
 		<-buildDone
-		return nil
+		return false, nil
 	}
 	m.evalFunc = nixEvalMock
 	m.buildFunc = nixBuildMock
 
-	deployFunc := func(context.Context, string, string, string) (bool, error) {
-		return false, nil
+	deployFunc := func(context.Context, string, string, string) (bool, string, error) {
+		return false, "", nil
 	}
 	m.deployerFunc = deployFunc
+	closureDiffFunc := func(context.Context, string) (string, error) {
+		return "closure-diff", nil
+	}
+	m.closureDiffFunc = closureDiffFunc
+	m.closureSizeFunc = func(context.Context, string) (int64, error) {
+		return 1024, nil
+	}
 
 	go m.Run()
 
@@ -88,28 +141,98 @@ func TestRun(t *testing.T) {
 	assert.EventuallyWithT(t, func(c *assert.CollectT) {
 		assert.NotEmpty(c, m.GetState().Deployment.EndAt)
 	}, 5*time.Second, 100*time.Millisecond, "deployment is not finished")
+	assert.Equal(t, "closure-diff", m.GetState().Deployment.ClosureDiff)
+	assert.Equal(t, int64(1024), m.GetState().Deployment.ClosureSize)
+	assert.False(t, m.GetState().Deployment.SwitchEndAt.IsZero())
+}
+
+func TestReload(t *testing.T) {
+	r := newRepositoryMock()
+	m := New(r, prometheus.New(), nix.New(types.Nix{}), logs.New(types.Logs{}), health.New(types.HealthChecks{}), "", "", "machine-id")
+	go m.Run()
 
+	remotes := []types.Remote{{Name: "origin", URL: "https://example.org/new.git"}}
+	m.Fetch("origin")
+	reloaded := make(chan error)
+	go func() {
+		reloaded <- m.Reload(remotes)
+	}()
+	// The reload is postponed until the end of the fetch
+	select {
+	case <-reloaded:
+		t.Fatal("the remotes have been reloaded while fetching")
+	case <-time.After(100 * time.Millisecond):
+	}
+	r.rsCh <- repository.RepositoryStatus{}
+	assert.Nil(t, <-reloaded)
+	assert.Equal(t, remotes, r.remotes)
+
+	// The new remotes are then fetched
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.True(c, m.GetState().IsFetching)
+		assert.Nil(c, m.GetState().PendingFetch)
+	}, 5*time.Second, 100*time.Millisecond)
 }
 
 func TestFetchBusy(t *testing.T) {
 	logrus.SetLevel(logrus.DebugLevel)
 	r := newRepositoryMock()
-	m := New(r, prometheus.New(), "", "", "machine-id")
+	m := New(r, prometheus.New(), nix.New(types.Nix{}), logs.New(types.Logs{}), health.New(types.HealthChecks{}), "", "", "machine-id")
 	go m.Run()
 
 	assert.Equal(t, State{}, m.GetState())
 
-	m.Fetch("origin")
+	req := m.Fetch("origin")
+	assert.Equal(t, 0, req.Position)
+	assert.Equal(t, req.ID, m.GetState().FetchId)
 	assert.Equal(t, repository.RepositoryStatus{}, m.GetState().RepositoryStatus)
 
-	m.Fetch("origin")
+	// Fetch requests received while fetching are queued: only the
+	// latest one is kept
+	pending := m.Fetch("origin")
+	assert.Equal(t, 1, pending.Position)
+	assert.NotEqual(t, req.ID, pending.ID)
+	assert.Equal(t, &pending, m.GetState().PendingFetch)
+	latest := m.Fetch("origin")
+	assert.NotEqual(t, pending.ID, latest.ID)
+	assert.Equal(t, 1, latest.Position)
+	assert.Equal(t, "origin", latest.Remote)
+	assert.Equal(t, &latest, m.GetState().PendingFetch)
+	assert.Equal(t, []SupersededFetch{{ID: pending.ID, SupersededBy: latest.ID}}, m.GetState().SupersededFetches)
 	assert.Equal(t, repository.RepositoryStatus{}, m.GetState().RepositoryStatus)
+
+	// A request of another remote supersedes it by fetching all
+	// remotes
+	all := m.Fetch("local")
+	assert.Equal(t, 1, all.Position)
+	assert.Equal(t, "", all.Remote)
+	assert.Equal(t, &all, m.GetState().PendingFetch)
+	assert.Equal(t, []SupersededFetch{
+		{ID: pending.ID, SupersededBy: latest.ID},
+		{ID: latest.ID, SupersededBy: all.ID},
+	}, m.GetState().SupersededFetches)
+
+	// The pending request is started once the manager is idle, and
+	// the requests without new commit are completed
+	r.rsCh <- repository.RepositoryStatus{}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.True(c, m.GetState().IsFetching)
+		assert.Equal(c, all.ID, m.GetState().FetchId)
+		assert.Equal(c, []string{req.ID}, m.GetState().UnchangedFetchIds)
+	}, 5*time.Second, 10*time.Millisecond, "the pending fetch is not started")
+	assert.Nil(t, m.GetState().PendingFetch)
+
+	r.rsCh <- repository.RepositoryStatus{}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.False(c, m.GetState().IsFetching)
+		assert.Equal(c, []string{req.ID, all.ID}, m.GetState().UnchangedFetchIds)
+	}, 5*time.Second, 10*time.Millisecond, "the fetch requests are not completed")
 }
 
 func TestRestartComin(t *testing.T) {
 	logrus.SetLevel(logrus.DebugLevel)
 	r := newRepositoryMock()
-	m := New(r, prometheus.New(), "", "", "machine-id")
+	m := New(r, prometheus.New(), nix.New(types.Nix{}), logs.New(types.Logs{}), health.New(types.HealthChecks{}), "", "", "machine-id")
 	dCh := make(chan deployment.DeploymentResult)
 	m.deploymentResultCh = dCh
 	isCominRestarted := false
@@ -131,19 +254,19 @@ func TestRestartComin(t *testing.T) {
 func TestOptionnalMachineId(t *testing.T) {
 	logrus.SetLevel(logrus.DebugLevel)
 	r := newRepositoryMock()
-	m := New(r, prometheus.New(), "", "", "the-test-machine-id")
+	m := New(r, prometheus.New(), nix.New(types.Nix{}), logs.New(types.Logs{}), health.New(types.HealthChecks{}), "", "", "the-test-machine-id")
 
 	evalDone := make(chan struct{})
 	buildDone := make(chan struct{})
-	nixEvalMock := func(ctx context.Context, repositoryPath string, hostname string) (string, string, string, error) {
+	nixEvalMock := func(ctx context.Context, repositoryPath string, hostname string) (string, string, string, string, error) {
 		<-evalDone
 		// When comin.machineId is empty, comin evaluates it as an empty string
 		evaluatedMachineId := ""
-		return "drv-path", "out-path", evaluatedMachineId, nil
+		return "drv-path", "out-path", evaluatedMachineId, "", nil
 	}
-	nixBuildMock := func(ctx context.Context, drvPath string) error {
+	nixBuildMock := func(ctx context.Context, drvPath string, outPath string) (bool, error) {
 		<-buildDone
-		return nil
+		return false, nil
 	}
 	m.evalFunc = nixEvalMock
 	m.buildFunc = nixBuildMock
@@ -163,17 +286,17 @@ func TestOptionnalMachineId(t *testing.T) {
 func TestIncorrectMachineId(t *testing.T) {
 	logrus.SetLevel(logrus.DebugLevel)
 	r := newRepositoryMock()
-	m := New(r, prometheus.New(), "", "", "the-test-machine-id")
+	m := New(r, prometheus.New(), nix.New(types.Nix{}), logs.New(types.Logs{}), health.New(types.HealthChecks{}), "", "", "the-test-machine-id")
 
 	evalDone := make(chan struct{})
 	buildDone := make(chan struct{})
-	nixEvalMock := func(ctx context.Context, repositoryPath string, hostname string) (string, string, string, error) {
+	nixEvalMock := func(ctx context.Context, repositoryPath string, hostname string) (string, string, string, string, error) {
 		<-evalDone
-		return "drv-path", "out-path", "incorrect-machine-id", nil
+		return "drv-path", "out-path", "incorrect-machine-id", "", nil
 	}
-	nixBuildMock := func(ctx context.Context, drvPath string) error {
+	nixBuildMock := func(ctx context.Context, drvPath string, outPath string) (bool, error) {
 		<-buildDone
-		return nil
+		return false, nil
 	}
 	m.evalFunc = nixEvalMock
 	m.buildFunc = nixBuildMock
@@ -197,3 +320,758 @@ func TestIncorrectMachineId(t *testing.T) {
 		assert.False(t, m.GetState().IsRunning)
 	}, 5*time.Second, 100*time.Millisecond, "evaluation is not finished")
 }
+
+func TestGcPostponed(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	r := newRepositoryMock()
+	m := New(r, prometheus.New(), nix.New(types.Nix{}), logs.New(types.Logs{}), health.New(types.HealthChecks{}), "", "", "")
+	gcDone := make(chan struct{})
+	gcDeleteOlderThan := ""
+	m.gcFunc = func(ctx context.Context, deleteOlderThan string) error {
+		gcDeleteOlderThan = deleteOlderThan
+		<-gcDone
+		return nil
+	}
+	go m.Run()
+
+	// The garbage collection is postponed while the manager is running
+	m.Fetch("origin")
+	m.CollectGarbage("30d")
+	assert.False(t, m.GetState().IsCollectingGarbage)
+
+	// The repository status is the same: the manager is now idle
+	r.rsCh <- repository.RepositoryStatus{}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.True(c, m.GetState().IsCollectingGarbage)
+	}, 5*time.Second, 100*time.Millisecond, "the garbage collection is not started")
+
+	// Fetches are queued while collecting the garbage
+	m.Fetch("origin")
+	assert.False(t, m.GetState().IsFetching)
+
+	close(gcDone)
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.False(c, m.GetState().IsCollectingGarbage)
+		assert.NotEmpty(c, m.GetState().GarbageCollectedAt)
+	}, 5*time.Second, 100*time.Millisecond, "the garbage collection is not finished")
+	assert.Equal(t, "30d", gcDeleteOlderThan)
+}
+
+func TestDeploymentWindow(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	r := newRepositoryMock()
+	m := newTestManager(t, r)
+	w, _ := window.New([]types.DeploymentWindow{{Operations: []string{"switch"}, Start: "02:00", End: "05:00"}})
+	m = m.WithDeploymentWindows(w)
+	m.windowCheckPeriod = 10 * time.Millisecond
+
+	var mu sync.Mutex
+	now, _ := time.Parse("15:04", "12:00")
+	m.nowFunc = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	go m.Run()
+
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "foo"}
+
+	// The built generation waits for the deployment window
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.True(c, m.GetState().IsWaitingForWindow)
+		assert.False(c, m.GetState().IsRunning)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not postponed")
+	assert.Empty(t, m.GetState().Deployment.UUID)
+
+	// The deployment window opens
+	mu.Lock()
+	now, _ = time.Parse("15:04", "03:00")
+	mu.Unlock()
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.False(c, m.GetState().IsWaitingForWindow)
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+}
+
+func TestApproval(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	r := newRepositoryMock()
+	m := newTestManager(t, r)
+	go m.Run()
+
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "foo", SelectedBranchRequireApproval: true}
+
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.True(c, m.GetState().IsWaitingForApproval)
+		assert.False(c, m.GetState().IsRunning)
+	}, 5*time.Second, 10*time.Millisecond, "the generation is not waiting for an approval")
+	assert.Empty(t, m.GetState().Deployment.UUID)
+
+	assert.NotNil(t, m.Approve("unknown-uuid"))
+	assert.Nil(t, m.Approve(m.GetState().Generation.UUID))
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.False(c, m.GetState().IsWaitingForApproval)
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+}
+
+func TestApprovalWhileFetching(t *testing.T) {
+	r := newRepositoryMock()
+	m := newTestManager(t, r)
+	go m.Run()
+
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "foo", SelectedBranchRequireApproval: true}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.True(c, m.GetState().IsWaitingForApproval)
+		assert.False(c, m.GetState().IsRunning)
+	}, 5*time.Second, 10*time.Millisecond, "the generation is not waiting for an approval")
+	uuid := m.GetState().Generation.UUID
+
+	// The approval received while fetching is postponed
+	m.Fetch("origin")
+	assert.Nil(t, m.Approve(uuid))
+	state := m.GetState()
+	assert.True(t, state.IsFetching)
+	assert.True(t, state.IsWaitingForApproval)
+	assert.Empty(t, state.Deployment.UUID)
+
+	// The approved generation is deployed once the fetch is done
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "foo", SelectedBranchRequireApproval: true}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+	assert.Equal(t, uuid, m.GetState().Deployment.Generation.UUID)
+
+	// An approved generation replaced by the fetch is not deployed
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "bar", SelectedBranchRequireApproval: true}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.True(c, m.GetState().IsWaitingForApproval)
+		assert.False(c, m.GetState().IsRunning)
+	}, 5*time.Second, 10*time.Millisecond, "the generation is not waiting for an approval")
+	uuid = m.GetState().Generation.UUID
+	m.Fetch("origin")
+	assert.Nil(t, m.Approve(uuid))
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "baz", SelectedBranchRequireApproval: true}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.True(c, m.GetState().IsWaitingForApproval)
+		assert.NotEqual(c, uuid, m.GetState().Generation.UUID)
+		assert.False(c, m.GetState().IsRunning)
+	}, 5*time.Second, 10*time.Millisecond, "the generation is not replaced")
+	assert.NotEqual(t, uuid, m.GetState().Deployment.Generation.UUID)
+}
+
+func TestFastForwardOnly(t *testing.T) {
+	r := newRepositoryMock()
+	m := newTestManager(t, r)
+	m = m.WithFastForwardOnly(true)
+	go m.Run()
+
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "foo"}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+
+	// A descendant of the deployed commit is deployed
+	r.isAncestor = true
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "bar"}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, "bar", m.GetState().Deployment.Generation.SelectedCommitId)
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+
+	// A commit which is not a descendant has to be approved
+	r.isAncestor = false
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "baz"}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.True(c, m.GetState().IsWaitingForApproval)
+	}, 5*time.Second, 10*time.Millisecond, "the generation is not waiting for an approval")
+	assert.True(t, m.GetState().Generation.NotFastForward)
+	assert.Equal(t, "bar", m.GetState().Deployment.Generation.SelectedCommitId)
+
+	assert.Nil(t, m.Approve(m.GetState().Generation.UUID))
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, "baz", m.GetState().Deployment.Generation.SelectedCommitId)
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+}
+
+func TestFreeze(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	r := newRepositoryMock()
+	m := newTestManager(t, r)
+	m = m.WithFreezeFile(filepath.Join(t.TempDir(), "freeze"))
+	m.windowCheckPeriod = 10 * time.Millisecond
+	assert.Nil(t, m.Freeze("alice", "incident"))
+	go m.Run()
+
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "foo"}
+
+	// The generation is built but not deployed
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.True(c, m.GetState().IsFrozen)
+		assert.True(c, m.GetState().IsWaitingForUnfreeze)
+		assert.Equal(c, "alice", m.GetState().Freeze.By)
+		assert.Equal(c, "incident", m.GetState().Freeze.Reason)
+		assert.Equal(c, generation.BuildSucceeded, m.GetState().Generation.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the generation is not waiting for deployments to be unfrozen")
+	assert.Empty(t, m.GetState().Deployment.UUID)
+
+	assert.Nil(t, m.Unfreeze())
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.False(c, m.GetState().IsFrozen)
+		assert.Nil(c, m.GetState().Freeze)
+		assert.False(c, m.GetState().IsWaitingForUnfreeze)
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+	// Unfreezing twice is not an error
+	assert.Nil(t, m.Unfreeze())
+}
+
+func TestAutoReboot(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	r := newRepositoryMock()
+	m := New(r, prometheus.New(), nix.New(types.Nix{}), logs.New(types.Logs{}), health.New(types.HealthChecks{}), "", "", "")
+	m, err := m.WithAutoReboot(types.AutoReboot{Enable: true, Start: "02:00", End: "05:00", Delay: 5})
+	assert.Nil(t, err)
+	m.windowCheckPeriod = 10 * time.Millisecond
+
+	var mu sync.Mutex
+	now, _ := time.Parse("15:04", "12:00")
+	m.nowFunc = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	m.rebootNeededFunc = func() (bool, error) {
+		return true, nil
+	}
+	scheduled := make(chan int, 1)
+	m.scheduleRebootFunc = func(delay int, message string) error {
+		scheduled <- delay
+		return nil
+	}
+	m.cancelRebootFunc = func() error {
+		return nil
+	}
+	go m.Run()
+
+	assert.True(t, m.GetState().RebootNeeded)
+	assert.False(t, m.GetState().IsRebootScheduled)
+	assert.NotNil(t, m.CancelReboot())
+
+	// The reboot window opens
+	mu.Lock()
+	now, _ = time.Parse("15:04", "03:00")
+	mu.Unlock()
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.True(c, m.GetState().IsRebootScheduled)
+	}, 5*time.Second, 10*time.Millisecond, "the reboot is not scheduled")
+	assert.Equal(t, 5, <-scheduled)
+
+	assert.Nil(t, m.CancelReboot())
+	assert.False(t, m.GetState().IsRebootScheduled)
+	// The canceled reboot is not scheduled again
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, m.GetState().IsRebootScheduled)
+}
+
+func TestSkipMarker(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	r := newRepositoryMock()
+	m := newTestManager(t, r)
+	go m.Run()
+
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "foo", SelectedCommitMsg: "Fix a typo [comin skip]"}
+	assert.Equal(t, "foo", m.GetState().SkippedCommitId)
+	assert.False(t, m.GetState().IsRunning)
+	assert.Empty(t, m.GetState().Generation.UUID)
+
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "bar", SelectedCommitMsg: "Update nginx"}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+	assert.Empty(t, m.GetState().SkippedCommitId)
+}
+
+func TestPathFilters(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	r := newRepositoryMock()
+	m := newTestManager(t, r)
+	m = m.WithPathFilters([]string{"hosts/machine/**", "modules/**"})
+	go m.Run()
+
+	// The first commit is always deployed
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "foo"}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+
+	r.changedFiles = []string{"hosts/other/configuration.nix", "README.md"}
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "bar"}
+	assert.Equal(t, "bar", m.GetState().SkippedCommitId)
+	assert.Equal(t, "no relevant changes", m.GetState().SkippedReason)
+	assert.Equal(t, "foo", m.GetState().Generation.SelectedCommitId)
+
+	r.changedFiles = []string{"README.md", "modules/nginx/default.nix"}
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "baz"}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, "baz", m.GetState().Deployment.Generation.SelectedCommitId)
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+	assert.Empty(t, m.GetState().SkippedCommitId)
+
+	// A commit selected from another branch is deployed even if no
+	// relevant file changed
+	r.changedFiles = []string{"README.md"}
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "qux", SelectedBranchName: "testing", SelectedBranchIsTesting: true, SelectedBranchOperation: "test"}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, "qux", m.GetState().Deployment.Generation.SelectedCommitId)
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+	assert.Empty(t, m.GetState().SkippedCommitId)
+}
+
+func TestInputs(t *testing.T) {
+	r := newRepositoryMock()
+	m := newTestManager(t, r)
+	m = m.WithPathFilters([]string{"hosts/machine/**"})
+	go m.Run()
+
+	rs := func(inputCommitId string) repository.RepositoryStatus {
+		return repository.RepositoryStatus{
+			SelectedCommitId: "foo",
+			Inputs: []*repository.Input{
+				{Name: "secrets", Path: "/var/lib/comin/inputs/secrets", CommitId: inputCommitId},
+			},
+		}
+	}
+	m.Fetch("origin")
+	r.rsCh <- rs("s1")
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+	assert.Equal(t, map[string]string{"secrets": "s1"}, m.GetState().Deployment.Generation.InputCommitIds)
+	uuid := m.GetState().Generation.UUID
+
+	// The same commits are not deployed again
+	m.Fetch("origin")
+	r.rsCh <- rs("s1")
+	assert.Equal(t, uuid, m.GetState().Generation.UUID)
+
+	// A new commit of an input is deployed, even if the commit of
+	// the repository didn't change
+	m.Fetch("origin")
+	r.rsCh <- rs("s2")
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, map[string]string{"secrets": "s2"}, m.GetState().Deployment.Generation.InputCommitIds)
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+	assert.NotEqual(t, uuid, m.GetState().Generation.UUID)
+	assert.Empty(t, m.GetState().SkippedCommitId)
+	uuid = m.GetState().Generation.UUID
+
+	// A commit is not evaluated while an input has never been
+	// fetched: the flake.lock revision would be deployed
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{
+		SelectedCommitId: "bar",
+		Inputs: []*repository.Input{
+			{Name: "secrets", Path: "/var/lib/comin/inputs/secrets"},
+		},
+	}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, "bar", m.GetState().RepositoryStatus.SelectedCommitId)
+		assert.False(c, m.GetState().IsRunning)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uuid, m.GetState().Generation.UUID)
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	assert.True(t, globToRegexp("hosts/machine/**").MatchString("hosts/machine/hardware/disks.nix"))
+	assert.False(t, globToRegexp("hosts/machine/**").MatchString("hosts/machine2/default.nix"))
+	assert.True(t, globToRegexp("**/*.nix").MatchString("flake.nix"))
+	assert.True(t, globToRegexp("**/*.nix").MatchString("modules/nginx/default.nix"))
+	assert.True(t, globToRegexp("flake.*").MatchString("flake.lock"))
+	assert.False(t, globToRegexp("*.nix").MatchString("modules/default.nix"))
+}
+
+func TestHasSkipMarker(t *testing.T) {
+	assert.True(t, hasSkipMarker("docs: fix a typo\n\n[skip deploy]"))
+	assert.True(t, hasSkipMarker("[Comin Skip] update the README"))
+	assert.False(t, hasSkipMarker("Update nginx"))
+}
+
+func TestManualRollback(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	r := newRepositoryMock()
+	m := New(r, prometheus.New(), nix.New(types.Nix{}), logs.New(types.Logs{}), health.New(types.HealthChecks{}), "", "", "")
+	m.rebootNeededFunc = func() (bool, error) {
+		return false, nil
+	}
+	m.rollbackTargetFunc = func(target string) (string, error) {
+		if target == "unknown" {
+			return "", fmt.Errorf("unknown target")
+		}
+		return "previous-out-path", nil
+	}
+	rollbackDone := make(chan struct{})
+	var rolledBackTo string
+	m.manualRollbackFunc = func(ctx context.Context, outPath, operation string) error {
+		rolledBackTo = outPath
+		<-rollbackDone
+		return nil
+	}
+	go m.Run()
+
+	assert.NotNil(t, m.Rollback("unknown"))
+	assert.Nil(t, m.GetState().ManualRollback)
+
+	assert.Nil(t, m.Rollback(""))
+	assert.True(t, m.GetState().IsRunning)
+	assert.True(t, m.GetState().ManualRollback.IsRunning)
+	// A rollback can not be started while the manager is running
+	assert.NotNil(t, m.Rollback(""))
+
+	close(rollbackDone)
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.False(c, m.GetState().IsRunning)
+		assert.False(c, m.GetState().ManualRollback.IsRunning)
+	}, 5*time.Second, 10*time.Millisecond, "the rollback is not finished")
+	assert.Equal(t, "previous-out-path", rolledBackTo)
+	assert.Empty(t, m.GetState().ManualRollback.ErrorMsg)
+}
+
+func TestRecordSystemGeneration(t *testing.T) {
+	m := New(newRepositoryMock(), prometheus.New(), nix.New(types.Nix{}), logs.New(types.Logs{}), health.New(types.HealthChecks{}), "", "", "")
+	number := 0
+	m.profileGenerationFunc = func() (int, error) {
+		number++
+		return number, nil
+	}
+	for i := 0; i < systemGenerationsMax+2; i++ {
+		d := deployment.Deployment{Generation: generation.Generation{SelectedCommitId: fmt.Sprintf("commit-%d", i), OutPath: "out-path"}}
+		m = m.recordSystemGeneration(d)
+	}
+	assert.Len(t, m.systemGenerations, systemGenerationsMax)
+	assert.Equal(t, SystemGeneration{Number: systemGenerationsMax + 2, CommitId: fmt.Sprintf("commit-%d", systemGenerationsMax+1), OutPath: "out-path"}, m.systemGenerations[0])
+}
+
+func TestHistory(t *testing.T) {
+	r := newRepositoryMock()
+	m := newTestManager(t, r)
+	h := history.New(filepath.Join(t.TempDir(), "history.jsonl"))
+	m = m.WithHistory(h)
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	m = m.WithAuditLog(audit.New(types.Audit{Path: auditPath, HashChain: true}, types.CommitSignatures{}))
+	var mu sync.Mutex
+	var deployErr error
+	m.deployerFunc = func(context.Context, string, string, string) (bool, string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return false, "", deployErr
+	}
+	go m.Run()
+
+	req := m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "foo", SelectedRemoteName: "origin"}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+	assert.Equal(t, req.ID, m.GetState().Deployment.Generation.FetchId)
+
+	mu.Lock()
+	deployErr = fmt.Errorf("switch failed")
+	mu.Unlock()
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "bar", SelectedRemoteName: "origin"}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		entries, err := h.Read()
+		assert.Nil(c, err)
+		assert.Len(c, entries, 2)
+	}, 5*time.Second, 10*time.Millisecond, "the deployments are not recorded")
+	entries, _ := h.Read()
+	assert.Equal(t, "foo", entries[0].CommitId)
+	assert.Equal(t, "done", entries[0].Status)
+	assert.Equal(t, "origin", entries[0].RemoteName)
+	assert.Equal(t, "bar", entries[1].CommitId)
+	assert.Equal(t, "failed", entries[1].Status)
+
+	count, err := audit.Verify(auditPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	content, _ := os.ReadFile(auditPath)
+	assert.Contains(t, string(content), `"trigger":"fetch request `+req.ID+`"`)
+
+	entry, err := m.Deployment(entries[0].UUID)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", entry.CommitId)
+	entry, err = m.Deployment(m.GetState().Deployment.UUID)
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", entry.CommitId)
+	_, err = m.Deployment("unknown")
+	assert.NotNil(t, err)
+}
+
+func TestEvents(t *testing.T) {
+	r := newRepositoryMock()
+	m := newTestManager(t, r)
+	ch, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+	go m.Run()
+
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "foo"}
+	expected := []events.Type{events.Fetched, events.Evaluating, events.Building, events.Switching, events.Done}
+	var e events.Event
+	for _, typ := range expected {
+		select {
+		case e = <-ch:
+			assert.Equal(t, typ, e.Type)
+			assert.Equal(t, "foo", e.CommitId)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the event %s has not been published", typ)
+		}
+	}
+	assert.Equal(t, m.GetState().Deployment.UUID, e.DeploymentUUID)
+	assert.Equal(t, m.GetState().Generation.UUID, e.GenerationUUID)
+}
+
+func TestFailureStreak(t *testing.T) {
+	r := newRepositoryMock()
+	textfilePath := filepath.Join(t.TempDir(), "comin.prom")
+	m := newTestManager(t, r)
+	m.prometheus = prometheus.New().WithTextfile(textfilePath)
+	var mu sync.Mutex
+	evalErr := fmt.Errorf("eval failed")
+	m.evalFunc = func(ctx context.Context, repositoryPath string, hostname string) (string, string, string, string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return "drv-path", "out-path", "", "", evalErr
+	}
+	go m.Run()
+
+	for i, commitId := range []string{"foo", "bar"} {
+		m.Fetch("origin")
+		r.rsCh <- repository.RepositoryStatus{SelectedCommitId: commitId}
+		assert.EventuallyWithT(t, func(c *assert.CollectT) {
+			assert.Equal(c, i+1, m.GetState().ConsecutiveFailures)
+			assert.False(c, m.GetState().IsRunning)
+		}, 5*time.Second, 10*time.Millisecond, "the failure is not recorded")
+	}
+	failingSince := m.GetState().FailingSince
+	assert.False(t, failingSince.IsZero())
+	// The evaluation failures are exported in the textfile
+	content, err := os.ReadFile(textfilePath)
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), "comin_consecutive_failures 2")
+
+	// A successful deployment ends the failure streak
+	mu.Lock()
+	evalErr = nil
+	mu.Unlock()
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "baz"}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+	assert.Equal(t, 0, m.GetState().ConsecutiveFailures)
+	assert.True(t, m.GetState().FailingSince.IsZero())
+}
+
+func TestOfflineBuildRetry(t *testing.T) {
+	r := newRepositoryMock()
+	m := newTestManager(t, r)
+	m.nix = nix.New(types.Nix{Offline: true})
+	var mu sync.Mutex
+	inStore := false
+	m.buildFunc = func(ctx context.Context, drvPath string, outPath string) (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !inStore {
+			return false, fmt.Errorf("not in the Nix store")
+		}
+		return true, nil
+	}
+	go m.Run()
+
+	reachable := []*repository.Remote{{Name: "origin", LastFetched: true}}
+	unreachable := []*repository.Remote{{Name: "origin", LastFetched: true, FetchErrorMsg: "network is unreachable"}}
+
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "foo", Remotes: reachable}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, generation.BuildFailed, m.GetState().Generation.Status)
+		assert.False(c, m.GetState().IsRunning)
+	}, 5*time.Second, 10*time.Millisecond, "the build doesn't fail")
+
+	// The closure is copied while the remotes are unreachable
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "foo", Remotes: unreachable}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.False(c, m.GetState().IsRunning)
+	}, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	inStore = true
+	mu.Unlock()
+	assert.Equal(t, generation.BuildFailed, m.GetState().Generation.Status)
+
+	// The build is retried once the remotes are reachable again
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "foo", Remotes: reachable}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+}
+
+func TestStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	r := newRepositoryMock()
+	m := newTestManager(t, r)
+	m = m.WithStateFile(path)
+	m.profileGenerationFunc = func() (int, error) {
+		return 42, nil
+	}
+	m.rebootNeededFunc = func() (bool, error) {
+		return false, nil
+	}
+	go m.Run()
+
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "foo", SelectedRemoteName: "origin", MainCommitId: "main"}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+	// The head of the main branch seeds the repository on restart
+	assert.Equal(t, "main", ReadMainCommitId(path))
+
+	// The state is restored by a new manager
+	m = New(newRepositoryMock(), prometheus.New(), nix.New(types.Nix{}), logs.New(types.Logs{}), health.New(types.HealthChecks{}), "", "", "")
+	m = m.WithStateFile(path)
+	go m.Run()
+	state := m.GetState()
+	assert.Equal(t, "foo", state.Deployment.Generation.SelectedCommitId)
+	assert.Equal(t, deployment.Done, state.Deployment.Status)
+	assert.Equal(t, 42, state.SystemGenerations[0].Number)
+	assert.Equal(t, "foo", m.deployedCommitId)
+
+	// A corrupted state file is ignored
+	assert.Nil(t, os.WriteFile(path, []byte("{"), 0640))
+	m = New(newRepositoryMock(), prometheus.New(), nix.New(types.Nix{}), logs.New(types.Logs{}), health.New(types.HealthChecks{}), "", "", "")
+	m = m.WithStateFile(path)
+	assert.Empty(t, m.deployment.UUID)
+	_, err := os.Stat(path + ".corrupted")
+	assert.Nil(t, err)
+
+	// A truncated state file is rebuilt from the history
+	h := history.New(filepath.Join(t.TempDir(), "history.jsonl"))
+	_, err = h.Append(history.Entry{UUID: "d1", CommitId: "foo", Operation: "switch", Status: "done"})
+	assert.Nil(t, err)
+	_, err = h.Append(history.Entry{UUID: "d2", CommitId: "bar", Operation: "switch", Status: "failed"})
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(path, []byte(""), 0640))
+	m = New(newRepositoryMock(), prometheus.New(), nix.New(types.Nix{}), logs.New(types.Logs{}), health.New(types.HealthChecks{}), "", "", "")
+	m = m.WithHistory(h)
+	m = m.WithStateFile(path)
+	assert.Equal(t, "d2", m.deployment.UUID)
+	assert.Equal(t, deployment.Failed, m.deployment.Status)
+	assert.Equal(t, "bar", m.deployment.Generation.SelectedCommitId)
+	assert.Equal(t, "foo", m.deployedCommitId)
+}
+
+func TestMigrateState(t *testing.T) {
+	// A state stored before the version field
+	s, err := migrateState([]byte(`{"deployed_commit_id": "foo", "system_generations": [{"number": 42}]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, stateVersion, s.Version)
+	assert.Equal(t, "foo", s.DeployedCommitId)
+	assert.Equal(t, 42, s.SystemGenerations[0].Number)
+
+	_, err = migrateState([]byte(`{"version": 1000}`))
+	assert.ErrorContains(t, err, "not supported")
+
+	// A state stored by a newer comin is kept aside
+	path := filepath.Join(t.TempDir(), "state.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`{"version": 1000}`), 0640))
+	m := New(newRepositoryMock(), prometheus.New(), nix.New(types.Nix{}), logs.New(types.Logs{}), health.New(types.HealthChecks{}), "", "", "")
+	m.WithStateFile(path)
+	_, err = os.Stat(path + ".bak")
+	assert.Nil(t, err)
+}
+
+func TestReadMainCommitId(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	assert.Equal(t, "", ReadMainCommitId(path))
+
+	// A state stored by a previous comin version
+	assert.Nil(t, os.WriteFile(path, []byte(`{"deployed_commit_id": "foo"}`), 0640))
+	assert.Equal(t, "foo", ReadMainCommitId(path))
+
+	// The commit deployed from a testing branch is not the head of
+	// the main branch
+	assert.Nil(t, os.WriteFile(path, []byte(`{"deployed_commit_id": "foo", "deployment": {"generation": {"branch-is-testing": true}}}`), 0640))
+	assert.Equal(t, "", ReadMainCommitId(path))
+
+	assert.Nil(t, os.WriteFile(path, []byte(`{"deployed_commit_id": "foo", "main_commit_id": "bar"}`), 0640))
+	assert.Equal(t, "bar", ReadMainCommitId(path))
+}
+
+func TestSpecialisation(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	r := newRepositoryMock()
+	m := newTestManager(t, r)
+	m.evalFunc = func(ctx context.Context, repositoryPath string, hostname string) (string, string, string, string, error) {
+		return "drv-path", "out-path", "", "gaming", nil
+	}
+	m.specialisationFunc = func(outPath, specialisation string) (string, error) {
+		return outPath + "-" + specialisation, nil
+	}
+	var deployedOutPath string
+	m.deployerFunc = func(ctx context.Context, machineId, outPath, operation string) (bool, string, error) {
+		deployedOutPath = outPath
+		return false, "", nil
+	}
+	go m.Run()
+
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "foo"}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, deployment.Done, m.GetState().Deployment.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not done")
+	assert.Equal(t, "out-path-gaming", deployedOutPath)
+}
+
+func TestDeploymentTimeout(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	r := newRepositoryMock()
+	m := newTestManager(t, r)
+	m = m.WithDeploymentTimeout(1)
+	// The build never terminates
+	m.buildFunc = func(ctx context.Context, drvPath string, outPath string) (bool, error) {
+		<-ctx.Done()
+		return false, ctx.Err()
+	}
+	go m.Run()
+
+	m.Fetch("origin")
+	r.rsCh <- repository.RepositoryStatus{SelectedCommitId: "foo"}
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.True(c, m.GetState().IsTimedOut)
+		assert.False(c, m.GetState().IsRunning)
+		assert.Equal(c, generation.BuildFailed, m.GetState().Generation.Status)
+	}, 5*time.Second, 10*time.Millisecond, "the deployment is not aborted")
+	assert.Empty(t, m.GetState().Deployment.UUID)
+}
@@ -0,0 +1,46 @@
+package manager
+
+import (
+	"context"
+
+	"github.com/nlewo/comin/internal/events"
+	"github.com/nlewo/comin/internal/generation"
+	"github.com/nlewo/comin/internal/repository"
+	"github.com/sirupsen/logrus"
+)
+
+// updateReachability records whether the remotes fetched by rs were
+// reachable. It returns true when they are reachable again after a
+// fetch which failed to reach all of them.
+func (m Manager) updateReachability(rs repository.RepositoryStatus) (Manager, bool) {
+	fetched, reachable := false, false
+	for _, r := range rs.Remotes {
+		if r.LastFetched {
+			fetched = true
+			reachable = reachable || r.FetchErrorMsg == ""
+		}
+	}
+	if !fetched {
+		return m, false
+	}
+	reconnected := m.isUnreachable && reachable
+	m.isUnreachable = !reachable
+	return m, reconnected
+}
+
+// isOfflineBuildPending returns true when, in offline mode, the
+// closure of the current generation was not in the Nix store.
+func (m Manager) isOfflineBuildPending() bool {
+	return m.nix.Offline() && m.generation.Status == generation.BuildFailed
+}
+
+// retryOfflineBuild builds again the current generation. In offline
+// mode, its closure is copied out-of-band: it can be in the Nix store
+// once the machine is reachable again.
+func (m Manager) retryOfflineBuild(ctx context.Context) Manager {
+	logrus.Infof("The remotes are reachable again: retrying the build of the generation %s", m.generation.UUID)
+	m.generation.FetchId = m.fetchId
+	m.generation = m.generation.Build(m.pipelineContext(ctx))
+	m.publishGeneration(events.Building, nil)
+	return m
+}
@@ -0,0 +1,43 @@
+package manager
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/nlewo/comin/internal/utils"
+)
+
+// A commit ID can also be the SHA-256 of an archive
+var commitIdRegexp = regexp.MustCompile(`^[0-9a-f]{7,64}$`)
+
+// WithPinFile returns a manager pinning deployments to the commit
+// written in the file path.
+func (m Manager) WithPinFile(path string) Manager {
+	m.pinFilepath = path
+	return m
+}
+
+// Pin makes comin deploy the commit commitId, which can be
+// abbreviated, and ignore newer commits until Unpin is called. This
+// survives comin restarts. The pin is applied by the next fetch.
+func (m Manager) Pin(commitId string) error {
+	if m.pinFilepath == "" {
+		return fmt.Errorf("The pin file is not configured")
+	}
+	if !commitIdRegexp.MatchString(commitId) {
+		return fmt.Errorf("'%s' is not a commit ID", commitId)
+	}
+	return utils.WriteFileAtomic(m.pinFilepath, []byte(commitId+"\n"), 0644)
+}
+
+// Unpin makes comin deploy the heads of the branches again.
+func (m Manager) Unpin() error {
+	if m.pinFilepath == "" {
+		return fmt.Errorf("The pin file is not configured")
+	}
+	if err := os.Remove(m.pinFilepath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
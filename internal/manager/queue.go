@@ -0,0 +1,106 @@
+package manager
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// FetchRequest is a request to fetch a remote. An empty remote means
+// all remotes are fetched.
+type FetchRequest struct {
+	ID     string `json:"id"`
+	Remote string `json:"remote"`
+	// The position of the request in the queue: 0 when the fetch
+	// has been started, 1 when it is pending
+	Position int `json:"position"`
+}
+
+// SupersededFetch is a pending fetch request replaced by a more
+// recent request: the deployment of its ID is the one of the request
+// superseding it.
+type SupersededFetch struct {
+	ID           string `json:"id"`
+	SupersededBy string `json:"superseded_by"`
+}
+
+type fetchRequest struct {
+	remote   string
+	resultCh chan FetchRequest
+}
+
+// maxUnchangedFetchIds is the number of fetch requests which didn't
+// select a new commit, or which have been superseded, kept in the
+// state
+const maxUnchangedFetchIds = 16
+
+// onFetchRequest starts the fetch if the manager is idle. Otherwise,
+// the request is queued: only the latest pending request is kept.
+func (m Manager) onFetchRequest(ctx context.Context, r fetchRequest) Manager {
+	if m.isFetching || m.isRunning {
+		var req FetchRequest
+		m, req = m.queueFetch(r.remote)
+		r.resultCh <- req
+		return m
+	}
+	req := FetchRequest{ID: uuid.NewString(), Remote: r.remote}
+	r.resultCh <- req
+	m.fetchId = req.ID
+	return m.onTriggerRepository(ctx, req.Remote)
+}
+
+// queueFetch queues a fetch of the remote, or of all remotes if
+// remote is empty. The request replaces the pending request, which is
+// recorded as superseded by it. If they don't fetch the same remote,
+// the request fetches all remotes in order to also fetch the remote
+// of the replaced request.
+func (m Manager) queueFetch(remote string) (Manager, FetchRequest) {
+	req := FetchRequest{
+		ID:       uuid.NewString(),
+		Remote:   remote,
+		Position: 1,
+	}
+	if m.pendingFetch != nil {
+		if m.pendingFetch.Remote != remote {
+			req.Remote = ""
+		}
+		logrus.Debugf("The pending fetch %s is superseded by the fetch %s", m.pendingFetch.ID, req.ID)
+		superseded := append([]SupersededFetch{}, m.supersededFetches...)
+		superseded = append(superseded, SupersededFetch{ID: m.pendingFetch.ID, SupersededBy: req.ID})
+		if len(superseded) > maxUnchangedFetchIds {
+			superseded = superseded[len(superseded)-maxUnchangedFetchIds:]
+		}
+		m.supersededFetches = superseded
+	}
+	m.pendingFetch = &req
+	logrus.Debugf("The manager is running: the fetch %s is pending", req.ID)
+	return m, req
+}
+
+// startPendingFetch starts the pending fetch request once the manager
+// is idle.
+func (m Manager) startPendingFetch(ctx context.Context) Manager {
+	req := *m.pendingFetch
+	m.pendingFetch = nil
+	logrus.Debugf("Starting the pending fetch %s", req.ID)
+	m.fetchId = req.ID
+	return m.onTriggerRepository(ctx, req.Remote)
+}
+
+// recordUnchangedFetch records that the current fetch request didn't
+// select a new commit to deploy. Since a pending fetch can start right
+// after, the request can't be reported only by the FetchId of the
+// state.
+func (m Manager) recordUnchangedFetch() Manager {
+	if m.fetchId == "" {
+		return m
+	}
+	ids := append([]string{}, m.unchangedFetchIds...)
+	ids = append(ids, m.fetchId)
+	if len(ids) > maxUnchangedFetchIds {
+		ids = ids[len(ids)-maxUnchangedFetchIds:]
+	}
+	m.unchangedFetchIds = ids
+	return m
+}
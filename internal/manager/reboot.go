@@ -0,0 +1,74 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/nlewo/comin/internal/window"
+	"github.com/sirupsen/logrus"
+)
+
+// WithAutoReboot returns a manager rebooting the machine during the
+// reboot window when the deployed configuration needs a reboot.
+func (m Manager) WithAutoReboot(config types.AutoReboot) (Manager, error) {
+	windows := []types.DeploymentWindow{}
+	if config.Start != "" || config.End != "" {
+		windows = append(windows, types.DeploymentWindow{
+			Operations: []string{"reboot"},
+			Days:       config.Days,
+			Start:      config.Start,
+			End:        config.End,
+		})
+	}
+	w, err := window.New(windows)
+	if err != nil {
+		return m, fmt.Errorf("The auto reboot window is invalid: %s", err)
+	}
+	m.autoReboot = config
+	m.rebootWindows = w
+	return m, nil
+}
+
+// CancelReboot cancels the scheduled reboot. The machine is not
+// rebooted automatically until a new configuration is deployed.
+func (m Manager) CancelReboot() error {
+	errCh := make(chan error)
+	m.cancelRebootCh <- errCh
+	return <-errCh
+}
+
+// checkReboot schedules a reboot if the deployed configuration needs
+// it and the reboot window is open.
+func (m Manager) checkReboot(ctx context.Context) Manager {
+	if !m.autoReboot.Enable || !m.rebootNeeded || m.isRebootScheduled || m.isRebootCanceled || m.isRunning {
+		return m
+	}
+	if !m.rebootWindows.IsAllowed("reboot", m.nowFunc()) {
+		return m
+	}
+	if err := m.scheduleRebootFunc(m.autoReboot.Delay, m.autoReboot.Message); err != nil {
+		logrus.Errorf("Failed to schedule the reboot: %s", err)
+		return m
+	}
+	m.isRebootScheduled = true
+	m.rebootScheduledAt = m.nowFunc().Add(time.Duration(m.autoReboot.Delay) * time.Minute)
+	return m
+}
+
+func (m Manager) onCancelReboot(ctx context.Context, errCh chan error) Manager {
+	if !m.isRebootScheduled {
+		errCh <- fmt.Errorf("No reboot is scheduled")
+		return m
+	}
+	if err := m.cancelRebootFunc(); err != nil {
+		errCh <- err
+		return m
+	}
+	errCh <- nil
+	m.isRebootScheduled = false
+	m.isRebootCanceled = true
+	m.rebootScheduledAt = time.Time{}
+	return m
+}
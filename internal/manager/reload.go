@@ -0,0 +1,51 @@
+package manager
+
+import (
+	"context"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+)
+
+type reloadRequest struct {
+	remotes []types.Remote
+	errCh   chan error
+}
+
+// Reload replaces the remotes of the repository, for instance when
+// the repository has been migrated to a new URL. Since the repository
+// can not be modified while fetching, the reload is postponed until
+// the current fetch is done. The new remotes are then fetched.
+func (m Manager) Reload(remotes []types.Remote) error {
+	errCh := make(chan error)
+	m.reloadCh <- reloadRequest{remotes: remotes, errCh: errCh}
+	return <-errCh
+}
+
+func (m Manager) onReload(ctx context.Context, r reloadRequest) Manager {
+	if m.pendingReload != nil {
+		m.pendingReload.errCh <- nil
+		logrus.Debugf("The pending reload is replaced")
+	}
+	m.pendingReload = &r
+	if m.isFetching {
+		logrus.Infof("The reload of the remotes is postponed since the manager is fetching")
+	}
+	return m
+}
+
+// startPendingReload reloads the remotes once the manager is not
+// fetching and queues a fetch of all remotes.
+func (m Manager) startPendingReload(ctx context.Context) Manager {
+	r := m.pendingReload
+	m.pendingReload = nil
+	if err := m.repository.Reload(r.remotes); err != nil {
+		logrus.Errorf("Failed to reload the remotes: %s", err)
+		r.errCh <- err
+		return m
+	}
+	logrus.Infof("The remotes have been reloaded")
+	r.errCh <- nil
+	m, _ = m.queueFetch("")
+	return m
+}
@@ -0,0 +1,83 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nlewo/comin/internal/audit"
+	"github.com/sirupsen/logrus"
+)
+
+// ManualRollback is a rollback requested by an operator. The
+// configuration stays activated until a new commit is deployed.
+type ManualRollback struct {
+	Target    string    `json:"target"`
+	OutPath   string    `json:"outpath"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	// Is the rollback still running
+	IsRunning bool   `json:"is_running"`
+	ErrorMsg  string `json:"error_msg"`
+}
+
+type rollbackRequest struct {
+	target string
+	errCh  chan error
+}
+
+// Rollback activates again a previous configuration: the generation
+// preceding the current one of the profile when target is empty, a
+// generation number of the profile, or a commit ID deployed by comin
+// whose gcroot still exists. The rollback runs asynchronously: an
+// error is only returned when it can not be started.
+func (m Manager) Rollback(target string) error {
+	errCh := make(chan error)
+	m.rollbackCh <- rollbackRequest{target: target, errCh: errCh}
+	return <-errCh
+}
+
+func (m Manager) onRollback(ctx context.Context, r rollbackRequest) Manager {
+	if m.isRunning {
+		r.errCh <- fmt.Errorf("The manager is running: retry once it is idle")
+		return m
+	}
+	outPath, err := m.rollbackTargetFunc(r.target)
+	if err != nil {
+		r.errCh <- err
+		return m
+	}
+	r.errCh <- nil
+	logrus.Infof("Rolling back to the configuration %s", outPath)
+	m.isRunning = true
+	m.manualRollback = &ManualRollback{
+		Target:    r.target,
+		OutPath:   outPath,
+		StartedAt: m.nowFunc(),
+		IsRunning: true,
+	}
+	go func() {
+		m.rollbackResultCh <- m.manualRollbackFunc(m.withLogFile(ctx), outPath, "switch")
+	}()
+	return m
+}
+
+func (m Manager) onRollbackResult(ctx context.Context, err error) Manager {
+	rollback := *m.manualRollback
+	rollback.IsRunning = false
+	rollback.EndedAt = m.nowFunc()
+	if err != nil {
+		logrus.Errorf("The rollback to %s failed: %s", rollback.OutPath, err)
+		rollback.ErrorMsg = err.Error()
+	} else {
+		logrus.Infof("The configuration %s has been activated again", rollback.OutPath)
+	}
+	m.manualRollback = &rollback
+	if err := m.audit.Append(audit.NewRollbackEntry(m.hostname, rollback.EndedAt, rollback.OutPath, err)); err != nil {
+		logrus.Errorf("Failed to record the rollback in the audit log: %s", err)
+	}
+	m.isRunning = false
+	m = m.updateRebootNeeded()
+	m.isRebootCanceled = false
+	return m
+}
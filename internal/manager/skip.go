@@ -0,0 +1,42 @@
+package manager
+
+import (
+	"strings"
+
+	"github.com/nlewo/comin/internal/repository"
+	"github.com/sirupsen/logrus"
+)
+
+// skipMarkers are the markers preventing a commit from being deployed
+// when they appear in its message. This allows trivial commits, such
+// as documentation changes, to not trigger a deployment.
+var skipMarkers = []string{
+	"[comin skip]",
+	"[skip comin]",
+	"[skip deploy]",
+	"[deploy skip]",
+}
+
+func hasSkipMarker(commitMsg string) bool {
+	msg := strings.ToLower(commitMsg)
+	for _, marker := range skipMarkers {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipCommit records the selected commit of rs as skipped instead of
+// creating a generation. The manager is then idle.
+func (m Manager) skipCommit(rs repository.RepositoryStatus, reason string) Manager {
+	if m.skippedCommitId != rs.SelectedCommitId {
+		logrus.Infof("The commit %s is skipped: %s", rs.SelectedCommitId, reason)
+		m.skippedCommitId = rs.SelectedCommitId
+		m.skippedAt = m.nowFunc()
+		m.skippedReason = reason
+		m.storeState()
+	}
+	m.isRunning = false
+	return m
+}
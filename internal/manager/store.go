@@ -0,0 +1,225 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nlewo/comin/internal/deployment"
+	"github.com/nlewo/comin/internal/generation"
+	"github.com/nlewo/comin/internal/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// stateVersion is the version of the schema of the stored state. It
+// is incremented, with a migration added to stateMigrations, when the
+// schema changes in a way the previous states can't be decoded.
+const stateVersion = 1
+
+// stateMigrations migrates a stored state decoded as JSON objects from
+// the version i to the version i+1
+var stateMigrations = map[int]func(map[string]interface{}) (map[string]interface{}, error){
+	// The version field has been introduced in the version 1
+	0: func(s map[string]interface{}) (map[string]interface{}, error) {
+		return s, nil
+	},
+}
+
+// stateVersionError is returned when the state has been stored by a
+// newer comin version
+type stateVersionError struct {
+	version int
+}
+
+func (e stateVersionError) Error() string {
+	return fmt.Sprintf("The state version %d is not supported by this comin version (the version %d is expected)", e.version, stateVersion)
+}
+
+// storedState is the part of the state of the manager restored after
+// a restart of comin
+type storedState struct {
+	Version          int                   `json:"version"`
+	Deployment       deployment.Deployment `json:"deployment"`
+	DeployedCommitId string                `json:"deployed_commit_id"`
+	// The head of the main branch the force pushes are detected
+	// against
+	MainCommitId      string             `json:"main_commit_id"`
+	SystemGenerations []SystemGeneration `json:"system_generations"`
+	SkippedCommitId   string             `json:"skipped_commit_id"`
+	SkippedAt         time.Time          `json:"skipped_at"`
+	SkippedReason     string             `json:"skipped_reason"`
+	// The current failure streak
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	FailingSince        time.Time `json:"failing_since"`
+}
+
+// WithStateFile returns a manager storing its state in the file path
+// when a deployment finishes or a commit is skipped. The state stored
+// by a previous comin run is restored: the last deployment is reported
+// by the status and the fast forward check is done against the last
+// deployed commit. A corrupted state file is replaced by a minimal
+// state rebuilt from the history, which has to be set before.
+func (m Manager) WithStateFile(path string) Manager {
+	m.stateFilepath = path
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m
+	} else if err != nil {
+		logrus.Errorf("Failed to read the state file %s: %s", path, err)
+		return m
+	}
+	s, err := migrateState(content)
+	var versionErr stateVersionError
+	if errors.As(err, &versionErr) {
+		logrus.Errorf("Failed to load the state file %s: %s", path, err)
+		// The state file is kept to be restored by a newer comin
+		if err := os.Rename(path, path+".bak"); err != nil {
+			logrus.Errorf("Failed to back up the state file %s: %s", path, err)
+		}
+		return m
+	} else if err != nil {
+		// The state file can be truncated by a power loss, for
+		// instance if it has been written by a previous comin
+		// version
+		logrus.Errorf("The state file %s is corrupted, the state is rebuilt from the history: %s", path, err)
+		if err := os.Rename(path, path+".corrupted"); err != nil {
+			logrus.Errorf("Failed to back up the state file %s: %s", path, err)
+		}
+		return m.rebuildState()
+	}
+	logrus.Infof("Restoring the state from %s", path)
+	m.deployment = s.Deployment
+	m.deployedCommitId = s.DeployedCommitId
+	m.systemGenerations = s.SystemGenerations
+	m.skippedCommitId = s.SkippedCommitId
+	m.skippedAt = s.SkippedAt
+	m.skippedReason = s.SkippedReason
+	m.consecutiveFailures = s.ConsecutiveFailures
+	m.failingSince = s.FailingSince
+	m.prometheus.SetConsecutiveFailures(m.consecutiveFailures, m.failingSince)
+	return m
+}
+
+// ReadMainCommitId returns the head of the main branch stored in the
+// state file path, in order to detect the force pushes which occurred
+// while comin was stopped. The states stored by previous comin
+// versions only contain the deployed commit, which is the head of the
+// main branch when it has been deployed from the main branch. An
+// empty string is returned when it is unknown.
+func ReadMainCommitId(path string) string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	s, err := migrateState(content)
+	if err != nil {
+		return ""
+	}
+	if s.MainCommitId != "" {
+		return s.MainCommitId
+	}
+	if !s.Deployment.Generation.SelectedBranchIsTesting {
+		return s.DeployedCommitId
+	}
+	return ""
+}
+
+// migrateState decodes a stored state and migrates it to the current
+// version of the schema
+func migrateState(content []byte) (s storedState, err error) {
+	var object map[string]interface{}
+	if err = json.Unmarshal(content, &object); err != nil {
+		return
+	}
+	version := 0
+	if v, ok := object["version"].(float64); ok {
+		version = int(v)
+	}
+	if version > stateVersion {
+		return s, stateVersionError{version: version}
+	}
+	for ; version < stateVersion; version++ {
+		logrus.Infof("Migrating the state from the version %d to the version %d", version, version+1)
+		if object, err = stateMigrations[version](object); err != nil {
+			return s, fmt.Errorf("Failed to migrate the state from the version %d: %s", version, err)
+		}
+	}
+	object["version"] = stateVersion
+	if content, err = json.Marshal(object); err != nil {
+		return
+	}
+	err = json.Unmarshal(content, &s)
+	return
+}
+
+// rebuildState restores a minimal state from the history: the last
+// deployment and the last deployed commit
+func (m Manager) rebuildState() Manager {
+	entries, err := m.history.Read()
+	if err != nil {
+		logrus.Errorf("Failed to read the history: %s", err)
+		return m
+	}
+	if len(entries) == 0 {
+		return m
+	}
+	e := entries[len(entries)-1]
+	m.deployment = deployment.Deployment{
+		UUID: e.UUID,
+		Generation: generation.Generation{
+			UUID:               e.GenerationUUID,
+			SelectedCommitId:   e.CommitId,
+			SelectedCommitMsg:  e.CommitMsg,
+			SelectedRemoteName: e.RemoteName,
+			SelectedBranchName: e.BranchName,
+			OutPath:            e.OutPath,
+		},
+		Operation:  e.Operation,
+		Status:     deployment.StatusFromString(e.Status),
+		ErrorMsg:   e.ErrorMsg,
+		StartAt:    e.StartAt,
+		EndAt:      e.EndAt,
+		RolledBack: e.RolledBack,
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Status == "done" && entries[i].Operation != "dry-activate" {
+			m.deployedCommitId = entries[i].CommitId
+			break
+		}
+	}
+	return m
+}
+
+// storeState writes the state in the state file. The file is replaced
+// atomically and synced to the disk so that a crash or a power loss
+// never leaves a truncated state.
+func (m Manager) storeState() {
+	if m.stateFilepath == "" {
+		return
+	}
+	content, err := json.Marshal(storedState{
+		Version:           stateVersion,
+		Deployment:        m.deployment,
+		DeployedCommitId:  m.deployedCommitId,
+		MainCommitId:      m.repositoryStatus.MainCommitId,
+		SystemGenerations: m.systemGenerations,
+		SkippedCommitId:   m.skippedCommitId,
+		SkippedAt:         m.skippedAt,
+		SkippedReason:     m.skippedReason,
+
+		ConsecutiveFailures: m.consecutiveFailures,
+		FailingSince:        m.failingSince,
+	})
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(m.stateFilepath), 0750)
+	}
+	if err == nil {
+		err = utils.WriteFileAtomic(m.stateFilepath, content, 0640)
+	}
+	if err != nil {
+		logrus.Errorf("Failed to store the state in %s: %s", m.stateFilepath, err)
+	}
+}
@@ -0,0 +1,53 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WithDeploymentTimeout returns a manager aborting the fetch, the
+// evaluation, the build and the deployment of a commit when they
+// exceed the timeout in seconds. When 0, there is no timeout.
+func (m Manager) WithDeploymentTimeout(timeout int) Manager {
+	m.deploymentTimeout = time.Duration(timeout) * time.Second
+	return m
+}
+
+// startPipeline starts the deadline of the deployment of a
+// commit. The deadline is started again when a deployment resumes
+// after waiting for an approval, a deployment window or an unfreeze.
+func (m Manager) startPipeline(ctx context.Context) Manager {
+	if m.cancelPipeline != nil {
+		m.cancelPipeline()
+	}
+	if m.deploymentTimeout > 0 {
+		m.pipelineCtx, m.cancelPipeline = context.WithTimeout(ctx, m.deploymentTimeout)
+	} else {
+		m.pipelineCtx, m.cancelPipeline = context.WithCancel(ctx)
+	}
+	m.isTimedOut = false
+	return m
+}
+
+// pipelineContext returns the context of the steps of the deployment
+// of a commit: nix commands are killed once the deadline is exceeded
+// and their outputs are written to the log file of the generation.
+func (m Manager) pipelineContext(ctx context.Context) context.Context {
+	if m.pipelineCtx != nil {
+		ctx = m.pipelineCtx
+	}
+	return m.withLogFile(ctx)
+}
+
+// checkTimeout records whether a step of the deployment failed
+// because the deployment timeout has been exceeded.
+func (m Manager) checkTimeout() Manager {
+	if m.pipelineCtx != nil && errors.Is(m.pipelineCtx.Err(), context.DeadlineExceeded) {
+		logrus.Errorf("The deployment has been aborted since it exceeded the timeout of %s", m.deploymentTimeout)
+		m.isTimedOut = true
+	}
+	return m
+}
@@ -0,0 +1,130 @@
+package nix
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// GcRoot is a gcroot of a deployed configuration. Its name is
+// TIMESTAMP-COMMITID: gcroots are then sorted by creation time.
+type GcRoot struct {
+	Name     string
+	CommitId string
+	OutPath  string
+}
+
+// CreateGcRoot creates a gcroot named by the commitId to prevent the
+// outPath from being garbage collected, and removes the oldest
+// gcroots to only keep the GcRootsKeep most recent ones. This allows
+// to always keep rollback targets in the store.
+func (n Nix) CreateGcRoot(commitId, outPath string) error {
+	if n.config.GcRootsDir == "" {
+		return nil
+	}
+	if err := createGcRoot(n.config.GcRootsDir, commitId, outPath, time.Now()); err != nil {
+		return err
+	}
+	if n.config.GcRootsKeep < 1 {
+		return nil
+	}
+	_, err := pruneGcRoots(n.config.GcRootsDir, n.config.GcRootsKeep, false)
+	return err
+}
+
+// PruneGcRoots removes the gcroots older than the GcRootsKeep most
+// recent ones and returns the removed gcroots. When dryRun is true,
+// gcroots are not removed.
+func (n Nix) PruneGcRoots(dryRun bool) ([]GcRoot, error) {
+	if n.config.GcRootsDir == "" || n.config.GcRootsKeep < 1 {
+		return nil, nil
+	}
+	return pruneGcRoots(n.config.GcRootsDir, n.config.GcRootsKeep, dryRun)
+}
+
+func createGcRoot(dir, commitId, outPath string, now time.Time) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	gcRoots, err := ListGcRoots(dir)
+	if err != nil {
+		return err
+	}
+	// A commit redeployed only has one gcroot: the most recent one
+	for _, gcRoot := range gcRoots {
+		if gcRoot.CommitId == commitId {
+			if err := os.Remove(filepath.Join(dir, gcRoot.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	gcRoot := filepath.Join(dir, fmt.Sprintf("%s-%s", now.UTC().Format("20060102150405"), commitId))
+	if err := os.Symlink(outPath, gcRoot); err != nil {
+		return fmt.Errorf("Failed to create symlink 'ln -s %s %s': %s", outPath, gcRoot, err)
+	}
+	logrus.Infof("Creating gcroot '%s'", gcRoot)
+	return nil
+}
+
+// ListGcRoots returns the gcroots of the directory dir, sorted from
+// the most recent to the oldest one.
+func ListGcRoots(dir string) (gcRoots []GcRoot, err error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return gcRoots, nil
+	} else if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSymlink == 0 {
+			continue
+		}
+		split := strings.SplitN(entry.Name(), "-", 2)
+		if len(split) != 2 {
+			continue
+		}
+		outPath, err := os.Readlink(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return gcRoots, err
+		}
+		gcRoots = append(gcRoots, GcRoot{
+			Name:     entry.Name(),
+			CommitId: split[1],
+			OutPath:  outPath,
+		})
+	}
+	sort.Slice(gcRoots, func(i, j int) bool {
+		return gcRoots[i].Name > gcRoots[j].Name
+	})
+	return
+}
+
+// pruneGcRoots removes gcroots older than the keep most recent ones
+// and returns the removed gcroots. When dryRun is true, gcroots are
+// not removed.
+func pruneGcRoots(dir string, keep int, dryRun bool) (removed []GcRoot, err error) {
+	gcRoots, err := ListGcRoots(dir)
+	if err != nil {
+		return
+	}
+	for i, gcRoot := range gcRoots {
+		if i < keep {
+			continue
+		}
+		if dryRun {
+			logrus.Infof("Dry-run enabled: gcroot '%s' has not been removed", gcRoot.Name)
+		} else {
+			if err = os.Remove(filepath.Join(dir, gcRoot.Name)); err != nil {
+				return
+			}
+			logrus.Infof("Removing gcroot '%s'", gcRoot.Name)
+		}
+		removed = append(removed, gcRoot)
+	}
+	return
+}
@@ -0,0 +1,38 @@
+package nix
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGcRoots(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Unix(0, 0)
+	for _, commitId := range []string{"c1", "c2", "c3", "c2"} {
+		now = now.Add(time.Second)
+		err := createGcRoot(dir, commitId, "/nix/store/"+commitId, now)
+		assert.Nil(t, err)
+	}
+	gcRoots, err := ListGcRoots(dir)
+	assert.Nil(t, err)
+	// The redeployed commit c2 only has one gcroot
+	assert.Len(t, gcRoots, 3)
+	assert.Equal(t, "c2", gcRoots[0].CommitId)
+	assert.Equal(t, "/nix/store/c2", gcRoots[0].OutPath)
+	assert.Equal(t, "c3", gcRoots[1].CommitId)
+	assert.Equal(t, "c1", gcRoots[2].CommitId)
+
+	removed, err := pruneGcRoots(dir, 2, true)
+	assert.Nil(t, err)
+	assert.Len(t, removed, 1)
+	gcRoots, _ = ListGcRoots(dir)
+	assert.Len(t, gcRoots, 3)
+
+	removed, err = pruneGcRoots(dir, 2, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "c1", removed[0].CommitId)
+	gcRoots, _ = ListGcRoots(dir)
+	assert.Len(t, gcRoots, 2)
+}
@@ -0,0 +1,41 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+type inputsKey struct{}
+
+// WithInputs returns a context where flakes are evaluated with their
+// inputs overridden by the inputs flake URLs, indexed by the input
+// names.
+func WithInputs(ctx context.Context, inputs map[string]string) context.Context {
+	return context.WithValue(ctx, inputsKey{}, inputs)
+}
+
+// InputUrl returns the flake URL of the commit commitId of the local
+// repository of an input.
+func InputUrl(path, commitId string) string {
+	return fmt.Sprintf("git+file://%s?rev=%s", path, commitId)
+}
+
+// overrideInputArgs returns the --override-input arguments of the
+// inputs of the context. Inputs can only be overridden in flakes.
+func (n Nix) overrideInputArgs(ctx context.Context) []string {
+	inputs, ok := ctx.Value(inputsKey{}).(map[string]string)
+	if !ok || n.config.NonFlake {
+		return nil
+	}
+	names := make([]string, 0, len(inputs))
+	for name := range inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	args := []string{}
+	for _, name := range names {
+		args = append(args, "--override-input", name, inputs[name])
+	}
+	return args
+}
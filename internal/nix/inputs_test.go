@@ -0,0 +1,27 @@
+package nix
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverrideInputArgs(t *testing.T) {
+	n := New(types.Nix{})
+	assert.Empty(t, n.overrideInputArgs(context.Background()))
+
+	ctx := WithInputs(context.Background(), map[string]string{
+		"site":    InputUrl("/var/lib/comin/inputs/site", "b"),
+		"secrets": InputUrl("/var/lib/comin/inputs/secrets", "a"),
+	})
+	assert.Equal(t, []string{
+		"--override-input", "secrets", "git+file:///var/lib/comin/inputs/secrets?rev=a",
+		"--override-input", "site", "git+file:///var/lib/comin/inputs/site?rev=b",
+	}, n.overrideInputArgs(ctx))
+
+	// Inputs can not be overridden in non flake repositories
+	n = New(types.Nix{NonFlake: true})
+	assert.Empty(t, n.overrideInputArgs(ctx))
+}
@@ -7,50 +7,392 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 
+	"github.com/nlewo/comin/internal/activation"
+	"github.com/nlewo/comin/internal/types"
 	"github.com/sirupsen/logrus"
 )
 
+// Nix runs nix commands according to the nix configuration of comin.
+type Nix struct {
+	config types.Nix
+	// The command used to show derivations, selected by DetectVersion
+	showDerivationArgs []string
+	// When not empty, configurations are activated by the
+	// activation helper listening on this socket
+	activationHelperSocket string
+	// When not empty, nix commands are run on this ssh destination
+	// (the builder of the build store)
+	remoteHost string
+}
+
+func New(config types.Nix) Nix {
+	return Nix{
+		config: config,
+	}
+}
+
+// WithActivationHelper returns a Nix activating the configurations
+// with the privileged activation helper listening on the socket
+// socketPath, when it is not empty.
+func (n Nix) WithActivationHelper(socketPath string) Nix {
+	n.activationHelperSocket = socketPath
+	return n
+}
+
+// Url returns the URL of the nix source to evaluate for the
+// repository located at repositoryPath checked out at commitId.
+func (n Nix) Url(repositoryPath, commitId string) string {
+	if n.config.NonFlake {
+		// The repository worktree is hard reset to the commitId
+		return filepath.Join(repositoryPath, n.config.File)
+	}
+	return fmt.Sprintf("git+file://%s?rev=%s", repositoryPath, commitId)
+}
+
+// PathUrl returns the url of a source extracted in the directory path,
+// such as the archive of a tarball remote
+func (n Nix) PathUrl(path string) string {
+	if n.config.NonFlake {
+		return filepath.Join(path, n.config.File)
+	}
+	return "path:" + path
+}
+
+var fullCommitIdRegexp = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// RevUrl returns the flake URL of the commit rev of the git repository
+// designated by flakeUrl: a local path or a git+, github:, gitlab: or
+// sourcehut: flake URL. Since nix doesn't resolve abbreviated commit
+// IDs, rev has to be a full commit ID.
+func RevUrl(flakeUrl, rev string) (string, error) {
+	if !fullCommitIdRegexp.MatchString(rev) {
+		return "", fmt.Errorf("The commit '%s' is not a full commit ID: nix requires the 40 hexadecimal characters of the commit ID", rev)
+	}
+	if !strings.Contains(flakeUrl, ":") {
+		path, err := filepath.Abs(flakeUrl)
+		if err != nil {
+			return "", err
+		}
+		flakeUrl = "git+file://" + path
+	}
+	u, err := url.Parse(flakeUrl)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasPrefix(u.Scheme, "git+"), u.Scheme == "github", u.Scheme == "gitlab", u.Scheme == "sourcehut":
+	default:
+		return "", fmt.Errorf("The flake URL '%s' doesn't designate a git repository: a commit can't be selected", flakeUrl)
+	}
+	query := u.Query()
+	query.Set("rev", rev)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// installable returns the nix arguments designating the attribute
+// attr of the nix source url. The url is a flake URL or the path of a
+// nix file when the NonFlake option is set.
+func (n Nix) installable(url, attr string) []string {
+	if n.config.NonFlake {
+		return []string{"--file", url, attr}
+	}
+	return []string{fmt.Sprintf("%s#%s", url, attr)}
+}
+
+// Impure returns true when configurations are evaluated in impure
+// mode.
+func (n Nix) Impure() bool {
+	return n.config.Impure
+}
+
+// Offline returns true when configurations are only activated if they
+// are already in the local Nix store.
+func (n Nix) Offline() bool {
+	return n.config.Offline
+}
+
+// evalArgs returns the arguments common to all nix commands
+// evaluating the configuration.
+func (n Nix) evalArgs() []string {
+	args := []string{}
+	if n.config.Impure {
+		args = append(args, "--impure")
+	}
+	if n.config.Offline {
+		args = append(args, "--offline")
+	}
+	return args
+}
+
+// sshOpts returns the ssh options used by nix to connect to ssh://
+// and ssh-ng:// stores and builders (the NIX_SSHOPTS variable).
+func (n Nix) sshOpts() string {
+	opts := []string{}
+	if n.config.Ssh.IdentityFile != "" {
+		opts = append(opts, "-i", n.config.Ssh.IdentityFile)
+	}
+	if n.config.Ssh.Port != 0 {
+		opts = append(opts, "-p", fmt.Sprintf("%d", n.config.Ssh.Port))
+	}
+	if n.config.Ssh.JumpHost != "" {
+		opts = append(opts, "-J", n.config.Ssh.JumpHost)
+	}
+	for _, o := range n.config.Ssh.Options {
+		opts = append(opts, "-o", o)
+	}
+	return strings.Join(opts, " ")
+}
+
+// proxyEnv returns the environment variables used by nix to contact
+// substituters through the proxy.
+func (n Nix) proxyEnv() []string {
+	if n.config.Proxy.URL == "" {
+		return nil
+	}
+	proxyURL := n.config.Proxy.URL
+	if n.config.Proxy.Username != "" {
+		if u, err := url.Parse(proxyURL); err == nil {
+			u.User = url.UserPassword(n.config.Proxy.Username, string(n.config.Proxy.Password))
+			proxyURL = u.String()
+		}
+	}
+	env := []string{}
+	for _, name := range []string{"http_proxy", "https_proxy", "all_proxy"} {
+		env = append(env, fmt.Sprintf("%s=%s", name, proxyURL))
+	}
+	return env
+}
+
+// env returns the environment variables added to the comin
+// environment to run nix commands.
+func (n Nix) env() []string {
+	env := n.proxyEnv()
+	if opts := n.sshOpts(); opts != "" {
+		env = append(env, fmt.Sprintf("NIX_SSHOPTS=%s", opts))
+	}
+	return env
+}
+
+// buildArgs returns the arguments bounding the resources used by
+// builds.
+func (n Nix) buildArgs() []string {
+	args := []string{}
+	if n.config.MaxJobs != "" {
+		args = append(args, "--max-jobs", n.config.MaxJobs)
+	}
+	if n.config.Cores != 0 {
+		args = append(args, "--cores", fmt.Sprintf("%d", n.config.Cores))
+	}
+	if n.config.BuildStore != "" {
+		// The derivation has been evaluated on the builder: it is
+		// already in the build store
+		args = append(args, "--store", n.config.BuildStore)
+	}
+	return args
+}
+
+func (n Nix) isHomeManager() bool {
+	return n.config.Mode == "home-manager"
+}
+
+// configurationAttrTemplate returns the attribute template of a
+// configuration, where %s is substituted by the hostname.
+func (n Nix) configurationAttrTemplate() string {
+	if n.config.ConfigurationAttr != "" {
+		return n.config.ConfigurationAttr
+	}
+	if n.isHomeManager() {
+		return "homeConfigurations.%s"
+	}
+	return "nixosConfigurations.%s"
+}
+
+// configurationAttr returns the attribute of the configuration of the
+// hostname.
+func (n Nix) configurationAttr(hostname string) string {
+	return fmt.Sprintf(n.configurationAttrTemplate(), hostname)
+}
+
+// configurationsAttr returns the attribute containing the
+// configurations, when the configuration attribute template ends
+// with the hostname.
+func (n Nix) configurationsAttr() (attr string, err error) {
+	template := n.configurationAttrTemplate()
+	if !strings.HasSuffix(template, ".%s") {
+		return "", fmt.Errorf("Configurations can not be listed from the attribute template '%s'", template)
+	}
+	return strings.TrimSuffix(template, ".%s"), nil
+}
+
+// toplevelAttr returns the attribute of the package to build and to
+// activate for the configuration hostname.
+func (n Nix) toplevelAttr(hostname string) string {
+	if n.isHomeManager() {
+		return n.configurationAttr(hostname) + ".activationPackage"
+	}
+	return n.configurationAttr(hostname) + ".config.system.build.toplevel"
+}
+
 // GetExpectedMachineId evals
-// nixosConfigurations.MACHINE.config.services.comin.machineId and
+// CONFIGURATION.config.services.comin.machineId and
 // returns (machine-id, nil) is comin.machineId is set, ("", nil) otherwise.
-func getExpectedMachineId(path, hostname string) (machineId string, err error) {
-	expr := fmt.Sprintf("%s#nixosConfigurations.%s.config.services.comin.machineId", path, hostname)
-	args := []string{
-		"eval",
-		expr,
-		"--json",
+// When comin.machineId is a list of accepted machine IDs, they are
+// separated by spaces.
+func (n Nix) getExpectedMachineId(ctx context.Context, path, hostname string) (machineId string, err error) {
+	// The comin module is not available in home-manager configurations
+	if n.isHomeManager() {
+		return "", nil
 	}
+	attr := n.configurationAttr(hostname) + ".config.services.comin.machineId"
+	args := []string{"eval"}
+	args = append(args, n.installable(path, attr)...)
+	args = append(args, "--json")
+	args = append(args, n.evalArgs()...)
+	args = append(args, n.overrideInputArgs(ctx)...)
 	var stdout bytes.Buffer
-	err = runNixCommand(args, &stdout, os.Stderr)
+	err = n.run(ctx, args, &stdout, stderr(ctx))
 	if err != nil {
 		return
 	}
-	var machineIdPtr *string
-	err = json.Unmarshal(stdout.Bytes(), &machineIdPtr)
-	if err != nil {
+	return parseMachineId(stdout.Bytes())
+}
+
+// parseMachineId parses the JSON value of the comin.machineId option:
+// null, a machine ID or a list of machine IDs
+func parseMachineId(value []byte) (machineId string, err error) {
+	var machineIds interface{}
+	if err = json.Unmarshal(value, &machineIds); err != nil {
 		return
 	}
-	if machineIdPtr != nil {
-		logrus.Debugf("Getting comin.machineId = %s", *machineIdPtr)
-		machineId = *machineIdPtr
-	} else {
+	switch v := machineIds.(type) {
+	case nil:
 		logrus.Debugf("Getting comin.machineId = null (not set)")
-		machineId = ""
+	case string:
+		machineId = v
+	case []interface{}:
+		ids := make([]string, 0, len(v))
+		for _, id := range v {
+			s, ok := id.(string)
+			if !ok {
+				return "", fmt.Errorf("The comin.machineId option is not a list of strings")
+			}
+			ids = append(ids, s)
+		}
+		machineId = strings.Join(ids, " ")
+	default:
+		return "", fmt.Errorf("The comin.machineId option is not a string or a list of strings")
+	}
+	if machineId != "" {
+		logrus.Debugf("Getting comin.machineId = %s", machineId)
 	}
 	return
 }
 
-func runNixCommand(args []string, stdout, stderr io.Writer) (err error) {
-	commonArgs := []string{"--extra-experimental-features", "nix-command", "--extra-experimental-features", "flakes", "--accept-flake-config"}
-	args = append(commonArgs, args...)
+// getSpecialisation evals
+// CONFIGURATION.config.services.comin.nix.specialisation and returns
+// the name of the specialisation to activate. The specialisation of
+// the comin configuration is used when this option is not set or
+// doesn't exist (home-manager configurations or older comin modules).
+func (n Nix) getSpecialisation(ctx context.Context, path, hostname string) (specialisation string, err error) {
+	if n.isHomeManager() {
+		return n.config.Specialisation, nil
+	}
+	attr := n.configurationAttr(hostname) + ".config.services.comin"
+	args := []string{"eval"}
+	args = append(args, n.installable(path, attr)...)
+	args = append(args, "--apply", "c: c.nix.specialisation or null", "--json")
+	args = append(args, n.evalArgs()...)
+	args = append(args, n.overrideInputArgs(ctx)...)
+	var stdout bytes.Buffer
+	err = n.run(ctx, args, &stdout, stderr(ctx))
+	if err != nil {
+		return
+	}
+	var specialisationPtr *string
+	err = json.Unmarshal(stdout.Bytes(), &specialisationPtr)
+	if err != nil {
+		return
+	}
+	if specialisationPtr == nil || *specialisationPtr == "" {
+		return n.config.Specialisation, nil
+	}
+	logrus.Debugf("Getting comin.nix.specialisation = %s", *specialisationPtr)
+	return *specialisationPtr, nil
+}
+
+// evalAttrArgs returns the arguments of the evaluation of the
+// attribute attr of the configuration of the hostname
+func (n Nix) evalAttrArgs(ctx context.Context, flakeUrl, hostname, attr string) []string {
+	args := []string{"eval"}
+	args = append(args, n.installable(flakeUrl, n.configurationAttr(hostname)+"."+attr)...)
+	args = append(args, "--json")
+	args = append(args, n.evalArgs()...)
+	args = append(args, n.overrideInputArgs(ctx)...)
+	return args
+}
+
+// EvalAttr evaluates the attribute attr of the configuration of the
+// hostname, such as config.networking.hostName, and returns its
+// value in JSON.
+func (n Nix) EvalAttr(ctx context.Context, flakeUrl, hostname, attr string) (value string, err error) {
+	n, ctx, flakeUrl, err = n.evaluator(ctx, flakeUrl)
+	if err != nil {
+		return
+	}
+	var stdout bytes.Buffer
+	err = n.run(ctx, n.evalAttrArgs(ctx, flakeUrl, hostname, attr), &stdout, stderr(ctx))
+	if err != nil {
+		return
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// SpecialisationOutPath returns the outPath of the specialisation
+// named specialisation of the configuration outPath.
+func SpecialisationOutPath(outPath, specialisation string) (string, error) {
+	path, err := filepath.EvalSymlinks(filepath.Join(outPath, "specialisation", specialisation))
+	if err != nil {
+		return "", fmt.Errorf("The specialisation '%s' doesn't exist in '%s'", specialisation, outPath)
+	}
+	return path, nil
+}
+
+// run runs a nix command with the environment required by the nix
+// configuration of comin.
+func (n Nix) run(ctx context.Context, args []string, stdout, stderr io.Writer) (err error) {
+	if n.remoteHost != "" {
+		return n.runRemote(ctx, args, stdout, stderr)
+	}
+	var env []string
+	if vars := n.env(); len(vars) != 0 {
+		env = append(os.Environ(), vars...)
+	}
+	return runNixCommandWithEnv(ctx, args, env, stdout, stderr)
+}
+
+func runNixCommand(ctx context.Context, args []string, stdout, stderr io.Writer) (err error) {
+	return runNixCommandWithEnv(ctx, args, nil, stdout, stderr)
+}
+
+// runNixCommandWithEnv runs a nix command with the env environment. The
+// environment of comin is used when env is nil.
+func runNixCommandWithEnv(ctx context.Context, args []string, env []string, stdout, stderr io.Writer) (err error) {
+	args = append(commonArgs(), args...)
 	cmdStr := fmt.Sprintf("nix %s", strings.Join(args, " "))
 	logrus.Infof("Running '%s'", cmdStr)
-	cmd := exec.Command("nix", args...)
+	// The command is killed when the context is done, for instance
+	// when the deployment timeout is exceeded
+	cmd := exec.CommandContext(ctx, "nix", args...)
+	cmd.Env = env
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
 	err = cmd.Run()
@@ -60,24 +402,73 @@ func runNixCommand(args []string, stdout, stderr io.Writer) (err error) {
 	return nil
 }
 
-func Eval(ctx context.Context, flakeUrl, hostname string) (drvPath string, outPath string, machineId string, err error) {
-	drvPath, outPath, err = ShowDerivation(ctx, flakeUrl, hostname)
+// commonArgs returns the arguments of all nix commands
+func commonArgs() []string {
+	return []string{"--extra-experimental-features", "nix-command", "--extra-experimental-features", "flakes", "--accept-flake-config"}
+}
+
+// Eval evaluates the configuration of the hostname. When a build store
+// is set, the configuration is evaluated on the builder and not
+// locally (see evaluator).
+func (n Nix) Eval(ctx context.Context, flakeUrl, hostname string) (drvPath string, outPath string, machineId string, specialisation string, err error) {
+	n, ctx, flakeUrl, err = n.evaluator(ctx, flakeUrl)
+	if err != nil {
+		return
+	}
+	drvPath, outPath, err = n.showDerivationPaths(ctx, flakeUrl, hostname)
+	if err != nil {
+		return
+	}
+	machineId, err = n.getExpectedMachineId(ctx, flakeUrl, hostname)
 	if err != nil {
 		return
 	}
-	machineId, err = getExpectedMachineId(flakeUrl, hostname)
+	specialisation, err = n.getSpecialisation(ctx, flakeUrl, hostname)
 	return
 }
 
-func ShowDerivation(ctx context.Context, flakeUrl, hostname string) (drvPath string, outPath string, err error) {
-	installable := fmt.Sprintf("%s#nixosConfigurations.%s.config.system.build.toplevel", flakeUrl, hostname)
-	args := []string{
-		"show-derivation",
-		installable,
-		"-L",
+// showDerivation runs the command showing the derivation of the
+// hostname configuration. When the nix version has not been detected,
+// 'nix derivation show' is tried first and 'nix show-derivation' is
+// used as a fallback.
+func (n Nix) showDerivation(ctx context.Context, flakeUrl, hostname string) (stdout bytes.Buffer, err error) {
+	candidates := [][]string{derivationShowArgs, showDerivationArgs}
+	if n.showDerivationArgs != nil {
+		candidates = [][]string{n.showDerivationArgs}
 	}
-	var stdout bytes.Buffer
-	err = runNixCommand(args, &stdout, os.Stderr)
+	errs := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		args := append([]string{}, c...)
+		args = append(args, n.installable(flakeUrl, n.toplevelAttr(hostname))...)
+		args = append(args, "-L")
+		args = append(args, n.evalArgs()...)
+		args = append(args, n.overrideInputArgs(ctx)...)
+		stdout.Reset()
+		err = n.run(ctx, args, &stdout, stderr(ctx))
+		if err == nil {
+			return
+		}
+		errs = append(errs, err.Error())
+	}
+	if len(candidates) > 1 {
+		err = fmt.Errorf("Neither 'nix derivation show' nor 'nix show-derivation' works: %s", strings.Join(errs, ", "))
+	}
+	return
+}
+
+// ShowDerivation returns the derivation and the output paths of the
+// configuration of the hostname, evaluated on the builder when a
+// build store is set
+func (n Nix) ShowDerivation(ctx context.Context, flakeUrl, hostname string) (drvPath string, outPath string, err error) {
+	n, ctx, flakeUrl, err = n.evaluator(ctx, flakeUrl)
+	if err != nil {
+		return
+	}
+	return n.showDerivationPaths(ctx, flakeUrl, hostname)
+}
+
+func (n Nix) showDerivationPaths(ctx context.Context, flakeUrl, hostname string) (drvPath string, outPath string, err error) {
+	stdout, err := n.showDerivation(ctx, flakeUrl, hostname)
 	if err != nil {
 		return
 	}
@@ -91,6 +482,10 @@ func ShowDerivation(ctx context.Context, flakeUrl, hostname string) (drvPath str
 	for key := range output {
 		keys = append(keys, key)
 	}
+	if len(keys) == 0 {
+		err = fmt.Errorf("No derivation found for the configuration '%s'", hostname)
+		return
+	}
 	drvPath = keys[0]
 	outPath = output[drvPath].Outputs.Out.Path
 	logrus.Infof("The derivation path is %s", drvPath)
@@ -112,9 +507,14 @@ type Derivation struct {
 
 type Show struct {
 	NixosConfigurations map[string]struct{} `json:"nixosConfigurations"`
+	HomeConfigurations  map[string]struct{} `json:"homeConfigurations"`
 }
 
-func List(flakeUrl string) (hosts []string, err error) {
+func (n Nix) List(ctx context.Context, flakeUrl string) (hosts []string, err error) {
+	// Only standard flake outputs are shown by nix flake show
+	if n.config.NonFlake || n.config.ConfigurationAttr != "" {
+		return n.listAttrNames(ctx, flakeUrl)
+	}
 	args := []string{
 		"flake",
 		"show",
@@ -122,7 +522,7 @@ func List(flakeUrl string) (hosts []string, err error) {
 		flakeUrl,
 	}
 	var stdout bytes.Buffer
-	err = runNixCommand(args, &stdout, os.Stderr)
+	err = n.run(ctx, args, &stdout, stderr(ctx))
 	if err != nil {
 		return
 	}
@@ -132,33 +532,162 @@ func List(flakeUrl string) (hosts []string, err error) {
 	if err != nil {
 		return
 	}
-	hosts = make([]string, 0, len(output.NixosConfigurations))
-	for key := range output.NixosConfigurations {
+	configurations := output.NixosConfigurations
+	if n.isHomeManager() {
+		configurations = output.HomeConfigurations
+	}
+	hosts = make([]string, 0, len(configurations))
+	for key := range configurations {
 		hosts = append(hosts, key)
 	}
 	return
 }
 
-func Build(ctx context.Context, drvPath string) (err error) {
+// listAttrNames lists the configuration attribute names by
+// evaluating the attribute containing the configurations.
+func (n Nix) listAttrNames(ctx context.Context, url string) (hosts []string, err error) {
+	attr, err := n.configurationsAttr()
+	if err != nil {
+		return
+	}
+	args := []string{"eval"}
+	args = append(args, n.installable(url, attr)...)
+	args = append(args, "--apply", "builtins.attrNames", "--json")
+	var stdout bytes.Buffer
+	err = n.run(ctx, args, &stdout, stderr(ctx))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(stdout.Bytes(), &hosts)
+	return
+}
+
+// Build builds the derivation drvPath. Builds failing because of a
+// transient error are retried with an exponential backoff.
+func (n Nix) Build(ctx context.Context, drvPath string) (err error) {
 	args := []string{
 		"build",
 		fmt.Sprintf("%s^*", drvPath),
 		"-L",
 		"--no-link"}
-	err = runNixCommand(args, os.Stdout, os.Stderr)
+	args = append(args, n.evalArgs()...)
+	args = append(args, n.buildArgs()...)
+	delay := time.Duration(n.config.BuildRetryDelay) * time.Second
+	return withRetries(ctx, n.config.BuildRetries, delay, func(w io.Writer) error {
+		return n.run(ctx, args, stdout(ctx), w)
+	})
+}
+
+// IsRealized returns true if the outPath is already in the local Nix
+// store.
+func (n Nix) IsRealized(ctx context.Context, outPath string) bool {
+	if outPath == "" {
+		return false
+	}
+	var out bytes.Buffer
+	args := []string{
+		"path-info",
+		outPath,
+	}
+	err := n.run(ctx, args, &out, &out)
+	return err == nil
+}
+
+// Realize builds the derivation drvPath, unless its outPath is already
+// in the local Nix store. Note paths available in substituters are
+// fetched by the build. In offline mode, the outPath has to be in the
+// local Nix store.
+func (n Nix) Realize(ctx context.Context, drvPath, outPath string) (skipped bool, err error) {
+	if n.IsRealized(ctx, outPath) {
+		logrus.Infof("nix: the outPath %s is already in the Nix store: skipping the build", outPath)
+		return true, nil
+	}
+	if n.config.Offline {
+		return false, fmt.Errorf("The outPath %s is not in the Nix store: it is not built in offline mode", outPath)
+	}
+	if err = n.Build(ctx, drvPath); err != nil {
+		return false, err
+	}
+	if n.config.BuildStore != "" {
+		err = n.copyFromBuildStore(ctx, outPath)
+	}
+	return false, err
+}
+
+// copyFromBuildStore copies the closure of the outPath from the build
+// store to the local store.
+func (n Nix) copyFromBuildStore(ctx context.Context, outPath string) error {
+	args := []string{
+		"copy",
+		"--from",
+		n.config.BuildStore,
+		outPath,
+	}
+	return n.run(ctx, args, stdout(ctx), stderr(ctx))
+}
+
+// currentProfile returns the path of the currently activated
+// configuration.
+func (n Nix) currentProfile() string {
+	if n.isHomeManager() {
+		return filepath.Join(os.Getenv("HOME"), ".local/state/nix/profiles/home-manager")
+	}
+	return "/run/current-system"
+}
+
+// ClosureDiff returns the closure diff between the currently running
+// configuration and the outPath, as computed by 'nix store
+// diff-closures'.
+func (n Nix) ClosureDiff(ctx context.Context, outPath string) (diff string, err error) {
+	args := []string{
+		"store",
+		"diff-closures",
+		n.currentProfile(),
+		outPath,
+	}
+	var stdout bytes.Buffer
+	err = n.run(ctx, args, &stdout, stderr(ctx))
 	if err != nil {
 		return
 	}
-	return
+	return stdout.String(), nil
+}
+
+// verifySignatures ensures all store paths of the outPath closure are
+// signed by enough trusted keys. It is a no-op when no trusted key is
+// configured.
+func (n Nix) verifySignatures(ctx context.Context, outPath string) error {
+	if len(n.config.TrustedPublicKeys) == 0 {
+		return nil
+	}
+	args := []string{
+		"store",
+		"verify",
+		"--recursive",
+		"--sigs-needed",
+		fmt.Sprintf("%d", n.config.SigsNeeded),
+		"--option",
+		"trusted-public-keys",
+		strings.Join(n.config.TrustedPublicKeys, " "),
+		outPath,
+	}
+	if err := n.run(ctx, args, stdout(ctx), stderr(ctx)); err != nil {
+		return fmt.Errorf("The closure of '%s' is not signed by the trusted public keys: %s", outPath, err)
+	}
+	logrus.Infof("The closure of '%s' is signed by the trusted public keys", outPath)
+	return nil
 }
 
-func setSystemProfile(operation string, outPath string, dryRun bool) error {
+// setSystemProfile adds the outPath to the system profile. This is only
+// done for the switch and boot operations: the test and dry-activate
+// operations don't create any boot entry.
+func setSystemProfile(ctx context.Context, operation string, outPath string, dryRun bool) error {
 	if operation == "switch" || operation == "boot" {
 		cmdStr := fmt.Sprintf("nix-env --profile /nix/var/nix/profiles/system --set %s", outPath)
 		logrus.Infof("Running '%s'", cmdStr)
 		cmd := exec.Command("nix-env", "--profile", "/nix/var/nix/profiles/system", "--set", outPath)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		cmd.Stdout = stdout(ctx)
+		cmd.Stderr = stderr(ctx)
 		if dryRun {
 			logrus.Infof("Dry-run enabled: '%s' has not been executed", cmdStr)
 		} else {
@@ -172,24 +701,22 @@ func setSystemProfile(operation string, outPath string, dryRun bool) error {
 	return nil
 }
 
-func createGcRoot(stateDir, outPath string, dryRun bool) error {
-	gcRootDir := filepath.Join(stateDir, "gcroots")
-	gcRoot := filepath.Join(
-		gcRootDir,
-		fmt.Sprintf("switch-to-configuration"))
-	if dryRun {
-		logrus.Infof("Dry-run enabled: 'ln -s %s %s'", outPath, gcRoot)
-		return nil
+// CollectGarbage runs nix-collect-garbage. When deleteOlderThan is
+// not empty, generations older than this period are also deleted.
+func CollectGarbage(ctx context.Context, deleteOlderThan string) error {
+	args := []string{}
+	if deleteOlderThan != "" {
+		args = append(args, "--delete-older-than", deleteOlderThan)
 	}
-	if err := os.MkdirAll(gcRootDir, 0750); err != nil {
-		return err
-	}
-	// TODO: only remove if file already exists
-	os.Remove(gcRoot)
-	if err := os.Symlink(outPath, gcRoot); err != nil {
-		return fmt.Errorf("Failed to create symlink 'ln -s %s %s': %s", outPath, gcRoot, err)
+	cmdStr := fmt.Sprintf("nix-collect-garbage %s", strings.Join(args, " "))
+	logrus.Infof("Running '%s'", cmdStr)
+	cmd := exec.CommandContext(ctx, "nix-collect-garbage", args...)
+	cmd.Stdout = stdout(ctx)
+	cmd.Stderr = stderr(ctx)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Command '%s' fails with %s", cmdStr, err)
 	}
-	logrus.Infof("Creating gcroot '%s'", gcRoot)
+	logrus.Infof("Command '%s' succeeded", cmdStr)
 	return nil
 }
 
@@ -209,33 +736,113 @@ func cominUnitFileHash() string {
 	return hash
 }
 
-func switchToConfiguration(operation string, outPath string, dryRun bool) error {
+// switchToConfiguration runs the switch-to-configuration script of
+// the outPath. Its output (units restarted, warnings...) is returned,
+// even if the script fails, in order to be recorded in the
+// deployment. For the dry-activate operation, it reports the changes
+// a switch would do.
+func switchToConfiguration(ctx context.Context, operation string, outPath string, dryRun bool) (output string, err error) {
 	switchToConfigurationExe := filepath.Join(outPath, "bin", "switch-to-configuration")
 	logrus.Infof("Running '%s %s'", switchToConfigurationExe, operation)
 	cmd := exec.Command(switchToConfigurationExe, operation)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	var buf bytes.Buffer
+	cmd.Stdout = io.MultiWriter(stdout(ctx), &buf)
+	cmd.Stderr = io.MultiWriter(stderr(ctx), &buf)
 	if dryRun {
-		logrus.Infof("Dry-run enabled: '%s switch' has not been executed", switchToConfigurationExe)
+		logrus.Infof("Dry-run enabled: '%s %s' has not been executed", switchToConfigurationExe, operation)
 	} else {
 		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("Command %s switch fails with %s", switchToConfigurationExe, err)
+			return buf.String(), fmt.Errorf("Command %s %s fails with %s", switchToConfigurationExe, operation, err)
 		}
-		logrus.Infof("Switch successfully terminated")
+		logrus.Infof("Command '%s %s' successfully terminated", switchToConfigurationExe, operation)
 	}
-	return nil
+	return buf.String(), nil
 }
 
-func Deploy(ctx context.Context, expectedMachineId, outPath, operation string) (needToRestartComin bool, err error) {
-	beforeCominUnitFileHash := cominUnitFileHash()
+// activateHomeManager runs the activation script of a home-manager
+// configuration and returns its output. Since the activation script
+// manages the environment of the user running it, comin has to be run
+// by this user.
+func activateHomeManager(ctx context.Context, outPath string) (output string, err error) {
+	activateExe := filepath.Join(outPath, "activate")
+	logrus.Infof("Running '%s'", activateExe)
+	cmd := exec.Command(activateExe)
+	var buf bytes.Buffer
+	cmd.Stdout = io.MultiWriter(stdout(ctx), &buf)
+	cmd.Stderr = io.MultiWriter(stderr(ctx), &buf)
+	if err := cmd.Run(); err != nil {
+		return buf.String(), fmt.Errorf("Command %s fails with %s", activateExe, err)
+	}
+	logrus.Infof("Activation successfully terminated")
+	return buf.String(), nil
+}
 
+// switchSystem adds the outPath to the system profile and runs its
+// switch-to-configuration script
+func switchSystem(ctx context.Context, outPath, operation string) (output string, err error) {
 	// This is required to write boot entries
-	// Only do this is operation is switch or boot
-	if err = setSystemProfile(operation, outPath, false); err != nil {
+	// Only do this is operation is switch or boot: the test
+	// operation activates the configuration without boot entry
+	if err = setSystemProfile(ctx, operation, outPath, false); err != nil {
+		return
+	}
+	return switchToConfiguration(ctx, operation, outPath, false)
+}
+
+// ActivateSystem is run by the activation helper on behalf of the
+// unprivileged comin daemon: the signatures of the closure are
+// verified again before outPath is activated.
+func (n Nix) ActivateSystem(ctx context.Context, outPath, operation string) (output string, err error) {
+	if err = n.verifySignatures(ctx, outPath); err != nil {
+		return
+	}
+	return switchSystem(ctx, outPath, operation)
+}
+
+func (n Nix) Deploy(ctx context.Context, expectedMachineId, outPath, operation string) (needToRestartComin bool, output string, err error) {
+	// Unsigned or tampered store paths are never activated
+	if err = n.verifySignatures(ctx, outPath); err != nil {
+		return
+	}
+	return n.activate(ctx, outPath, operation)
+}
+
+// CurrentSystem returns the outPath of the currently activated
+// configuration.
+func (n Nix) CurrentSystem() (string, error) {
+	return filepath.EvalSymlinks(n.currentProfile())
+}
+
+// Rollback activates the outPath of a previously activated
+// configuration. Its signatures are not verified since it has
+// already been activated.
+func (n Nix) Rollback(ctx context.Context, outPath, operation string) error {
+	logrus.Infof("Rolling back to the configuration %s", outPath)
+	_, _, err := n.activate(ctx, outPath, operation)
+	return err
+}
+
+func (n Nix) activate(ctx context.Context, outPath, operation string) (needToRestartComin bool, output string, err error) {
+	// A home-manager configuration doesn't have any boot entry nor
+	// the comin systemd service
+	if n.isHomeManager() {
+		if output, err = activateHomeManager(ctx, outPath); err != nil {
+			return
+		}
+		logrus.Infof("Deployment succeeded")
 		return
 	}
 
-	if err = switchToConfiguration(operation, outPath, false); err != nil {
+	beforeCominUnitFileHash := cominUnitFileHash()
+
+	if n.activationHelperSocket != "" {
+		logrus.Infof("Activating %s with the activation helper", outPath)
+		output, err = activation.New(n.activationHelperSocket).Activate(ctx, outPath, operation)
+		io.WriteString(stdout(ctx), output)
+	} else {
+		output, err = switchSystem(ctx, outPath, operation)
+	}
+	if err != nil {
 		return
 	}
 
@@ -0,0 +1,31 @@
+package nix
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+type outputKey struct{}
+
+// WithOutput returns a context where the output of commands run by
+// this package is also written to w, in addition to the comin stdout
+// and stderr. This is used to persist logs of a generation.
+func WithOutput(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, outputKey{}, w)
+}
+
+func output(ctx context.Context, std io.Writer) io.Writer {
+	if w, ok := ctx.Value(outputKey{}).(io.Writer); ok && w != nil {
+		return io.MultiWriter(std, w)
+	}
+	return std
+}
+
+func stdout(ctx context.Context) io.Writer {
+	return output(ctx, os.Stdout)
+}
+
+func stderr(ctx context.Context) io.Writer {
+	return output(ctx, os.Stderr)
+}
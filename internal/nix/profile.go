@@ -0,0 +1,119 @@
+package nix
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// profile returns the path of the profile containing the generations
+// of the activated configurations.
+func (n Nix) profile() string {
+	if n.isHomeManager() {
+		return filepath.Join(os.Getenv("HOME"), ".local/state/nix/profiles/home-manager")
+	}
+	return "/nix/var/nix/profiles/system"
+}
+
+// ProfileGeneration is a generation of the profile.
+type ProfileGeneration struct {
+	Number  int
+	OutPath string
+}
+
+// listProfileGenerations returns the generations of the profile
+// sorted by number, and the number of the current generation.
+func listProfileGenerations(profile string) (generations []ProfileGeneration, current int, err error) {
+	link, err := os.Readlink(profile)
+	if err != nil {
+		return
+	}
+	name := filepath.Base(profile)
+	re := regexp.MustCompile(fmt.Sprintf(`^%s-(\d+)-link$`, regexp.QuoteMeta(name)))
+	if m := re.FindStringSubmatch(filepath.Base(link)); m != nil {
+		current, _ = strconv.Atoi(m[1])
+	}
+	entries, err := os.ReadDir(filepath.Dir(profile))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		m := re.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+		number, _ := strconv.Atoi(m[1])
+		outPath, err := filepath.EvalSymlinks(filepath.Join(filepath.Dir(profile), entry.Name()))
+		if err != nil {
+			continue
+		}
+		generations = append(generations, ProfileGeneration{Number: number, OutPath: outPath})
+	}
+	sort.Slice(generations, func(i, j int) bool {
+		return generations[i].Number < generations[j].Number
+	})
+	return
+}
+
+// CurrentProfileGeneration returns the number of the current
+// generation of the profile.
+func (n Nix) CurrentProfileGeneration() (int, error) {
+	_, current, err := listProfileGenerations(n.profile())
+	if err != nil {
+		return 0, err
+	}
+	if current == 0 {
+		return 0, fmt.Errorf("The profile %s doesn't point to a generation", n.profile())
+	}
+	return current, nil
+}
+
+// resolveRollbackTarget returns the outPath of the target, which is
+// either empty to designate the generation preceding the current one,
+// a generation number of the profile or a commit ID (or a prefix)
+// deployed by comin whose gcroot still exists.
+func resolveRollbackTarget(profile, gcRootsDir, target string) (outPath string, err error) {
+	generations, current, err := listProfileGenerations(profile)
+	if err != nil {
+		return "", fmt.Errorf("Failed to list the generations of the profile %s: %s", profile, err)
+	}
+	if target == "" {
+		for i := len(generations) - 1; i >= 0; i-- {
+			if generations[i].Number < current {
+				return generations[i].OutPath, nil
+			}
+		}
+		return "", fmt.Errorf("The profile %s has no generation older than the current generation %d", profile, current)
+	}
+	// Commit IDs are abbreviated to at least 7 characters
+	if number, err := strconv.Atoi(target); err == nil && len(target) < 7 {
+		for _, g := range generations {
+			if g.Number == number {
+				return g.OutPath, nil
+			}
+		}
+		return "", fmt.Errorf("The generation %d of the profile %s doesn't exist", number, profile)
+	}
+	gcRoots, err := ListGcRoots(gcRootsDir)
+	if err != nil {
+		return "", err
+	}
+	for _, gcRoot := range gcRoots {
+		if strings.HasPrefix(gcRoot.CommitId, target) {
+			return gcRoot.OutPath, nil
+		}
+	}
+	return "", fmt.Errorf("No deployed configuration of the commit %s is kept in %s", target, gcRootsDir)
+}
+
+// ResolveRollbackTarget returns the outPath of a rollback target: the
+// previous generation of the profile when the target is empty, a
+// generation number of the profile or a commit ID previously deployed
+// by comin.
+func (n Nix) ResolveRollbackTarget(target string) (string, error) {
+	return resolveRollbackTarget(n.profile(), n.config.GcRootsDir, target)
+}
@@ -0,0 +1,42 @@
+package nix
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveRollbackTarget(t *testing.T) {
+	dir := t.TempDir()
+	profiles := filepath.Join(dir, "profiles")
+	assert.Nil(t, os.MkdirAll(profiles, 0755))
+	for _, n := range []string{"1", "2", "3"} {
+		outPath := filepath.Join(dir, "system-"+n)
+		assert.Nil(t, os.MkdirAll(outPath, 0755))
+		assert.Nil(t, os.Symlink(outPath, filepath.Join(profiles, "system-"+n+"-link")))
+	}
+	profile := filepath.Join(profiles, "system")
+	assert.Nil(t, os.Symlink("system-3-link", profile))
+	gcRootsDir := filepath.Join(dir, "gcroots")
+	assert.Nil(t, createGcRoot(gcRootsDir, "ad7c3f0e2b1a", filepath.Join(dir, "system-1"), time.Now()))
+
+	outPath, err := resolveRollbackTarget(profile, gcRootsDir, "")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "system-2"), outPath)
+
+	outPath, err = resolveRollbackTarget(profile, gcRootsDir, "1")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "system-1"), outPath)
+
+	outPath, err = resolveRollbackTarget(profile, gcRootsDir, "ad7c3f0")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "system-1"), outPath)
+
+	_, err = resolveRollbackTarget(profile, gcRootsDir, "4")
+	assert.NotNil(t, err)
+	_, err = resolveRollbackTarget(profile, gcRootsDir, "0123abcd")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,48 @@
+package nix
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The components of a system which are only updated by a reboot
+var bootComponents = []string{"kernel", "initrd", "kernel-modules", "systemd"}
+
+// rebootNeeded returns true if a component of the system
+// systemPath is different from the one of the booted system
+// bootedPath.
+func rebootNeeded(bootedPath, systemPath string) (bool, error) {
+	for _, c := range bootComponents {
+		booted, err := filepath.EvalSymlinks(filepath.Join(bootedPath, c))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		system, err := filepath.EvalSymlinks(filepath.Join(systemPath, c))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if booted != system {
+			logrus.Debugf("nix: the %s of the booted system %s is different from the one of the system %s", c, booted, system)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RebootNeeded returns true if the kernel, the initrd or systemd of
+// the system profile is different from the one of the booted
+// system.
+func (n Nix) RebootNeeded() (bool, error) {
+	if n.isHomeManager() {
+		return false, nil
+	}
+	return rebootNeeded("/run/booted-system", "/nix/var/nix/profiles/system")
+}
@@ -0,0 +1,34 @@
+package nix
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeSystem(t *testing.T, dir, name, kernel string) string {
+	system := filepath.Join(dir, name)
+	assert.Nil(t, os.MkdirAll(system, 0755))
+	assert.Nil(t, os.Symlink(filepath.Join(dir, kernel), filepath.Join(system, "kernel")))
+	return system
+}
+
+func TestRebootNeeded(t *testing.T) {
+	dir := t.TempDir()
+	for _, k := range []string{"kernel-1", "kernel-2"} {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, k), []byte{}, 0644))
+	}
+	booted := makeSystem(t, dir, "booted", "kernel-1")
+	same := makeSystem(t, dir, "same", "kernel-1")
+	updated := makeSystem(t, dir, "updated", "kernel-2")
+
+	needed, err := rebootNeeded(booted, same)
+	assert.Nil(t, err)
+	assert.False(t, needed)
+
+	needed, err = rebootNeeded(booted, updated)
+	assert.Nil(t, err)
+	assert.True(t, needed)
+}
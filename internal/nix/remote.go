@@ -0,0 +1,101 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// flakeArchive is the output of nix flake archive --json
+type flakeArchive struct {
+	Path   string                  `json:"path"`
+	Inputs map[string]flakeArchive `json:"inputs"`
+}
+
+// sshDestination returns the ssh destination ([user@]host) of the
+// ssh:// or ssh-ng:// store
+func sshDestination(store string) (string, error) {
+	u, err := url.Parse(store)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "ssh" && u.Scheme != "ssh-ng") || u.Host == "" {
+		return "", fmt.Errorf("The store '%s' is not a ssh:// or ssh-ng:// store", store)
+	}
+	if u.User != nil {
+		return u.User.Username() + "@" + u.Host, nil
+	}
+	return u.Host, nil
+}
+
+// shellQuote quotes the argument for the remote shell run by ssh
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// evaluator returns the Nix evaluating the configurations of the flake
+// flakeUrl, with the context and the flake URL to use. When a build
+// store is set, nixpkgs is not evaluated locally: the flake and its
+// overridden inputs are copied to the build store with nix flake
+// archive and the configurations are evaluated on the builder, over
+// ssh. The derivations are then in the build store.
+func (n Nix) evaluator(ctx context.Context, flakeUrl string) (Nix, context.Context, string, error) {
+	if n.config.BuildStore == "" || n.config.NonFlake || n.remoteHost != "" {
+		return n, ctx, flakeUrl, nil
+	}
+	destination, err := sshDestination(n.config.BuildStore)
+	if err != nil {
+		return n, ctx, "", err
+	}
+	args := []string{"flake", "archive", "--json", "--to", n.config.BuildStore, flakeUrl}
+	args = append(args, n.overrideInputArgs(ctx)...)
+	var stdout bytes.Buffer
+	if err := n.run(ctx, args, &stdout, stderr(ctx)); err != nil {
+		return n, ctx, "", fmt.Errorf("Failed to copy the flake to the build store: %s", err)
+	}
+	var archive flakeArchive
+	if err := json.Unmarshal(stdout.Bytes(), &archive); err != nil {
+		return n, ctx, "", err
+	}
+	if inputs, ok := ctx.Value(inputsKey{}).(map[string]string); ok {
+		remoteInputs := make(map[string]string, len(inputs))
+		for name := range inputs {
+			input, ok := archive.Inputs[name]
+			if !ok {
+				return n, ctx, "", fmt.Errorf("The input '%s' has not been copied to the build store", name)
+			}
+			remoteInputs[name] = "path:" + input.Path
+		}
+		ctx = WithInputs(ctx, remoteInputs)
+	}
+	n.remoteHost = destination
+	// The nix version of the builder is not detected
+	n.showDerivationArgs = nil
+	return n, ctx, "path:" + archive.Path, nil
+}
+
+// runRemote runs a nix command on the builder over ssh
+func (n Nix) runRemote(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	command := []string{"nix"}
+	for _, arg := range append(commonArgs(), args...) {
+		command = append(command, shellQuote(arg))
+	}
+	sshArgs := strings.Fields(n.sshOpts())
+	sshArgs = append(sshArgs, n.remoteHost, "--", strings.Join(command, " "))
+	cmdStr := fmt.Sprintf("ssh %s", strings.Join(sshArgs, " "))
+	logrus.Infof("Running '%s'", cmdStr)
+	cmd := exec.CommandContext(ctx, "ssh", sshArgs...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Command '%s' fails with %s", cmdStr, err)
+	}
+	return nil
+}
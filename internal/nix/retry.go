@@ -0,0 +1,71 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// transientErrors are the patterns of the nix error messages caused
+// by transient failures, such as network issues or substituter
+// timeouts. Other errors, such as evaluation errors, are
+// deterministic and are then never retried.
+var transientErrors = []string{
+	"unable to download",
+	"Couldn't resolve host name",
+	"Could not resolve host",
+	"Connection timed out",
+	"Connection reset by peer",
+	"Connection refused",
+	"Operation timed out",
+	"Timeout was reached",
+	"HTTP error 429",
+	"HTTP error 500",
+	"HTTP error 502",
+	"HTTP error 503",
+	"HTTP error 504",
+	"cannot connect to",
+	"SSL connection",
+	"Network is unreachable",
+}
+
+// isTransient returns true if the output of a failed nix command
+// reports a transient failure.
+func isTransient(output string) bool {
+	for _, p := range transientErrors {
+		if strings.Contains(output, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryDelay returns the delay before the retry number attempt
+// (starting at 1). The delay is doubled at each retry.
+func retryDelay(initial time.Duration, attempt int) time.Duration {
+	return initial << (attempt - 1)
+}
+
+// withRetries runs f until it succeeds, fails with a non transient
+// error or the number of retries is reached. The stderr of f is used
+// to detect transient failures.
+func withRetries(ctx context.Context, retries int, initialDelay time.Duration, f func(w io.Writer) error) (err error) {
+	for attempt := 0; ; attempt++ {
+		var buf bytes.Buffer
+		err = f(io.MultiWriter(stderr(ctx), &buf))
+		if err == nil || attempt >= retries || !isTransient(buf.String()) {
+			return
+		}
+		delay := retryDelay(initialDelay, attempt+1)
+		logrus.Warnf("nix: the build failed because of a transient error: retrying in %s (%d/%d)", delay, attempt+1, retries)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTransient(t *testing.T) {
+	assert.True(t, isTransient("error: unable to download 'https://cache.nixos.org/abc.narinfo': Timeout was reached (28)"))
+	assert.True(t, isTransient("error: cannot connect to socket at '/nix/var/nix/daemon-socket/socket'"))
+	assert.False(t, isTransient("error: undefined variable 'foo'"))
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, 10*time.Second, retryDelay(10*time.Second, 1))
+	assert.Equal(t, 20*time.Second, retryDelay(10*time.Second, 2))
+	assert.Equal(t, 40*time.Second, retryDelay(10*time.Second, 3))
+}
+
+func TestWithRetries(t *testing.T) {
+	ctx := context.Background()
+
+	calls := 0
+	err := withRetries(ctx, 2, time.Millisecond, func(w io.Writer) error {
+		calls++
+		fmt.Fprintln(w, "error: unable to download")
+		return fmt.Errorf("build failed")
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = withRetries(ctx, 2, time.Millisecond, func(w io.Writer) error {
+		calls++
+		if calls == 2 {
+			return nil
+		}
+		fmt.Fprintln(w, "error: unable to download")
+		return fmt.Errorf("build failed")
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, calls)
+
+	calls = 0
+	err = withRetries(ctx, 2, time.Millisecond, func(w io.Writer) error {
+		calls++
+		fmt.Fprintln(w, "error: undefined variable 'foo'")
+		return fmt.Errorf("build failed")
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, calls)
+}
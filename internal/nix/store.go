@@ -0,0 +1,67 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PingStore checks the store is reachable, for instance 'daemon' for
+// the Nix daemon or the URL of a binary cache
+func (n Nix) PingStore(ctx context.Context, store string) error {
+	var out bytes.Buffer
+	args := []string{
+		"store",
+		"ping",
+		"--store",
+		store,
+	}
+	return n.run(ctx, args, &out, stderr(ctx))
+}
+
+// parseSubstituters returns the substituters of the configuration
+// printed by 'nix show-config'
+func parseSubstituters(output string) []string {
+	for _, line := range strings.Split(output, "\n") {
+		split := strings.SplitN(line, "=", 2)
+		if len(split) == 2 && strings.TrimSpace(split[0]) == "substituters" {
+			return strings.Fields(split[1])
+		}
+	}
+	return nil
+}
+
+// Substituters returns the substituters used by nix
+func (n Nix) Substituters(ctx context.Context) ([]string, error) {
+	var out bytes.Buffer
+	if err := n.run(ctx, []string{"show-config"}, &out, stderr(ctx)); err != nil {
+		return nil, err
+	}
+	return parseSubstituters(out.String()), nil
+}
+
+// parseClosureSize returns the closure size printed by 'nix path-info
+// --closure-size'
+func parseClosureSize(output string) (int64, error) {
+	fields := strings.Fields(output)
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("Failed to parse the closure size from '%s'", strings.TrimSpace(output))
+	}
+	return strconv.ParseInt(fields[len(fields)-1], 10, 64)
+}
+
+// ClosureSize returns the size in bytes of the closure of the outPath
+func (n Nix) ClosureSize(ctx context.Context, outPath string) (int64, error) {
+	var out bytes.Buffer
+	args := []string{
+		"path-info",
+		"--closure-size",
+		outPath,
+	}
+	if err := n.run(ctx, args, &out, stderr(ctx)); err != nil {
+		return 0, err
+	}
+	return parseClosureSize(out.String())
+}
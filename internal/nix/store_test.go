@@ -0,0 +1,24 @@
+package nix
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSubstituters(t *testing.T) {
+	output := `sandbox = true
+substituters = https://cache.nixos.org/ https://cache.example.com
+trusted-substituters =
+`
+	assert.Equal(t, []string{"https://cache.nixos.org/", "https://cache.example.com"}, parseSubstituters(output))
+	assert.Empty(t, parseSubstituters("sandbox = true\n"))
+}
+
+func TestParseClosureSize(t *testing.T) {
+	size, err := parseClosureSize("/nix/store/ab4w9kh8k2rkd39hs6cwq3cp8m7s4h7a-nixos-system-machine\t 3453853720\n")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3453853720), size)
+	_, err = parseClosureSize("")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,83 @@
+package nix
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	derivationShowArgs = []string{"derivation", "show"}
+	showDerivationArgs = []string{"show-derivation"}
+)
+
+// parseVersion returns the major and minor numbers of the version
+// printed by 'nix --version', such as 'nix (Nix) 2.18.1'.
+func parseVersion(output string) (major, minor int, err error) {
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return 0, 0, fmt.Errorf("Failed to parse the nix version '%s'", output)
+	}
+	numbers := strings.SplitN(fields[len(fields)-1], ".", 3)
+	if len(numbers) < 2 {
+		return 0, 0, fmt.Errorf("Failed to parse the nix version '%s'", output)
+	}
+	if major, err = strconv.Atoi(numbers[0]); err != nil {
+		return 0, 0, fmt.Errorf("Failed to parse the nix version '%s': %s", output, err)
+	}
+	// The minor number can be suffixed, such as 2.19pre
+	minorStr := numbers[1]
+	if i := strings.IndexFunc(minorStr, func(r rune) bool {
+		return r < '0' || r > '9'
+	}); i >= 0 {
+		minorStr = minorStr[:i]
+	}
+	if minor, err = strconv.Atoi(minorStr); err != nil {
+		return 0, 0, fmt.Errorf("Failed to parse the nix version '%s': %s", output, err)
+	}
+	return
+}
+
+// supportsDerivationShow returns true if the 'nix derivation show'
+// command is available, ie. since Nix 2.15.
+func supportsDerivationShow(major, minor int) bool {
+	return major > 2 || (major == 2 && minor >= 15)
+}
+
+// Version returns the version printed by 'nix --version'
+func Version() (string, error) {
+	var stdout bytes.Buffer
+	cmd := exec.Command("nix", "--version")
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// DetectVersion runs 'nix --version' to select the command used to
+// show derivations. If the version can not be detected, both commands
+// are tried at evaluation time.
+func (n Nix) DetectVersion() Nix {
+	version, err := Version()
+	if err != nil {
+		logrus.Errorf("nix: failed to get the nix version: %s", err)
+		return n
+	}
+	major, minor, err := parseVersion(version)
+	if err != nil {
+		logrus.Errorf("nix: %s", err)
+		return n
+	}
+	logrus.Infof("nix: the nix version is %d.%d", major, minor)
+	if supportsDerivationShow(major, minor) {
+		n.showDerivationArgs = derivationShowArgs
+	} else {
+		n.showDerivationArgs = showDerivationArgs
+	}
+	return n
+}
@@ -0,0 +1,28 @@
+package nix
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVersion(t *testing.T) {
+	major, minor, err := parseVersion("nix (Nix) 2.18.1\n")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, major)
+	assert.Equal(t, 18, minor)
+	assert.True(t, supportsDerivationShow(major, minor))
+
+	major, minor, err = parseVersion("nix (Nix) 2.13.6")
+	assert.Nil(t, err)
+	assert.False(t, supportsDerivationShow(major, minor))
+
+	major, minor, err = parseVersion("nix (Nix) 2.19pre20231020_dirty")
+	assert.Nil(t, err)
+	assert.Equal(t, 19, minor)
+
+	_, _, err = parseVersion("")
+	assert.NotNil(t, err)
+	_, _, err = parseVersion("nix (Nix) unknown")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,80 @@
+package notify
+
+import (
+	"context"
+	"time"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/nlewo/comin/internal/utils"
+)
+
+// discordColors are the colors of the embeds of the events
+var discordColors = map[Event]int{
+	Start:   0x3498db,
+	Success: 0x2ecc71,
+	Failure: 0xe74c3c,
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description,omitempty"`
+	Color       int            `json:"color"`
+	Fields      []discordField `json:"fields"`
+	Timestamp   string         `json:"timestamp,omitempty"`
+}
+
+type discordMessage struct {
+	Embeds []discordEmbed `json:"embeds"`
+}
+
+// discord posts the notifications as embeds to a Discord webhook
+type discord struct {
+	config types.Discord
+}
+
+func newDiscord(config types.Discord) discord {
+	return discord{config: config}
+}
+
+func (d discord) Name() string {
+	return "the Discord webhook"
+}
+
+// embed returns the embed summarizing the notification
+func (d discord) embed(n Notification) discordEmbed {
+	e := discordEmbed{
+		Title: Title(n),
+		Color: discordColors[n.Event],
+		Fields: []discordField{
+			{Name: "Host", Value: n.Host, Inline: true},
+			{Name: "Branch", Value: n.RemoteName + "/" + n.BranchName, Inline: true},
+			{Name: "Commit", Value: shortCommitId(n.CommitId), Inline: true},
+			{Name: "Result", Value: n.Result, Inline: true},
+		},
+	}
+	if n.Event != Start {
+		e.Fields = append(e.Fields, discordField{Name: "Duration", Value: duration(n).String(), Inline: true})
+	}
+	if n.CommitSubject != "" {
+		e.Description = n.CommitSubject
+	}
+	if n.ErrorMsg != "" {
+		e.Description += "\n**Error:** " + n.ErrorMsg
+	}
+	if !n.StartAt.IsZero() {
+		e.Timestamp = n.StartAt.UTC().Format(time.RFC3339)
+	}
+	return e
+}
+
+func (d discord) Send(ctx context.Context, n Notification) error {
+	msg := discordMessage{Embeds: []discordEmbed{d.embed(n)}}
+	// The URL of the webhook is a secret
+	return withoutUrl(utils.PostJson(ctx, string(d.config.URL), nil, msg))
+}
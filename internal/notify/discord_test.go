@@ -0,0 +1,50 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscord(t *testing.T) {
+	var msg discordMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&msg))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	d := newDiscord(types.Discord{URL: types.Secret(server.URL)})
+	err := d.Send(context.Background(), Notification{
+		Event:         Failure,
+		Host:          "machine",
+		CommitId:      "3f2a9c1d5e",
+		CommitSubject: "Upgrade nginx",
+		RemoteName:    "origin",
+		BranchName:    "main",
+		Result:        "failed",
+		ErrorMsg:      "activation failed",
+		StartAt:       time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC),
+		Duration:      75,
+	})
+	assert.Nil(t, err)
+	assert.Len(t, msg.Embeds, 1)
+	e := msg.Embeds[0]
+	assert.Equal(t, "machine: the deployment of 3f2a9c1d failed", e.Title)
+	assert.Equal(t, "Upgrade nginx\n**Error:** activation failed", e.Description)
+	assert.Equal(t, 0xe74c3c, e.Color)
+	assert.Equal(t, "2024-01-01T10:00:00Z", e.Timestamp)
+	assert.Equal(t, []discordField{
+		{Name: "Host", Value: "machine", Inline: true},
+		{Name: "Branch", Value: "origin/main", Inline: true},
+		{Name: "Commit", Value: "3f2a9c1d", Inline: true},
+		{Name: "Result", Value: "failed", Inline: true},
+		{Name: "Duration", Value: "1m15s", Inline: true},
+	}, e.Fields)
+}
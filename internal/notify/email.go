@@ -0,0 +1,117 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlewo/comin/internal/logs"
+	"github.com/nlewo/comin/internal/types"
+)
+
+// logTailLines is the number of lines of the logs included in the
+// failure emails
+const logTailLines = 50
+
+// email sends the notifications by email with SMTP
+type email struct {
+	config types.Email
+	logs   logs.Logs
+}
+
+func newEmail(config types.Email, l logs.Logs) email {
+	return email{config: config, logs: l}
+}
+
+func (e email) Name() string {
+	return fmt.Sprintf("the SMTP server %s", e.config.Host)
+}
+
+// logTail returns the last n lines of the logs
+func logTail(content []byte, n int) string {
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// message returns the email of the notification, with its headers
+func (e email) message(n Notification, now time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", e.config.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(e.config.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", Title(n)))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+
+	body := Text(n)
+	if summary := ClosureDiffSummary(n.ClosureDiff); summary != "" {
+		body += "\n\nClosure diff:\n" + summary
+	}
+	// The logs of the generation contain the outputs of the
+	// evaluation, the build and the activation
+	if n.Event == Failure && n.GenerationUUID != "" {
+		if content, err := e.logs.Read(n.GenerationUUID); err == nil && len(content) > 0 {
+			body += fmt.Sprintf("\n\nThe last lines of the logs (comin logs %s):\n%s", n.GenerationUUID, logTail(content, logTailLines))
+		}
+	}
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+func (e email) Send(ctx context.Context, n Notification) error {
+	addr := net.JoinHostPort(e.config.Host, strconv.Itoa(e.config.Port))
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, e.config.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: e.config.Host}); err != nil {
+			return err
+		}
+	}
+	if e.config.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", e.config.Username, string(e.config.Password), e.config.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(e.config.From); err != nil {
+		return err
+	}
+	for _, to := range e.config.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(e.message(n, time.Now())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,105 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlewo/comin/internal/logs"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// smtpServer accepts one SMTP session and sends the received commands
+// and data on the returned channel
+func smtpServer(t *testing.T) (string, int, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	received := make(chan string, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var session strings.Builder
+		r := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "220 localhost ESMTP\r\n")
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			session.WriteString(line)
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					fmt.Fprintf(conn, "250 OK\r\n")
+				}
+				continue
+			}
+			switch {
+			case strings.HasPrefix(line, "EHLO"):
+				fmt.Fprintf(conn, "250-localhost\r\n250 8BITMIME\r\n")
+			case strings.HasPrefix(line, "DATA"):
+				inData = true
+				fmt.Fprintf(conn, "354 Go ahead\r\n")
+			case strings.HasPrefix(line, "QUIT"):
+				fmt.Fprintf(conn, "221 Bye\r\n")
+				received <- session.String()
+				return
+			default:
+				fmt.Fprintf(conn, "250 OK\r\n")
+			}
+		}
+		received <- session.String()
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, received
+}
+
+func TestLogTail(t *testing.T) {
+	assert.Equal(t, "b\nc", logTail([]byte("a\nb\nc\n"), 2))
+	assert.Equal(t, "a\nb", logTail([]byte("a\nb\n"), 5))
+}
+
+func TestEmail(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "g1.log"), []byte("building...\nerror: builder failed\n"), 0640))
+	host, port, received := smtpServer(t)
+
+	e := newEmail(types.Email{
+		Host: host,
+		Port: port,
+		From: "comin@example.org",
+		To:   []string{"ops@example.org"},
+	}, logs.New(types.Logs{Dir: dir}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := e.Send(ctx, Notification{
+		Event:          Failure,
+		Host:           "machine",
+		GenerationUUID: "g1",
+		CommitId:       "3f2a9c1d5e",
+		RemoteName:     "origin",
+		BranchName:     "main",
+		Operation:      "switch",
+		Result:         "build-failed",
+		ErrorMsg:       "exit status 1",
+	})
+	assert.Nil(t, err)
+	session := <-received
+	assert.Contains(t, session, "MAIL FROM:<comin@example.org>")
+	assert.Contains(t, session, "RCPT TO:<ops@example.org>")
+	assert.Contains(t, session, "Subject: machine: the build of 3f2a9c1d failed\r\n")
+	assert.Contains(t, session, "Error: exit status 1\r\n")
+	assert.Contains(t, session, "The last lines of the logs (comin logs g1):\r\nbuilding...\r\nerror: builder failed\r\n")
+}
@@ -0,0 +1,54 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/nlewo/comin/internal/utils"
+)
+
+// matrix posts the notifications as messages to a Matrix room
+type matrix struct {
+	config types.Matrix
+}
+
+func newMatrix(config types.Matrix) matrix {
+	return matrix{config: config}
+}
+
+func (m matrix) Name() string {
+	return fmt.Sprintf("the Matrix room %s", m.config.RoomId)
+}
+
+// matrixMessage is a m.room.message event with a HTML body
+type matrixMessage struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format"`
+	FormattedBody string `json:"formatted_body"`
+}
+
+func (m matrix) Send(ctx context.Context, n Notification) error {
+	title, text := Title(n), Text(n)
+	body, err := json.Marshal(matrixMessage{
+		MsgType:       "m.text",
+		Body:          title + "\n" + text,
+		Format:        "org.matrix.custom.html",
+		FormattedBody: "<b>" + html.EscapeString(title) + "</b><br>" + strings.ReplaceAll(html.EscapeString(text), "\n", "<br>"),
+	})
+	if err != nil {
+		return err
+	}
+	// The transaction ID makes the retries idempotent
+	txnId := n.id() + "-" + string(n.Event)
+	u := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		strings.TrimSuffix(m.config.Homeserver, "/"), url.PathEscape(m.config.RoomId), url.PathEscape(txnId))
+	headers := map[string]string{"Authorization": "Bearer " + string(m.config.AccessToken)}
+	return utils.Post(ctx, http.MethodPut, u, "application/json", headers, body)
+}
@@ -0,0 +1,47 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatrix(t *testing.T) {
+	var req *http.Request
+	var msg matrixMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&msg))
+		w.Write([]byte(`{"event_id": "$event"}`))
+	}))
+	defer server.Close()
+
+	m := newMatrix(types.Matrix{
+		Homeserver:  server.URL,
+		RoomId:      "!room:example.org",
+		AccessToken: "syt_secret",
+	})
+	err := m.Send(context.Background(), Notification{
+		Event:          Success,
+		Host:           "machine",
+		DeploymentUUID: "d1",
+		CommitId:       "3f2a9c1d5e",
+		CommitSubject:  "Use <nginx>",
+		RemoteName:     "origin",
+		BranchName:     "main",
+		Operation:      "switch",
+		Duration:       12,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.MethodPut, req.Method)
+	assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.org/send/m.room.message/d1-success", req.URL.Path)
+	assert.Equal(t, "Bearer syt_secret", req.Header.Get("Authorization"))
+	assert.Equal(t, "m.text", msg.MsgType)
+	assert.Equal(t, "machine: the deployment of 3f2a9c1d succeeded\nCommit 3f2a9c1d5e from 'origin/main': Use <nginx>\nOperation: switch\nDuration: 12s", msg.Body)
+	assert.Equal(t, "<b>machine: the deployment of 3f2a9c1d succeeded</b><br>Commit 3f2a9c1d5e from &#39;origin/main&#39;: Use &lt;nginx&gt;<br>Operation: switch<br>Duration: 12s", msg.FormattedBody)
+}
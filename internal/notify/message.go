@@ -0,0 +1,85 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxClosureDiffLines is the number of lines of the closure diff
+// summary
+const maxClosureDiffLines = 10
+
+// emojis are the shortcodes of the emojis of the events
+var emojis = map[Event]string{
+	Start:   "rocket",
+	Success: "white_check_mark",
+	Failure: "rotating_light",
+}
+
+// shortCommitId returns the abbreviated commit ID displayed in the
+// messages
+func shortCommitId(commitId string) string {
+	if len(commitId) > 8 {
+		return commitId[:8]
+	}
+	return commitId
+}
+
+// Title returns the title of the message of the notification, such as
+// "machine: the deployment of 3f2a9c1d failed"
+func Title(n Notification) string {
+	verb := "started"
+	switch n.Event {
+	case Success:
+		verb = "succeeded"
+	case Failure:
+		verb = "failed"
+	}
+	step := "deployment"
+	switch n.Result {
+	case "evaluation-failed":
+		step = "evaluation"
+	case "build-failed":
+		step = "build"
+	}
+	return fmt.Sprintf("%s: the %s of %s %s", n.Host, step, shortCommitId(n.CommitId), verb)
+}
+
+// Text returns the body of the message of the notification, one line
+// per detail of the deployment
+func Text(n Notification) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Commit %s from '%s/%s'", n.CommitId, n.RemoteName, n.BranchName)
+	if n.CommitSubject != "" {
+		fmt.Fprintf(&b, ": %s", n.CommitSubject)
+	}
+	fmt.Fprintf(&b, "\nOperation: %s", n.Operation)
+	if n.Event != Start {
+		fmt.Fprintf(&b, "\nDuration: %s", duration(n))
+	}
+	if n.ErrorMsg != "" {
+		fmt.Fprintf(&b, "\nError: %s", n.ErrorMsg)
+	}
+	return b.String()
+}
+
+// duration returns the duration of the deployment rounded to the
+// second
+func duration(n Notification) time.Duration {
+	return time.Duration(n.Duration * float64(time.Second)).Round(time.Second)
+}
+
+// ClosureDiffSummary returns the first lines of the closure diff
+// followed by the number of omitted lines
+func ClosureDiffSummary(closureDiff string) string {
+	closureDiff = strings.TrimSpace(closureDiff)
+	if closureDiff == "" {
+		return ""
+	}
+	lines := strings.Split(closureDiff, "\n")
+	if len(lines) <= maxClosureDiffLines {
+		return closureDiff
+	}
+	return fmt.Sprintf("%s\n... and %d more changes", strings.Join(lines[:maxClosureDiffLines], "\n"), len(lines)-maxClosureDiffLines)
+}
@@ -0,0 +1,269 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nlewo/comin/internal/deployment"
+	"github.com/nlewo/comin/internal/events"
+	"github.com/nlewo/comin/internal/generation"
+	"github.com/nlewo/comin/internal/logs"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+)
+
+type Event string
+
+const (
+	// The deployment starts
+	Start Event = "start"
+	// The deployment succeeded
+	Success Event = "success"
+	// The evaluation, the build or the deployment failed
+	Failure Event = "failure"
+)
+
+// Notification describes a deployment to the notifiers. The
+// failures of evaluations and builds are notified without deployment.
+type Notification struct {
+	Event          Event  `json:"event"`
+	Host           string `json:"host"`
+	DeploymentUUID string `json:"deployment_uuid,omitempty"`
+	GenerationUUID string `json:"generation_uuid"`
+	CommitId       string `json:"commit_id"`
+	CommitSubject  string `json:"commit_subject"`
+	RemoteName     string `json:"remote_name"`
+	BranchName     string `json:"branch_name"`
+	Operation      string `json:"operation"`
+	// The status of the deployment: running, done or failed
+	Result   string    `json:"result"`
+	ErrorMsg string    `json:"error,omitempty"`
+	StartAt  time.Time `json:"start_at"`
+	EndAt    time.Time `json:"end_at"`
+	// The duration of the deployment in seconds, 0 when it starts
+	Duration float64 `json:"duration"`
+	// The closure diff between the previous configuration and the
+	// deployed one, empty when the deployment starts
+	ClosureDiff string `json:"closure_diff,omitempty"`
+}
+
+// NewNotification returns the notification of the deployment d of the
+// machine host. The event depends on the status of the deployment.
+func NewNotification(host string, d deployment.Deployment) Notification {
+	n := Notification{
+		Event:          Start,
+		Host:           host,
+		DeploymentUUID: d.UUID,
+		GenerationUUID: d.Generation.UUID,
+		CommitId:       d.Generation.SelectedCommitId,
+		CommitSubject:  d.Generation.SelectedCommitSubject,
+		RemoteName:     d.Generation.SelectedRemoteName,
+		BranchName:     d.Generation.SelectedBranchName,
+		Operation:      d.Operation,
+		Result:         deployment.StatusToString(d.Status),
+		ErrorMsg:       d.ErrorMsg,
+		StartAt:        d.StartAt,
+		EndAt:          d.EndAt,
+		ClosureDiff:    d.ClosureDiff,
+	}
+	switch d.Status {
+	case deployment.Done:
+		n.Event = Success
+	case deployment.Failed:
+		n.Event = Failure
+	}
+	if n.Event != Start {
+		n.Duration = d.EndAt.Sub(d.StartAt).Seconds()
+	}
+	return n
+}
+
+// NewGenerationNotification returns the failure notification of the
+// generation g of the machine host whose evaluation or build failed
+// with the error err
+func NewGenerationNotification(host string, g generation.Generation, err error) Notification {
+	n := Notification{
+		Event:          Failure,
+		Host:           host,
+		GenerationUUID: g.UUID,
+		CommitId:       g.SelectedCommitId,
+		CommitSubject:  g.SelectedCommitSubject,
+		RemoteName:     g.SelectedRemoteName,
+		BranchName:     g.SelectedBranchName,
+		Operation:      deployment.Operation(g),
+		Result:         generation.StatusToString(g.Status),
+		StartAt:        g.EvalStartedAt,
+		EndAt:          g.EvalEndedAt,
+	}
+	if !g.BuildEndedAt.IsZero() {
+		n.EndAt = g.BuildEndedAt
+	}
+	if err != nil {
+		n.ErrorMsg = err.Error()
+	}
+	n.Duration = n.EndAt.Sub(n.StartAt).Seconds()
+	return n
+}
+
+// id returns an identifier of the notified deployment or generation
+func (n Notification) id() string {
+	if n.DeploymentUUID != "" {
+		return n.DeploymentUUID
+	}
+	return n.GenerationUUID
+}
+
+// Notifier sends notifications to a service
+type Notifier interface {
+	// Name identifies the notifier in the logs
+	Name() string
+	Send(ctx context.Context, n Notification) error
+}
+
+// target is a notifier with the events it is notified of
+type target struct {
+	notifier Notifier
+	events   []string
+}
+
+func (t target) accepts(e Event) bool {
+	if len(t.events) == 0 {
+		return true
+	}
+	for _, event := range t.events {
+		if Event(event) == e {
+			return true
+		}
+	}
+	return false
+}
+
+// sendTimeout is the timeout of an attempt to send a notification
+var sendTimeout = 10 * time.Second
+
+// retryDelay is the delay before the first retry of a failed
+// notification. It doubles at each retry.
+var retryDelay = time.Second
+
+// Notifications sends the notifications of the deployments to the
+// configured notifiers. Notifications are sent asynchronously: a slow
+// or unreachable service never delays a deployment. It handles the
+// lifecycle events of the deployments published by the manager.
+type Notifications struct {
+	hostname string
+	retries  int
+	targets  []target
+	wg       *sync.WaitGroup
+}
+
+// New returns the notifications of the configuration. The logs are
+// used by the notifiers reporting the end of the logs of failures.
+func New(config types.Notifications, hostname string, l logs.Logs) Notifications {
+	n := Notifications{
+		hostname: hostname,
+		wg:       &sync.WaitGroup{},
+	}
+	if config.Retries != nil {
+		n.retries = *config.Retries
+	}
+	for _, w := range config.Webhooks {
+		n.targets = append(n.targets, target{notifier: newWebhook(w), events: w.Events})
+	}
+	for _, c := range config.Ntfy {
+		n.targets = append(n.targets, target{notifier: newNtfy(c), events: c.Events})
+	}
+	for _, c := range config.Matrix {
+		n.targets = append(n.targets, target{notifier: newMatrix(c), events: c.Events})
+	}
+	for _, c := range config.Slack {
+		n.targets = append(n.targets, target{notifier: newSlack(c), events: c.Events})
+	}
+	for _, c := range config.Email {
+		n.targets = append(n.targets, target{notifier: newEmail(c, l), events: c.Events})
+	}
+	for _, c := range config.Telegram {
+		n.targets = append(n.targets, target{notifier: newTelegram(c), events: c.Events})
+	}
+	for _, c := range config.Discord {
+		n.targets = append(n.targets, target{notifier: newDiscord(c), events: c.Events})
+	}
+	return n
+}
+
+// Handle notifies the start and the end of the deployments and the
+// failures of the evaluations and the builds. It never blocks.
+func (n Notifications) Handle(e events.Event) {
+	switch {
+	case e.Deployment != nil && (e.Type == events.Switching || e.Type == events.Done || e.Type == events.Failed):
+		n.Notify(*e.Deployment)
+	case e.Generation != nil && e.Type == events.Failed:
+		n.NotifyGenerationFailure(*e.Generation, errors.New(e.ErrorMsg))
+	}
+}
+
+// Notify sends the notification of the deployment d to the notifiers
+// accepting its event
+func (n Notifications) Notify(d deployment.Deployment) {
+	n.notify(NewNotification(n.hostname, d))
+}
+
+// NotifyGenerationFailure sends the failure notification of the
+// generation g whose evaluation or build failed with the error err
+func (n Notifications) NotifyGenerationFailure(g generation.Generation, err error) {
+	n.notify(NewGenerationNotification(n.hostname, g, err))
+}
+
+func (n Notifications) notify(notification Notification) {
+	for _, t := range n.targets {
+		if !t.accepts(notification.Event) {
+			continue
+		}
+		n.wg.Add(1)
+		go func(notifier Notifier) {
+			defer n.wg.Done()
+			n.send(notifier, notification)
+		}(t.notifier)
+	}
+}
+
+// send sends the notification and retries with an exponential backoff
+// when it fails
+func (n Notifications) send(notifier Notifier, notification Notification) {
+	delay := retryDelay
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		err := notifier.Send(ctx, notification)
+		cancel()
+		if err == nil {
+			logrus.Debugf("notify: the %s notification of %s has been sent to %s", notification.Event, notification.id(), notifier.Name())
+			return
+		}
+		if attempt >= n.retries {
+			logrus.Errorf("notify: failed to send the %s notification of %s to %s: %s", notification.Event, notification.id(), notifier.Name(), err)
+			return
+		}
+		logrus.Infof("notify: failed to send the notification to %s, retrying in %s: %s", notifier.Name(), delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Wait waits for the notifications being sent, at most during
+// timeout. It is used before comin restarts.
+func (n Notifications) Wait(timeout time.Duration) {
+	if n.wg == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logrus.Errorf("notify: notifications are still being sent after %s", timeout)
+	}
+}
@@ -0,0 +1,206 @@
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlewo/comin/internal/deployment"
+	"github.com/nlewo/comin/internal/events"
+	"github.com/nlewo/comin/internal/generation"
+	"github.com/nlewo/comin/internal/logs"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewNotification(t *testing.T) {
+	startAt := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	d := deployment.Deployment{
+		UUID: "d1",
+		Generation: generation.Generation{
+			UUID:                  "g1",
+			SelectedCommitId:      "abc",
+			SelectedCommitSubject: "Upgrade nginx",
+			SelectedBranchName:    "main",
+		},
+		Operation: "switch",
+		Status:    deployment.Running,
+		StartAt:   startAt,
+	}
+	n := NewNotification("machine", d)
+	assert.Equal(t, Start, n.Event)
+	assert.Equal(t, "running", n.Result)
+	assert.Equal(t, 0.0, n.Duration)
+
+	d.Status = deployment.Failed
+	d.ErrorMsg = "activation failed"
+	d.EndAt = startAt.Add(90 * time.Second)
+	n = NewNotification("machine", d)
+	assert.Equal(t, Failure, n.Event)
+	assert.Equal(t, "failed", n.Result)
+	assert.Equal(t, "activation failed", n.ErrorMsg)
+	assert.Equal(t, 90.0, n.Duration)
+	assert.Equal(t, "machine", n.Host)
+	assert.Equal(t, "Upgrade nginx", n.CommitSubject)
+}
+
+func TestNewGenerationNotification(t *testing.T) {
+	startAt := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	g := generation.Generation{
+		UUID:             "g1",
+		SelectedCommitId: "abc",
+		Status:           generation.BuildFailed,
+		EvalStartedAt:    startAt,
+		EvalEndedAt:      startAt.Add(10 * time.Second),
+		BuildEndedAt:     startAt.Add(60 * time.Second),
+	}
+	n := NewGenerationNotification("machine", g, fmt.Errorf("exit status 1"))
+	assert.Equal(t, Failure, n.Event)
+	assert.Equal(t, "build-failed", n.Result)
+	assert.Equal(t, "switch", n.Operation)
+	assert.Equal(t, "exit status 1", n.ErrorMsg)
+	assert.Equal(t, 60.0, n.Duration)
+	assert.Equal(t, "g1", n.id())
+	assert.Equal(t, "machine: the build of abc failed", Title(n))
+}
+
+func TestWebhook(t *testing.T) {
+	retryDelay = time.Millisecond
+	var mu sync.Mutex
+	var received []Notification
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		// The first attempt fails
+		if attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var n Notification
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&n))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		received = append(received, n)
+	}))
+	defer server.Close()
+
+	retries := 2
+	n := New(types.Notifications{
+		Retries: &retries,
+		Webhooks: []types.Webhook{
+			{URL: types.Secret(server.URL), Events: []string{"failure"}},
+		},
+	}, "machine", logs.New(types.Logs{}))
+	// The start of the deployment is not notified
+	n.Notify(deployment.Deployment{UUID: "d1", Status: deployment.Running})
+	n.Notify(deployment.Deployment{UUID: "d1", Status: deployment.Failed, ErrorMsg: "failed"})
+	n.Wait(time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, attempts)
+	assert.Len(t, received, 1)
+	assert.Equal(t, Failure, received[0].Event)
+	assert.Equal(t, "machine", received[0].Host)
+	assert.Equal(t, "failed", received[0].ErrorMsg)
+}
+
+// recorder records the sent notifications
+type recorder struct {
+	mu            sync.Mutex
+	notifications []Notification
+}
+
+func (r *recorder) Name() string { return "recorder" }
+
+func (r *recorder) Send(ctx context.Context, n Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notifications = append(r.notifications, n)
+	return nil
+}
+
+func TestHandle(t *testing.T) {
+	r := &recorder{}
+	n := New(types.Notifications{}, "machine", logs.New(types.Logs{}))
+	n.targets = []target{{notifier: r}}
+
+	d := deployment.Deployment{UUID: "d1", Status: deployment.Running}
+	g := generation.Generation{UUID: "g2"}
+	n.Handle(events.Event{Type: events.Switching, Deployment: &d})
+	n.Wait(time.Second)
+	// The progress of the generations is not notified
+	n.Handle(events.Event{Type: events.Building, Generation: &g})
+	n.Handle(events.Event{Type: events.Failed, Generation: &g, ErrorMsg: "build failed"})
+	n.Wait(time.Second)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	assert.Len(t, r.notifications, 2)
+	assert.Equal(t, Start, r.notifications[0].Event)
+	assert.Equal(t, "d1", r.notifications[0].DeploymentUUID)
+	assert.Equal(t, Failure, r.notifications[1].Event)
+	assert.Equal(t, "g2", r.notifications[1].GenerationUUID)
+	assert.Equal(t, "build failed", r.notifications[1].ErrorMsg)
+}
+
+func TestWebhookRetries(t *testing.T) {
+	retryDelay = time.Millisecond
+	var mu sync.Mutex
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	retries := 2
+	n := New(types.Notifications{
+		Retries:  &retries,
+		Webhooks: []types.Webhook{{URL: types.Secret(server.URL)}},
+	}, "machine", logs.New(types.Logs{}))
+	n.Notify(deployment.Deployment{UUID: "d1", Status: deployment.Done})
+	n.Wait(time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 3, attempts)
+}
+
+func TestWebhookSignature(t *testing.T) {
+	var mu sync.Mutex
+	var signature string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		signature = r.Header.Get("X-Comin-Signature-256")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	n := New(types.Notifications{
+		Webhooks: []types.Webhook{{URL: types.Secret(server.URL), Secret: "secret"}},
+	}, "machine", logs.New(types.Logs{}))
+	n.Notify(deployment.Deployment{UUID: "d1", Status: deployment.Done})
+	n.Wait(time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), signature)
+	assert.Equal(t, signature, Signature("secret", body))
+}
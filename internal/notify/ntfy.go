@@ -0,0 +1,40 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/nlewo/comin/internal/utils"
+)
+
+// ntfy publishes the notifications to a topic of a ntfy server
+type ntfy struct {
+	config types.Ntfy
+}
+
+func newNtfy(config types.Ntfy) ntfy {
+	return ntfy{config: config}
+}
+
+func (n ntfy) Name() string {
+	return fmt.Sprintf("the ntfy topic %s", n.config.Topic)
+}
+
+func (n ntfy) Send(ctx context.Context, notification Notification) error {
+	url := strings.TrimSuffix(n.config.URL, "/") + "/" + n.config.Topic
+	headers := map[string]string{
+		"Title": Title(notification),
+		"Tags":  emojis[notification.Event],
+	}
+	if priority, ok := n.config.Priorities[string(notification.Event)]; ok {
+		headers["Priority"] = strconv.Itoa(priority)
+	}
+	if n.config.AccessToken != "" {
+		headers["Authorization"] = "Bearer " + string(n.config.AccessToken)
+	}
+	return utils.Post(ctx, http.MethodPost, url, "text/plain", headers, []byte(Text(notification)))
+}
@@ -0,0 +1,46 @@
+package notify
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNtfy(t *testing.T) {
+	var req *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	n := newNtfy(types.Ntfy{
+		URL:         server.URL + "/",
+		Topic:       "deployments",
+		AccessToken: "tk_secret",
+		Priorities:  map[string]int{"start": 2, "success": 3, "failure": 5},
+	})
+	err := n.Send(context.Background(), Notification{
+		Event:      Failure,
+		Host:       "machine",
+		CommitId:   "3f2a9c1d5e",
+		RemoteName: "origin",
+		BranchName: "main",
+		Operation:  "switch",
+		ErrorMsg:   "activation failed",
+		Duration:   93.4,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "/deployments", req.URL.Path)
+	assert.Equal(t, "machine: the deployment of 3f2a9c1d failed", req.Header.Get("Title"))
+	assert.Equal(t, "5", req.Header.Get("Priority"))
+	assert.Equal(t, "rotating_light", req.Header.Get("Tags"))
+	assert.Equal(t, "Bearer tk_secret", req.Header.Get("Authorization"))
+	assert.Equal(t, "Commit 3f2a9c1d5e from 'origin/main'\nOperation: switch\nDuration: 1m33s\nError: activation failed", string(body))
+}
@@ -0,0 +1,78 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"text/template"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/nlewo/comin/internal/utils"
+)
+
+// DefaultSlackTemplate is the template of the Slack messages when it
+// is not configured
+const DefaultSlackTemplate = ":{{.Emoji}}: *{{.Title}}*\n{{.Text}}{{if .ClosureDiffSummary}}\n```\n{{.ClosureDiffSummary}}\n```{{end}}"
+
+// slackEscaper escapes the control characters of the Slack messages
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// SlackMessage is the data of the Slack message template: the fields
+// of the notification, escaped for Slack, and the parts of the default
+// message
+type SlackMessage struct {
+	Notification
+	Emoji              string
+	Title              string
+	Text               string
+	ClosureDiffSummary string
+}
+
+// slack posts the notifications to a Slack incoming webhook
+type slack struct {
+	config types.Slack
+}
+
+func newSlack(config types.Slack) slack {
+	return slack{config: config}
+}
+
+func (s slack) Name() string {
+	return "the Slack webhook"
+}
+
+// message renders the template of the message of the notification
+func (s slack) message(n Notification) (string, error) {
+	text := s.config.Template
+	if text == "" {
+		text = DefaultSlackTemplate
+	}
+	tmpl, err := template.New("slack").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	n.CommitSubject = slackEscaper.Replace(n.CommitSubject)
+	n.ErrorMsg = slackEscaper.Replace(n.ErrorMsg)
+	n.ClosureDiff = slackEscaper.Replace(n.ClosureDiff)
+	data := SlackMessage{
+		Notification:       n,
+		Emoji:              emojis[n.Event],
+		Title:              slackEscaper.Replace(Title(n)),
+		Text:               Text(n),
+		ClosureDiffSummary: ClosureDiffSummary(n.ClosureDiff),
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (s slack) Send(ctx context.Context, n Notification) error {
+	text, err := s.message(n)
+	if err != nil {
+		return err
+	}
+	// The URL of the webhook is a secret
+	return withoutUrl(utils.PostJson(ctx, string(s.config.URL), nil, map[string]string{"text": text}))
+}
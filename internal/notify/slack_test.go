@@ -0,0 +1,58 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClosureDiffSummary(t *testing.T) {
+	assert.Equal(t, "", ClosureDiffSummary("\n"))
+	assert.Equal(t, "nginx: 1.24.0 → 1.25.3, +12.3 KiB", ClosureDiffSummary("nginx: 1.24.0 → 1.25.3, +12.3 KiB\n"))
+
+	lines := make([]string, 0)
+	for i := 0; i < 12; i++ {
+		lines = append(lines, fmt.Sprintf("package-%d: 1.0 → 1.1", i))
+	}
+	summary := ClosureDiffSummary(strings.Join(lines, "\n"))
+	assert.True(t, strings.HasPrefix(summary, "package-0: 1.0 → 1.1\n"))
+	assert.True(t, strings.HasSuffix(summary, "package-9: 1.0 → 1.1\n... and 2 more changes"))
+}
+
+func TestSlack(t *testing.T) {
+	var msg map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&msg))
+	}))
+	defer server.Close()
+
+	n := Notification{
+		Event:         Success,
+		Host:          "machine",
+		CommitId:      "3f2a9c1d5e",
+		CommitSubject: "Use <nginx> & co",
+		RemoteName:    "origin",
+		BranchName:    "main",
+		Operation:     "switch",
+		Duration:      12,
+		ClosureDiff:   "nginx: 1.24.0 → 1.25.3, +12.3 KiB\n",
+	}
+	s := newSlack(types.Slack{URL: types.Secret(server.URL)})
+	assert.Nil(t, s.Send(context.Background(), n))
+	assert.Equal(t,
+		":white_check_mark: *machine: the deployment of 3f2a9c1d succeeded*\n"+
+			"Commit 3f2a9c1d5e from 'origin/main': Use &lt;nginx&gt; &amp; co\nOperation: switch\nDuration: 12s\n"+
+			"```\nnginx: 1.24.0 → 1.25.3, +12.3 KiB\n```",
+		msg["text"])
+
+	s = newSlack(types.Slack{URL: types.Secret(server.URL), Template: "{{.Host}} deployed {{.CommitSubject}}"})
+	assert.Nil(t, s.Send(context.Background(), n))
+	assert.Equal(t, "machine deployed Use &lt;nginx&gt; &amp; co", msg["text"])
+}
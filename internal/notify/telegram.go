@@ -0,0 +1,34 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/nlewo/comin/internal/utils"
+)
+
+// telegramApiUrl is the URL of the Telegram Bot API
+var telegramApiUrl = "https://api.telegram.org"
+
+// telegram sends the notifications to a Telegram chat with a bot
+type telegram struct {
+	config types.Telegram
+}
+
+func newTelegram(config types.Telegram) telegram {
+	return telegram{config: config}
+}
+
+func (t telegram) Name() string {
+	return fmt.Sprintf("the Telegram chat %s", t.config.ChatId)
+}
+
+func (t telegram) Send(ctx context.Context, n Notification) error {
+	u := fmt.Sprintf("%s/bot%s/sendMessage", telegramApiUrl, string(t.config.BotToken))
+	// The URL contains the bot token
+	return withoutUrl(utils.PostJson(ctx, u, nil, map[string]string{
+		"chat_id": t.config.ChatId,
+		"text":    Title(n) + "\n" + Text(n),
+	}))
+}
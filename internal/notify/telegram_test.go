@@ -0,0 +1,43 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTelegram(t *testing.T) {
+	var path string
+	var msg map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&msg))
+	}))
+	defer server.Close()
+	telegramApiUrl = server.URL
+
+	tg := newTelegram(types.Telegram{BotToken: "123:secret", ChatId: "-1001234"})
+	err := tg.Send(context.Background(), Notification{
+		Event:      Start,
+		Host:       "machine",
+		CommitId:   "3f2a9c1d5e",
+		RemoteName: "origin",
+		BranchName: "main",
+		Operation:  "switch",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "/bot123:secret/sendMessage", path)
+	assert.Equal(t, "-1001234", msg["chat_id"])
+	assert.Equal(t, "machine: the deployment of 3f2a9c1d started\nCommit 3f2a9c1d5e from 'origin/main'\nOperation: switch", msg["text"])
+
+	// The bot token is not leaked in errors
+	telegramApiUrl = "http://127.0.0.1:1"
+	err = tg.Send(context.Background(), Notification{})
+	assert.NotNil(t, err)
+	assert.NotContains(t, err.Error(), "secret")
+}
@@ -0,0 +1,72 @@
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/nlewo/comin/internal/utils"
+)
+
+// signatureHeader is the header of the HMAC-SHA256 signature of the
+// payload, when the webhook has a secret
+const signatureHeader = "X-Comin-Signature-256"
+
+// webhook posts the notifications in JSON to an URL
+type webhook struct {
+	url    string
+	secret string
+}
+
+func newWebhook(config types.Webhook) webhook {
+	return webhook{
+		url:    string(config.URL),
+		secret: string(config.Secret),
+	}
+}
+
+// Name returns the host of the URL: the URL itself can contain a
+// secret
+func (w webhook) Name() string {
+	if u, err := url.Parse(w.url); err == nil {
+		return fmt.Sprintf("the webhook on %s", u.Host)
+	}
+	return "the webhook"
+}
+
+func (w webhook) Send(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{}
+	if w.secret != "" {
+		headers[signatureHeader] = Signature(w.secret, body)
+	}
+	return withoutUrl(utils.Post(ctx, http.MethodPost, w.url, "application/json", headers, body))
+}
+
+// Signature returns the value of the signature header of the payload
+// body signed with the secret
+func Signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// withoutUrl removes the URL of the request from the error when the
+// URL contains a secret
+func withoutUrl(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
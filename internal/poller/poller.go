@@ -1,6 +1,8 @@
 package poller
 
 import (
+	"context"
+	"math/rand"
 	"time"
 
 	"github.com/nlewo/comin/internal/manager"
@@ -8,25 +10,48 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func Poller(m manager.Manager, remotes []types.Remote) {
+// nextPoll returns the time of the next fetch of the remote: a random
+// delay of at most Jitter seconds is added to the period to avoid
+// machines of a fleet fetching the remote at the same time.
+func nextPoll(now time.Time, period, jitter int, rnd *rand.Rand) time.Time {
+	next := now.Add(time.Duration(period) * time.Second)
+	if jitter > 0 {
+		next = next.Add(time.Duration(rnd.Int63n(int64(jitter) * int64(time.Second))))
+	}
+	return next
+}
+
+// Poller periodically fetches the remotes until the context is
+// canceled.
+func Poller(ctx context.Context, m manager.Manager, remotes []types.Remote) {
 	poll := false
 	for _, remote := range remotes {
 		if remote.Poller.Period != 0 {
-			logrus.Infof("Starting the poller for the remote '%s' with period %ds", remote.Name, remote.Poller.Period)
+			logrus.Infof("Starting the poller for the remote '%s' with period %ds (jitter %ds)", remote.Name, remote.Poller.Period, remote.Poller.Jitter)
 			poll = true
 		}
 	}
 	if !poll {
 		return
 	}
-	counter := 0
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	// The first fetch also waits for a random delay
+	next := make([]time.Time, len(remotes))
+	for i, remote := range remotes {
+		next[i] = nextPoll(time.Now(), 0, remote.Poller.Jitter, rnd)
+	}
 	for {
-		for _, remote := range remotes {
-			if remote.Poller.Period != 0 && counter%remote.Poller.Period == 0 {
+		now := time.Now()
+		for i, remote := range remotes {
+			if remote.Poller.Period != 0 && !now.Before(next[i]) {
 				m.Fetch(remote.Name)
+				next[i] = nextPoll(now, remote.Poller.Period, remote.Poller.Jitter, rnd)
 			}
 		}
-		time.Sleep(time.Second)
-		counter += 1
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
 	}
 }
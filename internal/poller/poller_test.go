@@ -0,0 +1,20 @@
+package poller
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextPoll(t *testing.T) {
+	rnd := rand.New(rand.NewSource(0))
+	now := time.Now()
+	assert.Equal(t, now.Add(60*time.Second), nextPoll(now, 60, 0, rnd))
+	for i := 0; i < 100; i++ {
+		next := nextPoll(now, 60, 30, rnd)
+		assert.False(t, next.Before(now.Add(60*time.Second)))
+		assert.True(t, next.Before(now.Add(90*time.Second)))
+	}
+}
@@ -2,6 +2,7 @@ package prometheus
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -12,6 +13,15 @@ type Prometheus struct {
 	buildInfo      *prometheus.GaugeVec
 	deploymentInfo *prometheus.GaugeVec
 	fetchCounter   *prometheus.CounterVec
+	rebootNeeded   prometheus.Gauge
+	// The start and end dates of the last deployment
+	deploymentStartTimestamp prometheus.Gauge
+	deploymentEndTimestamp   prometheus.Gauge
+	consecutiveFailures      prometheus.Gauge
+	failingSinceTimestamp    prometheus.Gauge
+	// When not empty, the metrics are written to this node-exporter
+	// textfile collector file after each deployment
+	textfilePath string
 }
 
 func New() Prometheus {
@@ -28,17 +38,65 @@ func New() Prometheus {
 		Name: "comin_fetch_count",
 		Help: "Number of fetches per status",
 	}, []string{"remote_name", "status"})
+	rebootNeeded := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "comin_reboot_needed",
+		Help: "1 if the machine needs to be rebooted to run the deployed kernel, initrd or systemd.",
+	})
+	deploymentStartTimestamp := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "comin_deployment_start_timestamp_seconds",
+		Help: "The date of the start of the last deployment.",
+	})
+	deploymentEndTimestamp := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "comin_deployment_end_timestamp_seconds",
+		Help: "The date of the end of the last deployment.",
+	})
+	consecutiveFailures := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "comin_consecutive_failures",
+		Help: "The number of evaluations, builds or deployments which failed in a row.",
+	})
+	failingSinceTimestamp := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "comin_failing_since_timestamp_seconds",
+		Help: "The date of the first failure of the current failure streak, 0 if the last deployment succeeded.",
+	})
 	promReg.MustRegister(buildInfo)
 	promReg.MustRegister(deploymentInfo)
 	promReg.MustRegister(fetchCounter)
+	promReg.MustRegister(rebootNeeded)
+	promReg.MustRegister(deploymentStartTimestamp)
+	promReg.MustRegister(deploymentEndTimestamp)
+	promReg.MustRegister(consecutiveFailures)
+	promReg.MustRegister(failingSinceTimestamp)
 	return Prometheus{
-		promRegistry:   promReg,
-		buildInfo:      buildInfo,
-		deploymentInfo: deploymentInfo,
-		fetchCounter:   fetchCounter,
+		promRegistry:             promReg,
+		buildInfo:                buildInfo,
+		deploymentInfo:           deploymentInfo,
+		fetchCounter:             fetchCounter,
+		rebootNeeded:             rebootNeeded,
+		deploymentStartTimestamp: deploymentStartTimestamp,
+		deploymentEndTimestamp:   deploymentEndTimestamp,
+		consecutiveFailures:      consecutiveFailures,
+		failingSinceTimestamp:    failingSinceTimestamp,
 	}
 }
 
+// WithTextfile returns a Prometheus writing the metrics to the
+// node-exporter textfile collector file path, which has to end with
+// .prom.
+func (m Prometheus) WithTextfile(path string) Prometheus {
+	m.textfilePath = path
+	return m
+}
+
+// WriteTextfile writes the metrics to the textfile collector file. It
+// is a no-op when no file is configured. The file is atomically
+// replaced, so node-exporter never reads a partial file.
+func (m Prometheus) WriteTextfile() error {
+	if m.textfilePath == "" {
+		return nil
+	}
+	return prometheus.WriteToTextfile(m.textfilePath, m.promRegistry)
+}
+
 func (m Prometheus) Handler() http.Handler {
 	return promhttp.HandlerFor(
 		m.promRegistry,
@@ -60,3 +118,25 @@ func (m Prometheus) SetDeploymentInfo(commitId, status string) {
 	m.deploymentInfo.Reset()
 	m.deploymentInfo.With(prometheus.Labels{"commit_id": commitId, "status": status}).Set(1)
 }
+
+func (m Prometheus) SetDeploymentTimestamps(startAt, endAt time.Time) {
+	m.deploymentStartTimestamp.Set(float64(startAt.Unix()))
+	m.deploymentEndTimestamp.Set(float64(endAt.Unix()))
+}
+
+func (m Prometheus) SetConsecutiveFailures(failures int, since time.Time) {
+	m.consecutiveFailures.Set(float64(failures))
+	if since.IsZero() {
+		m.failingSinceTimestamp.Set(0)
+	} else {
+		m.failingSinceTimestamp.Set(float64(since.Unix()))
+	}
+}
+
+func (m Prometheus) SetRebootNeeded(rebootNeeded bool) {
+	if rebootNeeded {
+		m.rebootNeeded.Set(1)
+	} else {
+		m.rebootNeeded.Set(0)
+	}
+}
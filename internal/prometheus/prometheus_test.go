@@ -0,0 +1,25 @@
+package prometheus
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	// No textfile is written when it is not configured
+	assert.Nil(t, New().WriteTextfile())
+
+	path := filepath.Join(t.TempDir(), "comin.prom")
+	m := New().WithTextfile(path)
+	m.SetDeploymentInfo("abcd", "done")
+	m.SetDeploymentTimestamps(time.Unix(1700000000, 0), time.Unix(1700000060, 0))
+	assert.Nil(t, m.WriteTextfile())
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), `comin_deployment_info{commit_id="abcd",status="done"} 1`)
+	assert.Contains(t, string(content), "comin_deployment_end_timestamp_seconds 1.70000006e+09")
+}
@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	gitConfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/nlewo/comin/internal/types"
+)
+
+// CheckRemote checks the remote is reachable with its authentication
+// and proxy and that its main branch, or a tag matching its tag
+// pattern, exists. Nothing is fetched.
+func CheckRemote(ctx context.Context, remote types.Remote) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(remote.Timeout)*time.Second)
+	defer cancel()
+	if remote.Kind == "tarball" {
+		resp, err := getArchive(ctx, remote, "")
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	auth, err := auth(remote)
+	if err != nil {
+		return FetchError{Remote: remote.Name, Kind: FetchErrorAuthentication, Err: err}
+	}
+	gitRemote := git.NewRemote(memory.NewStorage(), &gitConfig.RemoteConfig{
+		Name: remote.Name,
+		URLs: []string{remote.URL},
+	})
+	refs, err := gitRemote.ListContext(ctx, &git.ListOptions{
+		Auth:         auth,
+		ProxyOptions: proxyOptions(remote),
+	})
+	if err != nil {
+		return newFetchError(remote.Name, err)
+	}
+	if pattern := remote.Branches.Main.TagPattern; pattern != "" {
+		for _, ref := range refs {
+			if _, ok := tagVersion(pattern, ref.Name().Short()); ref.Name().IsTag() && ok {
+				return nil
+			}
+		}
+		return FetchError{Remote: remote.Name, Kind: FetchErrorNotFound, Err: fmt.Errorf("No tag matches the pattern '%s'", pattern)}
+	}
+	if remote.Branches.Main.Name == "" {
+		return nil
+	}
+	for _, ref := range refs {
+		if ref.Name() == plumbing.NewBranchReferenceName(remote.Branches.Main.Name) {
+			return nil
+		}
+	}
+	return FetchError{Remote: remote.Name, Kind: FetchErrorNotFound, Err: fmt.Errorf("The branch '%s' doesn't exist", remote.Branches.Main.Name)}
+}
+
+// CheckInput checks the repository of the input is reachable and its
+// branch exists
+func CheckInput(ctx context.Context, input types.Input) error {
+	return CheckRemote(ctx, inputRemote(input))
+}
@@ -2,15 +2,22 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/url"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/go-git/go-git/v5"
 	gitConfig "github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"github.com/nlewo/comin/internal/types"
 	"github.com/sirupsen/logrus"
 )
@@ -58,6 +65,23 @@ func getRemoteCommitHash(r repository, remote, branch string) *plumbing.Hash {
 	return &commitId
 }
 
+// hardResetError is returned when the head of a branch is not on top
+// of the previous head (force push)
+type hardResetError struct {
+	head plumbing.Hash
+	base plumbing.Hash
+}
+
+func (e hardResetError) Error() string {
+	return fmt.Sprintf("This branch has been hard reset: its head '%s' is not on top of '%s'",
+		e.head.String(), e.base.String())
+}
+
+func isHardResetError(err error) bool {
+	var e hardResetError
+	return errors.As(err, &e)
+}
+
 func hasNotBeenHardReset(r repository, branchName string, currentMainHash *plumbing.Hash, remoteMainHead *plumbing.Hash) error {
 	if currentMainHash != nil && remoteMainHead != nil && *currentMainHash != *remoteMainHead {
 		var ok bool
@@ -66,13 +90,21 @@ func hasNotBeenHardReset(r repository, branchName string, currentMainHash *plumb
 			return err
 		}
 		if !ok {
-			return fmt.Errorf("This branch has been hard reset: its head '%s' is not on top of '%s'",
-				remoteMainHead.String(), currentMainHash.String())
+			return hardResetError{head: *remoteMainHead, base: *currentMainHash}
 		}
 	}
 	return nil
 }
 
+func isShallow(r repository, remoteName string) bool {
+	for _, remote := range r.GitConfig.Remotes {
+		if remote.Name == remoteName {
+			return remote.Depth > 0
+		}
+	}
+	return false
+}
+
 func getHeadFromRemoteAndBranch(r repository, remoteName, branchName, currentMainCommitId string) (newHead plumbing.Hash, msg string, err error) {
 	var currentMainHash *plumbing.Hash
 	head := getRemoteCommitHash(r, remoteName, branchName)
@@ -84,15 +116,21 @@ func getHeadFromRemoteAndBranch(r repository, remoteName, branchName, currentMai
 		currentMainHash = &c
 	}
 
-	if err = hasNotBeenHardReset(r, branchName, currentMainHash, head); err != nil {
-		return
-	}
-
 	commitObject, err := r.Repository.CommitObject(*head)
 	if err != nil {
 		return
 	}
 
+	// The history of a shallow remote is truncated: whether the
+	// branch has been hard reset can not be checked. The head is
+	// also returned with a hardResetError since the caller can
+	// accept force pushes.
+	if !isShallow(r, remoteName) {
+		if err = hasNotBeenHardReset(r, branchName, currentMainHash, head); err != nil {
+			return *head, commitObject.Message, err
+		}
+	}
+
 	return *head, commitObject.Message, nil
 }
 
@@ -112,33 +150,185 @@ func hardReset(r repository, newHead plumbing.Hash) error {
 	return nil
 }
 
-// fetch fetches the config.Remote
-func fetch(r repository, remote types.Remote) (err error) {
-	logrus.Debugf("Fetching remote '%s'", remote.Name)
-	fetchOptions := git.FetchOptions{
-		RemoteName: remote.Name,
+// redactURL hides the credentials a HTTP(S) URL could contain, such as
+// a token used as user name
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return rawURL
+	}
+	u.User = url.User("xxxxx")
+	return u.String()
+}
+
+// auth returns the authentication method used to fetch the remote or
+// nil if the remote doesn't require authentication
+func auth(remote types.Remote) (transport.AuthMethod, error) {
+	if remote.Auth.SshPrivateKeyPath != "" {
+		// The user of the URL (git@host:repo) is used if any
+		user := "git"
+		if endpoint, err := transport.NewEndpoint(remote.URL); err == nil && endpoint.User != "" {
+			user = endpoint.User
+		}
+		publicKeys, err := gitssh.NewPublicKeysFromFile(user, remote.Auth.SshPrivateKeyPath, "")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the SSH private key %s: %s", remote.Auth.SshPrivateKeyPath, err)
+		}
+		// Otherwise, the default known_hosts files are used
+		if remote.Auth.SshKnownHostsPath != "" {
+			publicKeys.HostKeyCallback, err = gitssh.NewKnownHostsCallback(remote.Auth.SshKnownHostsPath)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to read the known hosts file %s: %s", remote.Auth.SshKnownHostsPath, err)
+			}
+		}
+		return publicKeys, nil
 	}
-	// TODO: support several authentication methods
 	if remote.Auth.AccessToken != "" {
-		fetchOptions.Auth = &http.BasicAuth{
+		return &http.BasicAuth{
 			// On GitLab, any non blank username is
 			// working.
 			Username: "comin",
-			Password: remote.Auth.AccessToken,
+			Password: string(remote.Auth.AccessToken),
+		}, nil
+	}
+	return nil, nil
+}
+
+// proxyOptions returns the proxy used to fetch the remote
+func proxyOptions(remote types.Remote) transport.ProxyOptions {
+	return transport.ProxyOptions{
+		URL:      remote.Proxy.URL,
+		Username: remote.Proxy.Username,
+		Password: string(remote.Proxy.Password),
+	}
+}
+
+// branchRefSpecs returns the refspecs of the main and testing branches
+// existing on the remote. The testing branch is optional and a refspec
+// of a missing branch would make the fetch fail.
+func branchRefSpecs(ctx context.Context, r repository, remote types.Remote, auth transport.AuthMethod) (refSpecs []gitConfig.RefSpec, err error) {
+	gitRemote, err := r.Repository.Remote(remote.Name)
+	if err != nil {
+		return
+	}
+	refs, err := gitRemote.ListContext(ctx, &git.ListOptions{
+		Auth:         auth,
+		ProxyOptions: proxyOptions(remote),
+	})
+	if err != nil {
+		return
+	}
+	for _, branch := range []string{remote.Branches.Main.Name, remote.Branches.Testing.Name} {
+		if branch == "" {
+			continue
+		}
+		for _, ref := range refs {
+			if ref.Name() == plumbing.NewBranchReferenceName(branch) {
+				refSpecs = append(refSpecs, gitConfig.RefSpec(fmt.Sprintf("+refs/heads/%s:refs/remotes/%s/%s", branch, remote.Name, branch)))
+				break
+			}
 		}
 	}
+	if remote.Branches.Main.TagPattern != "" {
+		refSpecs = append(refSpecs, gitConfig.RefSpec("+refs/tags/*:refs/tags/*"))
+	}
+	if len(refSpecs) == 0 {
+		return nil, fmt.Errorf("The branch '%s' doesn't exist", remote.Branches.Main.Name)
+	}
+	return
+}
+
+// FetchError is the error of the fetch of a remote. Its Kind
+// distinguishes errors requiring an action of an operator
+// (authentication, missing repository) from transient errors
+// (network, timeout).
+type FetchError struct {
+	Remote string
+	Kind   string
+	Err    error
+}
+
+const (
+	FetchErrorAuthentication = "authentication"
+	FetchErrorNotFound       = "not_found"
+	FetchErrorTimeout        = "timeout"
+	FetchErrorNetwork        = "network"
+	FetchErrorOther          = "other"
+)
 
-	// TODO: we should get a parent context
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(remote.Timeout)*time.Second)
+func (e FetchError) Error() string {
+	return fmt.Sprintf("'git fetch %s' fails: '%s'", e.Remote, e.Err)
+}
+
+func (e FetchError) Unwrap() error {
+	return e.Err
+}
+
+func newFetchError(remoteName string, err error) FetchError {
+	var netErr net.Error
+	var noMatchingRefSpec git.NoMatchingRefSpecError
+	kind := FetchErrorOther
+	switch {
+	case errors.Is(err, transport.ErrAuthenticationRequired),
+		errors.Is(err, transport.ErrAuthorizationFailed),
+		errors.Is(err, transport.ErrInvalidAuthMethod):
+		kind = FetchErrorAuthentication
+	case errors.Is(err, transport.ErrRepositoryNotFound),
+		errors.Is(err, transport.ErrEmptyRemoteRepository),
+		errors.As(err, &noMatchingRefSpec):
+		kind = FetchErrorNotFound
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		kind = FetchErrorTimeout
+	case errors.As(err, &netErr):
+		kind = FetchErrorNetwork
+	}
+	return FetchError{Remote: remoteName, Kind: kind, Err: err}
+}
+
+// fetchErrorKind returns the kind of a fetch error
+func fetchErrorKind(err error) string {
+	var fetchErr FetchError
+	if errors.As(err, &fetchErr) {
+		return fetchErr.Kind
+	}
+	return FetchErrorOther
+}
+
+// fetch fetches the config.Remote. The fetch is aborted when the
+// context is canceled or after the timeout of the remote.
+func fetch(ctx context.Context, r repository, remote types.Remote) (err error) {
+	logrus.Debugf("Fetching remote '%s'", remote.Name)
+	fetchOptions := git.FetchOptions{
+		RemoteName:   remote.Name,
+		ProxyOptions: proxyOptions(remote),
+	}
+	fetchOptions.Auth, err = auth(remote)
+	if err != nil {
+		return FetchError{Remote: remote.Name, Kind: FetchErrorAuthentication, Err: err}
+	}
+	fetchOptions.Depth = remote.Depth
+	// Tags which are not in the history of fetched branches are
+	// not fetched by default
+	if remote.Branches.Main.TagPattern != "" {
+		fetchOptions.Tags = git.AllTags
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(remote.Timeout)*time.Second)
 	defer cancel()
-	// TODO: we should only fetch tracked branches
+	if remote.SingleBranch {
+		fetchOptions.RefSpecs, err = branchRefSpecs(ctx, r, remote, fetchOptions.Auth)
+		if err != nil {
+			return newFetchError(remote.Name, err)
+		}
+	}
 	err = r.Repository.FetchContext(ctx, &fetchOptions)
 	if err == nil {
-		logrus.Infof("New commits have been fetched from '%s'", remote.URL)
+		logrus.Infof("New commits have been fetched from '%s'", redactURL(remote.URL))
 		return nil
 	} else if err != git.NoErrAlreadyUpToDate {
 		logrus.Errorf("Pull from remote '%s' failed: %s", remote.Name, err)
-		return fmt.Errorf("'git fetch %s' fails: '%s'", remote.Name, err)
+		return newFetchError(remote.Name, err)
 	} else {
 		logrus.Debugf("No new commits have been fetched from the remote '%s'", remote.Name)
 		return nil
@@ -192,7 +382,7 @@ func manageRemotes(r *git.Repository, remotes []types.Remote) error {
 func manageRemote(r *git.Repository, remote types.Remote) error {
 	gitRemote, err := r.Remote(remote.Name)
 	if err == git.ErrRemoteNotFound {
-		logrus.Infof("Adding remote '%s' with url '%s'", remote.Name, remote.URL)
+		logrus.Infof("Adding remote '%s' with url '%s'", remote.Name, redactURL(remote.URL))
 		_, err = r.CreateRemote(&gitConfig.RemoteConfig{
 			Name: remote.Name,
 			URLs: []string{remote.URL},
@@ -210,7 +400,12 @@ func manageRemote(r *git.Repository, remote types.Remote) error {
 		if err := r.DeleteRemote(remote.Name); err != nil {
 			return err
 		}
-		logrus.Infof("Updating remote %s (%s)", remote.Name, remote.URL)
+		// The branches fetched from the previous URL could
+		// be selected if the new URL can not be fetched
+		if err := removeRemoteReferences(r, remote.Name); err != nil {
+			return err
+		}
+		logrus.Infof("Updating remote %s (%s)", remote.Name, redactURL(remote.URL))
 		_, err = r.CreateRemote(&gitConfig.RemoteConfig{
 			Name: remote.Name,
 			URLs: []string{remote.URL},
@@ -222,18 +417,77 @@ func manageRemote(r *git.Repository, remote types.Remote) error {
 	return nil
 }
 
-func verifyHead(r *git.Repository, config types.GitConfig) error {
-	head, err := r.Head()
-	if head == nil {
-		return fmt.Errorf("Repository HEAD should not be nil")
+// removeRemoteReferences removes the references fetched from the
+// remote (refs/remotes/<remote>/*)
+func removeRemoteReferences(r *git.Repository, remoteName string) error {
+	refs, err := r.References()
+	if err != nil {
+		return err
+	}
+	prefix := fmt.Sprintf("refs/remotes/%s/", remoteName)
+	var names []plumbing.ReferenceName
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if strings.HasPrefix(ref.Name().String(), prefix) {
+			names = append(names, ref.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	logrus.Debugf("Repository HEAD is %s", head.Strings()[1])
+	for _, name := range names {
+		if err := r.Storer.RemoveReference(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	commit, err := r.CommitObject(head.Hash())
+// verifyCommitter returns an error if the email of the committer of
+// the commit doesn't match one of the allowed globs (*@example.org for
+// instance). It is a no-op when no glob is provided.
+func verifyCommitter(r *git.Repository, commitId plumbing.Hash, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	commit, err := r.CommitObject(commitId)
 	if err != nil {
 		return err
 	}
+	email := strings.ToLower(commit.Committer.Email)
+	for _, glob := range allowed {
+		if matched, _ := path.Match(strings.ToLower(glob), email); matched {
+			return nil
+		}
+	}
+	return fmt.Errorf("The committer %s of the commit %s is not allowed", commit.Committer.Email, commitId)
+}
 
+// verifyCommit returns an error if the commit is not signed by one of
+// the GPG public keys or by one of the SSH allowed signers. It is a
+// no-op when no key is provided.
+func verifyCommit(r *git.Repository, commitId plumbing.Hash, config types.GitConfig) error {
+	if len(config.GpgPublicKeyPaths) == 0 && config.SshAllowedSignersPath == "" {
+		return nil
+	}
+	commit, err := r.CommitObject(commitId)
+	if err != nil {
+		return err
+	}
+	if commit.PGPSignature == "" {
+		return fmt.Errorf("The commit %s is not signed", commitId)
+	}
+	if isSshSignature(commit.PGPSignature) {
+		if config.SshAllowedSignersPath == "" {
+			return fmt.Errorf("The commit %s is signed with an SSH key but no allowed signers file is configured", commitId)
+		}
+		principals, err := verifySshSignature(commit, config.SshAllowedSignersPath)
+		if err != nil {
+			return err
+		}
+		logrus.Debugf("The commit %s is signed by %s", commitId, principals)
+		return nil
+	}
 	for _, keyPath := range config.GpgPublicKeyPaths {
 		key, err := ioutil.ReadFile(keyPath)
 		if err != nil {
@@ -241,12 +495,51 @@ func verifyHead(r *git.Repository, config types.GitConfig) error {
 		}
 		entity, err := commit.Verify(string(key))
 		if err != nil {
-			logrus.Debug(err)
+			logrus.Debugf("The signature of the commit %s can not be verified with the key %s: %s", commitId, keyPath, err)
 		} else {
-			logrus.Debugf("Commit %s signed by %s", head.Hash(), entity.PrimaryIdentity().Name)
+			logrus.Debugf("The commit %s is signed by %s", commitId, entity.PrimaryIdentity().Name)
 			return nil
 		}
+	}
+	return fmt.Errorf("The commit %s is not signed by a trusted key", commitId)
+}
+
+// IsAncestor returns true if the commit base is an ancestor of the
+// commit top
+func (r *repository) IsAncestor(base, top string) (bool, error) {
+	return isAncestor(r.Repository, plumbing.NewHash(base), plumbing.NewHash(top))
+}
 
+// ChangedFiles returns the paths of the files added, modified or
+// removed between the from and to commits
+func (r *repository) ChangedFiles(from, to string) (paths []string, err error) {
+	fromCommit, err := r.Repository.CommitObject(plumbing.NewHash(from))
+	if err != nil {
+		return
+	}
+	toCommit, err := r.Repository.CommitObject(plumbing.NewHash(to))
+	if err != nil {
+		return
+	}
+	fromTree, err := fromCommit.Tree()
+	if err != nil {
+		return
+	}
+	toTree, err := toCommit.Tree()
+	if err != nil {
+		return
 	}
-	return fmt.Errorf("Commit %s is not signed", head.Hash())
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return
+	}
+	for _, change := range changes {
+		if change.From.Name != "" {
+			paths = append(paths, change.From.Name)
+		}
+		if change.To.Name != "" && change.To.Name != change.From.Name {
+			paths = append(paths, change.To.Name)
+		}
+	}
+	return
 }
@@ -0,0 +1,134 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+)
+
+// Input is the status of a repository overriding an input of the
+// flake
+type Input struct {
+	Name string `json:"name,omitempty"`
+	Url  string `json:"url,omitempty"`
+	// The path of the local repository of the input
+	Path          string `json:"path,omitempty"`
+	Branch        string `json:"branch,omitempty"`
+	CommitId      string `json:"commit_id,omitempty"`
+	CommitMsg     string `json:"commit_msg,omitempty"`
+	FetchErrorMsg string `json:"fetch_error_msg,omitempty"`
+	// The kind of the fetch error
+	FetchErrorKind string    `json:"fetch_error_kind,omitempty"`
+	FetchedAt      time.Time `json:"fetched_at,omitempty"`
+}
+
+// inputRemote returns the remote of the local repository of the input
+func inputRemote(input types.Input) types.Remote {
+	return types.Remote{
+		Name:    "origin",
+		URL:     input.URL,
+		Auth:    input.Auth,
+		Proxy:   input.Proxy,
+		Timeout: input.Timeout,
+		Branches: types.Branches{
+			Main: types.Branch{
+				Name: input.Branch,
+			},
+		},
+	}
+}
+
+// fetchInput fetches the branch of the input in the local repository
+// located at path and checks out its head. Each input has its own
+// repository since its history is not related to the history of the
+// remotes.
+// The commit signatures and the allowed committers of the gitConfig
+// apply to the inputs too: the fetched commit is only checked out once
+// it has been verified.
+func fetchInput(ctx context.Context, gitConfig types.GitConfig, path string, input types.Input) (commitId, commitMsg string, err error) {
+	remote := inputRemote(input)
+	config := types.GitConfig{
+		Path:    path,
+		Remotes: []types.Remote{remote},
+	}
+	r := repository{GitConfig: config}
+	r.Repository, err = repositoryOpen(config)
+	if err != nil {
+		return
+	}
+	if err = manageRemote(r.Repository, remote); err != nil {
+		return
+	}
+	if err = fetch(ctx, r, remote); err != nil {
+		return
+	}
+	head := getRemoteCommitHash(r, remote.Name, input.Branch)
+	if head == nil {
+		return "", "", fmt.Errorf("The branch '%s' of the input '%s' doesn't exist", input.Branch, input.Name)
+	}
+	commit, err := r.Repository.CommitObject(*head)
+	if err != nil {
+		return
+	}
+	if err = verifyCommit(r.Repository, *head, gitConfig); err != nil {
+		return
+	}
+	if err = verifyCommitter(r.Repository, *head, gitConfig.AllowedCommitters); err != nil {
+		return
+	}
+	if err = hardReset(r, *head); err != nil {
+		return
+	}
+	return head.String(), commit.Message, nil
+}
+
+// fetchInputs fetches all inputs. When the fetch of an input fails,
+// the previously fetched commit of this input is kept.
+func fetchInputs(ctx context.Context, config types.GitConfig, inputs []*Input) {
+	for i, input := range config.Inputs {
+		status := inputs[i]
+		commitId, commitMsg, err := fetchInput(ctx, config, status.Path, input)
+		status.FetchedAt = time.Now()
+		if err != nil {
+			logrus.Errorf("Failed to fetch the input '%s': %s", input.Name, err)
+			status.FetchErrorMsg = err.Error()
+			status.FetchErrorKind = fetchErrorKind(err)
+			continue
+		}
+		status.FetchErrorMsg = ""
+		status.FetchErrorKind = ""
+		if commitId != status.CommitId {
+			logrus.Infof("The input '%s' is now at the commit %s", input.Name, commitId)
+		}
+		status.CommitId = commitId
+		status.CommitMsg = commitMsg
+	}
+}
+
+// localInputHead returns the commit checked out in the local
+// repository of an input, which has been verified when it was
+// fetched. It is empty when the input has never been fetched.
+func localInputHead(path string) (commitId, commitMsg string) {
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		return
+	}
+	head, err := r.Head()
+	if err != nil {
+		return
+	}
+	commit, err := r.CommitObject(head.Hash())
+	if err != nil {
+		return
+	}
+	return head.Hash().String(), commit.Message
+}
+
+func inputPath(config types.GitConfig, input types.Input) string {
+	return filepath.Join(config.InputsPath, input.Name)
+}
@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// readPin returns the commit ID written in the pin file, or an empty
+// string when deployments are not pinned.
+func readPin(path string) string {
+	if path == "" {
+		return ""
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// isReachable returns true if the commit is the head, or an ancestor
+// of the head, of a branch of a remote
+func (r *repository) isReachable(hash plumbing.Hash) bool {
+	for _, remote := range r.RepositoryStatus.Remotes {
+		heads := []string{}
+		if remote.Main != nil {
+			heads = append(heads, remote.Main.CommitId)
+		}
+		if remote.Testing != nil {
+			heads = append(heads, remote.Testing.CommitId)
+		}
+		for _, head := range heads {
+			if head == "" {
+				continue
+			}
+			if head == hash.String() {
+				return true
+			}
+			if found, err := isAncestor(r.Repository, hash, plumbing.NewHash(head)); err == nil && found {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectPinnedCommit selects the pinned commit, which can be
+// abbreviated, instead of the commit selected from the branches. The
+// pinned commit is deployed with the default operation. It has to be
+// reachable from a branch of a remote: an arbitrary object of the
+// repository can't be deployed.
+func (r *repository) selectPinnedCommit(pin string) (commitId string, err error) {
+	hash, err := r.Repository.ResolveRevision(plumbing.Revision(pin))
+	if err != nil {
+		return "", fmt.Errorf("The pinned commit '%s' doesn't exist: %s", pin, err)
+	}
+	if !r.isReachable(*hash) {
+		return "", fmt.Errorf("The pinned commit '%s' is not reachable from the branches of the remotes", pin)
+	}
+	commit, err := r.Repository.CommitObject(*hash)
+	if err != nil {
+		return "", err
+	}
+	r.RepositoryStatus.SelectedCommitMsg = commit.Message
+	r.RepositoryStatus.SelectedBranchIsTesting = false
+	r.RepositoryStatus.SelectedBranchOperation = ""
+	r.RepositoryStatus.SelectedBranchRequireApproval = false
+	r.RepositoryStatus.PinnedCommitId = hash.String()
+	return hash.String(), nil
+}
@@ -19,6 +19,14 @@ type repository struct {
 
 type Repository interface {
 	FetchAndUpdate(ctx context.Context, remoteName string) (rsCh chan RepositoryStatus)
+	// ChangedFiles returns the files changed between two commits
+	ChangedFiles(from, to string) ([]string, error)
+	// IsAncestor returns true if the commit base is an ancestor
+	// of the commit top
+	IsAncestor(base, top string) (bool, error)
+	// Reload replaces the remotes of the repository. It must not
+	// be called while fetching.
+	Reload(remotes []types.Remote) error
 }
 
 // repositoryStatus is the last saved repositoryStatus
@@ -37,20 +45,42 @@ func New(config types.GitConfig, repositoryStatus RepositoryStatus) (r *reposito
 	return
 }
 
+// Reload replaces the remotes of the repository by the remotes of a
+// new configuration. The remotes whose URL changed are re-pointed to
+// their new URL, without cloning the repository again: the commits
+// already fetched are kept and only the new ones are fetched.
+func (r *repository) Reload(remotes []types.Remote) error {
+	if err := manageRemotes(r.Repository, remotes); err != nil {
+		return err
+	}
+	r.GitConfig.Remotes = remotes
+	r.RepositoryStatus = NewRepositoryStatus(r.GitConfig, r.RepositoryStatus)
+	return nil
+}
+
 func (r *repository) FetchAndUpdate(ctx context.Context, remoteName string) (rsCh chan RepositoryStatus) {
 	rsCh = make(chan RepositoryStatus)
 	go func() {
-		// FIXME: switch to the FetchContext to clean resource up on timeout
-		err := r.Fetch(remoteName)
+		err := r.FetchContext(ctx, remoteName)
 		if err == nil {
 			r.Update()
 		}
+		fetchInputs(ctx, r.GitConfig, r.RepositoryStatus.Inputs)
 		rsCh <- r.RepositoryStatus
 	}()
 	return rsCh
 }
 
+// Fetch fetches the remote remoteName or all remotes if remoteName is
+// empty
 func (r *repository) Fetch(remoteName string) (err error) {
+	return r.FetchContext(context.Background(), remoteName)
+}
+
+// FetchContext fetches the remote remoteName or all remotes if
+// remoteName is empty. The fetch is aborted when the context is
+// canceled.
+func (r *repository) FetchContext(ctx context.Context, remoteName string) (err error) {
 	var found bool
 	r.RepositoryStatus.Error = nil
 	r.RepositoryStatus.ErrorMsg = ""
@@ -61,9 +91,10 @@ func (r *repository) Fetch(remoteName string) (err error) {
 			}
 		}
 		if !found {
+			err = fmt.Errorf("The remote '%s' doesn't exist", remoteName)
 			r.RepositoryStatus.Error = err
 			r.RepositoryStatus.ErrorMsg = err.Error()
-			return fmt.Errorf("The remote '%s' doesn't exist", remoteName)
+			return err
 		}
 	}
 
@@ -74,10 +105,12 @@ func (r *repository) Fetch(remoteName string) (err error) {
 			continue
 		}
 		repositoryStatusRemote.LastFetched = true
-		if err = fetch(*r, remote); err != nil {
+		if err = fetch(ctx, *r, remote); err != nil {
 			repositoryStatusRemote.FetchErrorMsg = err.Error()
+			repositoryStatusRemote.FetchErrorKind = fetchErrorKind(err)
 		} else {
 			repositoryStatusRemote.FetchErrorMsg = ""
+			repositoryStatusRemote.FetchErrorKind = ""
 			repositoryStatusRemote.Fetched = true
 		}
 		repositoryStatusRemote.FetchedAt = time.Now()
@@ -87,6 +120,8 @@ func (r *repository) Fetch(remoteName string) (err error) {
 
 func (r *repository) Update() error {
 	selectedCommitId := ""
+	// Restored if the selected commit can not be verified
+	previous := r.RepositoryStatus
 
 	// We first walk on all Main branches in order to get a commit
 	// from a Main branch. Once found, we could then walk on all
@@ -101,14 +136,40 @@ func (r *repository) Update() error {
 				remote.FetchErrorMsg)
 			continue
 		}
-		head, msg, err := getHeadFromRemoteAndBranch(
-			*r,
-			remote.Name,
-			remote.Main.Name,
-			r.RepositoryStatus.MainCommitId)
+		var head plumbing.Hash
+		var msg string
+		var err error
+		// In the tag mode, the selected branch name is the
+		// deployed tag
+		branchName := remote.Main.Name
+		if remote.Main.TagPattern != "" {
+			head, msg, branchName, err = getHeadFromRemoteAndTag(
+				*r,
+				remote.Name,
+				remote.Main.TagPattern,
+				remote.Main.TagConstraint,
+				r.RepositoryStatus.MainCommitId)
+			remote.Main.Tag = branchName
+		} else {
+			head, msg, err = getHeadFromRemoteAndBranch(
+				*r,
+				remote.Name,
+				remote.Main.Name,
+				r.RepositoryStatus.MainCommitId)
+		}
+		// A force pushed head can be deployed, possibly once
+		// approved, depending on the force push policy
+		remote.Main.ForcePushed = false
+		requireApproval := remote.Main.RequireApproval
+		if isHardResetError(err) && (remote.Main.ForcePushPolicy == "accept" || remote.Main.ForcePushPolicy == "approve") {
+			logrus.Warnf("The head %s of the remote %s has been force pushed: %s", head, remote.Name, err)
+			remote.Main.ForcePushed = true
+			requireApproval = requireApproval || remote.Main.ForcePushPolicy == "approve"
+			err = nil
+		}
 		if err != nil {
 			remote.Main.ErrorMsg = err.Error()
-			logrus.Debugf("Failed to getHeadFromRemoteAndBranch: %s", err)
+			logrus.Debugf("Failed to get the head of the remote %s: %s", remote.Name, err)
 			continue
 		} else {
 			remote.Main.ErrorMsg = ""
@@ -121,18 +182,22 @@ func (r *repository) Update() error {
 		if selectedCommitId == "" {
 			selectedCommitId = head.String()
 			r.RepositoryStatus.SelectedCommitMsg = msg
-			r.RepositoryStatus.SelectedBranchName = remote.Main.Name
+			r.RepositoryStatus.SelectedBranchName = branchName
 			r.RepositoryStatus.SelectedRemoteName = remote.Name
 			r.RepositoryStatus.SelectedBranchIsTesting = false
+			r.RepositoryStatus.SelectedBranchOperation = remote.Main.Operation
+			r.RepositoryStatus.SelectedBranchRequireApproval = requireApproval
 		}
 		if head.String() != r.RepositoryStatus.MainCommitId {
 			selectedCommitId = head.String()
 			r.RepositoryStatus.SelectedCommitMsg = msg
-			r.RepositoryStatus.SelectedBranchName = remote.Main.Name
+			r.RepositoryStatus.SelectedBranchName = branchName
 			r.RepositoryStatus.SelectedBranchIsTesting = false
+			r.RepositoryStatus.SelectedBranchOperation = remote.Main.Operation
+			r.RepositoryStatus.SelectedBranchRequireApproval = requireApproval
 			r.RepositoryStatus.SelectedRemoteName = remote.Name
 			r.RepositoryStatus.MainCommitId = head.String()
-			r.RepositoryStatus.MainBranchName = remote.Main.Name
+			r.RepositoryStatus.MainBranchName = branchName
 			r.RepositoryStatus.MainRemoteName = remote.Name
 			break
 		}
@@ -150,6 +215,15 @@ func (r *repository) Update() error {
 		if remote.Testing.Name == "" {
 			continue
 		}
+		// The testing branch is optional: when it doesn't exist,
+		// the main branch is deployed
+		if getRemoteCommitHash(*r, remote.Name, remote.Testing.Name) == nil {
+			remote.Testing.CommitId = ""
+			remote.Testing.CommitMsg = ""
+			remote.Testing.OnTopOf = ""
+			remote.Testing.ErrorMsg = ""
+			continue
+		}
 
 		head, msg, err := getHeadFromRemoteAndBranch(
 			*r,
@@ -173,13 +247,41 @@ func (r *repository) Update() error {
 			r.RepositoryStatus.SelectedCommitMsg = msg
 			r.RepositoryStatus.SelectedBranchName = remote.Testing.Name
 			r.RepositoryStatus.SelectedBranchIsTesting = true
+			r.RepositoryStatus.SelectedBranchOperation = remote.Testing.Operation
+			r.RepositoryStatus.SelectedBranchRequireApproval = remote.Testing.RequireApproval
 			r.RepositoryStatus.SelectedRemoteName = remote.Name
 			break
 		}
 	}
 
+	r.RepositoryStatus.PinnedCommitId = ""
+	if pin := readPin(r.GitConfig.PinFilepath); pin != "" {
+		pinnedCommitId, err := r.selectPinnedCommit(pin)
+		if err != nil {
+			r.RepositoryStatus.Error = err
+			r.RepositoryStatus.ErrorMsg = err.Error()
+			return err
+		}
+		selectedCommitId = pinnedCommitId
+	}
+
 	if selectedCommitId != "" {
+		err := verifyCommit(r.Repository, plumbing.NewHash(selectedCommitId), r.GitConfig)
+		if err == nil {
+			err = verifyCommitter(r.Repository, plumbing.NewHash(selectedCommitId), r.GitConfig.AllowedCommitters)
+		}
+		if err != nil {
+			logrus.Errorf("The commit %s is not deployed: %s", selectedCommitId, err)
+			r.RepositoryStatus = previous
+			r.RepositoryStatus.Error = err
+			r.RepositoryStatus.ErrorMsg = err.Error()
+			return err
+		}
 		r.RepositoryStatus.SelectedCommitId = selectedCommitId
+		if commit, err := r.Repository.CommitObject(plumbing.NewHash(selectedCommitId)); err == nil {
+			r.RepositoryStatus.SelectedCommitAuthor = fmt.Sprintf("%s <%s>", commit.Author.Name, commit.Author.Email)
+			r.RepositoryStatus.SelectedCommitDate = commit.Author.When
+		}
 	}
 
 	if err := hardReset(*r, plumbing.NewHash(selectedCommitId)); err != nil {
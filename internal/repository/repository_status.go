@@ -9,19 +9,31 @@ import (
 )
 
 type MainBranch struct {
-	Name      string `json:"name,omitempty"`
-	CommitId  string `json:"commit_id,omitempty"`
-	CommitMsg string `json:"commit_msg,omitempty"`
-	ErrorMsg  string `json:"error_msg,omitempty"`
-	OnTopOf   string `json:"on_top_of,omitempty"`
+	Name            string `json:"name,omitempty"`
+	Operation       string `json:"operation,omitempty"`
+	RequireApproval bool   `json:"require_approval,omitempty"`
+	CommitId        string `json:"commit_id,omitempty"`
+	CommitMsg       string `json:"commit_msg,omitempty"`
+	ErrorMsg        string `json:"error_msg,omitempty"`
+	OnTopOf         string `json:"on_top_of,omitempty"`
+	TagPattern      string `json:"tag_pattern,omitempty"`
+	TagConstraint   string `json:"tag_constraint,omitempty"`
+	// The highest tag matching the TagPattern
+	Tag             string `json:"tag,omitempty"`
+	ForcePushPolicy string `json:"force_push_policy,omitempty"`
+	// The head has been force pushed and accepted by the
+	// ForcePushPolicy
+	ForcePushed bool `json:"force_pushed,omitempty"`
 }
 
 type TestingBranch struct {
-	Name      string `json:"name,omitempty"`
-	CommitId  string `json:"commit_id,omitempty"`
-	CommitMsg string `json:"commit_msg,omitempty"`
-	ErrorMsg  string `json:"error_msg,omitempty"`
-	OnTopOf   string `json:"on_top_of,omitempty"`
+	Name            string `json:"name,omitempty"`
+	Operation       string `json:"operation,omitempty"`
+	RequireApproval bool   `json:"require_approval,omitempty"`
+	CommitId        string `json:"commit_id,omitempty"`
+	CommitMsg       string `json:"commit_msg,omitempty"`
+	ErrorMsg        string `json:"error_msg,omitempty"`
+	OnTopOf         string `json:"on_top_of,omitempty"`
 }
 
 type Remote struct {
@@ -35,22 +47,42 @@ type Remote struct {
 	// Is this remote the last festched one? This is mainly useful
 	// to increase Prometheus counters.b
 	LastFetched bool `json:"last_fetched,omitempty"`
+	// The kind of the fetch error (authentication, not_found,
+	// timeout, network or other)
+	FetchErrorKind string `json:"fetch_error_kind,omitempty"`
 }
 
 type RepositoryStatus struct {
 	// This is the deployed Main commit ID. It is used to ensure
 	// fast forward
-	SelectedCommitId        string    `json:"selected_commit_id"`
-	SelectedCommitMsg       string    `json:"selected_commit_msg"`
+	SelectedCommitId  string `json:"selected_commit_id"`
+	SelectedCommitMsg string `json:"selected_commit_msg"`
+	// The author of the selected commit, "name <email>"
+	SelectedCommitAuthor    string    `json:"selected_commit_author,omitempty"`
+	SelectedCommitDate      time.Time `json:"selected_commit_date,omitempty"`
 	SelectedRemoteName      string    `json:"selected_remote_name"`
 	SelectedBranchName      string    `json:"selected_branch_name"`
 	SelectedBranchIsTesting bool      `json:"selected_branch_is_testing"`
-	MainCommitId            string    `json:"main_commit_id"`
-	MainRemoteName          string    `json:"main_remote_name"`
-	MainBranchName          string    `json:"main_branch_name"`
-	Remotes                 []*Remote `json:"remotes"`
-	Error                   error     `json:"-"`
-	ErrorMsg                string    `json:"error_msg"`
+	// The operation used to deploy the selected branch. When
+	// empty, the default operation is used.
+	SelectedBranchOperation string `json:"selected_branch_operation"`
+	// Commits of the selected branch have to be approved to be
+	// deployed
+	SelectedBranchRequireApproval bool      `json:"selected_branch_require_approval"`
+	MainCommitId                  string    `json:"main_commit_id"`
+	MainRemoteName                string    `json:"main_remote_name"`
+	MainBranchName                string    `json:"main_branch_name"`
+	Remotes                       []*Remote `json:"remotes"`
+	Error                         error     `json:"-"`
+	ErrorMsg                      string    `json:"error_msg"`
+	// The commit deployed instead of the heads of the branches
+	// until it is unpinned
+	PinnedCommitId string `json:"pinned_commit_id"`
+	// The repositories overriding inputs of the flake
+	Inputs []*Input `json:"inputs,omitempty"`
+	// The directory containing the source of the selected commit
+	// when it is not the repository worktree (tarball remotes)
+	SelectedPath string `json:"selected_path,omitempty"`
 }
 
 func NewRepositoryStatus(config types.GitConfig, repositoryStatus RepositoryStatus) RepositoryStatus {
@@ -62,18 +94,73 @@ func NewRepositoryStatus(config types.GitConfig, repositoryStatus RepositoryStat
 		r.Remotes[i] = &Remote{
 			Name: remote.Name,
 
-			Url: remote.URL,
+			Url: redactURL(remote.URL),
 			Main: &MainBranch{
-				Name: remote.Branches.Main.Name,
+				Name:            remote.Branches.Main.Name,
+				Operation:       remote.Branches.Main.Operation,
+				RequireApproval: remote.Branches.Main.RequireApproval,
+				TagPattern:      remote.Branches.Main.TagPattern,
+				TagConstraint:   remote.Branches.Main.TagConstraint,
+				ForcePushPolicy: remote.Branches.Main.ForcePushPolicy,
 			},
 			Testing: &TestingBranch{
-				Name: remote.Branches.Testing.Name,
+				Name:            remote.Branches.Testing.Name,
+				Operation:       remote.Branches.Testing.Operation,
+				RequireApproval: remote.Branches.Testing.RequireApproval,
 			},
 		}
 	}
+	r.Inputs = make([]*Input, len(config.Inputs))
+	for i, input := range config.Inputs {
+		r.Inputs[i] = &Input{
+			Name:   input.Name,
+			Url:    redactURL(input.URL),
+			Path:   inputPath(config, input),
+			Branch: input.Branch,
+		}
+		// The previously fetched commit is kept until the input is
+		// fetched again, even if comin restarted: an input is never
+		// silently evaluated at its flake.lock revision
+		for _, previous := range repositoryStatus.Inputs {
+			if previous.Name == input.Name && previous.Url == r.Inputs[i].Url {
+				r.Inputs[i].CommitId = previous.CommitId
+				r.Inputs[i].CommitMsg = previous.CommitMsg
+			}
+		}
+		if r.Inputs[i].CommitId == "" {
+			r.Inputs[i].CommitId, r.Inputs[i].CommitMsg = localInputHead(r.Inputs[i].Path)
+		}
+	}
 	return r
 }
 
+// InputCommitIds returns the commit ID of the fetched inputs, indexed
+// by their name
+func (r RepositoryStatus) InputCommitIds() map[string]string {
+	if len(r.Inputs) == 0 {
+		return nil
+	}
+	commitIds := make(map[string]string)
+	for _, input := range r.Inputs {
+		if input.CommitId != "" {
+			commitIds[input.Name] = input.CommitId
+		}
+	}
+	return commitIds
+}
+
+// UnresolvedInputs returns the names of the inputs which have never
+// been fetched: the flake can not be evaluated without them
+func (r RepositoryStatus) UnresolvedInputs() []string {
+	names := []string{}
+	for _, input := range r.Inputs {
+		if input.CommitId == "" {
+			names = append(names, input.Name)
+		}
+	}
+	return names
+}
+
 func (r RepositoryStatus) IsTesting() bool {
 	return r.SelectedBranchIsTesting
 }
@@ -1,8 +1,12 @@
 package repository
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/nlewo/comin/internal/types"
 	"github.com/stretchr/testify/assert"
@@ -460,6 +464,7 @@ func TestWithoutTesting(t *testing.T) {
 	assert.Equal(t, HeadCommitId(r.Repository), r.RepositoryStatus.SelectedCommitId)
 	assert.Equal(t, "main", r.RepositoryStatus.SelectedBranchName)
 	assert.Equal(t, "r1", r.RepositoryStatus.SelectedRemoteName)
+	assert.Empty(t, r.RepositoryStatus.Remotes[0].Testing.ErrorMsg)
 }
 
 func TestRepositoryUpdateMain(t *testing.T) {
@@ -707,3 +712,381 @@ func TestTestingHardReset(t *testing.T) {
 	assert.Equal(t, "main", r.RepositoryStatus.SelectedBranchName)
 	assert.Equal(t, "r1", r.RepositoryStatus.SelectedRemoteName)
 }
+
+func TestRepositoryUpdatePinned(t *testing.T) {
+	remoteRepositoryDir := t.TempDir()
+	cominRepositoryDir := t.TempDir()
+	remoteRepository, err := initRemoteRepostiory(remoteRepositoryDir, true)
+	assert.Nil(t, err)
+	pinFilepath := filepath.Join(t.TempDir(), "pin")
+
+	gitConfig := types.GitConfig{
+		Path: cominRepositoryDir,
+		Remotes: []types.Remote{
+			types.Remote{
+				Name: "origin",
+				URL:  remoteRepositoryDir,
+				Branches: types.Branches{
+					Main: types.Branch{
+						Name: "main",
+					},
+				},
+				Timeout: 30,
+			},
+		},
+		PinFilepath: pinFilepath,
+	}
+	r, _ := New(gitConfig, RepositoryStatus{})
+	_ = r.Fetch("")
+	_ = r.Update()
+	pinnedCommitId := r.RepositoryStatus.SelectedCommitId
+
+	// Newer commits are ignored while the deployment is pinned
+	assert.Nil(t, os.WriteFile(pinFilepath, []byte(pinnedCommitId[:7]+"\n"), 0644))
+	newCommitId, err := commitFile(remoteRepository, remoteRepositoryDir, "main", "file-4")
+	assert.Nil(t, err)
+	_ = r.Fetch("")
+	assert.Nil(t, r.Update())
+	assert.Equal(t, pinnedCommitId, r.RepositoryStatus.SelectedCommitId)
+	assert.Equal(t, pinnedCommitId, r.RepositoryStatus.PinnedCommitId)
+	assert.Equal(t, pinnedCommitId, HeadCommitId(r.Repository))
+	assert.Equal(t, newCommitId, r.RepositoryStatus.Remotes[0].Main.CommitId)
+
+	// The head of the main branch is selected once unpinned
+	assert.Nil(t, os.Remove(pinFilepath))
+	_ = r.Fetch("")
+	assert.Nil(t, r.Update())
+	assert.Equal(t, newCommitId, r.RepositoryStatus.SelectedCommitId)
+	assert.Empty(t, r.RepositoryStatus.PinnedCommitId)
+
+	// An unknown pinned commit is an error
+	assert.Nil(t, os.WriteFile(pinFilepath, []byte("0123456789abcdef"), 0644))
+	_ = r.Fetch("")
+	assert.NotNil(t, r.Update())
+
+	// A commit which is not reachable from the branches can't be
+	// pinned
+	localCommitId, err := commitFile(r.Repository, cominRepositoryDir, "local", "file-5")
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(pinFilepath, []byte(localCommitId), 0644))
+	_ = r.Fetch("")
+	err = r.Update()
+	assert.ErrorContains(t, err, "not reachable")
+}
+
+func TestRemoteFallback(t *testing.T) {
+	r1Dir := t.TempDir()
+	r2Dir := t.TempDir()
+	cominRepositoryDir := t.TempDir()
+	_, err := initRemoteRepostiory(r1Dir, false)
+	assert.Nil(t, err)
+	r2, err := initRemoteRepostiory(r2Dir, false)
+	assert.Nil(t, err)
+
+	gitConfig := types.GitConfig{
+		Path: cominRepositoryDir,
+		Remotes: []types.Remote{
+			types.Remote{
+				Name: "origin",
+				URL:  r1Dir,
+				Branches: types.Branches{
+					Main: types.Branch{
+						Name: "main",
+					},
+				},
+				Timeout: 30,
+			},
+			types.Remote{
+				Name: "mirror",
+				URL:  r2Dir,
+				Branches: types.Branches{
+					Main: types.Branch{
+						Name: "main",
+					},
+				},
+				Timeout: 30,
+			},
+		},
+	}
+	r, err := New(gitConfig, RepositoryStatus{})
+	assert.Nil(t, err)
+	// The first remote is preferred when remotes are at the same
+	// commit
+	_ = r.Fetch("")
+	_ = r.Update()
+	assert.Equal(t, "origin", r.RepositoryStatus.SelectedRemoteName)
+
+	// The first remote is unavailable: the commit is served by
+	// the mirror
+	assert.Nil(t, os.RemoveAll(r1Dir))
+	c4, err := commitFile(r2, r2Dir, "main", "file-4")
+	assert.Nil(t, err)
+	_ = r.Fetch("")
+	_ = r.Update()
+	assert.NotEmpty(t, r.RepositoryStatus.Remotes[0].FetchErrorMsg)
+	assert.Equal(t, c4, r.RepositoryStatus.SelectedCommitId)
+	assert.Equal(t, "mirror", r.RepositoryStatus.SelectedRemoteName)
+}
+
+func TestRepositoryUpdateSigned(t *testing.T) {
+	r1Dir := t.TempDir()
+	cominRepositoryDir := t.TempDir()
+	r1, _ := initRemoteRepostiory(r1Dir, false)
+	entity, publicKeyPath := newGpgKey(t, t.TempDir())
+	gitConfig := types.GitConfig{
+		Path: cominRepositoryDir,
+		Remotes: []types.Remote{
+			types.Remote{
+				Name: "r1",
+				URL:  r1Dir,
+				Branches: types.Branches{
+					Main: types.Branch{
+						Name: "main",
+					},
+				},
+				Timeout: 30,
+			},
+		},
+		GpgPublicKeyPaths: []string{publicKeyPath},
+	}
+	r, _ := New(gitConfig, RepositoryStatus{})
+
+	// r1/main: c1 - c2 - *c3 (unsigned)
+	_ = r.Fetch("")
+	err := r.Update()
+	assert.ErrorContains(t, err, "is not signed")
+	assert.Equal(t, "", r.RepositoryStatus.SelectedCommitId)
+	assert.NotEmpty(t, r.RepositoryStatus.ErrorMsg)
+
+	// r1/main: c1 - c2 - c3 - *c4 (signed)
+	c4, _ := commitSignedFile(r1, r1Dir, "main", "file-4", entity)
+	_ = r.Fetch("")
+	err = r.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, c4, r.RepositoryStatus.SelectedCommitId)
+
+	// r1/main: c1 - c2 - c3 - c4 - *c5 (unsigned)
+	_, _ = commitFile(r1, r1Dir, "main", "file-5")
+	_ = r.Fetch("")
+	err = r.Update()
+	assert.NotNil(t, err)
+	assert.Equal(t, c4, r.RepositoryStatus.SelectedCommitId)
+	assert.Equal(t, "file-4", r.RepositoryStatus.SelectedCommitMsg)
+}
+
+func TestRepositoryShallowSingleBranch(t *testing.T) {
+	r1Dir := t.TempDir()
+	cominRepositoryDir := t.TempDir()
+	r1, _ := initRemoteRepostiory(r1Dir, false)
+	gitConfig := types.GitConfig{
+		Path: cominRepositoryDir,
+		Remotes: []types.Remote{
+			types.Remote{
+				Name: "r1",
+				URL:  r1Dir,
+				Branches: types.Branches{
+					Main: types.Branch{
+						Name: "main",
+					},
+					Testing: types.Branch{
+						Name: "testing",
+					},
+				},
+				Timeout:      30,
+				Depth:        1,
+				SingleBranch: true,
+			},
+		},
+	}
+	r, _ := New(gitConfig, RepositoryStatus{})
+
+	// r1/main: c1 - c2 - *c3
+	// r1/feature: c1 - c2 - c3 - c4
+	c3 := HeadCommitId(r1)
+	_, _ = commitFile(r1, r1Dir, "feature", "file-4")
+	err := r.Fetch("")
+	assert.Nil(t, err)
+	assert.Empty(t, r.RepositoryStatus.Remotes[0].FetchErrorMsg)
+	err = r.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, c3, r.RepositoryStatus.SelectedCommitId)
+	_, err = r.Repository.Reference("refs/remotes/r1/feature", true)
+	assert.NotNil(t, err)
+	shallows, err := r.Repository.Storer.Shallow()
+	assert.Nil(t, err)
+	assert.NotEmpty(t, shallows)
+
+	// r1/main: c1 - c2 - c3 - c5 - c6 - *c7
+	_, _ = commitFile(r1, r1Dir, "main", "file-5")
+	_, _ = commitFile(r1, r1Dir, "main", "file-6")
+	c7, _ := commitFile(r1, r1Dir, "main", "file-7")
+	_ = r.Fetch("")
+	err = r.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, c7, r.RepositoryStatus.SelectedCommitId)
+}
+
+func TestRepositoryUpdateForcePushPolicy(t *testing.T) {
+	for _, policy := range []string{"accept", "approve"} {
+		remoteRepositoryDir := t.TempDir()
+		cominRepositoryDir := t.TempDir()
+		remoteRepository, err := initRemoteRepostiory(remoteRepositoryDir, false)
+		assert.Nil(t, err)
+		gitConfig := types.GitConfig{
+			Path: cominRepositoryDir,
+			Remotes: []types.Remote{
+				types.Remote{
+					Name: "origin",
+					URL:  remoteRepositoryDir,
+					Branches: types.Branches{
+						Main: types.Branch{
+							Name:            "main",
+							ForcePushPolicy: policy,
+						},
+					},
+					Timeout: 30,
+				},
+			},
+		}
+		r, _ := New(gitConfig, RepositoryStatus{})
+
+		// origin/main: c1 - c2 - c3 - *c4
+		previousHash := HeadCommitId(remoteRepository)
+		c4, _ := commitFile(remoteRepository, remoteRepositoryDir, "main", "file-4")
+		_ = r.Fetch("")
+		_ = r.Update()
+		assert.Equal(t, c4, r.RepositoryStatus.SelectedCommitId)
+		assert.False(t, r.RepositoryStatus.SelectedBranchRequireApproval)
+
+		// origin/main: c1 - c2 - *c3
+		ref := plumbing.NewHashReference("refs/heads/main", plumbing.NewHash(previousHash))
+		err = remoteRepository.Storer.SetReference(ref)
+		assert.Nil(t, err)
+		_ = r.Fetch("")
+		err = r.Update()
+		assert.Nil(t, err)
+		assert.Equal(t, previousHash, r.RepositoryStatus.SelectedCommitId)
+		assert.True(t, r.RepositoryStatus.Remotes[0].Main.ForcePushed)
+		assert.Empty(t, r.RepositoryStatus.Remotes[0].Main.ErrorMsg)
+		assert.Equal(t, policy == "approve", r.RepositoryStatus.SelectedBranchRequireApproval)
+	}
+}
+
+func TestReload(t *testing.T) {
+	r1Dir := t.TempDir()
+	r2Dir := t.TempDir()
+	cominRepositoryDir := t.TempDir()
+	_, err := initRemoteRepostiory(r1Dir, false)
+	assert.Nil(t, err)
+	r2, err := initRemoteRepostiory(r2Dir, false)
+	assert.Nil(t, err)
+	newCommitId, err := commitFile(r2, r2Dir, "main", "file-4")
+	assert.Nil(t, err)
+	remote := types.Remote{
+		Name: "origin",
+		URL:  r1Dir,
+		Branches: types.Branches{
+			Main: types.Branch{
+				Name: "main",
+			},
+		},
+		Timeout: 30,
+	}
+	gitConfig := types.GitConfig{
+		Path:    cominRepositoryDir,
+		Remotes: []types.Remote{remote},
+	}
+	r, err := New(gitConfig, RepositoryStatus{})
+	assert.Nil(t, err)
+	assert.Nil(t, r.Fetch(""))
+	assert.NotNil(t, getRemoteCommitHash(*r, "origin", "main"))
+
+	// The remote is re-pointed to the new URL and the branches
+	// fetched from the previous URL are removed
+	remote.URL = r2Dir
+	assert.Nil(t, r.Reload([]types.Remote{remote}))
+	assert.Nil(t, getRemoteCommitHash(*r, "origin", "main"))
+	assert.Equal(t, r2Dir, r.RepositoryStatus.Remotes[0].Url)
+	gitRemote, err := r.Repository.Remote("origin")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{r2Dir}, gitRemote.Config().URLs)
+
+	assert.Nil(t, r.Fetch(""))
+	assert.Equal(t, newCommitId, getRemoteCommitHash(*r, "origin", "main").String())
+}
+
+func TestFetchInputs(t *testing.T) {
+	remoteDir := t.TempDir()
+	secretsDir := t.TempDir()
+	stateDir := t.TempDir()
+	_, err := initRemoteRepostiory(remoteDir, false)
+	assert.Nil(t, err)
+	secrets, err := initRemoteRepostiory(secretsDir, false)
+	assert.Nil(t, err)
+	gitConfig := types.GitConfig{
+		Path: filepath.Join(stateDir, "repository"),
+		Remotes: []types.Remote{
+			{
+				Name: "origin",
+				URL:  remoteDir,
+				Branches: types.Branches{
+					Main: types.Branch{
+						Name: "main",
+					},
+				},
+				Timeout: 30,
+			},
+		},
+		Inputs: []types.Input{
+			{
+				Name:    "secrets",
+				URL:     secretsDir,
+				Branch:  "main",
+				Timeout: 30,
+			},
+		},
+		InputsPath: filepath.Join(stateDir, "inputs"),
+	}
+	r, err := New(gitConfig, RepositoryStatus{})
+	assert.Nil(t, err)
+
+	rs := <-r.FetchAndUpdate(context.Background(), "")
+	secretsHead := HeadCommitId(secrets)
+	assert.Equal(t, map[string]string{"secrets": secretsHead}, rs.InputCommitIds())
+	assert.Equal(t, filepath.Join(stateDir, "inputs", "secrets"), rs.Inputs[0].Path)
+	// The head of the input is checked out
+	input, err := git.PlainOpen(rs.Inputs[0].Path)
+	assert.Nil(t, err)
+	assert.Equal(t, secretsHead, HeadCommitId(input))
+
+	newCommitId, err := commitFile(secrets, secretsDir, "main", "secret-2")
+	assert.Nil(t, err)
+	rs = <-r.FetchAndUpdate(context.Background(), "")
+	assert.Equal(t, map[string]string{"secrets": newCommitId}, rs.InputCommitIds())
+
+	// A commit of a committer which is not allowed is not checked out
+	gitConfig.AllowedCommitters = []string{"*@example.org"}
+	r, err = New(gitConfig, rs)
+	assert.Nil(t, err)
+	_, err = commitFile(secrets, secretsDir, "main", "secret-3")
+	assert.Nil(t, err)
+	rs = <-r.FetchAndUpdate(context.Background(), "")
+	assert.Equal(t, map[string]string{"secrets": newCommitId}, rs.InputCommitIds())
+	assert.Contains(t, rs.Inputs[0].FetchErrorMsg, "is not allowed")
+	assert.Equal(t, newCommitId, HeadCommitId(input))
+
+	// The previous commit is kept when the fetch fails
+	assert.Nil(t, os.RemoveAll(secretsDir))
+	rs = <-r.FetchAndUpdate(context.Background(), "")
+	assert.Equal(t, map[string]string{"secrets": newCommitId}, rs.InputCommitIds())
+	assert.NotEmpty(t, rs.Inputs[0].FetchErrorMsg)
+
+	// After a restart, the commit checked out in the local
+	// repository of the input is used until it is fetched again
+	r, err = New(gitConfig, RepositoryStatus{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"secrets": newCommitId}, r.RepositoryStatus.InputCommitIds())
+	rs = <-r.FetchAndUpdate(context.Background(), "")
+	assert.Equal(t, map[string]string{"secrets": newCommitId}, rs.InputCommitIds())
+	assert.Empty(t, rs.UnresolvedInputs())
+}
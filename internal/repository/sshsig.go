@@ -0,0 +1,286 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// This file implements the verification of commits signed with SSH
+// keys (git gpg.format=ssh). The signature format is described in
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.sshsig
+
+const (
+	sshSignatureHeader    = "-----BEGIN SSH SIGNATURE-----"
+	sshSignatureFooter    = "-----END SSH SIGNATURE-----"
+	sshSignatureMagic     = "SSHSIG"
+	sshSignatureNamespace = "git"
+)
+
+type sshSignature struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+type sshSignedData struct {
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+type allowedSigner struct {
+	principals string
+	publicKey  ssh.PublicKey
+	// The patterns of the namespaces the key is allowed to sign,
+	// all namespaces when empty
+	namespaces []string
+	// The key is only valid between validAfter and validBefore
+	// when they are not zero
+	validAfter  time.Time
+	validBefore time.Time
+}
+
+// accepts returns an error if the signer is not allowed to sign in
+// the namespace at the time at
+func (s allowedSigner) accepts(namespace string, at time.Time) error {
+	if len(s.namespaces) > 0 {
+		allowed := false
+		for _, pattern := range s.namespaces {
+			negated := strings.HasPrefix(pattern, "!")
+			matched, _ := path.Match(strings.TrimPrefix(pattern, "!"), namespace)
+			if matched && negated {
+				allowed = false
+				break
+			}
+			allowed = allowed || matched
+		}
+		if !allowed {
+			return fmt.Errorf("the key of %s is not allowed to sign in the namespace '%s'", s.principals, namespace)
+		}
+	}
+	if !s.validAfter.IsZero() && at.Before(s.validAfter) {
+		return fmt.Errorf("the key of %s is only valid after %s", s.principals, s.validAfter)
+	}
+	if !s.validBefore.IsZero() && !at.Before(s.validBefore) {
+		return fmt.Errorf("the key of %s is only valid before %s", s.principals, s.validBefore)
+	}
+	return nil
+}
+
+// nextField returns the first whitespace separated field of the line
+// and the rest of the line. Whitespaces between double quotes don't
+// separate fields.
+func nextField(line string) (field, rest string) {
+	line = strings.TrimLeft(line, " \t")
+	quoted := false
+	for i, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case (c == ' ' || c == '\t') && !quoted:
+			return line[:i], strings.TrimLeft(line[i:], " \t")
+		}
+	}
+	return line, ""
+}
+
+// parseSignerTime parses the time of the valid-after and valid-before
+// options: YYYYMMDD[HHMM[SS]], in UTC when it ends with Z and in the
+// local time otherwise
+func parseSignerTime(value string) (time.Time, error) {
+	location := time.Local
+	if strings.HasSuffix(value, "Z") || strings.HasSuffix(value, "z") {
+		location = time.UTC
+		value = value[:len(value)-1]
+	}
+	layouts := map[int]string{8: "20060102", 12: "200601021504", 14: "20060102150405"}
+	layout, ok := layouts[len(value)]
+	if !ok {
+		return time.Time{}, fmt.Errorf("the time '%s' is not formatted as YYYYMMDD[HHMM[SS]][Z]", value)
+	}
+	return time.ParseInLocation(layout, value, location)
+}
+
+// parseSignerOptions sets the options of the signer. The certificate
+// authorities are not supported.
+func parseSignerOptions(signer *allowedSigner, options []string) (err error) {
+	for _, option := range options {
+		name, value := option, ""
+		if i := strings.Index(option, "="); i >= 0 {
+			name, value = option[:i], strings.Trim(option[i+1:], "\"")
+		}
+		switch strings.ToLower(name) {
+		case "namespaces":
+			signer.namespaces = strings.Split(value, ",")
+		case "valid-after":
+			if signer.validAfter, err = parseSignerTime(value); err != nil {
+				return
+			}
+		case "valid-before":
+			if signer.validBefore, err = parseSignerTime(value); err != nil {
+				return
+			}
+		case "cert-authority":
+			return fmt.Errorf("the cert-authority option is not supported")
+		default:
+			return fmt.Errorf("the option '%s' is not supported", name)
+		}
+	}
+	return nil
+}
+
+func isSshSignature(signature string) bool {
+	return strings.HasPrefix(strings.TrimSpace(signature), sshSignatureHeader)
+}
+
+func parseSshSignature(armored string) (sig sshSignature, err error) {
+	armored = strings.TrimSpace(armored)
+	if !strings.HasPrefix(armored, sshSignatureHeader) || !strings.HasSuffix(armored, sshSignatureFooter) {
+		return sig, fmt.Errorf("The SSH signature is not armored")
+	}
+	armored = strings.TrimPrefix(armored, sshSignatureHeader)
+	armored = strings.TrimSuffix(armored, sshSignatureFooter)
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(armored), ""))
+	if err != nil {
+		return sig, fmt.Errorf("The SSH signature can not be decoded: %s", err)
+	}
+	if !bytes.HasPrefix(blob, []byte(sshSignatureMagic)) {
+		return sig, fmt.Errorf("The SSH signature doesn't start with %s", sshSignatureMagic)
+	}
+	if err = ssh.Unmarshal(blob[len(sshSignatureMagic):], &sig); err != nil {
+		return sig, fmt.Errorf("The SSH signature can not be parsed: %s", err)
+	}
+	if sig.Version != 1 {
+		return sig, fmt.Errorf("The SSH signature version %d is not supported", sig.Version)
+	}
+	return sig, nil
+}
+
+// readAllowedSigners reads a file in the ssh-keygen allowed signers
+// format: each line contains principals, optional options and a
+// public key. The lines with an option which is not supported are
+// ignored: their key is not allowed to sign.
+func readAllowedSigners(path string) (signers []allowedSigner, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		principals, rest := nextField(line)
+		// The options preceding the public key are parsed as
+		// the options of an authorized key
+		publicKey, _, options, _, err := ssh.ParseAuthorizedKey([]byte(rest))
+		if err != nil {
+			logrus.Warnf("The line %d of the allowed signers file %s is ignored: %s", n, path, err)
+			continue
+		}
+		signer := allowedSigner{principals: strings.Trim(principals, "\""), publicKey: publicKey}
+		if err := parseSignerOptions(&signer, options); err != nil {
+			logrus.Warnf("The line %d of the allowed signers file %s is ignored: %s", n, path, err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	return signers, scanner.Err()
+}
+
+// verifySshSignature returns the principals of the allowed signer
+// who signed the commit
+func verifySshSignature(commit *object.Commit, allowedSignersPath string) (principals string, err error) {
+	sig, err := parseSshSignature(commit.PGPSignature)
+	if err != nil {
+		return
+	}
+	if sig.Namespace != sshSignatureNamespace {
+		return "", fmt.Errorf("The SSH signature namespace '%s' is not '%s'", sig.Namespace, sshSignatureNamespace)
+	}
+	publicKey, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return
+	}
+	signers, err := readAllowedSigners(allowedSignersPath)
+	if err != nil {
+		return
+	}
+	// The validity of the key is checked at the commit time, as
+	// git does
+	var rejections []string
+	for _, signer := range signers {
+		if !bytes.Equal(signer.publicKey.Marshal(), publicKey.Marshal()) {
+			continue
+		}
+		if err := signer.accepts(sig.Namespace, commit.Committer.When); err != nil {
+			rejections = append(rejections, err.Error())
+			continue
+		}
+		principals = signer.principals
+		break
+	}
+	if principals == "" && len(rejections) > 0 {
+		return "", fmt.Errorf("The commit %s is not signed by an allowed signer: %s", commit.Hash, strings.Join(rejections, ", "))
+	}
+	if principals == "" {
+		return "", fmt.Errorf("The commit %s is not signed by an allowed signer", commit.Hash)
+	}
+
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return "", fmt.Errorf("The SSH signature hash algorithm '%s' is not supported", sig.HashAlgorithm)
+	}
+	encoded := &plumbing.MemoryObject{}
+	if err = commit.EncodeWithoutSignature(encoded); err != nil {
+		return "", err
+	}
+	reader, err := encoded.Reader()
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(h, reader); err != nil {
+		return "", err
+	}
+	signedData := append([]byte(sshSignatureMagic), ssh.Marshal(sshSignedData{
+		Namespace:     sig.Namespace,
+		Reserved:      sig.Reserved,
+		HashAlgorithm: sig.HashAlgorithm,
+		Hash:          h.Sum(nil),
+	})...)
+
+	var signature ssh.Signature
+	if err = ssh.Unmarshal(sig.Signature, &signature); err != nil {
+		return "", fmt.Errorf("The SSH signature can not be parsed: %s", err)
+	}
+	if err = publicKey.Verify(signedData, &signature); err != nil {
+		return "", fmt.Errorf("The SSH signature of the commit %s is not valid: %s", commit.Hash, err)
+	}
+	return principals, nil
+}
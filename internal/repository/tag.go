@@ -0,0 +1,134 @@
+package repository
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"golang.org/x/mod/semver"
+)
+
+// tagVersion returns the semantic version of a tag matching the
+// pattern. The version is the part of the tag following the prefix of
+// the pattern: the version of the tag prod-v1.2.3 matching the pattern
+// prod-v* is v1.2.3.
+func tagVersion(pattern, tag string) (version string, ok bool) {
+	if matched, err := path.Match(pattern, tag); err != nil || !matched {
+		return "", false
+	}
+	prefix := pattern
+	if i := strings.IndexAny(pattern, "*?["); i >= 0 {
+		prefix = pattern[:i]
+	}
+	version = strings.TrimPrefix(tag, prefix)
+	if !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+	if !semver.IsValid(version) {
+		return "", false
+	}
+	return version, true
+}
+
+// satisfyConstraint returns true if the version satisfies all the space
+// separated comparators of the constraint (>=v1.2.0 <v2.0.0 for
+// instance)
+func satisfyConstraint(version, constraint string) (bool, error) {
+	for _, comparator := range strings.Fields(constraint) {
+		operator := ""
+		for _, op := range []string{">=", "<=", ">", "<", "="} {
+			if strings.HasPrefix(comparator, op) {
+				operator = op
+				break
+			}
+		}
+		bound := strings.TrimPrefix(comparator, operator)
+		if !strings.HasPrefix(bound, "v") {
+			bound = "v" + bound
+		}
+		if !semver.IsValid(bound) {
+			return false, fmt.Errorf("The version '%s' of the tag constraint '%s' is not a semantic version", bound, constraint)
+		}
+		c := semver.Compare(version, bound)
+		var ok bool
+		switch operator {
+		case ">":
+			ok = c > 0
+		case ">=":
+			ok = c >= 0
+		case "<":
+			ok = c < 0
+		case "<=":
+			ok = c <= 0
+		default:
+			ok = c == 0
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// highestTag returns the tag with the highest version among tags
+// matching the pattern and satisfying the constraint
+func highestTag(r repository, pattern, constraint string) (tagName string, commitId plumbing.Hash, err error) {
+	iter, err := r.Repository.Tags()
+	if err != nil {
+		return
+	}
+	highestVersion := ""
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().Short()
+		version, ok := tagVersion(pattern, name)
+		if !ok {
+			return nil
+		}
+		ok, err := satisfyConstraint(version, constraint)
+		if err != nil {
+			return err
+		}
+		if !ok || (highestVersion != "" && semver.Compare(version, highestVersion) <= 0) {
+			return nil
+		}
+		hash := ref.Hash()
+		// Annotated tags point to a tag object
+		if tag, err := r.Repository.TagObject(hash); err == nil {
+			commit, err := tag.Commit()
+			if err != nil {
+				return nil
+			}
+			hash = commit.Hash
+		}
+		highestVersion = version
+		tagName = name
+		commitId = hash
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if tagName == "" {
+		return "", commitId, fmt.Errorf("No tag matches the pattern '%s' and the constraint '%s'", pattern, constraint)
+	}
+	return
+}
+
+func getHeadFromRemoteAndTag(r repository, remoteName, pattern, constraint, currentMainCommitId string) (newHead plumbing.Hash, msg, tagName string, err error) {
+	tagName, head, err := highestTag(r, pattern, constraint)
+	if err != nil {
+		return
+	}
+	commitObject, err := r.Repository.CommitObject(head)
+	if err != nil {
+		return
+	}
+	if currentMainCommitId != "" && !isShallow(r, remoteName) {
+		currentMainHash := plumbing.NewHash(currentMainCommitId)
+		if err = hasNotBeenHardReset(r, tagName, &currentMainHash, &head); err != nil {
+			return head, commitObject.Message, tagName, err
+		}
+	}
+	return head, commitObject.Message, tagName, nil
+}
@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagVersion(t *testing.T) {
+	version, ok := tagVersion("prod-v*", "prod-v1.2.3")
+	assert.True(t, ok)
+	assert.Equal(t, "v1.2.3", version)
+	version, ok = tagVersion("*", "1.2.3")
+	assert.True(t, ok)
+	assert.Equal(t, "v1.2.3", version)
+	_, ok = tagVersion("prod-v*", "staging-v1.2.3")
+	assert.False(t, ok)
+	_, ok = tagVersion("prod-v*", "prod-vlatest")
+	assert.False(t, ok)
+}
+
+func TestSatisfyConstraint(t *testing.T) {
+	ok, err := satisfyConstraint("v1.2.3", "")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = satisfyConstraint("v1.2.3", ">=v1.2.0 <v2.0.0")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = satisfyConstraint("v2.0.0", ">=1.2.0 <2.0.0")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = satisfyConstraint("v1.2.3", "1.2.3")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, err = satisfyConstraint("v1.2.3", "~1.2")
+	assert.NotNil(t, err)
+}
+
+func TestRepositoryUpdateTag(t *testing.T) {
+	r1Dir := t.TempDir()
+	cominRepositoryDir := t.TempDir()
+	r1, _ := initRemoteRepostiory(r1Dir, false)
+	gitConfig := types.GitConfig{
+		Path: cominRepositoryDir,
+		Remotes: []types.Remote{
+			types.Remote{
+				Name: "r1",
+				URL:  r1Dir,
+				Branches: types.Branches{
+					Main: types.Branch{
+						Name:          "main",
+						TagPattern:    "prod-v*",
+						TagConstraint: "<v2.0.0",
+					},
+				},
+				Timeout: 30,
+			},
+		},
+	}
+	r, _ := New(gitConfig, RepositoryStatus{})
+
+	// r1/main: c1 - c2 - c3 (prod-v1.0.0)
+	c3 := HeadCommitId(r1)
+	_, err := r1.CreateTag("prod-v1.0.0", plumbing.NewHash(c3), nil)
+	assert.Nil(t, err)
+	_ = r.Fetch("")
+	err = r.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, c3, r.RepositoryStatus.SelectedCommitId)
+	assert.Equal(t, "prod-v1.0.0", r.RepositoryStatus.SelectedBranchName)
+
+	// r1/main: c1 - c2 - c3 (prod-v1.0.0) - c4 (prod-v1.10.0) - c5 (prod-v2.0.0) - c6
+	c4, _ := commitFile(r1, r1Dir, "main", "file-4")
+	_, err = r1.CreateTag("prod-v1.10.0", plumbing.NewHash(c4), &git.CreateTagOptions{
+		Message: "release",
+		Tagger:  &object.Signature{Name: "John Doe", Email: "john@doe.org", When: time.Unix(0, 0)},
+	})
+	assert.Nil(t, err)
+	c5, _ := commitFile(r1, r1Dir, "main", "file-5")
+	_, err = r1.CreateTag("prod-v2.0.0", plumbing.NewHash(c5), nil)
+	assert.Nil(t, err)
+	_, _ = commitFile(r1, r1Dir, "main", "file-6")
+	_ = r.Fetch("")
+	err = r.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, c4, r.RepositoryStatus.SelectedCommitId)
+	assert.Equal(t, "prod-v1.10.0", r.RepositoryStatus.SelectedBranchName)
+	assert.Equal(t, "prod-v1.10.0", r.RepositoryStatus.Remotes[0].Main.Tag)
+}
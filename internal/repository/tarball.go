@@ -0,0 +1,374 @@
+package repository
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+)
+
+// tarball is a repository whose source is an archive (tar or tar.gz)
+// published at a HTTP(S) URL, for instance a release artifact stored in
+// a S3 bucket. The archive is only downloaded when its ETag changes and
+// its commit ID is the SHA-256 of the archive. Each archive is
+// extracted in its own directory of the repository path.
+type tarball struct {
+	GitConfig        types.GitConfig
+	RepositoryStatus RepositoryStatus
+	// The ETag of the last downloaded archive
+	etag string
+}
+
+// NewTarball creates a repository fetching the archive of the single
+// remote of the config
+func NewTarball(config types.GitConfig, repositoryStatus RepositoryStatus) (t *tarball, err error) {
+	if len(config.Remotes) != 1 {
+		return nil, fmt.Errorf("A tarball repository requires exactly one remote")
+	}
+	if err = os.MkdirAll(config.Path, 0755); err != nil {
+		return
+	}
+	t = &tarball{GitConfig: config}
+	t.RepositoryStatus = NewRepositoryStatus(config, repositoryStatus)
+	return
+}
+
+func (t *tarball) FetchAndUpdate(ctx context.Context, remoteName string) (rsCh chan RepositoryStatus) {
+	rsCh = make(chan RepositoryStatus)
+	go func() {
+		t.fetch(ctx)
+		fetchInputs(ctx, t.GitConfig, t.RepositoryStatus.Inputs)
+		rsCh <- t.RepositoryStatus
+	}()
+	return rsCh
+}
+
+// fetch downloads the archive if it changed and selects it, unless
+// the deployment is pinned to another archive
+func (t *tarball) fetch(ctx context.Context) {
+	remote := t.GitConfig.Remotes[0]
+	status := t.RepositoryStatus.Remotes[0]
+	t.RepositoryStatus.Error = nil
+	t.RepositoryStatus.ErrorMsg = ""
+	t.RepositoryStatus.PinnedCommitId = ""
+	pin := readPin(t.GitConfig.PinFilepath)
+	status.LastFetched = true
+	status.FetchedAt = time.Now()
+
+	commitId, path, err := t.download(ctx, remote)
+	if err != nil {
+		logrus.Errorf("Failed to download the archive of the remote '%s': %s", remote.Name, err)
+		status.FetchErrorMsg = err.Error()
+		status.FetchErrorKind = fetchErrorKind(err)
+		return
+	}
+	status.FetchErrorMsg = ""
+	status.FetchErrorKind = ""
+	status.Fetched = true
+	defer t.checkPinnedArchive(pin)
+	// The archive has not been modified
+	if commitId == "" {
+		return
+	}
+
+	msg := fmt.Sprintf("Archive %s", redactURL(remote.URL))
+	if t.etag != "" {
+		msg = fmt.Sprintf("%s (ETag %s)", msg, t.etag)
+	}
+	status.Main.CommitId = commitId
+	status.Main.CommitMsg = msg
+	if pin != "" && !strings.HasPrefix(commitId, pin) {
+		logrus.Infof("The archive %s is not selected since the deployment is pinned", commitId)
+		// The archive is downloaded again once unpinned
+		t.etag = ""
+		t.removeArchives(t.RepositoryStatus.SelectedPath)
+		return
+	}
+	if commitId != t.RepositoryStatus.MainCommitId {
+		logrus.Infof("A new archive has been fetched from '%s'", redactURL(remote.URL))
+	}
+
+	rs := &t.RepositoryStatus
+	rs.SelectedCommitId = commitId
+	rs.SelectedCommitMsg = msg
+	// An archive has no author
+	rs.SelectedCommitAuthor = ""
+	rs.SelectedCommitDate = time.Time{}
+	rs.SelectedRemoteName = remote.Name
+	rs.SelectedBranchName = remote.Branches.Main.Name
+	rs.SelectedBranchIsTesting = false
+	rs.SelectedBranchOperation = remote.Branches.Main.Operation
+	rs.SelectedBranchRequireApproval = remote.Branches.Main.RequireApproval
+	rs.SelectedPath = path
+	rs.MainCommitId = commitId
+	rs.MainRemoteName = remote.Name
+	rs.MainBranchName = remote.Branches.Main.Name
+	t.removeArchives(path)
+}
+
+// checkPinnedArchive checks the selected archive is the pinned one.
+// Since only the last published archive can be downloaded, an archive
+// which has never been selected can't be pinned.
+func (t *tarball) checkPinnedArchive(pin string) {
+	if pin == "" {
+		return
+	}
+	rs := &t.RepositoryStatus
+	if rs.SelectedCommitId == "" || !strings.HasPrefix(rs.SelectedCommitId, pin) {
+		err := fmt.Errorf("The pinned commit '%s' is not the SHA-256 of the selected archive", pin)
+		rs.Error = err
+		rs.ErrorMsg = err.Error()
+		return
+	}
+	rs.PinnedCommitId = rs.SelectedCommitId
+}
+
+// download downloads and extracts the archive of the remote. It returns
+// an empty commitId if the archive has not been modified since the
+// last download.
+func (t *tarball) download(ctx context.Context, remote types.Remote) (commitId, path string, err error) {
+	logrus.Debugf("Downloading the archive of the remote '%s'", remote.Name)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(remote.Timeout)*time.Second)
+	defer cancel()
+
+	etag := ""
+	if t.RepositoryStatus.SelectedPath != "" {
+		etag = t.etag
+	}
+	resp, err := getArchive(ctx, remote, etag)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		logrus.Debugf("The archive of the remote '%s' has not been modified", remote.Name)
+		return "", "", nil
+	}
+
+	// The archive is stored in a temporary file since its hash
+	// is only known once it has been fully downloaded
+	file, err := os.CreateTemp(t.GitConfig.Path, ".archive-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(file, h), resp.Body); err != nil {
+		return "", "", newFetchError(remote.Name, err)
+	}
+	commitId = hex.EncodeToString(h.Sum(nil))
+	path = filepath.Join(t.GitConfig.Path, commitId)
+
+	if _, err = os.Stat(path); os.IsNotExist(err) {
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+		if err = extractArchive(file, path); err != nil {
+			return "", "", fmt.Errorf("Failed to extract the archive of the remote '%s': %s", remote.Name, err)
+		}
+	} else if err != nil {
+		return
+	}
+	t.etag = resp.Header.Get("ETag")
+	return commitId, path, nil
+}
+
+// getArchive sends the request of the archive of the remote. The
+// archive is not sent again by the server (304 Not Modified) if its
+// ETag is etag. Other responses than 200 and 304 are returned as
+// errors.
+func getArchive(ctx context.Context, remote types.Remote, etag string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, remote.URL, nil)
+	if err != nil {
+		return nil, FetchError{Remote: remote.Name, Kind: FetchErrorOther, Err: err}
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if remote.Auth.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+string(remote.Auth.AccessToken))
+	}
+	client, err := httpClient(remote)
+	if err != nil {
+		return nil, FetchError{Remote: remote.Name, Kind: FetchErrorOther, Err: err}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, newFetchError(remote.Name, err)
+	}
+	kind := ""
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotModified:
+		return resp, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		kind = FetchErrorAuthentication
+	case http.StatusNotFound:
+		kind = FetchErrorNotFound
+	default:
+		kind = FetchErrorOther
+	}
+	resp.Body.Close()
+	return nil, FetchError{Remote: remote.Name, Kind: kind, Err: fmt.Errorf("GET %s: %s", redactURL(remote.URL), resp.Status)}
+}
+
+// httpClient returns the HTTP client used to download the archive of
+// the remote through its proxy, if any
+func httpClient(remote types.Remote) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if remote.Proxy.URL != "" {
+		proxyURL, err := url.Parse(remote.Proxy.URL)
+		if err != nil {
+			return nil, err
+		}
+		if remote.Proxy.Username != "" {
+			proxyURL.User = url.UserPassword(remote.Proxy.Username, string(remote.Proxy.Password))
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// extractArchive extracts a tar or a tar.gz archive in the directory
+// dir. When all files of the archive are in a single top level
+// directory, the content of this directory is extracted instead, as
+// done by Nix for flake tarballs.
+func extractArchive(r io.Reader, dir string) (err error) {
+	tmp := dir + ".tmp"
+	if err = os.RemoveAll(tmp); err != nil {
+		return
+	}
+	defer os.RemoveAll(tmp)
+	if err = extractTar(r, tmp); err != nil {
+		return
+	}
+	root := tmp
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		return
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		root = filepath.Join(tmp, entries[0].Name())
+	}
+	return os.Rename(root, dir)
+}
+
+func extractTar(r io.Reader, dir string) (err error) {
+	br := bufio.NewReader(r)
+	// The gzip magic number
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	// Symlinks are created once all files are extracted: a file
+	// can then not be written outside of dir through a symlink
+	symlinks := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, header.Name)
+		if target != dir && !strings.HasPrefix(target, dir+string(os.PathSeparator)) {
+			return fmt.Errorf("The path '%s' is outside of the archive", header.Name)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode)&0755|0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, tr)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			symlinks[target] = header.Linkname
+		default:
+			logrus.Debugf("The entry '%s' of the archive is skipped", header.Name)
+		}
+	}
+	for target, linkname := range symlinks {
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return
+		}
+		if err = os.Symlink(linkname, target); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// removeArchives removes the extracted archives, except the current
+// one
+func (t *tarball) removeArchives(current string) {
+	entries, err := os.ReadDir(t.GitConfig.Path)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(t.GitConfig.Path, entry.Name())
+		if !entry.IsDir() || path == current || len(entry.Name()) != sha256.Size*2 {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			logrus.Errorf("Failed to remove the archive directory %s: %s", path, err)
+		}
+	}
+}
+
+// ChangedFiles is not supported since archives have no history
+func (t *tarball) ChangedFiles(from, to string) ([]string, error) {
+	return nil, fmt.Errorf("Changed files are not supported by tarball remotes")
+}
+
+// IsAncestor is not supported since archives have no history
+func (t *tarball) IsAncestor(base, top string) (bool, error) {
+	return false, fmt.Errorf("Ancestry is not supported by tarball remotes")
+}
+
+// Reload replaces the remote of the repository
+func (t *tarball) Reload(remotes []types.Remote) error {
+	if len(remotes) != 1 || remotes[0].Kind != "tarball" {
+		return fmt.Errorf("A tarball repository can only be reloaded with a single tarball remote")
+	}
+	t.GitConfig.Remotes = remotes
+	// The archive is downloaded again at the next fetch to select
+	// it in the new status
+	t.RepositoryStatus = NewRepositoryStatus(t.GitConfig, t.RepositoryStatus)
+	return nil
+}
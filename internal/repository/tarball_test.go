@@ -0,0 +1,162 @@
+package repository
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTarball(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		assert.Nil(t, err)
+		_, err = tw.Write([]byte(content))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestTarball(t *testing.T) {
+	archive := makeTarball(t, map[string]string{"infra-1.0/flake.nix": "{ }"})
+	etag := `"v1"`
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "Bearer my-token", r.Header.Get("Authorization"))
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write(archive)
+	}))
+	defer server.Close()
+
+	config := types.GitConfig{
+		Path: t.TempDir(),
+		Remotes: []types.Remote{{
+			Name:    "origin",
+			Kind:    "tarball",
+			URL:     server.URL + "/infra.tar.gz",
+			Auth:    types.Auth{AccessToken: "my-token"},
+			Timeout: 30,
+		}},
+	}
+	r, err := NewTarball(config, RepositoryStatus{})
+	assert.Nil(t, err)
+
+	rs := <-r.FetchAndUpdate(context.Background(), "")
+	assert.Empty(t, rs.Remotes[0].FetchErrorMsg)
+	assert.Len(t, rs.SelectedCommitId, 64)
+	assert.Equal(t, filepath.Join(config.Path, rs.SelectedCommitId), rs.SelectedPath)
+	// The top level directory of the archive is stripped
+	content, err := os.ReadFile(filepath.Join(rs.SelectedPath, "flake.nix"))
+	assert.Nil(t, err)
+	assert.Equal(t, "{ }", string(content))
+
+	// The archive has not been modified
+	previous := rs.SelectedCommitId
+	rs = <-r.FetchAndUpdate(context.Background(), "")
+	assert.Equal(t, 2, requests)
+	assert.Empty(t, rs.Remotes[0].FetchErrorMsg)
+	assert.Equal(t, previous, rs.SelectedCommitId)
+
+	// A new archive is published and the previous one is removed
+	archive = makeTarball(t, map[string]string{"flake.nix": "{ outputs = _: { }; }"})
+	etag = `"v2"`
+	rs = <-r.FetchAndUpdate(context.Background(), "")
+	assert.NotEqual(t, previous, rs.SelectedCommitId)
+	content, err = os.ReadFile(filepath.Join(rs.SelectedPath, "flake.nix"))
+	assert.Nil(t, err)
+	assert.Equal(t, "{ outputs = _: { }; }", string(content))
+	_, err = os.Stat(filepath.Join(config.Path, previous))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTarballFetchError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	config := types.GitConfig{
+		Path:    t.TempDir(),
+		Remotes: []types.Remote{{Name: "origin", Kind: "tarball", URL: server.URL, Timeout: 30}},
+	}
+	r, err := NewTarball(config, RepositoryStatus{})
+	assert.Nil(t, err)
+	rs := <-r.FetchAndUpdate(context.Background(), "")
+	assert.Equal(t, FetchErrorAuthentication, rs.Remotes[0].FetchErrorKind)
+	assert.Empty(t, rs.SelectedCommitId)
+}
+
+func TestTarballPin(t *testing.T) {
+	archive := makeTarball(t, map[string]string{"flake.nix": "{ }"})
+	etag := `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write(archive)
+	}))
+	defer server.Close()
+
+	config := types.GitConfig{
+		Path:        t.TempDir(),
+		PinFilepath: filepath.Join(t.TempDir(), "pin"),
+		Remotes:     []types.Remote{{Name: "origin", Kind: "tarball", URL: server.URL, Timeout: 30}},
+	}
+	r, err := NewTarball(config, RepositoryStatus{})
+	assert.Nil(t, err)
+	rs := <-r.FetchAndUpdate(context.Background(), "")
+	pinned := rs.SelectedCommitId
+
+	// The selected archive is pinned: the new archives are not
+	// selected
+	assert.Nil(t, os.WriteFile(config.PinFilepath, []byte(pinned[:12]+"\n"), 0644))
+	archive = makeTarball(t, map[string]string{"flake.nix": "{ outputs = _: { }; }"})
+	etag = `"v2"`
+	rs = <-r.FetchAndUpdate(context.Background(), "")
+	assert.Nil(t, rs.Error)
+	assert.Equal(t, pinned, rs.SelectedCommitId)
+	assert.Equal(t, pinned, rs.PinnedCommitId)
+	assert.NotEqual(t, pinned, rs.Remotes[0].Main.CommitId)
+	_, err = os.Stat(filepath.Join(config.Path, pinned))
+	assert.Nil(t, err)
+
+	// The new archive is selected once unpinned
+	assert.Nil(t, os.Remove(config.PinFilepath))
+	rs = <-r.FetchAndUpdate(context.Background(), "")
+	assert.NotEqual(t, pinned, rs.SelectedCommitId)
+	assert.Empty(t, rs.PinnedCommitId)
+
+	// An archive which is not the selected one can't be pinned
+	assert.Nil(t, os.WriteFile(config.PinFilepath, []byte(pinned+"\n"), 0644))
+	previous := rs.SelectedCommitId
+	rs = <-r.FetchAndUpdate(context.Background(), "")
+	assert.NotNil(t, rs.Error)
+	assert.Equal(t, previous, rs.SelectedCommitId)
+}
+
+func TestExtractArchiveOutside(t *testing.T) {
+	archive := makeTarball(t, map[string]string{"../evil": "evil"})
+	dir := filepath.Join(t.TempDir(), "archive")
+	err := extractArchive(bytes.NewReader(archive), dir)
+	assert.ErrorContains(t, err, "outside")
+}
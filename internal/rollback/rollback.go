@@ -0,0 +1,190 @@
+package rollback
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/nlewo/comin/internal/deployment"
+	"github.com/nlewo/comin/internal/nix"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+)
+
+const unit = "comin-magic-rollback"
+
+// Rollback implements the magic rollback: before activating a
+// configuration, a systemd timer activating the previous
+// configuration is armed. It is only disarmed once the deployment
+// succeeded and comin confirmed it can still reach its own API and the
+// optional confirmation URL. If the new configuration breaks comin or
+// the network, the timer reverts the machine to the previous
+// configuration.
+type Rollback struct {
+	config types.MagicRollback
+	nix    nix.Nix
+	// The URL used by comin to confirm it can reach its own API
+	apiUrl string
+
+	runFunc     func(name string, args ...string) error
+	confirmFunc func(ctx context.Context) error
+	currentFunc func() (string, error)
+}
+
+func New(config types.MagicRollback, n nix.Nix, apiAddress string, apiPort int) Rollback {
+	if apiAddress == "" || apiAddress == "0.0.0.0" {
+		apiAddress = "127.0.0.1"
+	}
+	r := Rollback{
+		config:  config,
+		nix:     n,
+		apiUrl:  fmt.Sprintf("http://%s:%d/status", apiAddress, apiPort),
+		runFunc: run,
+	}
+	r.currentFunc = r.nix.CurrentSystem
+	r.confirmFunc = r.confirm
+	return r
+}
+
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Command '%s %v' fails with %s: %s", name, args, err, output)
+	}
+	return nil
+}
+
+// rollbackScript returns the script activating the previous
+// configuration.
+func rollbackScript(previous, operation string) string {
+	script := ""
+	if operation == "switch" {
+		script = fmt.Sprintf("nix-env --profile /nix/var/nix/profiles/system --set %s && ", previous)
+	}
+	return script + fmt.Sprintf("%s %s", filepath.Join(previous, "bin", "switch-to-configuration"), operation)
+}
+
+// arm starts the rollback timer. A timer kept armed by a previous
+// failed deployment is stopped first since the unit name is fixed.
+func (r Rollback) arm(previous, operation string) error {
+	if r.isArmed() {
+		if err := r.disarm(); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("rollback: arming the rollback timer to '%s' in %d seconds", previous, r.config.Timeout)
+	// The transient units are collected even if the rollback
+	// fails: their name can then be reused
+	return r.runFunc("systemd-run",
+		"--unit", unit,
+		"--collect",
+		fmt.Sprintf("--on-active=%ds", r.config.Timeout),
+		"--timer-property=AccuracySec=1s",
+		"--property=Environment=PATH=/run/current-system/sw/bin",
+		filepath.Join(previous, "sw", "bin", "sh"), "-c", rollbackScript(previous, operation))
+}
+
+func (r Rollback) disarm() error {
+	logrus.Infof("rollback: disarming the rollback timer")
+	return r.runFunc("systemctl", "stop", unit+".timer")
+}
+
+func (r Rollback) isArmed() bool {
+	return r.runFunc("systemctl", "is-active", "--quiet", unit+".timer") == nil
+}
+
+// confirm ensures comin can reach its own API and the confirmation
+// URL, if any.
+func (r Rollback) confirm(ctx context.Context) error {
+	if err := get(ctx, r.apiUrl); err != nil {
+		return err
+	}
+	if r.config.ConfirmUrl != "" {
+		return get(ctx, r.config.ConfirmUrl)
+	}
+	return nil
+}
+
+// get succeeds when a GET request on url returns a 2xx status
+func get(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("The URL '%s' returns the status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// confirmAndDisarm disarms the rollback timer once comin reached its
+// own API. It gives up when the timer is about to expire.
+func (r Rollback) confirmAndDisarm(ctx context.Context) {
+	deadline := time.Now().Add(time.Duration(r.config.Timeout) * time.Second)
+	for time.Now().Before(deadline) {
+		err := r.confirmFunc(ctx)
+		if err == nil {
+			if err := r.disarm(); err != nil {
+				logrus.Errorf("rollback: failed to disarm the rollback timer: %s", err)
+			}
+			return
+		}
+		logrus.Infof("rollback: failed to confirm the deployment: %s", err)
+		time.Sleep(time.Second)
+	}
+	logrus.Errorf("rollback: the deployment has not been confirmed: the rollback timer is going to be triggered")
+}
+
+// Wrap returns a DeployFunc arming the rollback timer before running
+// deployFunc, in case the activation kills comin, and restarting it
+// once the activation is terminated. The timer is disarmed once the
+// deployment succeeded and is confirmed. When the deployment fails,
+// the timer is kept armed to activate the previous configuration
+// again. When comin has to restart, the deployment is confirmed by the
+// restarted comin (see ConfirmPending).
+func (r Rollback) Wrap(deployFunc deployment.DeployFunc) deployment.DeployFunc {
+	return func(ctx context.Context, machineId, outPath, operation string) (bool, string, error) {
+		if operation != "switch" && operation != "test" {
+			return deployFunc(ctx, machineId, outPath, operation)
+		}
+		previous, err := r.currentFunc()
+		if err != nil {
+			return false, "", fmt.Errorf("Failed to get the current configuration to arm the rollback timer: %s", err)
+		}
+		if err := r.arm(previous, operation); err != nil {
+			return false, "", err
+		}
+		needToRestartComin, output, err := deployFunc(ctx, machineId, outPath, operation)
+		// The timeout starts once the configuration is
+		// activated: a slow activation is not rolled back while
+		// it is running
+		if armErr := r.arm(previous, operation); armErr != nil {
+			logrus.Errorf("rollback: failed to restart the rollback timer after the activation: %s", armErr)
+		}
+		if err != nil {
+			logrus.Errorf("rollback: the deployment failed: the rollback timer is kept armed")
+		} else if !needToRestartComin {
+			r.confirmAndDisarm(ctx)
+		}
+		return needToRestartComin, output, err
+	}
+}
+
+// ConfirmPending confirms the deployment of a previous comin process
+// if its rollback timer is still armed.
+func (r Rollback) ConfirmPending(ctx context.Context) {
+	if r.isArmed() {
+		logrus.Infof("rollback: a rollback timer is armed: confirming the deployment")
+		r.confirmAndDisarm(ctx)
+	}
+}
@@ -0,0 +1,121 @@
+package rollback
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nlewo/comin/internal/nix"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollbackScript(t *testing.T) {
+	assert.Equal(t,
+		"nix-env --profile /nix/var/nix/profiles/system --set /nix/store/previous && /nix/store/previous/bin/switch-to-configuration switch",
+		rollbackScript("/nix/store/previous", "switch"))
+	assert.Equal(t,
+		"/nix/store/previous/bin/switch-to-configuration test",
+		rollbackScript("/nix/store/previous", "test"))
+}
+
+func TestConfirmAndDisarm(t *testing.T) {
+	r := New(types.MagicRollback{Timeout: 5}, nix.New(types.Nix{}), "", 4242)
+	assert.Equal(t, "http://127.0.0.1:4242/status", r.apiUrl)
+
+	commands := []string{}
+	r.runFunc = func(name string, args ...string) error {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		return nil
+	}
+	calls := 0
+	r.confirmFunc = func(ctx context.Context) error {
+		calls++
+		if calls < 2 {
+			return fmt.Errorf("unreachable")
+		}
+		return nil
+	}
+	r.confirmAndDisarm(context.Background())
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, []string{"systemctl stop comin-magic-rollback.timer"}, commands)
+}
+
+func TestWrap(t *testing.T) {
+	r := New(types.MagicRollback{Timeout: 5}, nix.New(types.Nix{}), "", 4242)
+	// systemd only runs one unit with the rollback unit name
+	armed := false
+	commands := []string{}
+	r.runFunc = func(name string, args ...string) error {
+		command := name + " " + args[0]
+		commands = append(commands, command)
+		switch command {
+		case "systemd-run --unit":
+			if armed {
+				return fmt.Errorf("Unit comin-magic-rollback.service was already loaded")
+			}
+			armed = true
+		case "systemctl stop":
+			armed = false
+		case "systemctl is-active":
+			if !armed {
+				return fmt.Errorf("inactive")
+			}
+		}
+		return nil
+	}
+	r.confirmFunc = func(ctx context.Context) error {
+		return nil
+	}
+	current := t.TempDir()
+	r.currentFunc = func() (string, error) {
+		return current, nil
+	}
+
+	// A failed deployment keeps the rollback timer armed
+	deployFunc := r.Wrap(func(ctx context.Context, machineId, outPath, operation string) (bool, string, error) {
+		return false, "", fmt.Errorf("activation failed")
+	})
+	_, _, err := deployFunc(context.Background(), "", "/nix/store/new", "switch")
+	assert.EqualError(t, err, "activation failed")
+	assert.True(t, armed)
+
+	// The timer kept armed doesn't prevent the next deployment
+	commands = []string{}
+	deployFunc = r.Wrap(func(ctx context.Context, machineId, outPath, operation string) (bool, string, error) {
+		return false, "", nil
+	})
+	_, _, err = deployFunc(context.Background(), "", "/nix/store/new", "switch")
+	assert.Nil(t, err)
+	assert.False(t, armed)
+	// The timer is restarted once the configuration is activated
+	assert.Equal(t, []string{
+		"systemctl is-active", "systemctl stop", "systemd-run --unit",
+		"systemctl is-active", "systemctl stop", "systemd-run --unit",
+		"systemctl stop",
+	}, commands)
+}
+
+func TestConfirm(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/external" {
+			w.WriteHeader(status)
+		}
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	r := New(types.MagicRollback{ConfirmUrl: server.URL + "/external"}, nix.New(types.Nix{}), u.Hostname(), port)
+	assert.Nil(t, r.confirm(context.Background()))
+
+	status = http.StatusServiceUnavailable
+	err := r.confirm(context.Background())
+	assert.EqualError(t, err, fmt.Sprintf("The URL '%s/external' returns the status 503", server.URL))
+}
@@ -0,0 +1,43 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notify sends the state to the service manager with the sd_notify
+// protocol, such as READY=1 or STATUS=... It does nothing when comin
+// is not run by systemd with Type=notify.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A socket starting with @ is in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval returns the interval of the watchdog configured by
+// WatchdogSec in the systemd service, or 0 when the watchdog is not
+// enabled for this process
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
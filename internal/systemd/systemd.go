@@ -0,0 +1,69 @@
+package systemd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nlewo/comin/internal/events"
+	"github.com/nlewo/comin/internal/manager"
+	"github.com/sirupsen/logrus"
+)
+
+// Status returns the status line of the comin service describing the
+// event
+func Status(e events.Event) string {
+	switch e.Type {
+	case events.Fetched:
+		return fmt.Sprintf("Fetched the commit %s", e.CommitId)
+	case events.Evaluating:
+		return fmt.Sprintf("Evaluating the commit %s", e.CommitId)
+	case events.Building:
+		return fmt.Sprintf("Building the commit %s", e.CommitId)
+	case events.Switching:
+		return fmt.Sprintf("Deploying the commit %s", e.CommitId)
+	case events.Done:
+		return fmt.Sprintf("Deployed the commit %s", e.CommitId)
+	case events.Failed:
+		// A status is a single line
+		return fmt.Sprintf("Failed to deploy the commit %s: %s", e.CommitId, strings.ReplaceAll(e.ErrorMsg, "\n", " "))
+	}
+	return ""
+}
+
+// Run notifies systemd that comin is ready once the manager is
+// running, updates the status of the service on the events of the
+// deployments and sends the watchdog keepalives. A keepalive is only
+// sent when the manager answers: systemd restarts comin if its manager
+// is wedged.
+func Run(m manager.Manager) {
+	eventCh, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+	m.GetState()
+	// The keepalives are still sent: systemd would otherwise kill
+	// comin if the readiness notification only failed transiently
+	if err := Notify("READY=1\nSTATUS=Waiting for commits"); err != nil {
+		logrus.Errorf("Failed to notify systemd: %s", err)
+	}
+
+	var watchdogCh <-chan time.Time
+	if interval := WatchdogInterval(); interval > 0 {
+		logrus.Infof("Sending the systemd watchdog keepalives every %s", interval/2)
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		watchdogCh = ticker.C
+	}
+	for {
+		select {
+		case e := <-eventCh:
+			if status := Status(e); status != "" {
+				Notify("STATUS=" + status)
+			}
+		case <-watchdogCh:
+			m.GetState()
+			if err := Notify("WATCHDOG=1"); err != nil {
+				logrus.Errorf("Failed to send the systemd watchdog keepalive: %s", err)
+			}
+		}
+	}
+}
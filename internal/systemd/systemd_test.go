@@ -0,0 +1,56 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nlewo/comin/internal/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	assert.Nil(t, Notify("READY=1"))
+
+	socket := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	assert.Nil(t, err)
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	assert.Nil(t, Notify("READY=1"))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "READY=1", string(buf[:n]))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Unsetenv("WATCHDOG_USEC")
+	assert.Equal(t, time.Duration(0), WatchdogInterval())
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	assert.Equal(t, 30*time.Second, WatchdogInterval())
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	assert.Equal(t, 30*time.Second, WatchdogInterval())
+
+	// The watchdog is enabled for another process
+	os.Setenv("WATCHDOG_PID", "1")
+	assert.Equal(t, time.Duration(0), WatchdogInterval())
+}
+
+func TestStatus(t *testing.T) {
+	assert.Equal(t, "Building the commit abc", Status(events.Event{Type: events.Building, CommitId: "abc"}))
+	assert.Equal(t,
+		"Failed to deploy the commit abc: build failed: exit 1",
+		Status(events.Event{Type: events.Failed, CommitId: "abc", ErrorMsg: "build failed:\nexit 1"}))
+}
@@ -1,5 +1,25 @@
 package types
 
+import "fmt"
+
+// Secret is a configuration value, such as a token or a password,
+// which is hidden from logs: the configuration is logged with %#v in
+// debug mode.
+type Secret string
+
+// GoString hides the secret from logs
+func (s Secret) GoString() string {
+	return fmt.Sprintf("%q", s.String())
+}
+
+// String hides the secret from logs
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "xxxxx"
+}
+
 type Remote struct {
 	Name     string
 	URL      string
@@ -8,28 +28,97 @@ type Remote struct {
 	Timeout  int      `yaml:"timeout"`
 	// The period to poll the remote in second
 	Poller Poller `yaml:"poller"`
+	// When not 0, only the last Depth commits of the branches are
+	// fetched (shallow fetch). Force pushes can then not be
+	// detected.
+	Depth int `yaml:"depth"`
+	// Only fetch the main and testing branches instead of all
+	// branches of the remote
+	SingleBranch bool `yaml:"single_branch"`
+	// The proxy used to fetch the remote
+	Proxy Proxy `yaml:"proxy"`
+	// The kind of the remote: "git" (the default) or "tarball" to
+	// fetch an archive of the repository from a HTTP(S) URL
+	Kind string `yaml:"kind"`
+}
+
+// Proxy is a HTTP(S) or SOCKS5 proxy
+type Proxy struct {
+	// The proxy URL, http://proxy.example.org:3128 or
+	// socks5://proxy.example.org:1080 for instance
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	// The password is read from the PasswordPath file and can not
+	// be set in the configuration file
+	Password     Secret `yaml:"-"`
+	PasswordPath string `yaml:"password_path"`
 }
 
 type Poller struct {
 	Period int `yaml:"period"`
+	// The maximal random delay in second added to the period
+	Jitter int `yaml:"jitter"`
 }
 
 type GitConfig struct {
 	// The repository Path
-	Path              string
-	Remotes           []Remote
+	Path    string
+	Remotes []Remote
+	// When not empty, only commits signed by one of these GPG
+	// public keys are selected
 	GpgPublicKeyPaths []string
+	// When not empty, commits signed with SSH keys are only
+	// selected if the key is listed in this allowed signers file
+	SshAllowedSignersPath string
+	// When not empty, only commits whose committer email matches
+	// one of these globs are selected
+	AllowedCommitters []string
+	// The file containing the commit deployments are pinned to
+	PinFilepath string
+	Inputs      []Input
+	// The directory containing a repository per input
+	InputsPath string
 }
 
 type Auth struct {
-	AccessToken     string
+	// The token is read from the AccessTokenPath file and can not
+	// be set in the configuration file
+	AccessToken Secret `yaml:"-"`
+	// The file containing the token used to fetch the remote over
+	// HTTPS. Environment variables such as $CREDENTIALS_DIRECTORY
+	// are expanded.
 	AccessTokenPath string `yaml:"access_token_path"`
+	// The private key used to fetch the remote over SSH
+	SshPrivateKeyPath string `yaml:"ssh_private_key_path"`
+	// The known_hosts file used to verify the SSH server key. When
+	// empty, the default known_hosts files are used.
+	SshKnownHostsPath string `yaml:"ssh_known_hosts_path"`
 }
 
 type Branch struct {
 	Name string `yaml:"name"`
+	// The switch-to-configuration operation used to deploy
+	// commits of this branch (switch, boot, test or
+	// dry-activate). By default, the main branch is deployed with
+	// switch and the testing branch with test.
+	Operation string `yaml:"operation"`
+	// When true, built commits of this branch are only deployed
+	// once approved by an operator
+	RequireApproval bool `yaml:"require_approval"`
 	// TODO: use it
 	Protected bool `yaml:"protected"`
+	// When not empty, the highest tag matching this glob pattern
+	// (prod-v* for instance) is deployed instead of the head of
+	// the branch. Only supported by the main branch.
+	TagPattern string `yaml:"tag_pattern"`
+	// Space separated semver comparators (>=v1.2.0 <v2.0.0 for
+	// instance) the version of the tag has to satisfy
+	TagConstraint string `yaml:"tag_constraint"`
+	// What to do when the branch has been force pushed (its head is
+	// not on top of the deployed commit): refuse (the default),
+	// approve (deploy once approved) or accept. Only supported by
+	// the main branch.
+	ForcePushPolicy string `yaml:"force_push_policy"`
 }
 
 type Branches struct {
@@ -40,6 +129,186 @@ type Branches struct {
 type HttpServer struct {
 	ListenAddress string `yaml:"listen_address"`
 	Port          int    `yaml:"port"`
+	// The file of the token required by the requests modifying the
+	// state of comin. It is created by comin when it doesn't exist.
+	TokenPath string `yaml:"token_path"`
+}
+
+type Exporter struct {
+	ListenAddress string `yaml:"listen_address"`
+	Port          int    `yaml:"port"`
+	// When not empty, the metrics are also written to this
+	// node-exporter textfile collector file after each deployment
+	TextfilePath string `yaml:"textfile_path"`
+	// The metrics are not served on /metrics
+	DisableHttp bool `yaml:"disable_http"`
+}
+
+type Nix struct {
+	// The kind of configuration to deploy: "nixos" to deploy
+	// nixosConfigurations or "home-manager" to deploy
+	// homeConfigurations
+	Mode string `yaml:"mode"`
+	// When true, the File nix file is evaluated instead of the
+	// repository flake
+	NonFlake bool `yaml:"non_flake"`
+	// The nix file path, relative to the repository root
+	File string `yaml:"file"`
+	// The attribute template of the configuration, where %s is
+	// replaced by the hostname. It defaults to
+	// nixosConfigurations.%s (homeConfigurations.%s in the
+	// home-manager mode).
+	ConfigurationAttr string `yaml:"configuration_attr"`
+	// Evaluate and build the configuration with --impure
+	Impure bool `yaml:"impure"`
+	// When not empty, the closure of the configuration has to be
+	// signed by these keys to be activated
+	TrustedPublicKeys []string `yaml:"trusted_public_keys"`
+	// The number of signatures required on each store path
+	SigsNeeded int `yaml:"sigs_needed"`
+	// The directory containing the gcroots of deployed
+	// configurations
+	GcRootsDir string `yaml:"gc_roots_dir"`
+	// The number of gcroots of deployed configurations to keep
+	GcRootsKeep int `yaml:"gc_roots_keep"`
+	// The nix build --max-jobs option. When empty, the nix
+	// configuration is used.
+	MaxJobs string `yaml:"max_jobs"`
+	// The nix build --cores option. When 0, the nix configuration
+	// is used.
+	Cores int `yaml:"cores"`
+	// When true, substituters are never contacted and only
+	// configurations already in the local Nix store are activated
+	Offline bool `yaml:"offline"`
+	// When not empty, configurations are evaluated and built on
+	// this remote store (such as ssh-ng://builder) and their
+	// closure is copied back to the local store
+	BuildStore string `yaml:"build_store"`
+	// The ssh options of nix commands involving ssh stores
+	Ssh Ssh `yaml:"ssh"`
+	// The number of times a build failing because of a transient
+	// error (network, substituter timeout...) is retried
+	BuildRetries int `yaml:"build_retries"`
+	// The delay in seconds before the first build retry. It is
+	// doubled at each retry.
+	BuildRetryDelay int `yaml:"build_retry_delay"`
+	// The name of the specialisation to activate instead of the
+	// default configuration
+	Specialisation string `yaml:"specialisation"`
+	// The proxy used by nix commands run by comin to contact
+	// substituters. Substitutions performed by the nix-daemon use
+	// the proxy of the daemon environment.
+	Proxy Proxy `yaml:"proxy"`
+}
+
+type Ssh struct {
+	IdentityFile string `yaml:"identity_file"`
+	Port         int    `yaml:"port"`
+	JumpHost     string `yaml:"jump_host"`
+	// Additional options, such as StrictHostKeyChecking=accept-new
+	Options []string `yaml:"options"`
+}
+
+type Gc struct {
+	// The period in seconds between two garbage collections. When
+	// 0, the garbage is not periodically collected.
+	Period int `yaml:"period"`
+	// The garbage is collected when the free space of the Nix
+	// store is below this number of bytes. When 0, the free space
+	// is not checked.
+	MinFreeSpace uint64 `yaml:"min_free_space"`
+	// Generations older than this period are deleted (the
+	// nix-collect-garbage --delete-older-than format, 30d for
+	// instance). When empty, generations are not deleted.
+	DeleteOlderThan string `yaml:"delete_older_than"`
+}
+
+type HealthChecks struct {
+	// Commands run after the activation: the machine is healthy
+	// when all of them exit successfully
+	Commands []string `yaml:"commands"`
+	// Systemd units which have to be active
+	Units []string `yaml:"units"`
+	// When true, the machine is not healthy if a systemd unit
+	// failed
+	NoFailedUnits bool        `yaml:"no_failed_units"`
+	HttpProbes    []HttpProbe `yaml:"http_probes"`
+	TcpProbes     []TcpProbe  `yaml:"tcp_probes"`
+	// The period in seconds during which failing health checks
+	// are retried. Once elapsed, the previous configuration is
+	// activated again.
+	GracePeriod int `yaml:"grace_period"`
+	// The period in seconds between two health checks
+	Interval int `yaml:"interval"`
+}
+
+// HttpProbe succeeds when a GET request on the Url returns the
+// ExpectedStatus
+type HttpProbe struct {
+	Url            string `yaml:"url"`
+	ExpectedStatus int    `yaml:"expected_status"`
+	// The timeout in seconds of a request
+	Timeout int `yaml:"timeout"`
+	// The number of times a failing request is retried
+	Retries int `yaml:"retries"`
+	// The period in seconds between two attempts
+	RetryInterval int `yaml:"retry_interval"`
+}
+
+// TcpProbe succeeds when a TCP connection to the Address can be
+// established
+type TcpProbe struct {
+	Address string `yaml:"address"`
+	// The timeout in seconds of a connection
+	Timeout int `yaml:"timeout"`
+	// The number of times a failing connection is retried
+	Retries int `yaml:"retries"`
+	// The period in seconds between two attempts
+	RetryInterval int `yaml:"retry_interval"`
+}
+
+type Logs struct {
+	// The directory where logs of generations are stored
+	Dir string `yaml:"dir"`
+	// The maximal number of log files. When 0, the number of
+	// files is not limited.
+	MaxFiles int `yaml:"max_files"`
+	// The maximal size in bytes of all log files. When 0, the
+	// size is not limited.
+	MaxSize int64 `yaml:"max_size"`
+}
+
+type History struct {
+	// The maximal number of deployments in the history
+	MaxEntries int `yaml:"max_entries"`
+}
+
+// MachineIdentity is the source of the machine ID compared to the
+// comin.machineId option of the configurations
+type MachineIdentity struct {
+	// machine-id (the /etc/machine-id file, by default), file
+	// (the Path file), hostname or dmi (the DMI product UUID)
+	Source string `yaml:"source"`
+	// The file containing the machine ID of the file source
+	Path string `yaml:"path"`
+}
+
+// TpmAttestation binds the deployments to a key resident in the TPM
+// of the machine
+type TpmAttestation struct {
+	Enable bool `yaml:"enable"`
+	// The persistent handle of the TPM signing key
+	KeyHandle string `yaml:"key_handle"`
+}
+
+// Audit is an append-only log of the deployments
+type Audit struct {
+	// The JSONL file of the audit log. The audit log is disabled
+	// when empty.
+	Path string `yaml:"path"`
+	// Each entry contains the hash of the previous one, which
+	// allows to detect modified or removed entries
+	HashChain bool `yaml:"hash_chain"`
 }
 
 type Configuration struct {
@@ -48,5 +317,343 @@ type Configuration struct {
 	StateFilepath string     `yaml:"state_filepath"`
 	Remotes       []Remote   `yaml:"remotes"`
 	ApiServer     HttpServer `yaml:"api_server"`
-	Exporter      HttpServer `yaml:"exporter"`
+	Exporter      Exporter   `yaml:"exporter"`
+	Nix           Nix        `yaml:"nix"`
+	Gc            Gc         `yaml:"gc"`
+	Logs          Logs       `yaml:"logs"`
+	History       History    `yaml:"history"`
+	Audit         Audit      `yaml:"audit"`
+	// The source of the machine ID of the machine
+	MachineIdentity MachineIdentity `yaml:"machine_identity"`
+	TpmAttestation  TpmAttestation  `yaml:"tpm_attestation"`
+	HealthChecks    HealthChecks    `yaml:"health_checks"`
+	MagicRollback   MagicRollback   `yaml:"magic_rollback"`
+	// When an operation has deployment windows, it is only run
+	// during these windows
+	DeploymentWindows []DeploymentWindow `yaml:"deployment_windows"`
+	Hooks             Hooks              `yaml:"hooks"`
+	Notifications     Notifications      `yaml:"notifications"`
+	CommitStatuses    CommitStatuses     `yaml:"commit_statuses"`
+	Announcements     Announcements      `yaml:"announcements"`
+	ActivationHelper  ActivationHelper   `yaml:"activation_helper"`
+	AutoReboot        AutoReboot         `yaml:"auto_reboot"`
+	// The timeout in seconds of the deployment of a commit, from
+	// the fetch to the activation. When 0, there is no timeout.
+	DeploymentTimeout int `yaml:"deployment_timeout"`
+	// Commits are only deployed when their signature can be
+	// verified
+	CommitSignatures CommitSignatures `yaml:"commit_signatures"`
+	// When not empty, commits which don't change files matching
+	// one of these globs are not deployed
+	PathFilters []string `yaml:"path_filters"`
+	// When not empty, only commits whose committer email matches
+	// one of these globs are deployed
+	AllowedCommitters []string `yaml:"allowed_committers"`
+	// Repositories fetched alongside the remotes and used to
+	// override inputs of the flake
+	Inputs []Input `yaml:"inputs"`
+	// When true, a commit which is not a descendant of the
+	// deployed commit has to be approved to be deployed
+	FastForwardOnly bool `yaml:"fast_forward_only"`
+	// The level of the logs: debug, info, warn or error. It is
+	// overridden by the --log-level, --quiet and --debug options.
+	LogLevel string `yaml:"log_level"`
+	// The format of the logs: text, json or journald. It is
+	// overridden by the --log-format option.
+	LogFormat string `yaml:"log_format"`
+}
+
+// Input is a repository, such as a secrets or site data repository,
+// overriding an input of the flake
+type Input struct {
+	// The name of the flake input overridden by the repository
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// The branch whose head is used to override the input
+	Branch string `yaml:"branch"`
+	Auth   Auth   `yaml:"auth"`
+	Proxy  Proxy  `yaml:"proxy"`
+	// The fetch timeout in seconds
+	Timeout int `yaml:"timeout"`
+}
+
+type CommitSignatures struct {
+	// Paths of files containing armored GPG public keys. When
+	// not empty, a commit is only deployed if it is signed by one
+	// of these keys.
+	GpgPublicKeyPaths []string `yaml:"gpg_public_key_paths"`
+	// The path of a file in the ssh-keygen allowed signers
+	// format. When not empty, a commit is only deployed if it is
+	// signed by one of these SSH keys.
+	SshAllowedSignersPath string `yaml:"ssh_allowed_signers_path"`
+}
+
+type AutoReboot struct {
+	// Reboot the machine when the deployed configuration needs it
+	Enable bool `yaml:"enable"`
+	// The reboot window. When Start and End are empty, the machine
+	// can be rebooted anytime.
+	Days  []string `yaml:"days"`
+	Start string   `yaml:"start"`
+	End   string   `yaml:"end"`
+	// The number of minutes between the wall warning and the
+	// reboot
+	Delay int `yaml:"delay"`
+	// The wall message sent to logged in users
+	Message string `yaml:"message"`
+}
+
+type Hooks struct {
+	// Executables run before the activation. The deployment is
+	// aborted if one of them fails.
+	PreDeployment []string `yaml:"pre_deployment"`
+	// Executables run after a successful deployment
+	PostDeploymentSuccess []string `yaml:"post_deployment_success"`
+	// Executables run after a failed deployment
+	PostDeploymentFailure []string `yaml:"post_deployment_failure"`
+	// The timeout in seconds of each hook
+	Timeout int `yaml:"timeout"`
+}
+
+// Notifications are sent to external services when deployments start
+// and terminate and when the evaluation or the build of a commit fails
+type Notifications struct {
+	// The number of retries of a notification which failed to be
+	// sent, 3 when it is not set
+	Retries  *int       `yaml:"retries"`
+	Webhooks []Webhook  `yaml:"webhooks"`
+	Ntfy     []Ntfy     `yaml:"ntfy"`
+	Matrix   []Matrix   `yaml:"matrix"`
+	Slack    []Slack    `yaml:"slack"`
+	Email    []Email    `yaml:"email"`
+	Telegram []Telegram `yaml:"telegram"`
+	Discord  []Discord  `yaml:"discord"`
+}
+
+// Webhook receives the notifications in JSON with POST requests
+type Webhook struct {
+	URL Secret `yaml:"url"`
+	// The file containing the URL, when it contains a secret.
+	// Environment variables such as $CREDENTIALS_DIRECTORY are
+	// expanded.
+	URLPath string `yaml:"url_path"`
+	// The secret is read from the SecretPath file and can not be
+	// set in the configuration file
+	Secret Secret `yaml:"-"`
+	// The file containing the secret signing the payloads.
+	// Environment variables such as $CREDENTIALS_DIRECTORY are
+	// expanded.
+	SecretPath string `yaml:"secret_path"`
+	// The notified events: start, success and failure. All events
+	// are notified when empty.
+	Events []string `yaml:"events"`
+}
+
+// Ntfy publishes the notifications to a topic of a ntfy server
+type Ntfy struct {
+	// The URL of the ntfy server, https://ntfy.sh by default
+	URL   string `yaml:"url"`
+	Topic string `yaml:"topic"`
+	// The token is read from the AccessTokenPath file and can not
+	// be set in the configuration file
+	AccessToken Secret `yaml:"-"`
+	// The file containing the access token of the topic.
+	// Environment variables such as $CREDENTIALS_DIRECTORY are
+	// expanded.
+	AccessTokenPath string `yaml:"access_token_path"`
+	// The ntfy priorities, from 1 (min) to 5 (max), of the events.
+	// By default, the start is low (2), the success is default (3)
+	// and the failure is urgent (5).
+	Priorities map[string]int `yaml:"priorities"`
+	// The notified events: start, success and failure. All events
+	// are notified when empty.
+	Events []string `yaml:"events"`
+}
+
+// Matrix posts the notifications as messages to a Matrix room
+type Matrix struct {
+	// The URL of the homeserver, such as https://matrix.org
+	Homeserver string `yaml:"homeserver"`
+	// The ID of the room, such as !abcdef:matrix.org. The user of
+	// the access token has to be a member of this room.
+	RoomId string `yaml:"room_id"`
+	// The token is read from the AccessTokenPath file and can not
+	// be set in the configuration file
+	AccessToken Secret `yaml:"-"`
+	// The file containing the access token of the Matrix user.
+	// Environment variables such as $CREDENTIALS_DIRECTORY are
+	// expanded.
+	AccessTokenPath string `yaml:"access_token_path"`
+	// The notified events: start, success and failure. All events
+	// are notified when empty.
+	Events []string `yaml:"events"`
+}
+
+// Slack posts the notifications to a Slack incoming webhook
+type Slack struct {
+	// The URL is read from the URLPath file and can not be set in
+	// the configuration file since it contains a secret
+	URL Secret `yaml:"-"`
+	// The file containing the URL of the incoming webhook.
+	// Environment variables such as $CREDENTIALS_DIRECTORY are
+	// expanded.
+	URLPath string `yaml:"url_path"`
+	// The Go template of the messages. When empty, the message
+	// contains the host, the commit, its subject, the error and
+	// the closure diff summary.
+	Template string `yaml:"template"`
+	// The notified events: start, success and failure. All events
+	// are notified when empty.
+	Events []string `yaml:"events"`
+}
+
+// Email sends the notifications by email with SMTP. STARTTLS is used
+// when the server supports it.
+type Email struct {
+	// The SMTP server
+	Host string `yaml:"host"`
+	// The port of the SMTP server, 587 by default
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	// The password is read from the PasswordPath file and can not
+	// be set in the configuration file
+	Password Secret `yaml:"-"`
+	// The file containing the password of the SMTP user.
+	// Environment variables such as $CREDENTIALS_DIRECTORY are
+	// expanded.
+	PasswordPath string   `yaml:"password_path"`
+	From         string   `yaml:"from"`
+	To           []string `yaml:"to"`
+	// The notified events: start, success and failure. Only
+	// failures are notified when empty.
+	Events []string `yaml:"events"`
+}
+
+// Telegram sends the notifications to a Telegram chat with a bot
+type Telegram struct {
+	// The token is read from the BotTokenPath file and can not be
+	// set in the configuration file
+	BotToken Secret `yaml:"-"`
+	// The file containing the token of the bot. Environment
+	// variables such as $CREDENTIALS_DIRECTORY are expanded.
+	BotTokenPath string `yaml:"bot_token_path"`
+	// The ID of the chat, such as -1001234567890, or the username
+	// of a channel, such as @deployments
+	ChatId string `yaml:"chat_id"`
+	// The notified events: start, success and failure. All events
+	// are notified when empty.
+	Events []string `yaml:"events"`
+}
+
+// Discord posts the notifications as embeds to a Discord webhook
+type Discord struct {
+	// The URL is read from the URLPath file and can not be set in
+	// the configuration file since it contains a secret
+	URL Secret `yaml:"-"`
+	// The file containing the URL of the webhook. Environment
+	// variables such as $CREDENTIALS_DIRECTORY are expanded.
+	URLPath string `yaml:"url_path"`
+	// The notified events: start, success and failure. All events
+	// are notified when empty.
+	Events []string `yaml:"events"`
+}
+
+// ActivationHelper is a privileged process activating the
+// configurations on behalf of an unprivileged comin daemon
+type ActivationHelper struct {
+	// The unix socket of the activation helper. When not empty,
+	// the comin daemon doesn't activate the configurations itself
+	// but sends them to the helper.
+	SocketPath string `yaml:"socket_path"`
+	// The group allowed to send requests to the helper: the group
+	// of the comin daemon
+	SocketGroup string `yaml:"socket_group"`
+}
+
+// Announcements inform the interactive users of the machine that a
+// configuration is activated and of the result of the activation
+type Announcements struct {
+	// The file where the last announcement is written, such as a
+	// MOTD fragment. Disabled when empty.
+	MotdPath string `yaml:"motd_path"`
+	// Broadcast the announcements to the logged in users with wall
+	Wall bool `yaml:"wall"`
+}
+
+// CommitStatuses reports the progress of the deployments of the
+// machine as statuses of the deployed commits on the forges
+type CommitStatuses struct {
+	// The URL of the comin API of the machine, such as
+	// https://machine.example.org:4242. When not empty, the
+	// statuses link to the deployments and the logs on this API.
+	TargetUrl string         `yaml:"target_url"`
+	GitHub    []GitHubStatus `yaml:"github"`
+	GitLab    []GitLabStatus `yaml:"gitlab"`
+	Gitea     []GiteaStatus  `yaml:"gitea"`
+}
+
+// GitHubStatus reports the statuses to a GitHub repository
+type GitHubStatus struct {
+	// The repository, such as owner/infra
+	Repository string `yaml:"repository"`
+	// The URL of the GitHub API, https://api.github.com by default
+	ApiUrl string `yaml:"api_url"`
+	// The token is read from the AccessTokenPath file and can not
+	// be set in the configuration file
+	AccessToken Secret `yaml:"-"`
+	// The file containing a token allowed to create commit
+	// statuses. Environment variables such as
+	// $CREDENTIALS_DIRECTORY are expanded.
+	AccessTokenPath string `yaml:"access_token_path"`
+}
+
+// GitLabStatus reports the statuses to a GitLab project
+type GitLabStatus struct {
+	// The ID or the path of the project, such as group/infra
+	Project string `yaml:"project"`
+	// The URL of the GitLab instance, https://gitlab.com by default
+	ApiUrl string `yaml:"api_url"`
+	// The token is read from the AccessTokenPath file and can not
+	// be set in the configuration file
+	AccessToken Secret `yaml:"-"`
+	// The file containing a token with the api scope. Environment
+	// variables such as $CREDENTIALS_DIRECTORY are expanded.
+	AccessTokenPath string `yaml:"access_token_path"`
+}
+
+// GiteaStatus reports the statuses to a Gitea or Forgejo repository
+type GiteaStatus struct {
+	// The repository, such as owner/infra
+	Repository string `yaml:"repository"`
+	// The URL of the Gitea or Forgejo instance
+	ApiUrl string `yaml:"api_url"`
+	// The token is read from the AccessTokenPath file and can not
+	// be set in the configuration file
+	AccessToken Secret `yaml:"-"`
+	// The file containing a token with the write:repository
+	// scope. Environment variables such as $CREDENTIALS_DIRECTORY
+	// are expanded.
+	AccessTokenPath string `yaml:"access_token_path"`
+}
+
+type DeploymentWindow struct {
+	// The operations allowed during this window
+	Operations []string `yaml:"operations"`
+	// The days of the window (mon, tue, ...). When empty, the
+	// window is open every day.
+	Days []string `yaml:"days"`
+	// The start and end times of the window, formatted as HH:MM
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+}
+
+type MagicRollback struct {
+	Enable bool `yaml:"enable"`
+	// The number of seconds comin has to confirm the deployment
+	// before the previous configuration is activated again
+	Timeout int `yaml:"timeout"`
+	// When not empty, the deployment is also only confirmed once a
+	// GET request on this URL succeeds, for instance to check the
+	// machine can still reach the network
+	ConfirmUrl string `yaml:"confirm_url"`
 }
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// PostJson posts the value v encoded in JSON to the url with the
+// headers
+func PostJson(ctx context.Context, url string, headers map[string]string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return Post(ctx, http.MethodPost, url, "application/json", headers, body)
+}
+
+// Post sends the body to the url with the method and the headers. An
+// error is returned when the server doesn't reply with a 2xx status.
+// It is used by the notifiers and the commit status reporters.
+func Post(ctx context.Context, method, url, contentType string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("the server replied with the status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
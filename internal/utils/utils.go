@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
+	"github.com/nlewo/comin/internal/types"
 	"github.com/sirupsen/logrus"
 )
 
@@ -37,11 +39,104 @@ func FormatCommitMsg(msg string) string {
 	return formatted
 }
 
-func ReadMachineId() (machineId string, err error) {
-	machineIdBytes, err := os.ReadFile("/etc/machine-id")
-	machineId = strings.TrimSuffix(string(machineIdBytes), "\n")
+// CommitSubject returns the first line of the commit message msg
+func CommitSubject(msg string) string {
+	return strings.TrimSpace(strings.SplitN(msg, "\n", 2)[0])
+}
+
+// WriteFileAtomic replaces the file path by the content. The content
+// is written to a temporary file which is synced to the disk before
+// being renamed, so that a crash or a power loss leaves either the
+// previous or the new file, never a truncated one.
+func WriteFileAtomic(path string, content []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(content); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	// The rename is durable once the directory is synced
+	dir, err := os.Open(filepath.Dir(path))
 	if err != nil {
-		return "", fmt.Errorf("Can not read file '/etc/machine-id': %s", err)
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// The files of the machine-id and dmi machine identity sources
+var machineIdPath = "/etc/machine-id"
+var dmiProductUuidPath = "/sys/class/dmi/id/product_uuid"
+
+// ReadMachineId returns the machine ID of the machine from the source
+// of the identity: the /etc/machine-id file by default.
+func ReadMachineId(identity types.MachineIdentity) (machineId string, err error) {
+	path := machineIdPath
+	switch identity.Source {
+	case "hostname":
+		return os.Hostname()
+	case "file":
+		path = identity.Path
+	case "dmi":
+		path = dmiProductUuidPath
+	}
+	machineIdBytes, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Can not read file '%s': %s", path, err)
+	}
+	machineId = strings.TrimSpace(string(machineIdBytes))
+	// The DMI UUID is uppercase on some machines
+	if identity.Source == "dmi" {
+		machineId = strings.ToLower(machineId)
 	}
 	return
 }
+
+// MachineIdAccepted returns true if the machineId is one of the
+// whitespace separated machine IDs of the comin.machineId option
+// evaluated in expected
+func MachineIdAccepted(expected, machineId string) bool {
+	for _, id := range strings.Fields(expected) {
+		if id == machineId {
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduleReboot reboots the machine in delay minutes. The message
+// is sent to logged in users by shutdown.
+func ScheduleReboot(delay int, message string) error {
+	logrus.Infof("Scheduling a reboot in %d minutes: 'shutdown -r +%d'", delay, delay)
+	cmd := exec.Command("shutdown", "-r", fmt.Sprintf("+%d", delay), message)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Command 'shutdown -r +%d' fails with %s", delay, err)
+	}
+	return nil
+}
+
+// CancelReboot cancels a reboot scheduled by ScheduleReboot.
+func CancelReboot() error {
+	logrus.Infof("Canceling the scheduled reboot: 'shutdown -c'")
+	cmd := exec.Command("shutdown", "-c")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Command 'shutdown -c' fails with %s", err)
+	}
+	return nil
+}
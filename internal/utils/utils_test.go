@@ -1,8 +1,12 @@
 package utils
 
 import (
-	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestFormatCommitMsg(t *testing.T) {
@@ -23,3 +27,53 @@ Long Body
 	assert.Equal(t, expected, formatted)
 
 }
+
+func TestCommitSubject(t *testing.T) {
+	assert.Equal(t, "Summary", CommitSubject("Summary\n\nLong Body\n"))
+	assert.Equal(t, "Summary", CommitSubject("Summary"))
+	assert.Equal(t, "", CommitSubject(""))
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	assert.Nil(t, WriteFileAtomic(path, []byte("first"), 0640))
+	assert.Nil(t, WriteFileAtomic(path, []byte("second"), 0640))
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "second", string(content))
+	// The temporary file has been renamed
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NotNil(t, WriteFileAtomic(filepath.Join(t.TempDir(), "missing", "state.json"), []byte("content"), 0640))
+}
+
+func TestReadMachineId(t *testing.T) {
+	dir := t.TempDir()
+	machineIdPath = filepath.Join(dir, "machine-id")
+	dmiProductUuidPath = filepath.Join(dir, "product_uuid")
+	assert.Nil(t, os.WriteFile(machineIdPath, []byte("0123456789abcdef\n"), 0644))
+	assert.Nil(t, os.WriteFile(dmiProductUuidPath, []byte("4C4C4544-0042-3510\n"), 0644))
+
+	machineId, err := ReadMachineId(types.MachineIdentity{})
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789abcdef", machineId)
+
+	machineId, err = ReadMachineId(types.MachineIdentity{Source: "dmi"})
+	assert.Nil(t, err)
+	assert.Equal(t, "4c4c4544-0042-3510", machineId)
+
+	machineId, err = ReadMachineId(types.MachineIdentity{Source: "file", Path: dmiProductUuidPath})
+	assert.Nil(t, err)
+	assert.Equal(t, "4C4C4544-0042-3510", machineId)
+
+	_, err = ReadMachineId(types.MachineIdentity{Source: "file", Path: filepath.Join(dir, "missing")})
+	assert.NotNil(t, err)
+}
+
+func TestMachineIdAccepted(t *testing.T) {
+	assert.True(t, MachineIdAccepted("aaa", "aaa"))
+	assert.True(t, MachineIdAccepted("aaa bbb", "bbb"))
+	assert.False(t, MachineIdAccepted("aaa bbb", "ccc"))
+	assert.False(t, MachineIdAccepted("", ""))
+}
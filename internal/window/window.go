@@ -0,0 +1,105 @@
+package window
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nlewo/comin/internal/types"
+)
+
+var days = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+type window struct {
+	operations map[string]struct{}
+	// When empty, the window is open every day
+	days map[time.Weekday]struct{}
+	// Minutes since midnight
+	start int
+	end   int
+}
+
+// Windows are the deployment windows of operations. An operation
+// without any window can be run anytime.
+type Windows struct {
+	windows []window
+}
+
+func parseTime(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("The time '%s' is not formatted as HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func New(config []types.DeploymentWindow) (Windows, error) {
+	w := Windows{}
+	for _, c := range config {
+		if len(c.Operations) == 0 {
+			return w, fmt.Errorf("The deployment window %s-%s doesn't have any operation", c.Start, c.End)
+		}
+		win := window{
+			operations: make(map[string]struct{}),
+			days:       make(map[time.Weekday]struct{}),
+		}
+		for _, o := range c.Operations {
+			win.operations[o] = struct{}{}
+		}
+		for _, d := range c.Days {
+			day, ok := days[strings.ToLower(d)]
+			if !ok {
+				return w, fmt.Errorf("The day '%s' of the deployment window is not supported (it should be mon, tue, wed, thu, fri, sat or sun)", d)
+			}
+			win.days[day] = struct{}{}
+		}
+		var err error
+		if win.start, err = parseTime(c.Start); err != nil {
+			return w, err
+		}
+		if win.end, err = parseTime(c.End); err != nil {
+			return w, err
+		}
+		w.windows = append(w.windows, win)
+	}
+	return w, nil
+}
+
+func (w window) isOpen(t time.Time) bool {
+	minutes := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.start > w.end && minutes < w.end {
+		// The window started the day before
+		day = (day + 6) % 7
+	}
+	if _, ok := w.days[day]; len(w.days) > 0 && !ok {
+		return false
+	}
+	if w.start <= w.end {
+		return minutes >= w.start && minutes < w.end
+	}
+	return minutes >= w.start || minutes < w.end
+}
+
+// IsAllowed returns true if the operation can be run at time t.
+func (w Windows) IsAllowed(operation string, t time.Time) bool {
+	constrained := false
+	for _, win := range w.windows {
+		if _, ok := win.operations[operation]; !ok {
+			continue
+		}
+		constrained = true
+		if win.isOpen(t) {
+			return true
+		}
+	}
+	return !constrained
+}
@@ -0,0 +1,45 @@
+package window
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02 15:04", s)
+	return t
+}
+
+func TestIsAllowed(t *testing.T) {
+	w, err := New([]types.DeploymentWindow{
+		{Operations: []string{"switch"}, Start: "02:00", End: "05:00"},
+		{Operations: []string{"boot"}, Days: []string{"sat"}, Start: "23:00", End: "01:00"},
+	})
+	assert.Nil(t, err)
+
+	assert.True(t, w.IsAllowed("switch", date("2024-06-05 02:00")))
+	assert.True(t, w.IsAllowed("switch", date("2024-06-05 04:59")))
+	assert.False(t, w.IsAllowed("switch", date("2024-06-05 05:00")))
+	assert.False(t, w.IsAllowed("switch", date("2024-06-05 12:00")))
+
+	// 2024-06-08 is a saturday
+	assert.True(t, w.IsAllowed("boot", date("2024-06-08 23:30")))
+	assert.True(t, w.IsAllowed("boot", date("2024-06-09 00:30")))
+	assert.False(t, w.IsAllowed("boot", date("2024-06-09 23:30")))
+	assert.False(t, w.IsAllowed("boot", date("2024-06-08 00:30")))
+
+	// Operations without window are allowed anytime
+	assert.True(t, w.IsAllowed("dry-activate", date("2024-06-05 12:00")))
+}
+
+func TestNewInvalid(t *testing.T) {
+	_, err := New([]types.DeploymentWindow{{Operations: []string{"switch"}, Start: "2am", End: "05:00"}})
+	assert.NotNil(t, err)
+	_, err = New([]types.DeploymentWindow{{Operations: []string{"switch"}, Days: []string{"monday"}, Start: "02:00", End: "05:00"}})
+	assert.NotNil(t, err)
+	_, err = New([]types.DeploymentWindow{{Start: "02:00", End: "05:00"}})
+	assert.NotNil(t, err)
+}
@@ -8,6 +8,51 @@
           Whether to run the comin service.
         '';
       };
+      privilege_separation = mkOption {
+        description = "Options to run the comin daemon as an unprivileged user.";
+        default = {};
+        type = submodule {
+          options = {
+            enable = mkOption {
+              type = bool;
+              default = false;
+              description = ''
+                Run the comin daemon (fetch, evaluation, build and API) as the unprivileged comin user. The configurations are activated by the comin-activation-helper service, running as root, which only sets the system profile, runs switch-to-configuration and restarts comin. The helper is not restarted by the deployments. It requires the trusted_public_keys of the nix option: the helper only activates signed closures. The automatic reboots, the magic rollback and the deletion of the system generations by the garbage collection are not supported.
+              '';
+            };
+          };
+        };
+      };
+      gc = mkOption {
+        description = "Options for the garbage collection of the Nix store. comin never collects the garbage while building or deploying a configuration.";
+        default = {};
+        type = submodule {
+          options = {
+            period = mkOption {
+              type = int;
+              default = 0;
+              description = ''
+                The period in seconds between two garbage collections. The garbage is also collected once comin started. When 0, the garbage is not periodically collected.
+              '';
+            };
+            min_free_space = mkOption {
+              type = int;
+              default = 0;
+              description = ''
+                The garbage is collected when the free space of the Nix store is below this number of bytes. When 0, the free space is not checked.
+              '';
+            };
+            delete_older_than = mkOption {
+              type = str;
+              default = "";
+              example = "30d";
+              description = ''
+                Delete generations older than this period (see the nix-collect-garbage --delete-older-than option). When empty, generations are not deleted.
+              '';
+            };
+          };
+        };
+      };
       hostname = mkOption {
         type = str;
         default = config.networking.hostName;
@@ -18,6 +63,96 @@
           nixosConfigurations."<hostname>".config.system.build.toplevel
         '';
       };
+      allowed_committers = mkOption {
+        type = listOf str;
+        default = [];
+        example = [ "alice@example.org" "*@ops.example.org" ];
+        description = ''
+          When not empty, a commit is only deployed if the email of its committer matches one of these globs (case insensitive).
+        '';
+      };
+      commit_signatures = mkOption {
+        description = "Options to only deploy signed commits.";
+        default = {};
+        type = submodule {
+          options = {
+            gpg_public_key_paths = mkOption {
+              type = listOf str;
+              default = [];
+              example = [ "/etc/comin/alice.asc" ];
+              description = ''
+                Paths of files containing armored GPG public keys. When not empty, a commit is only deployed if it is signed by one of these keys: unsigned commits and commits signed by an unknown key are refused.
+              '';
+            };
+            ssh_allowed_signers_path = mkOption {
+              type = str;
+              default = "";
+              example = "/etc/comin/allowed_signers";
+              description = ''
+                The path of a file in the ssh-keygen allowed signers format (see the git gpg.ssh.allowedSignersFile option). When not empty, a commit is only deployed if it is signed by one of these SSH keys.
+              '';
+            };
+          };
+        };
+      };
+      deployment_timeout = mkOption {
+        type = int;
+        default = 0;
+        example = 3600;
+        description = ''
+          The maximal duration in seconds of the fetch, the evaluation, the build and the deployment of a commit. When it is exceeded, nix commands are killed and the deployment is aborted: the previous configuration is left untouched (an activation already started is never interrupted). When 0, there is no timeout.
+        '';
+      };
+      fast_forward_only = mkOption {
+        type = bool;
+        default = false;
+        description = ''
+          Whether a commit which is not a descendant of the deployed commit (rebase, force push, switch from the testing branch to an unrelated main branch) has to be approved with comin approve to be deployed.
+        '';
+      };
+      path_filters = mkOption {
+        type = listOf str;
+        default = [];
+        example = [ "hosts/machine/**" "modules/**" "flake.*" ];
+        description = ''
+          When not empty, a new commit is only deployed if it changes a file matching one of these globs (relative to the root of the repository). In a glob, ** matches any number of directories. Other commits are skipped.
+        '';
+      };
+      deployment_windows = mkOption {
+        description = "Deployment windows of operations. An operation with deployment windows is only run during these windows: the built configuration waits for the next window. Operations without any window are run anytime. Times are in the local time of the machine.";
+        default = [];
+        type = listOf (submodule {
+          options = {
+            operations = mkOption {
+              type = listOf (types.enum [ "switch" "boot" "test" "dry-activate" ]);
+              description = ''
+                The operations allowed during this window.
+              '';
+            };
+            days = mkOption {
+              type = listOf (types.enum [ "mon" "tue" "wed" "thu" "fri" "sat" "sun" ]);
+              default = [];
+              description = ''
+                The days of the window. When empty, the window is open every day.
+              '';
+            };
+            start = mkOption {
+              type = str;
+              example = "02:00";
+              description = ''
+                The start time of the window, formatted as HH:MM.
+              '';
+            };
+            end = mkOption {
+              type = str;
+              example = "05:00";
+              description = ''
+                The end time of the window, formatted as HH:MM. When it is before the start time, the window ends the next day.
+              '';
+            };
+          };
+        });
+      };
       exporter = mkOption {
         description = "Options for the Prometheus exporter.";
         default = {};
@@ -44,17 +179,210 @@
                 Open port in firewall for incoming connections to the Prometheus exporter.
               '';
             };
+            textfile_path = mkOption {
+              type = str;
+              default = "";
+              example = "/var/lib/prometheus-node-exporter-text-files/comin.prom";
+              description = ''
+                When not empty, the metrics are also written to this node-exporter textfile collector file after each deployment. It has to end with .prom.
+              '';
+            };
+            disable_http = mkOption {
+              type = types.bool;
+              default = false;
+              description = ''
+                Whether the metrics are not served on the /metrics endpoint, for instance when they are only written to the textfile_path.
+              '';
+            };
           };
         };
       };
-      remotes = mkOption {
-        description = "Ordered list of repositories to pull.";
+      nix = mkOption {
+        description = "Options for the Nix evaluation.";
+        default = {};
+        type = submodule {
+          options = {
+            non_flake = mkOption {
+              type = types.bool;
+              default = false;
+              description = ''
+                Whether the repository is not a flake. In this case, comin evaluates the file option instead of the repository flake.
+              '';
+            };
+            file = mkOption {
+              type = str;
+              default = "default.nix";
+              description = ''
+                The nix file to evaluate when non_flake is enabled. The path is relative to the repository root.
+              '';
+            };
+            configuration_attr = mkOption {
+              type = str;
+              default = "";
+              example = "colmenaHive.nodes.%s";
+              description = ''
+                The attribute template of the configuration of the machine, where %s is replaced by the hostname. When empty, nixosConfigurations.%s is used.
+              '';
+            };
+            impure = mkOption {
+              type = types.bool;
+              default = false;
+              description = ''
+                Whether to evaluate and build the configuration with --impure. This is required when the configuration reads files outside of the repository.
+              '';
+            };
+            trusted_public_keys = mkOption {
+              type = listOf str;
+              default = [];
+              description = ''
+                When not empty, the closure of the configuration is only activated if its store paths are signed by these public keys (checked with nix store verify).
+              '';
+            };
+            max_jobs = mkOption {
+              type = str;
+              default = "";
+              example = "2";
+              description = ''
+                The maximum number of build jobs run in parallel (nix build --max-jobs). It can also be auto. When empty, the nix configuration is used.
+              '';
+            };
+            cores = mkOption {
+              type = int;
+              default = 0;
+              description = ''
+                The number of cores used by each build job (nix build --cores). When 0, the nix configuration is used.
+              '';
+            };
+            build_retries = mkOption {
+              type = int;
+              default = 0;
+              description = ''
+                The number of times a build failing because of a transient error (network, substituter timeout...) is retried. Evaluation errors are never retried.
+              '';
+            };
+            build_retry_delay = mkOption {
+              type = int;
+              default = 10;
+              description = ''
+                The delay in seconds before the first build retry. It is doubled at each retry.
+              '';
+            };
+            build_store = mkOption {
+              type = str;
+              default = "";
+              example = "ssh-ng://builder";
+              description = ''
+                When not empty, the configurations are evaluated and built on this remote ssh:// or ssh-ng:// store and their closure is copied back to the local store before being activated. The flake and its inputs are copied to the builder with nix flake archive and the configurations are evaluated there, over ssh: nixpkgs is never evaluated locally. Only supported with flakes.
+              '';
+            };
+            specialisation = mkOption {
+              type = str;
+              default = "";
+              example = "gaming";
+              description = ''
+                When not empty, this specialisation of the configuration is activated instead of the default configuration. It is also the default boot entry. This option is read from the evaluated configuration, so a commit changing it is deployed with the new specialisation.
+              '';
+            };
+            proxy = mkOption {
+              description = "The proxy used by the nix commands run by comin to contact substituters. Substitutions performed by the nix-daemon use the proxy of the daemon, configured with networking.proxy.";
+              default = {};
+              type = submodule {
+                options = {
+                  url = mkOption {
+                    type = str;
+                    default = "";
+                    example = "http://proxy.example.org:3128";
+                    description = ''
+                      The proxy URL. The http://, https:// and socks5:// schemes are supported.
+                    '';
+                  };
+                  username = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The user name of an authenticated proxy.
+                    '';
+                  };
+                  password_path = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The path of the file containing the password of an authenticated proxy. Environment variables are expanded: $CREDENTIALS_DIRECTORY can be used to read a systemd credential.
+                    '';
+                  };
+                };
+              };
+            };
+            ssh = mkOption {
+              description = "The ssh options of nix commands involving ssh:// and ssh-ng:// stores, such as the build_store (the NIX_SSHOPTS variable).";
+              default = {};
+              type = submodule {
+                options = {
+                  identity_file = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The path of the ssh private key.
+                    '';
+                  };
+                  port = mkOption {
+                    type = int;
+                    default = 0;
+                    description = ''
+                      The ssh port. When 0, the ssh configuration is used.
+                    '';
+                  };
+                  jump_host = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The jump host used to connect to the store (ssh -J).
+                    '';
+                  };
+                  options = mkOption {
+                    type = listOf str;
+                    default = [];
+                    description = ''
+                      Additional ssh options (ssh -o).
+                    '';
+                  };
+                };
+              };
+            };
+            offline = mkOption {
+              type = bool;
+              default = false;
+              description = ''
+                Whether to only activate configurations already present in the local Nix store, populated out-of-band (with nix copy for instance). Substituters are never contacted and configurations are never built.
+              '';
+            };
+            gc_roots_keep = mkOption {
+              type = int;
+              default = 3;
+              description = ''
+                The number of gcroots of deployed configurations to keep. These gcroots prevent rollback targets from being garbage collected.
+              '';
+            };
+            sigs_needed = mkOption {
+              type = int;
+              default = 1;
+              description = ''
+                The number of trusted signatures required on each store path of the closure.
+              '';
+            };
+          };
+        };
+      };
+      inputs = mkOption {
+        description = "Repositories, such as a secrets or site data repository, fetched alongside the remotes and overriding inputs of the flake (nix flake --override-input). The commits of these repositories are recorded in the deployment state and a new commit of one of them triggers a new deployment.";
+        default = [];
         type = listOf (submodule {
           options = {
             name = mkOption {
               type = str;
+              example = "secrets";
               description = ''
-                The name of the remote.
+                The name of the flake input overridden by the repository.
               '';
             };
             url = mkOption {
@@ -63,16 +391,39 @@
                 The URL of the repository.
               '';
             };
+            branch = mkOption {
+              type = str;
+              default = "main";
+              description = ''
+                The branch whose head overrides the input.
+              '';
+            };
             auth = mkOption {
-              description = "Authentication options.";
+              description = "Authentication options of the input repository.";
               default = {};
               type = submodule {
                 options = {
                   access_token_path = mkOption {
                     type = str;
                     default = "";
+                    example = "$CREDENTIALS_DIRECTORY/gitlab-token";
+                    description = ''
+                      The path of the file containing the token used to fetch the repository over HTTPS. Environment variables are expanded: $CREDENTIALS_DIRECTORY can be used to read a systemd credential.
+                    '';
+                  };
+                  ssh_private_key_path = mkOption {
+                    type = str;
+                    default = "";
+                    example = "/run/secrets/comin-deploy-key";
                     description = ''
-                      The path of the auth file.
+                      The path of the private key used to fetch the repository over SSH, such as a deploy key.
+                    '';
+                  };
+                  ssh_known_hosts_path = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The path of the known_hosts file used to verify the key of the SSH server. When empty, the default known_hosts files (~/.ssh/known_hosts and /etc/ssh/ssh_known_hosts) are used.
                     '';
                   };
                 };
@@ -85,44 +436,215 @@
                 Git fetch timeout in seconds.
               '';
             };
-            branches = mkOption {
-              description = "Branches to pull.";
+            proxy = mkOption {
+              description = "The proxy used to fetch the input repository.";
               default = {};
               type = submodule {
                 options = {
-                  main = mkOption {
-                    default = {};
-                    description = "The main branch to fetch.";
-                    type = submodule {
-                      options = {
-                        name = mkOption {
-                          type = str;
-                          default = "main";
-                          description = "The name of the main branch.";
-                        };
-                      };
-                    };
+                  url = mkOption {
+                    type = str;
+                    default = "";
+                    example = "http://proxy.example.org:3128";
+                    description = ''
+                      The proxy URL. The http://, https:// and socks5:// schemes are supported.
+                    '';
                   };
-                  testing = mkOption {
-                    default = {};
-                    description = "The testing branch to fetch.";
-                    type = submodule {
-                      options = {
-                        name = mkOption {
-                          type = str;
-                          default = "testing-${config.services.comin.hostname}";
-                          description = "The name of the testing branch.";
-                        };
-                      };
-                    };
+                  username = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The user name of an authenticated proxy.
+                    '';
+                  };
+                  password_path = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The path of the file containing the password of an authenticated proxy. Environment variables are expanded: $CREDENTIALS_DIRECTORY can be used to read a systemd credential.
+                    '';
                   };
                 };
               };
             };
-            poller = mkOption {
-              default = {};
-              description = "The poller options.";
-              type = submodule {
+          };
+        });
+      };
+      remotes = mkOption {
+        description = "Ordered list of repositories to pull.";
+        type = listOf (submodule {
+          options = {
+            name = mkOption {
+              type = str;
+              description = ''
+                The name of the remote.
+              '';
+            };
+            url = mkOption {
+              type = str;
+              description = ''
+                The URL of the repository.
+              '';
+            };
+            kind = mkOption {
+              type = enum [ "git" "tarball" ];
+              default = "git";
+              description = ''
+                The kind of the remote. A tarball remote is the URL of a tar or tar.gz archive of the repository, such as a release artifact published on a HTTP server or a S3 bucket. The archive is downloaded when its ETag changes. A tarball remote has to be the only remote and it doesn't support testing branches, path_filters, fast_forward_only, allowed_committers and commit_signatures.
+              '';
+            };
+            auth = mkOption {
+              description = "Authentication options.";
+              default = {};
+              type = submodule {
+                options = {
+                  access_token_path = mkOption {
+                    type = str;
+                    default = "";
+                    example = "$CREDENTIALS_DIRECTORY/gitlab-token";
+                    description = ''
+                      The path of the file containing the token used to fetch the repository over HTTPS. Environment variables are expanded: $CREDENTIALS_DIRECTORY can be used to read a systemd credential.
+                    '';
+                  };
+                  ssh_private_key_path = mkOption {
+                    type = str;
+                    default = "";
+                    example = "/run/secrets/comin-deploy-key";
+                    description = ''
+                      The path of the private key used to fetch the repository over SSH, such as a deploy key.
+                    '';
+                  };
+                  ssh_known_hosts_path = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The path of the known_hosts file used to verify the key of the SSH server. When empty, the default known_hosts files (~/.ssh/known_hosts and /etc/ssh/ssh_known_hosts) are used.
+                    '';
+                  };
+                };
+              };
+            };
+            timeout = mkOption {
+              type = int;
+              default = 300;
+              description = ''
+                Git fetch timeout in seconds.
+              '';
+            };
+            depth = mkOption {
+              type = int;
+              default = 0;
+              example = 1;
+              description = ''
+                When not 0, only fetch this number of commits of the branches (shallow fetch). Since the history is truncated, comin can no longer detect that a branch has been force pushed: the force_push_policy of the main branch has to be accept.
+              '';
+            };
+            single_branch = mkOption {
+              type = bool;
+              default = false;
+              description = ''
+                Only fetch the main and testing branches instead of all the branches of the remote.
+              '';
+            };
+            proxy = mkOption {
+              description = "The proxy used to fetch the remote.";
+              default = {};
+              type = submodule {
+                options = {
+                  url = mkOption {
+                    type = str;
+                    default = "";
+                    example = "http://proxy.example.org:3128";
+                    description = ''
+                      The proxy URL. The http://, https:// and socks5:// schemes are supported.
+                    '';
+                  };
+                  username = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The user name of an authenticated proxy.
+                    '';
+                  };
+                  password_path = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The path of the file containing the password of an authenticated proxy. Environment variables are expanded: $CREDENTIALS_DIRECTORY can be used to read a systemd credential.
+                    '';
+                  };
+                };
+              };
+            };
+            branches = mkOption {
+              description = "Branches to pull.";
+              default = {};
+              type = submodule {
+                options = {
+                  main = mkOption {
+                    default = {};
+                    description = "The main branch to fetch.";
+                    type = submodule {
+                      options = {
+                        name = mkOption {
+                          type = str;
+                          default = "main";
+                          description = "The name of the main branch.";
+                        };
+                        operation = mkOption {
+                          type = types.enum [ "switch" "boot" "test" "dry-activate" ];
+                          default = "switch";
+                          description = "The switch-to-configuration operation used to deploy the main branch.";
+                        };
+                        require_approval = mkOption {
+                          type = types.bool;
+                          default = false;
+                          description = "Whether built commits of the main branch are only deployed once approved with comin approve.";
+                        };
+                        force_push_policy = mkOption {
+                          type = types.enum [ "refuse" "approve" "accept" ];
+                          default = "refuse";
+                          description = "What to do when the main branch has been force pushed (its head is no longer on top of the deployed commit): refuse to deploy it, deploy it once approved with comin approve, or accept it.";
+                        };
+                        tag_pattern = mkOption {
+                          type = str;
+                          default = "";
+                          example = "prod-v*";
+                          description = "When not empty, the tag matching this glob pattern with the highest semantic version is deployed instead of the head of the main branch. The version is the part of the tag following the prefix of the pattern.";
+                        };
+                        tag_constraint = mkOption {
+                          type = str;
+                          default = "";
+                          example = ">=v1.2.0 <v2.0.0";
+                          description = "Space separated comparators (>, >=, <, <= or =) the version of the deployed tag has to satisfy.";
+                        };
+                      };
+                    };
+                  };
+                  testing = mkOption {
+                    default = {};
+                    description = "The testing branch to fetch.";
+                    type = submodule {
+                      options = {
+                        name = mkOption {
+                          type = str;
+                          default = "testing-${config.services.comin.hostname}";
+                          description = "The name of the testing branch.";
+                        };
+                        operation = mkOption {
+                          type = types.enum [ "switch" "boot" "test" "dry-activate" ];
+                          default = "test";
+                          description = "The switch-to-configuration operation used to deploy the testing branch. Use dry-activate to only report what would be changed.";
+                        };
+                      };
+                    };
+                  };
+                };
+              };
+            };
+            poller = mkOption {
+              default = {};
+              description = "The poller options.";
+              type = submodule {
                 options = {
                   period = mkOption {
                     type = types.int;
@@ -131,12 +653,72 @@
                       The poller period in seconds.
                     '';
                   };
+                  jitter = mkOption {
+                    type = types.int;
+                    default = 0;
+                    example = 30;
+                    description = ''
+                      The maximal random delay in seconds added to the poller period, to avoid machines of a fleet fetching the repository and the binary cache at the same time.
+                    '';
+                  };
                 };
               };
             };
           };
         });
       };
+      auto_reboot = mkOption {
+        description = "Options to automatically reboot the machine when the deployed configuration has a kernel, an initrd or a systemd different from the booted ones. The scheduled reboot can be canceled with POST /reboot/cancel on the comin API.";
+        default = {};
+        type = submodule {
+          options = {
+            enable = mkOption {
+              type = types.bool;
+              default = false;
+              description = ''
+                Whether to automatically reboot the machine when needed.
+              '';
+            };
+            days = mkOption {
+              type = listOf (types.enum [ "mon" "tue" "wed" "thu" "fri" "sat" "sun" ]);
+              default = [];
+              description = ''
+                The days of the reboot window. When empty, the window is open every day.
+              '';
+            };
+            start = mkOption {
+              type = str;
+              default = "";
+              example = "03:00";
+              description = ''
+                The start time of the reboot window, formatted as HH:MM. When start and end are empty, the machine can be rebooted anytime.
+              '';
+            };
+            end = mkOption {
+              type = str;
+              default = "";
+              example = "04:00";
+              description = ''
+                The end time of the reboot window, formatted as HH:MM.
+              '';
+            };
+            delay = mkOption {
+              type = int;
+              default = 5;
+              description = ''
+                The number of minutes between the wall warning and the reboot.
+              '';
+            };
+            message = mkOption {
+              type = str;
+              default = "comin: rebooting to run the deployed configuration";
+              description = ''
+                The wall message sent to logged in users.
+              '';
+            };
+          };
+        };
+      };
       debug = mkOption {
         type = types.bool;
         default = false;
@@ -144,14 +726,724 @@
           Whether to run comin in debug mode. Be careful, secrets are shown!.
         '';
       };
+      log_level = mkOption {
+        type = enum [ "debug" "info" "warn" "error" ];
+        default = "info";
+        description = ''
+          The verbosity of the comin logs. The warn level silences the commands run by comin. The debug option takes precedence.
+        '';
+      };
+      log_format = mkOption {
+        type = enum [ "text" "json" "journald" ];
+        default = "text";
+        description = ''
+          The format of the comin logs. In the json format, each log line is a JSON object with the hostname and, during a deployment, the generation_id, deployment_id and commit fields. In the journald format, the logs are sent to journald with these fields as COMIN_HOSTNAME, COMIN_GENERATION_ID, COMIN_DEPLOYMENT_ID and COMIN_COMMIT.
+        '';
+      };
+      watchdog_sec = mkOption {
+        type = int;
+        default = 300;
+        description = ''
+          The timeout in seconds of the systemd watchdog of the comin service. comin sends a keepalive every half timeout while its main loop is responsive: systemd restarts comin when it is wedged. 0 disables the watchdog.
+        '';
+      };
+      health_checks = mkOption {
+        description = "Health checks run after the activation of a configuration with the switch or test operations. If they still fail once the grace period is elapsed, the deployment fails and the previous configuration is activated again.";
+        default = {};
+        type = submodule {
+          options = {
+            commands = mkOption {
+              type = listOf str;
+              default = [];
+              description = ''
+                Shell commands run after the activation. The machine is healthy when all of them exit successfully.
+              '';
+            };
+            units = mkOption {
+              type = listOf str;
+              default = [];
+              description = ''
+                Systemd units which have to be active after the activation.
+              '';
+            };
+            no_failed_units = mkOption {
+              type = bool;
+              default = false;
+              description = ''
+                Whether the machine is unhealthy when a systemd unit failed.
+              '';
+            };
+            http_probes = mkOption {
+              description = "HTTP probes: a probe succeeds when a GET request on its URL returns the expected status.";
+              default = [];
+              type = listOf (submodule {
+                options = {
+                  url = mkOption {
+                    type = str;
+                    description = ''
+                      The URL of the probe.
+                    '';
+                  };
+                  expected_status = mkOption {
+                    type = int;
+                    default = 200;
+                    description = ''
+                      The expected HTTP status.
+                    '';
+                  };
+                  timeout = mkOption {
+                    type = int;
+                    default = 5;
+                    description = ''
+                      The timeout of a request in seconds.
+                    '';
+                  };
+                  retries = mkOption {
+                    type = int;
+                    default = 0;
+                    description = ''
+                      The number of times a failing request is retried.
+                    '';
+                  };
+                  retry_interval = mkOption {
+                    type = int;
+                    default = 1;
+                    description = ''
+                      The period in seconds between two attempts of the probe.
+                    '';
+                  };
+                };
+              });
+            };
+            tcp_probes = mkOption {
+              description = "TCP probes: a probe succeeds when a TCP connection to its address can be established.";
+              default = [];
+              type = listOf (submodule {
+                options = {
+                  address = mkOption {
+                    type = str;
+                    example = "127.0.0.1:5432";
+                    description = ''
+                      The host and port of the probe.
+                    '';
+                  };
+                  timeout = mkOption {
+                    type = int;
+                    default = 5;
+                    description = ''
+                      The timeout of a connection in seconds.
+                    '';
+                  };
+                  retries = mkOption {
+                    type = int;
+                    default = 0;
+                    description = ''
+                      The number of times a failing connection is retried.
+                    '';
+                  };
+                  retry_interval = mkOption {
+                    type = int;
+                    default = 1;
+                    description = ''
+                      The period in seconds between two attempts of the probe.
+                    '';
+                  };
+                };
+              });
+            };
+            grace_period = mkOption {
+              type = int;
+              default = 60;
+              description = ''
+                The period in seconds during which failing health checks are retried.
+              '';
+            };
+            interval = mkOption {
+              type = int;
+              default = 5;
+              description = ''
+                The period in seconds between two health checks.
+              '';
+            };
+          };
+        };
+      };
+      audit = mkOption {
+        description = "Options for the append-only audit log of the deployments and the rollbacks. Each line is a JSON entry with the time, the host, the action, its trigger, the commit, its signature status, the operation and the result.";
+        default = {};
+        type = submodule {
+          options = {
+            path = mkOption {
+              type = str;
+              default = "";
+              example = "/var/lib/comin/audit.jsonl";
+              description = ''
+                The file of the audit log. The audit log is disabled when empty.
+              '';
+            };
+            hash_chain = mkOption {
+              type = bool;
+              default = false;
+              description = ''
+                Each entry contains the hash of the previous one, which allows to detect modified or removed entries with comin verify-audit-log.
+              '';
+            };
+          };
+        };
+      };
+      history = mkOption {
+        description = "Options for the history of the deployments, stored in /var/lib/comin/history.jsonl.";
+        default = {};
+        type = submodule {
+          options = {
+            max_entries = mkOption {
+              type = int;
+              default = 1000;
+              description = ''
+                The maximal number of deployments kept in the history. The logs of the deployments removed from the history are removed.
+              '';
+            };
+          };
+        };
+      };
+      hooks = mkOption {
+        description = "Executables run around deployments. They receive the deployment through the COMIN_DEPLOYMENT_UUID, COMIN_GENERATION_UUID, COMIN_REMOTE_NAME, COMIN_BRANCH_NAME, COMIN_COMMIT_ID, COMIN_OUT_PATH, COMIN_OPERATION, COMIN_STATUS and COMIN_ERROR_MSG environment variables.";
+        default = {};
+        type = submodule {
+          options = {
+            pre_deployment = mkOption {
+              type = listOf str;
+              default = [];
+              description = ''
+                Executables run before the activation. The deployment is aborted if one of them fails.
+              '';
+            };
+            post_deployment_success = mkOption {
+              type = listOf str;
+              default = [];
+              description = ''
+                Executables run after a successful deployment.
+              '';
+            };
+            post_deployment_failure = mkOption {
+              type = listOf str;
+              default = [];
+              description = ''
+                Executables run after a failed deployment.
+              '';
+            };
+            timeout = mkOption {
+              type = int;
+              default = 300;
+              description = ''
+                The timeout in seconds of each hook. The hooks exceeding it are killed. The post-deployment hooks are also run when the deployment timeout has been exceeded.
+              '';
+            };
+          };
+        };
+      };
+      announcements = mkOption {
+        description = "Announcements informing the interactive users of the machine that a configuration is being activated and of the result of the activation.";
+        default = {};
+        type = submodule {
+          options = {
+            motd_path = mkOption {
+              type = str;
+              default = "";
+              example = "/run/comin/motd";
+              description = ''
+                The file where the last announcement is written, to be displayed as a message of the day. Disabled when empty.
+              '';
+            };
+            wall = mkOption {
+              type = bool;
+              default = false;
+              description = ''
+                Broadcast the announcements to the terminals of the logged in users with wall.
+              '';
+            };
+          };
+        };
+      };
+      commit_statuses = mkOption {
+        description = "Statuses of the deployed commits reported to the forges while they are evaluated, built and deployed. The context of the statuses is comin/<hostname>: the statuses of several machines deploying the same commit don't overwrite each other.";
+        default = {};
+        type = submodule {
+          options = {
+            target_url = mkOption {
+              type = str;
+              default = "";
+              example = "https://machine.example.org:4242";
+              description = ''
+                The URL of the comin API of the machine. When not empty, the statuses link to the deployment (/deployments/ID) or to the logs of the generation (/logs/ID).
+              '';
+            };
+            github = mkOption {
+              description = "GitHub repositories receiving the commit statuses.";
+              default = [];
+              type = listOf (submodule {
+                options = {
+                  repository = mkOption {
+                    type = str;
+                    example = "owner/infra";
+                    description = ''
+                      The repository containing the deployed commits.
+                    '';
+                  };
+                  api_url = mkOption {
+                    type = str;
+                    default = "https://api.github.com";
+                    description = ''
+                      The URL of the GitHub API. For GitHub Enterprise Server, it is https://HOSTNAME/api/v3.
+                    '';
+                  };
+                  access_token_path = mkOption {
+                    type = str;
+                    description = ''
+                      The file containing a token allowed to create commit statuses, such as a fine-grained token with the "Commit statuses" write permission. Environment variables such as $CREDENTIALS_DIRECTORY are expanded.
+                    '';
+                  };
+                };
+              });
+            };
+            gitea = mkOption {
+              description = "Gitea or Forgejo repositories receiving the commit statuses.";
+              default = [];
+              type = listOf (submodule {
+                options = {
+                  repository = mkOption {
+                    type = str;
+                    example = "owner/infra";
+                    description = ''
+                      The repository containing the deployed commits.
+                    '';
+                  };
+                  api_url = mkOption {
+                    type = str;
+                    example = "https://codeberg.org";
+                    description = ''
+                      The URL of the Gitea or Forgejo instance.
+                    '';
+                  };
+                  access_token_path = mkOption {
+                    type = str;
+                    description = ''
+                      The file containing a token with the write:repository scope. Environment variables such as $CREDENTIALS_DIRECTORY are expanded.
+                    '';
+                  };
+                };
+              });
+            };
+            gitlab = mkOption {
+              description = "GitLab projects receiving the commit statuses. They are shown in the pipelines of the merge requests.";
+              default = [];
+              type = listOf (submodule {
+                options = {
+                  project = mkOption {
+                    type = str;
+                    example = "group/infra";
+                    description = ''
+                      The ID or the path of the project containing the deployed commits.
+                    '';
+                  };
+                  api_url = mkOption {
+                    type = str;
+                    default = "https://gitlab.com";
+                    description = ''
+                      The URL of the GitLab instance.
+                    '';
+                  };
+                  access_token_path = mkOption {
+                    type = str;
+                    description = ''
+                      The file containing a token with the api scope and at least the Developer role on the project. Environment variables such as $CREDENTIALS_DIRECTORY are expanded.
+                    '';
+                  };
+                };
+              });
+            };
+          };
+        };
+      };
+      notifications = mkOption {
+        description = "Notifications sent to external services when deployments start and terminate and when the evaluation or the build of a commit fails. They are sent asynchronously and retried when they fail.";
+        default = {};
+        type = submodule {
+          options = {
+            retries = mkOption {
+              type = int;
+              default = 3;
+              description = ''
+                The number of retries of a notification which failed to be sent, 0 to never retry. The delay between two attempts doubles at each retry, starting from 1 second.
+              '';
+            };
+            slack = mkOption {
+              description = "Slack incoming webhooks receiving the notifications.";
+              default = [];
+              type = listOf (submodule {
+                options = {
+                  url_path = mkOption {
+                    type = str;
+                    description = ''
+                      The file containing the URL of the incoming webhook. Environment variables such as $CREDENTIALS_DIRECTORY are expanded.
+                    '';
+                  };
+                  template = mkOption {
+                    type = str;
+                    default = "";
+                    example = "{{.Host}}: {{.Result}} {{.CommitSubject}}";
+                    description = ''
+                      The Go template of the messages. It receives the fields of the webhook notifications (Event, Host, CommitId, CommitSubject, BranchName, Operation, Result, ErrorMsg, ClosureDiff...) and the Emoji, Title, Text and ClosureDiffSummary fields. When empty, the message contains the host, the commit, its subject, the error and the closure diff summary.
+                    '';
+                  };
+                  events = mkOption {
+                    type = listOf (types.enum [ "start" "success" "failure" ]);
+                    default = [];
+                    description = ''
+                      The notified events. All events are notified when empty.
+                    '';
+                  };
+                };
+              });
+            };
+            telegram = mkOption {
+              description = "Telegram chats receiving the notifications from a bot.";
+              default = [];
+              type = listOf (submodule {
+                options = {
+                  bot_token_path = mkOption {
+                    type = str;
+                    description = ''
+                      The file containing the token of the bot. Environment variables such as $CREDENTIALS_DIRECTORY are expanded.
+                    '';
+                  };
+                  chat_id = mkOption {
+                    type = str;
+                    example = "-1001234567890";
+                    description = ''
+                      The ID of the chat or the username of a channel, such as @deployments. The bot has to be a member of the chat.
+                    '';
+                  };
+                  events = mkOption {
+                    type = listOf (types.enum [ "start" "success" "failure" ]);
+                    default = [];
+                    description = ''
+                      The notified events. All events are notified when empty.
+                    '';
+                  };
+                };
+              });
+            };
+            webhooks = mkOption {
+              description = "Webhooks receiving the notifications with POST requests. The JSON payload contains the event, host, deployment_uuid, generation_uuid, commit_id, commit_subject, remote_name, branch_name, operation, result, error, start_at, end_at, duration (in seconds) and closure_diff fields.";
+              default = [];
+              type = listOf (submodule {
+                options = {
+                  url = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The URL of the webhook. It is stored in the Nix store: use url_path when it contains a secret.
+                    '';
+                  };
+                  url_path = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The file containing the URL of the webhook, instead of url. Environment variables such as $CREDENTIALS_DIRECTORY are expanded.
+                    '';
+                  };
+                  secret_path = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The file containing the secret signing the payloads with HMAC-SHA256 in the X-Comin-Signature-256 header. The payloads are not signed when empty. Environment variables such as $CREDENTIALS_DIRECTORY are expanded.
+                    '';
+                  };
+                  events = mkOption {
+                    type = listOf (types.enum [ "start" "success" "failure" ]);
+                    default = [];
+                    description = ''
+                      The notified events. All events are notified when empty.
+                    '';
+                  };
+                };
+              });
+            };
+            discord = mkOption {
+              description = "Discord webhooks receiving the notifications as embeds summarizing the deployments.";
+              default = [];
+              type = listOf (submodule {
+                options = {
+                  url_path = mkOption {
+                    type = str;
+                    description = ''
+                      The file containing the URL of the webhook. Environment variables such as $CREDENTIALS_DIRECTORY are expanded.
+                    '';
+                  };
+                  events = mkOption {
+                    type = listOf (types.enum [ "start" "success" "failure" ]);
+                    default = [];
+                    description = ''
+                      The notified events. All events are notified when empty.
+                    '';
+                  };
+                };
+              });
+            };
+            email = mkOption {
+              description = "Emails sent with SMTP. STARTTLS is used when the server supports it.";
+              default = [];
+              type = listOf (submodule {
+                options = {
+                  host = mkOption {
+                    type = str;
+                    description = ''
+                      The SMTP server.
+                    '';
+                  };
+                  port = mkOption {
+                    type = int;
+                    default = 587;
+                    description = ''
+                      The port of the SMTP server.
+                    '';
+                  };
+                  username = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The SMTP user. No authentication is used when empty.
+                    '';
+                  };
+                  password_path = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The file containing the password of the SMTP user. Environment variables such as $CREDENTIALS_DIRECTORY are expanded.
+                    '';
+                  };
+                  from = mkOption {
+                    type = str;
+                    example = "comin@example.org";
+                    description = ''
+                      The sender of the emails.
+                    '';
+                  };
+                  to = mkOption {
+                    type = listOf str;
+                    description = ''
+                      The recipients of the emails.
+                    '';
+                  };
+                  events = mkOption {
+                    type = listOf (types.enum [ "start" "success" "failure" ]);
+                    default = [ "failure" ];
+                    description = ''
+                      The notified events. The failure emails contain the last lines of the logs of the evaluation, the build and the activation.
+                    '';
+                  };
+                };
+              });
+            };
+            matrix = mkOption {
+              description = "Matrix rooms receiving the notifications.";
+              default = [];
+              type = listOf (submodule {
+                options = {
+                  homeserver = mkOption {
+                    type = str;
+                    example = "https://matrix.org";
+                    description = ''
+                      The URL of the homeserver.
+                    '';
+                  };
+                  room_id = mkOption {
+                    type = str;
+                    example = "!abcdef:matrix.org";
+                    description = ''
+                      The ID of the room. The user of the access token has to be a member of this room.
+                    '';
+                  };
+                  access_token_path = mkOption {
+                    type = str;
+                    description = ''
+                      The file containing the access token of the Matrix user. Environment variables such as $CREDENTIALS_DIRECTORY are expanded.
+                    '';
+                  };
+                  events = mkOption {
+                    type = listOf (types.enum [ "start" "success" "failure" ]);
+                    default = [];
+                    description = ''
+                      The notified events. All events are notified when empty.
+                    '';
+                  };
+                };
+              });
+            };
+            ntfy = mkOption {
+              description = "ntfy topics receiving the notifications.";
+              default = [];
+              type = listOf (submodule {
+                options = {
+                  url = mkOption {
+                    type = str;
+                    default = "https://ntfy.sh";
+                    description = ''
+                      The URL of the ntfy server.
+                    '';
+                  };
+                  topic = mkOption {
+                    type = str;
+                    description = ''
+                      The topic the notifications are published to.
+                    '';
+                  };
+                  access_token_path = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The file containing the access token of the topic. Environment variables such as $CREDENTIALS_DIRECTORY are expanded.
+                    '';
+                  };
+                  priorities = mkOption {
+                    type = attrsOf int;
+                    default = {};
+                    example = { success = 1; };
+                    description = ''
+                      The ntfy priorities, from 1 (min) to 5 (max), of the start, success and failure events. By default, the start is low (2), the success is default (3) and the failure is urgent (5).
+                    '';
+                  };
+                  events = mkOption {
+                    type = listOf (types.enum [ "start" "success" "failure" ]);
+                    default = [];
+                    description = ''
+                      The notified events. All events are notified when empty.
+                    '';
+                  };
+                };
+              });
+            };
+          };
+        };
+      };
+      logs = mkOption {
+        description = "Options for the logs of evaluations, builds and deployments, stored in /var/lib/comin/logs.";
+        default = {};
+        type = submodule {
+          options = {
+            max_files = mkOption {
+              type = int;
+              default = 20;
+              description = ''
+                The maximal number of log files to keep.
+              '';
+            };
+            max_size = mkOption {
+              type = int;
+              default = 104857600;
+              description = ''
+                The maximal size in bytes of all log files.
+              '';
+            };
+          };
+        };
+      };
+      magic_rollback = mkOption {
+        description = "Before activating a configuration with the switch or test operations, comin arms a systemd timer activating the previous configuration. The timer is disarmed once the deployment succeeded and comin confirmed it can still reach its own API. If the new configuration breaks comin or the network, the machine is reverted to the previous configuration.";
+        default = {};
+        type = submodule {
+          options = {
+            enable = mkOption {
+              type = types.bool;
+              default = false;
+              description = ''
+                Whether to enable the magic rollback.
+              '';
+            };
+            timeout = mkOption {
+              type = int;
+              default = 120;
+              description = ''
+                The number of seconds comin has to confirm the deployment, once the configuration is activated, before the previous configuration is activated again.
+              '';
+            };
+            confirm_url = mkOption {
+              type = types.nullOr str;
+              default = null;
+              example = "https://example.org";
+              description = ''
+                When set, the deployment is also only confirmed once a GET request on this URL succeeds, for instance to check the machine can still reach the network.
+              '';
+            };
+          };
+        };
+      };
+      tpm_attestation = mkOption {
+        description = "Options to bind the deployments to a key resident in the TPM of the machine. Before activating a configuration, comin signs a random challenge with the TPM key and checks the signature with the public key declared by this configuration. This prevents a machine spoofing the machine ID of another one to deploy its configuration.";
+        default = {};
+        type = submodule {
+          options = {
+            enable = mkOption {
+              type = bool;
+              default = false;
+              description = ''
+                Whether to attest the TPM key before each activation. The configurations to deploy have to declare the public_key option: the other ones are not activated.
+              '';
+            };
+            key_handle = mkOption {
+              type = str;
+              default = "0x81000001";
+              description = ''
+                The persistent handle of the TPM signing key (an unrestricted ECDSA or RSA key).
+              '';
+            };
+            public_key = mkOption {
+              type = types.nullOr str;
+              default = null;
+              example = "-----BEGIN PUBLIC KEY-----\nMFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE...\n-----END PUBLIC KEY-----\n";
+              description = ''
+                The PEM encoded public key of the TPM key of this machine, for instance from tpm2_readpublic -c 0x81000001 -f pem. It is written to /etc/comin/tpm-public-key.pem.
+              '';
+            };
+          };
+        };
+      };
+      machine_identity = mkOption {
+        description = "Options for the source of the machine ID compared to the machineId option.";
+        default = {};
+        type = submodule {
+          options = {
+            source = mkOption {
+              type = types.enum [ "machine-id" "file" "hostname" "dmi" ];
+              default = "machine-id";
+              description = ''
+                The source of the machine ID: the /etc/machine-id file, the file of the path option, the hostname or the DMI product UUID (/sys/class/dmi/id/product_uuid). Cloned machines sharing the same /etc/machine-id can be identified by their DMI product UUID.
+              '';
+            };
+            path = mkOption {
+              type = str;
+              default = "";
+              example = "/etc/comin/machine-id";
+              description = ''
+                The file containing the machine ID, used by the file source.
+              '';
+            };
+          };
+        };
+      };
       machineId = mkOption {
-        type = types.nullOr types.str;
+        type = types.nullOr (types.either types.str (types.listOf types.str));
         default = null;
+        example = [ "c0c4f7a3b7d24b0e9a0d0a3b2c1d0e9f" "4a5b6c7d8e9f40a1b2c3d4e5f6a7b8c9" ];
         description = ''
           The expected machine-id of the machine configured by
           comin. If not null, the configuration is only deployed
           when this specified machine-id is equal to the actual
-          machine-id.
+          machine-id. When it is a list, the configuration is
+          deployed on any of the listed machines.
+          The actual machine-id is read from the source of the
+          machine_identity option.
           This is mainly useful for server migration: this allows
           to migrate a configuration from a machine to another
           machine (with different hardware for instance) without
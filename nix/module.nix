@@ -4,22 +4,109 @@ overlay: { config, pkgs, lib, ... }: let
   cominConfig = {
     hostname = cfg.services.comin.hostname;
     state_dir = "/var/lib/comin";
+    log_level = cfg.services.comin.log_level;
+    log_format = cfg.services.comin.log_format;
     remotes = cfg.services.comin.remotes;
+    nix = cfg.services.comin.nix;
+    gc = cfg.services.comin.gc;
+    logs = cfg.services.comin.logs;
+    history = cfg.services.comin.history;
+    audit = cfg.services.comin.audit;
+    machine_identity = cfg.services.comin.machine_identity;
+    tpm_attestation = {
+      inherit (cfg.services.comin.tpm_attestation) enable key_handle;
+    };
+    health_checks = cfg.services.comin.health_checks;
+    magic_rollback = cfg.services.comin.magic_rollback;
+    deployment_windows = cfg.services.comin.deployment_windows;
+    deployment_timeout = cfg.services.comin.deployment_timeout;
+    commit_signatures = cfg.services.comin.commit_signatures;
+    path_filters = cfg.services.comin.path_filters;
+    allowed_committers = cfg.services.comin.allowed_committers;
+    inputs = cfg.services.comin.inputs;
+    fast_forward_only = cfg.services.comin.fast_forward_only;
+    hooks = cfg.services.comin.hooks;
+    notifications = cfg.services.comin.notifications;
+    commit_statuses = cfg.services.comin.commit_statuses;
+    announcements = cfg.services.comin.announcements;
+    activation_helper = lib.optionalAttrs cfg.services.comin.privilege_separation.enable {
+      socket_path = "/run/comin-activation-helper/activation.sock";
+      socket_group = "comin";
+    };
+    auto_reboot = cfg.services.comin.auto_reboot;
     exporter = {
       listen_address = cfg.services.comin.exporter.listen_address;
       port = cfg.services.comin.exporter.port;
+      textfile_path = cfg.services.comin.exporter.textfile_path;
+      disable_http = cfg.services.comin.exporter.disable_http;
     };
   };
   cominConfigYaml = yaml.generate "comin.yaml" cominConfig;
+  privilegeSeparation = cfg.services.comin.privilege_separation.enable;
+  cominUser = if privilegeSeparation then "comin" else "root";
 in {
   imports = [ ./module-options.nix ];
   config = lib.mkIf cfg.services.comin.enable {
     nixpkgs.overlays = [ overlay ];
     environment.systemPackages = [ pkgs.comin ];
-    networking.firewall.allowedTCPPorts = lib.optional cfg.services.comin.exporter.openFirewall cfg.services.comin.exporter.port;
-    systemd.services.comin = {
+    # Used by the comin CLI commands when --config is not set
+    environment.etc."comin/config.yaml".source = cominConfigYaml;
+    # Read by comin in the configuration to deploy to attest its TPM key
+    environment.etc."comin/tpm-public-key.pem" = lib.mkIf (cfg.services.comin.tpm_attestation.public_key != null) {
+      text = cfg.services.comin.tpm_attestation.public_key;
+    };
+    # The directory of the textfile collector file has to exist
+    # The directories written by comin are owned by the comin user
+    # with the privilege separation
+    systemd.tmpfiles.rules = lib.optional (cfg.services.comin.exporter.textfile_path != "")
+      "d ${dirOf cfg.services.comin.exporter.textfile_path} 0755 ${cominUser} ${cominUser} -"
+      ++ lib.optional (privilegeSeparation && cfg.services.comin.announcements.motd_path != "")
+      "d ${dirOf cfg.services.comin.announcements.motd_path} 0755 comin comin -";
+    assertions = [{
+      assertion = privilegeSeparation -> !cfg.services.comin.auto_reboot.enable;
+      message = "services.comin.auto_reboot requires comin to run as root: it is not supported with services.comin.privilege_separation.";
+    } {
+      assertion = privilegeSeparation -> !cfg.services.comin.magic_rollback.enable;
+      message = "services.comin.magic_rollback requires comin to run as root: it is not supported with services.comin.privilege_separation.";
+    } {
+      assertion = privilegeSeparation -> cfg.services.comin.nix.trusted_public_keys != [ ];
+      message = "services.comin.privilege_separation requires services.comin.nix.trusted_public_keys: the activation helper only activates signed closures.";
+    } {
+      assertion = cfg.services.comin.tpm_attestation.enable -> cfg.services.comin.tpm_attestation.public_key != null;
+      message = "services.comin.tpm_attestation requires the public key of the TPM key: set services.comin.tpm_attestation.public_key.";
+    } {
+      assertion = lib.all (r: r.depth > 0 -> r.branches.main.force_push_policy == "accept") cfg.services.comin.remotes;
+      message = "The force pushes of a remote fetched with a depth can not be detected: set services.comin.remotes.*.branches.main.force_push_policy to accept.";
+    }];
+    # Creates the tss group owning the TPM resource manager device
+    security.tpm2.enable = lib.mkIf cfg.services.comin.tpm_attestation.enable (lib.mkDefault true);
+    users.users.comin = lib.mkIf privilegeSeparation {
+      isSystemUser = true;
+      group = "comin";
+    };
+    users.groups.comin = lib.mkIf privilegeSeparation { };
+    # The helper runs the activations: it can not be restarted by
+    # them. A new version of the helper is run after a reboot.
+    systemd.services.comin-activation-helper = lib.mkIf privilegeSeparation {
       wantedBy = [ "multi-user.target" ];
       path = [ config.nix.package ];
+      restartIfChanged = false;
+      serviceConfig = {
+        ExecStart =
+          "${pkgs.comin}/bin/comin "
+          + (lib.optionalString cfg.services.comin.debug "--debug ")
+          + " activation-helper "
+          + "--config ${cominConfigYaml}";
+        Restart = "always";
+      };
+    };
+    networking.firewall.allowedTCPPorts = lib.optional (cfg.services.comin.exporter.openFirewall && !cfg.services.comin.exporter.disable_http) cfg.services.comin.exporter.port;
+    systemd.services.comin = {
+      wantedBy = [ "multi-user.target" ];
+      # bash runs the health check commands
+      path = [ config.nix.package pkgs.bash ]
+        ++ lib.optional cfg.services.comin.announcements.wall pkgs.util-linux
+        ++ lib.optional cfg.services.comin.tpm_attestation.enable pkgs.tpm2-tools;
       # The comin service is restarted by comin itself when it
       # detects the unit file changed.
       restartIfChanged = false;
@@ -29,8 +116,24 @@ in {
           + (lib.optionalString cfg.services.comin.debug "--debug ")
           + " run "
           + "--config ${cominConfigYaml}";
+          # Reloads the remotes of the configuration file
+          ExecReload = "${pkgs.coreutils}/bin/kill -HUP $MAINPID";
           Restart = "always";
+          # comin notifies systemd once it is ready and sends
+          # keepalives to the watchdog
+          Type = "notify";
+          WatchdogSec = cfg.services.comin.watchdog_sec;
+      } // lib.optionalAttrs privilegeSeparation {
+          User = "comin";
+          Group = "comin";
+          # The state directory is owned by the comin user
+          StateDirectory = "comin";
+          # The tss group can access the TPM resource manager
+          SupplementaryGroups = lib.optional cfg.services.comin.tpm_attestation.enable "tss";
       };
+    } // lib.optionalAttrs privilegeSeparation {
+      requires = [ "comin-activation-helper.service" ];
+      after = [ "comin-activation-helper.service" ];
     };
   };
 }